@@ -46,9 +46,9 @@ while [[ $# -gt 0 ]]; do
   esac
 done
 
-# Discover all service directories
+# Discover all service directories; shared is a Go module the services import, not a service
 cd $(dirname "$0")
-ALL_SERVICE_DIRS=$(find ${BASE_DIR} -maxdepth 1 -mindepth 1 -type d -printf "%f\n")
+ALL_SERVICE_DIRS=$(find ${BASE_DIR} -maxdepth 1 -mindepth 1 -type d ! -name shared -printf "%f\n")
 
 # Determine which services to process
 if [ ${#SERVICES[@]} -gt 0 ]; then
@@ -118,8 +118,8 @@ for SERVICE in "${SERVICE_DIRS[@]}"; do
       aws ecr create-repository --repository-name $ECR_REPOSITORY --region $AWS_REGION
     fi
     
-    # Build the Docker image
-    docker buildx build --platform linux/amd64 --provenance=false -t $ECR_REPOSITORY:$IMAGE_TAG .
+    # Build the Docker image from the services directory, so the shared module is in the context
+    docker buildx build --platform linux/amd64 --provenance=false -t $ECR_REPOSITORY:$IMAGE_TAG ..
     
     # Tag the image for ECR
     echo "Tagging image as $FULL_IMAGE_NAME"
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -13,8 +14,14 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "archive-source"
+
 type EventDetail struct {
 	Timestamp          int64                `json:"timestamp"`
 	AccountId          string               `json:"accountId"`
@@ -72,26 +79,37 @@ type ArchiveSourceEvent struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
+	RetentionPolicy        string                      `json:"retentionPolicy,omitempty"`
+	RetentionDays          int                         `json:"retentionDays,omitempty"`
+	RetentionDueAt         string                      `json:"retentionDueAt,omitempty"`
+	Tags                   map[string]string           `json:"tags,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
+	Cost                   json.RawMessage             `json:"cost,omitempty"`
+	Version                int64                       `json:"version,omitempty"`
 
 	// Output
-	HlsPlaylist      *string   `json:"hlsPlaylist"`
-	HlsUrl           *string   `json:"hlsUrl"`
-	DashPlaylist     *string   `json:"dashPlaylist"`
-	DashUrl          *string   `json:"dashUrl"`
-	Mp4Outputs       []*string `json:"mp4Outputs"`
-	Mp4Urls          []*string `json:"mp4Urls"`
-	MssPlaylist      *string   `json:"mssPlaylist"`
-	MssUrl           *string   `json:"mssUrl"`
-	CmafDashPlaylist *string   `json:"cmafDashPlaylist"`
-	CmafDashUrl      *string   `json:"cmafDashUrl"`
-	CmafHlsPlaylist  *string   `json:"cmafHlsPlaylist"`
-	CmafHlsUrl       *string   `json:"cmafHlsUrl"`
-	ThumbNails       []*string `json:"thumbNails"`
-	ThumbNailsUrls   []*string `json:"thumbNailsUrls"`
+	HlsPlaylist            *string   `json:"hlsPlaylist"`
+	HlsUrl                 *string   `json:"hlsUrl"`
+	DashPlaylist           *string   `json:"dashPlaylist"`
+	DashUrl                *string   `json:"dashUrl"`
+	Mp4Outputs             []*string `json:"mp4Outputs"`
+	Mp4Urls                []*string `json:"mp4Urls"`
+	MssPlaylist            *string   `json:"mssPlaylist"`
+	MssUrl                 *string   `json:"mssUrl"`
+	CmafDashPlaylist       *string   `json:"cmafDashPlaylist"`
+	CmafDashUrl            *string   `json:"cmafDashUrl"`
+	CmafHlsPlaylist        *string   `json:"cmafHlsPlaylist"`
+	CmafHlsUrl             *string   `json:"cmafHlsUrl"`
+	ThumbNails             []*string `json:"thumbNails"`
+	ThumbNailsUrls         []*string `json:"thumbNailsUrls"`
+	MediaPackageResourceId string    `json:"mediaPackageResourceId,omitempty"`
 }
 
 type Warning struct {
@@ -108,15 +126,21 @@ type S3Client interface {
 	PutObjectTagging(input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error)
 }
 
+type Config struct {
+	logging.LogConfig
+
+	// FunctionName is the function itself, whose name without the
+	// -archive-source suffix is the stack name the source is tagged with.
+	FunctionName string `env:"AWS_LAMBDA_FUNCTION_NAME"`
+}
+
 type Handler struct {
+	Config   Config
 	S3Client S3Client
 }
 
 func (h *Handler) HandleRequest(event ArchiveSourceEvent) (*ArchiveSourceEvent, error) {
-	eventJson, _ := json.Marshal(event)
-	log.Printf("REQUEST:: %s", eventJson)
-
-	stackName := strings.ReplaceAll(os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), "-archive-source", "")
+	stackName := strings.ReplaceAll(h.Config.FunctionName, "-archive-source", "")
 	input := &s3.PutObjectTaggingInput{
 		Bucket: aws.String(event.SrcBucket),
 		Key:    aws.String(event.SrcVideo),
@@ -136,7 +160,7 @@ func (h *Handler) HandleRequest(event ArchiveSourceEvent) (*ArchiveSourceEvent,
 
 	_, err := h.S3Client.PutObjectTagging(input)
 	if err != nil {
-		log.Printf("ERROR: failed to tag source object: %v", err)
+		slog.Error("TAG FAILED", "error", err)
 		return nil, fmt.Errorf("archive-source: main.Handler.HandleRequest: PutObjectTagging: %w", err)
 	}
 
@@ -144,6 +168,8 @@ func (h *Handler) HandleRequest(event ArchiveSourceEvent) (*ArchiveSourceEvent,
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(
 		&aws.Config{
 			Region: aws.String(os.Getenv("AWS_REGION")),
@@ -154,9 +180,16 @@ func main() {
 		log.Fatalf("failed to create a new session: %v", err)
 	}
 
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("archive-source: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	s3Client := s3.New(sess)
 	handler := &Handler{
+		Config:   config,
 		S3Client: s3Client,
 	}
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// CostEstimate mirrors the cost output-validate sets on the record.
+type CostEstimate struct {
+	Currency string       `json:"currency"`
+	Total    float64      `json:"total"`
+	Tenant   string       `json:"tenant"`
+	Outputs  []OutputCost `json:"outputs"`
+}
+
+type OutputCost struct {
+	Group       string  `json:"group"`
+	Kind        string  `json:"kind"`
+	Codec       string  `json:"codec,omitempty"`
+	Resolution  string  `json:"resolution,omitempty"`
+	FrameRate   float64 `json:"frameRate,omitempty"`
+	Accelerated bool    `json:"accelerated,omitempty"`
+	Minutes     float64 `json:"minutes"`
+	Cost        float64 `json:"cost"`
+}
+
+// CostEntry mirrors the entry output-validate records in the CostTable for
+// every encode.
+type CostEntry struct {
+	WorkflowName string        `json:"workflowName"`
+	Cost         *CostEstimate `json:"cost"`
+}
+
+// CostReport sums the estimates of the encodes that completed in a month,
+// so an asset reprocessed in the month counts once for each encode. The
+// estimates are summed as they are, in the currency of the price table they
+// were made with.
+type CostReport struct {
+	Month     string                `json:"month"`
+	Currency  string                `json:"currency,omitempty"`
+	Encodes   int                   `json:"encodes"`
+	Minutes   float64               `json:"minutes"`
+	Total     float64               `json:"total"`
+	Workflows map[string]*CostTotal `json:"workflows"`
+	Tenants   map[string]*CostTotal `json:"tenants"`
+}
+
+type CostTotal struct {
+	Encodes int     `json:"encodes"`
+	Minutes float64 `json:"minutes"`
+	Total   float64 `json:"total"`
+}
+
+func (t *CostTotal) add(cost *CostEstimate) {
+	t.Encodes++
+	for _, output := range cost.Outputs {
+		t.Minutes += output.Minutes
+	}
+	t.Total += cost.Total
+}
+
+func (t *CostTotal) round() {
+	t.Minutes = roundCost(t.Minutes)
+	t.Total = roundCost(t.Total)
+}
+
+// getCosts reports the month given as YYYY-MM, the current month by
+// default, by workflow and by tenant.
+func (h *Handler) getCosts(params map[string]string) (*CostReport, error) {
+	month := params["month"]
+	if month == "" {
+		month = time.Now().UTC().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.getCosts: month %q is not YYYY-MM: %w", month, ErrInvalidParameter)
+	}
+
+	report := &CostReport{
+		Month:     month,
+		Workflows: map[string]*CostTotal{},
+		Tenants:   map[string]*CostTotal{},
+	}
+	var total CostTotal
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.CostTable),
+		KeyConditionExpression: aws.String("#month = :month"),
+		ProjectionExpression:   aws.String("#workflowName, #cost"),
+		ExpressionAttributeNames: map[string]*string{
+			"#month":        aws.String("month"),
+			"#workflowName": aws.String("workflowName"),
+			"#cost":         aws.String("cost"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":month": {S: aws.String(month)},
+		},
+	}
+
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("asset-api: main.Handler.getCosts: Query: %w", err)
+		}
+
+		var entries []CostEntry
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &entries); err != nil {
+			return nil, fmt.Errorf("asset-api: main.Handler.getCosts: UnmarshalListOfMaps: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.Cost == nil {
+				continue
+			}
+			if report.Currency == "" {
+				report.Currency = entry.Cost.Currency
+			}
+			total.add(entry.Cost)
+			if report.Workflows[entry.WorkflowName] == nil {
+				report.Workflows[entry.WorkflowName] = &CostTotal{}
+			}
+			report.Workflows[entry.WorkflowName].add(entry.Cost)
+			if report.Tenants[entry.Cost.Tenant] == nil {
+				report.Tenants[entry.Cost.Tenant] = &CostTotal{}
+			}
+			report.Tenants[entry.Cost.Tenant].add(entry.Cost)
+		}
+
+		if len(data.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+
+	total.round()
+	report.Encodes, report.Minutes, report.Total = total.Encodes, total.Minutes, total.Total
+	for _, totals := range []map[string]*CostTotal{report.Workflows, report.Tenants} {
+		for _, t := range totals {
+			t.round()
+		}
+	}
+
+	return report, nil
+}
+
+// roundCost keeps six decimals, as the estimates do.
+func roundCost(value float64) float64 {
+	return math.Round(value*1e6) / 1e6
+}
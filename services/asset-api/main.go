@@ -0,0 +1,594 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "asset-api"
+
+const (
+	defaultLimit = 25
+	maxLimit     = 100
+
+	statusIndex    = "workflowStatus-startTime-index"
+	sourceKeyIndex = "srcVideo-startTime-index"
+)
+
+var (
+	ErrAssetNotFound     = errors.New("asset not found")
+	ErrInvalidParameter  = errors.New("invalid query parameter")
+	ErrRouteNotFound     = errors.New("route not found")
+	ErrMethodNotAllowed  = errors.New("method not allowed")
+	ErrInvalidNextToken  = errors.New("invalid nextToken")
+	ErrMissingListFilter = errors.New("one of status or sourceKey is required")
+	// ErrIndexNotProvisioned is returned while a stack being upgraded has
+	// not created, or is still backfilling, the index a route queries.
+	ErrIndexNotProvisioned = errors.New("index not yet provisioned")
+)
+
+// WorkflowRecord is the part of the workflow table item the API reads.
+type WorkflowRecord struct {
+	GUID                   string             `json:"guid"`
+	StartTime              string             `json:"startTime"`
+	EndTime                string             `json:"endTime"`
+	WorkflowStatus         string             `json:"workflowStatus"`
+	WorkflowName           string             `json:"workflowName"`
+	SrcBucket              string             `json:"srcBucket"`
+	SrcVideo               string             `json:"srcVideo"`
+	EncodingProfile        int                `json:"encodingProfile"`
+	JobTemplate            string             `json:"jobTemplate"`
+	DuplicateOf            string             `json:"duplicateOf"`
+	LinkedSources          []AssetSource      `json:"linkedSources"`
+	Tags                   map[string]string  `json:"tags"`
+	Restore                *AssetRestore      `json:"restore"`
+	Deletion               *AssetDeletion     `json:"deletion"`
+	Invalidation           *AssetInvalidation `json:"invalidation"`
+	RetentionPolicy        string             `json:"retentionPolicy"`
+	RetentionDays          int                `json:"retentionDays"`
+	RetentionDueAt         string             `json:"retentionDueAt"`
+	RetentionStatus        string             `json:"retentionStatus"`
+	RetentionAppliedAt     string             `json:"retentionAppliedAt"`
+	RetentionArchive       string             `json:"retentionArchive"`
+	RetentionError         string             `json:"retentionError"`
+	HlsUrl                 *string            `json:"hlsUrl"`
+	DashUrl                *string            `json:"dashUrl"`
+	Mp4Urls                []*string          `json:"mp4Urls"`
+	MssUrl                 *string            `json:"mssUrl"`
+	CmafDashUrl            *string            `json:"cmafDashUrl"`
+	CmafHlsUrl             *string            `json:"cmafHlsUrl"`
+	ThumbNailsUrls         []*string          `json:"thumbNailsUrls"`
+	MediaPackageResourceId string             `json:"mediaPackageResourceId"`
+	EgressEndpoints        map[string]string  `json:"egressEndpoints"`
+	StageDurations         map[string]int64   `json:"stageDurations"`
+	Cost                   *CostEstimate      `json:"cost"`
+	Version                int64              `json:"version"`
+}
+
+// Asset is the public view of a workflow record. Its fields are the API
+// contract: new fields may be added, existing ones are never renamed, and
+// internal attributes such as encodingJob are never exposed.
+type Asset struct {
+	GUID            string             `json:"guid"`
+	Status          string             `json:"status"`
+	Workflow        string             `json:"workflow"`
+	Source          AssetSource        `json:"source"`
+	EncodingProfile int                `json:"encodingProfile,omitempty"`
+	JobTemplate     string             `json:"jobTemplate,omitempty"`
+	DuplicateOf     string             `json:"duplicateOf,omitempty"`
+	LinkedSources   []AssetSource      `json:"linkedSources,omitempty"`
+	Tags            map[string]string  `json:"tags,omitempty"`
+	Restore         *AssetRestore      `json:"restore,omitempty"`
+	Retention       *AssetRetention    `json:"retention,omitempty"`
+	Deletion        *AssetDeletion     `json:"deletion,omitempty"`
+	Invalidation    *AssetInvalidation `json:"invalidation,omitempty"`
+	CreatedAt       string             `json:"createdAt"`
+	CompletedAt     string             `json:"completedAt,omitempty"`
+	Playback        Playback           `json:"playback"`
+	Thumbnails      []string           `json:"thumbnails"`
+	StageDurations  map[string]int64   `json:"stageDurations,omitempty"`
+	Cost            *CostEstimate      `json:"cost,omitempty"`
+	Version         int64              `json:"version"`
+}
+
+type AssetSource struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// AssetRestore is the latest restore of an archived source for a reprocess.
+type AssetRestore struct {
+	Status      string `json:"status"`
+	Tier        string `json:"tier"`
+	JobTemplate string `json:"jobTemplate,omitempty"`
+	RequestedAt string `json:"requestedAt"`
+	CompletedAt string `json:"completedAt,omitempty"`
+	ExpiresAt   string `json:"expiresAt,omitempty"`
+}
+
+// AssetDeletion is the latest deletion request of the asset, set by the
+// asset-delete service.
+type AssetDeletion struct {
+	Status         string `json:"status"`
+	RequestedAt    string `json:"requestedAt"`
+	RequestedBy    string `json:"requestedBy"`
+	PreviousStatus string `json:"previousStatus"`
+	PurgeAt        string `json:"purgeAt"`
+	RestoredAt     string `json:"restoredAt,omitempty"`
+	RestoredBy     string `json:"restoredBy,omitempty"`
+	PurgedAt       string `json:"purgedAt,omitempty"`
+	InvalidationId string `json:"invalidationId,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// AssetInvalidation is the CloudFront invalidation of the latest publish that
+// replaced earlier outputs, set by the cdn-invalidation service.
+type AssetInvalidation struct {
+	Status      string   `json:"status"`
+	Ids         []string `json:"ids,omitempty"`
+	Paths       int      `json:"paths,omitempty"`
+	Segments    bool     `json:"segments,omitempty"`
+	RequestedAt string   `json:"requestedAt,omitempty"`
+	CompletedAt string   `json:"completedAt,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// AssetRetention is what happens, or happened, to the source once published.
+type AssetRetention struct {
+	Policy    string `json:"policy"`
+	Days      int    `json:"days"`
+	DueAt     string `json:"dueAt,omitempty"`
+	Status    string `json:"status,omitempty"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+	Archive   string `json:"archive,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Playback struct {
+	Hls          string            `json:"hls,omitempty"`
+	Dash         string            `json:"dash,omitempty"`
+	CmafHls      string            `json:"cmafHls,omitempty"`
+	CmafDash     string            `json:"cmafDash,omitempty"`
+	Mss          string            `json:"mss,omitempty"`
+	Mp4          []string          `json:"mp4,omitempty"`
+	MediaPackage map[string]string `json:"mediaPackage,omitempty"`
+}
+
+type AssetList struct {
+	Assets    []Asset `json:"assets"`
+	NextToken string  `json:"nextToken,omitempty"`
+}
+
+// HistoryEvent mirrors the items the dynamo service writes to the history
+// table.
+type HistoryEvent struct {
+	Version                int64  `json:"version"`
+	Timestamp              string `json:"timestamp"`
+	Status                 string `json:"status"`
+	PreviousStatus         string `json:"previousStatus,omitempty"`
+	PreviousStatusDuration int64  `json:"previousStatusDuration,omitempty"`
+	Execution              string `json:"execution,omitempty"`
+	Actor                  string `json:"actor,omitempty"`
+	Error                  string `json:"error,omitempty"`
+}
+
+type AssetHistory struct {
+	GUID   string         `json:"guid"`
+	Events []HistoryEvent `json:"events"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	HistoryTable  string `env:"HistoryTable" required:"true"`
+	// CostTable holds the estimate of every encode, by the month it
+	// completed in.
+	CostTable string `env:"CostTable" required:"true"`
+}
+
+type Handler struct {
+	Config         Config
+	DynamoDBClient DynamoDBClient
+}
+
+func (h *Handler) HandleRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var body interface{}
+	var err error
+	switch {
+	case request.HTTPMethod != http.MethodGet:
+		err = ErrMethodNotAllowed
+	case request.Resource == "/assets":
+		body, err = h.listAssets(request.QueryStringParameters)
+	case request.Resource == "/assets/{guid}":
+		body, err = h.getAsset(request.PathParameters["guid"])
+	case request.Resource == "/assets/{guid}/history":
+		body, err = h.getHistory(request.PathParameters["guid"])
+	case request.Resource == "/costs":
+		body, err = h.getCosts(request.QueryStringParameters)
+	default:
+		err = ErrRouteNotFound
+	}
+
+	if err != nil {
+		return errorResponse(err)
+	}
+	return jsonResponse(http.StatusOK, body)
+}
+
+func (h *Handler) getAsset(guid string) (*Asset, error) {
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {
+				S: aws.String(guid),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.getAsset: GetItem: %w", err)
+	}
+	if len(data.Item) == 0 {
+		return nil, fmt.Errorf("asset-api: main.Handler.getAsset: guid %s: %w", guid, ErrAssetNotFound)
+	}
+
+	var record WorkflowRecord
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &record); err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.getAsset: UnmarshalMap: %w", err)
+	}
+
+	asset := toAsset(record)
+	return &asset, nil
+}
+
+// listAssets queries by status or by source key, optionally bounded by a
+// startTime range given as dates or RFC 3339 timestamps.
+func (h *Handler) listAssets(params map[string]string) (*AssetList, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(h.Config.DynamoDBTable),
+		ExpressionAttributeNames:  map[string]*string{"#startTime": aws.String("startTime")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{},
+		ScanIndexForward:          aws.Bool(false),
+	}
+
+	var keyCondition string
+	switch {
+	case params["status"] != "":
+		input.IndexName = aws.String(statusIndex)
+		input.ExpressionAttributeNames["#key"] = aws.String("workflowStatus")
+		input.ExpressionAttributeValues[":key"] = &dynamodb.AttributeValue{S: aws.String(params["status"])}
+	case params["sourceKey"] != "":
+		input.IndexName = aws.String(sourceKeyIndex)
+		input.ExpressionAttributeNames["#key"] = aws.String("srcVideo")
+		input.ExpressionAttributeValues[":key"] = &dynamodb.AttributeValue{S: aws.String(params["sourceKey"])}
+	default:
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: %w", ErrMissingListFilter)
+	}
+	keyCondition = "#key = :key"
+
+	from, err := parseTimeBound(params["from"], false)
+	if err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: from: %w", err)
+	}
+	to, err := parseTimeBound(params["to"], true)
+	if err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: to: %w", err)
+	}
+	switch {
+	case from != "" && to != "":
+		keyCondition += " AND #startTime BETWEEN :from AND :to"
+	case from != "":
+		keyCondition += " AND #startTime >= :from"
+	case to != "":
+		keyCondition += " AND #startTime <= :to"
+	default:
+		delete(input.ExpressionAttributeNames, "#startTime")
+	}
+	if from != "" {
+		input.ExpressionAttributeValues[":from"] = &dynamodb.AttributeValue{S: aws.String(from)}
+	}
+	if to != "" {
+		input.ExpressionAttributeValues[":to"] = &dynamodb.AttributeValue{S: aws.String(to)}
+	}
+	input.KeyConditionExpression = aws.String(keyCondition)
+
+	limit := defaultLimit
+	if params["limit"] != "" {
+		limit, err = strconv.Atoi(params["limit"])
+		if err != nil || limit < 1 || limit > maxLimit {
+			return nil, fmt.Errorf("asset-api: main.Handler.listAssets: limit must be between 1 and %d: %w", maxLimit, ErrInvalidParameter)
+		}
+	}
+	input.Limit = aws.Int64(int64(limit))
+
+	if params["nextToken"] != "" {
+		input.ExclusiveStartKey, err = decodeNextToken(params["nextToken"])
+		if err != nil {
+			return nil, fmt.Errorf("asset-api: main.Handler.listAssets: %w", err)
+		}
+	}
+
+	data, err := h.DynamoDBClient.Query(input)
+	if isMissingIndex(err) {
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: %s: %w", *input.IndexName, ErrIndexNotProvisioned)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: Query: %w", err)
+	}
+
+	var records []WorkflowRecord
+	if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &records); err != nil {
+		return nil, fmt.Errorf("asset-api: main.Handler.listAssets: UnmarshalListOfMaps: %w", err)
+	}
+
+	list := &AssetList{
+		Assets:    make([]Asset, 0, len(records)),
+		NextToken: encodeNextToken(data.LastEvaluatedKey),
+	}
+	for _, record := range records {
+		list.Assets = append(list.Assets, toAsset(record))
+	}
+
+	return list, nil
+}
+
+// isMissingIndex reports whether err is DynamoDB rejecting a query on an
+// index the table does not have yet, or is still backfilling.
+func isMissingIndex(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != "ValidationException" {
+		return false
+	}
+	message := aerr.Message()
+	return strings.Contains(message, "does not have the specified index") ||
+		strings.Contains(message, "backfilling global secondary index")
+}
+
+func (h *Handler) getHistory(guid string) (*AssetHistory, error) {
+	history := &AssetHistory{
+		GUID:   guid,
+		Events: []HistoryEvent{},
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(h.Config.HistoryTable),
+		KeyConditionExpression:   aws.String("#guid = :guid"),
+		ExpressionAttributeNames: map[string]*string{"#guid": aws.String("guid")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":guid": {S: aws.String(guid)},
+		},
+	}
+
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("asset-api: main.Handler.getHistory: Query: %w", err)
+		}
+
+		var page []HistoryEvent
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &page); err != nil {
+			return nil, fmt.Errorf("asset-api: main.Handler.getHistory: UnmarshalListOfMaps: %w", err)
+		}
+		history.Events = append(history.Events, page...)
+
+		if len(data.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+
+	if len(history.Events) == 0 {
+		return nil, fmt.Errorf("asset-api: main.Handler.getHistory: guid %s: %w", guid, ErrAssetNotFound)
+	}
+
+	return history, nil
+}
+
+func toAsset(record WorkflowRecord) Asset {
+	asset := Asset{
+		GUID:     record.GUID,
+		Status:   record.WorkflowStatus,
+		Workflow: record.WorkflowName,
+		Source: AssetSource{
+			Bucket: record.SrcBucket,
+			Key:    record.SrcVideo,
+		},
+		EncodingProfile: record.EncodingProfile,
+		JobTemplate:     record.JobTemplate,
+		DuplicateOf:     record.DuplicateOf,
+		LinkedSources:   record.LinkedSources,
+		Tags:            record.Tags,
+		Restore:         record.Restore,
+		Deletion:        record.Deletion,
+		Invalidation:    record.Invalidation,
+		CreatedAt:       record.StartTime,
+		Playback: Playback{
+			Hls:          aws.StringValue(record.HlsUrl),
+			Dash:         aws.StringValue(record.DashUrl),
+			CmafHls:      aws.StringValue(record.CmafHlsUrl),
+			CmafDash:     aws.StringValue(record.CmafDashUrl),
+			Mss:          aws.StringValue(record.MssUrl),
+			Mp4:          aws.StringValueSlice(record.Mp4Urls),
+			MediaPackage: record.EgressEndpoints,
+		},
+		Thumbnails:     aws.StringValueSlice(record.ThumbNailsUrls),
+		StageDurations: record.StageDurations,
+		Cost:           record.Cost,
+		Version:        record.Version,
+	}
+
+	if record.WorkflowStatus == "Complete" {
+		asset.CompletedAt = record.EndTime
+	}
+	if len(asset.Playback.MediaPackage) == 0 {
+		asset.Playback.MediaPackage = nil
+	}
+	if record.RetentionPolicy != "" {
+		asset.Retention = &AssetRetention{
+			Policy:    record.RetentionPolicy,
+			Days:      record.RetentionDays,
+			DueAt:     record.RetentionDueAt,
+			Status:    record.RetentionStatus,
+			AppliedAt: record.RetentionAppliedAt,
+			Archive:   record.RetentionArchive,
+			Error:     record.RetentionError,
+		}
+	}
+
+	return asset
+}
+
+// parseTimeBound accepts a date or an RFC 3339 timestamp and returns it in
+// the startTime format. A date used as an upper bound covers the whole day.
+func parseTimeBound(value string, upper bool) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a date or RFC 3339 timestamp: %w", value, ErrInvalidParameter)
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t.Format("2006-01-02T15:04:05.000Z"), nil
+}
+
+// Pagination tokens are the query's LastEvaluatedKey. Every key attribute of
+// the table and its indexes is a string, so the token is a flat map.
+func encodeNextToken(key map[string]*dynamodb.AttributeValue) string {
+	if len(key) == 0 {
+		return ""
+	}
+
+	values := map[string]string{}
+	for name, value := range key {
+		values[name] = aws.StringValue(value.S)
+	}
+	token, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func decodeNextToken(token string) (map[string]*dynamodb.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidNextToken
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(raw, &values); err != nil || len(values) == 0 {
+		return nil, ErrInvalidNextToken
+	}
+
+	key := map[string]*dynamodb.AttributeValue{}
+	for name, value := range values {
+		key[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	return key, nil
+}
+
+func jsonResponse(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		slog.Error("REQUEST FAILED", "error", fmt.Errorf("asset-api: main.jsonResponse: json.Marshal: %w", err))
+		status, bodyJson = http.StatusInternalServerError, []byte(`{"message":"internal error"}`)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(bodyJson),
+	}, nil
+}
+
+func errorResponse(err error) (events.APIGatewayProxyResponse, error) {
+	slog.Error("REQUEST FAILED", "error", err)
+
+	switch {
+	case errors.Is(err, ErrAssetNotFound), errors.Is(err, ErrRouteNotFound):
+		return jsonResponse(http.StatusNotFound, ErrorResponse{Message: clientMessage(err)})
+	case errors.Is(err, ErrMethodNotAllowed):
+		return jsonResponse(http.StatusMethodNotAllowed, ErrorResponse{Message: clientMessage(err)})
+	case errors.Is(err, ErrInvalidParameter), errors.Is(err, ErrInvalidNextToken), errors.Is(err, ErrMissingListFilter):
+		return jsonResponse(http.StatusBadRequest, ErrorResponse{Message: clientMessage(err)})
+	case errors.Is(err, ErrIndexNotProvisioned):
+		return jsonResponse(http.StatusServiceUnavailable, ErrorResponse{Message: clientMessage(err)})
+	}
+	// anything else is internal, and only logged
+	return jsonResponse(http.StatusInternalServerError, ErrorResponse{Message: "internal error"})
+}
+
+// clientMessage is the message of a client error without the service and
+// function names it was wrapped with, e.g. "guid x: asset not found".
+func clientMessage(err error) string {
+	message := strings.TrimPrefix(err.Error(), serviceName+": ")
+	for strings.HasPrefix(message, "main.") {
+		_, rest, ok := strings.Cut(message, ": ")
+		if !ok {
+			break
+		}
+		message = rest
+	}
+	return message
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		log.Fatalf("asset-api: main: session.NewSession: %v", err)
+	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("asset-api: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:         config,
+		DynamoDBClient: dynamodb.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func workflowItem(guid string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"guid":           {S: aws.String(guid)},
+		"startTime":      {S: aws.String("2025-01-02T10:00:00.000Z")},
+		"endTime":        {S: aws.String("2025-01-02T10:05:00Z")},
+		"workflowStatus": {S: aws.String("Complete")},
+		"workflowName":   {S: aws.String("vod")},
+		"srcBucket":      {S: aws.String("source-bucket")},
+		"srcVideo":       {S: aws.String("video.mp4")},
+		"hlsUrl":         {S: aws.String("https://cdn/" + guid + "/hls/video.m3u8")},
+		"mp4Urls":        {L: []*dynamodb.AttributeValue{{S: aws.String("https://cdn/" + guid + "/mp4/video.mp4")}}},
+		"encodingJob":    {M: map[string]*dynamodb.AttributeValue{"Role": {S: aws.String("role")}}},
+		"version":        {N: aws.String("4")},
+	}
+}
+
+func TestGetAsset(t *testing.T) {
+	t.Run("should return the public asset", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: workflowItem("123e4567-e89b-12d3-a456-426614174000"),
+		}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodGet,
+			Resource:       "/assets/{guid}",
+			PathParameters: map[string]string{"guid": "123e4567-e89b-12d3-a456-426614174000"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.NotContains(t, response.Body, "encodingJob")
+
+		var asset Asset
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &asset))
+		assert.Equal(t, "Complete", asset.Status)
+		assert.Equal(t, AssetSource{Bucket: "source-bucket", Key: "video.mp4"}, asset.Source)
+		assert.Equal(t, "2025-01-02T10:05:00Z", asset.CompletedAt)
+		assert.Equal(t, "https://cdn/123e4567-e89b-12d3-a456-426614174000/hls/video.m3u8", asset.Playback.Hls)
+		assert.Len(t, asset.Playback.Mp4, 1)
+		assert.Equal(t, int64(4), asset.Version)
+	})
+
+	t.Run("should return 404 when the asset does not exist", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodGet,
+			Resource:       "/assets/{guid}",
+			PathParameters: map[string]string{"guid": "missing"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	})
+
+	t.Run("should return 500 when db get fails", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(nil, assert.AnError)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodGet,
+			Resource:       "/assets/{guid}",
+			PathParameters: map[string]string{"guid": "123e4567-e89b-12d3-a456-426614174000"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+		assert.NotContains(t, response.Body, assert.AnError.Error())
+	})
+}
+
+func TestListAssets(t *testing.T) {
+	t.Run("should query the status index within the date range", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return *input.IndexName == statusIndex &&
+				*input.KeyConditionExpression == "#key = :key AND #startTime BETWEEN :from AND :to" &&
+				*input.ExpressionAttributeValues[":key"].S == "Complete" &&
+				*input.ExpressionAttributeValues[":from"].S == "2025-01-01T00:00:00.000Z" &&
+				*input.ExpressionAttributeValues[":to"].S == "2025-01-31T23:59:59.999Z" &&
+				*input.Limit == 10
+		})).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{workflowItem("a"), workflowItem("b")},
+			LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+				"guid":           {S: aws.String("b")},
+				"workflowStatus": {S: aws.String("Complete")},
+				"startTime":      {S: aws.String("2025-01-02T10:00:00.000Z")},
+			},
+		}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod: http.MethodGet,
+			Resource:   "/assets",
+			QueryStringParameters: map[string]string{
+				"status": "Complete",
+				"from":   "2025-01-01",
+				"to":     "2025-01-31",
+				"limit":  "10",
+			},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+
+		var list AssetList
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &list))
+		assert.Len(t, list.Assets, 2)
+		assert.NotEmpty(t, list.NextToken)
+
+		key, err := decodeNextToken(list.NextToken)
+		assert.Nil(t, err)
+		assert.Equal(t, "b", *key["guid"].S)
+	})
+
+	t.Run("should query the source key index", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return *input.IndexName == sourceKeyIndex &&
+				*input.KeyConditionExpression == "#key = :key" &&
+				*input.ExpressionAttributeValues[":key"].S == "video.mp4" &&
+				*input.Limit == defaultLimit
+		})).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{workflowItem("a")},
+		}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Resource:              "/assets",
+			QueryStringParameters: map[string]string{"sourceKey": "video.mp4"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.NotContains(t, response.Body, "nextToken")
+	})
+
+	t.Run("should return 503 until the index is provisioned", func(t *testing.T) {
+		for _, message := range []string{
+			"The table does not have the specified index: workflowStatus-startTime-index",
+			"Cannot read from backfilling global secondary index: workflowStatus-startTime-index",
+		} {
+			dynamoDBClientMock := new(DynamoDBClientMock)
+			dynamoDBClientMock.On("Query", mock.Anything).Return(nil, awserr.New("ValidationException", message, nil))
+
+			handler := &Handler{
+				DynamoDBClient: dynamoDBClientMock,
+			}
+
+			response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+				HTTPMethod:            http.MethodGet,
+				Resource:              "/assets",
+				QueryStringParameters: map[string]string{"status": "Complete"},
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode, message)
+			assert.JSONEq(t, `{"message":"workflowStatus-startTime-index: index not yet provisioned"}`, response.Body)
+		}
+	})
+
+	t.Run("should return 500 for other validation errors", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("Query", mock.Anything).Return(nil, awserr.New("ValidationException", "Invalid KeyConditionExpression", nil))
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Resource:              "/assets",
+			QueryStringParameters: map[string]string{"sourceKey": "video.mp4"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+	})
+
+	t.Run("should reject invalid parameters", func(t *testing.T) {
+		handler := &Handler{
+			DynamoDBClient: new(DynamoDBClientMock),
+		}
+
+		for _, params := range []map[string]string{
+			{},
+			{"status": "Complete", "from": "yesterday"},
+			{"status": "Complete", "limit": "1000"},
+			{"status": "Complete", "nextToken": "not-a-token"},
+		} {
+			response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+				HTTPMethod:            http.MethodGet,
+				Resource:              "/assets",
+				QueryStringParameters: params,
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, response.StatusCode, params)
+			assert.NotContains(t, response.Body, "main.Handler", params)
+		}
+	})
+
+	t.Run("should describe the invalid parameter", func(t *testing.T) {
+		handler := &Handler{
+			DynamoDBClient: new(DynamoDBClientMock),
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Resource:              "/assets",
+			QueryStringParameters: map[string]string{"status": "Complete", "from": "yesterday"},
+		})
+
+		assert.Nil(t, err)
+		assert.JSONEq(t, `{"message":"from: \"yesterday\" is not a date or RFC 3339 timestamp: invalid query parameter"}`, response.Body)
+	})
+}
+
+func TestGetHistory(t *testing.T) {
+	t.Run("should return every page of events", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return input.ExclusiveStartKey == nil
+		})).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{{
+				"guid":    {S: aws.String("a")},
+				"version": {N: aws.String("1")},
+				"status":  {S: aws.String("Ingest")},
+			}},
+			LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+				"guid":    {S: aws.String("a")},
+				"version": {N: aws.String("1")},
+			},
+		}, nil).Once()
+		dynamoDBClientMock.On("Query", mock.Anything).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{{
+				"guid":           {S: aws.String("a")},
+				"version":        {N: aws.String("2")},
+				"status":         {S: aws.String("Encoding")},
+				"previousStatus": {S: aws.String("Ingest")},
+			}},
+		}, nil).Once()
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodGet,
+			Resource:       "/assets/{guid}/history",
+			PathParameters: map[string]string{"guid": "a"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+
+		var history AssetHistory
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &history))
+		assert.Len(t, history.Events, 2)
+		assert.Equal(t, "Encoding", history.Events[1].Status)
+		dynamoDBClientMock.AssertExpectations(t)
+	})
+}
+
+func TestRouting(t *testing.T) {
+	handler := &Handler{
+		DynamoDBClient: new(DynamoDBClientMock),
+	}
+
+	response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodDelete,
+		Resource:   "/assets/{guid}",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+
+	response, err = handler.HandleRequest(events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodGet,
+		Resource:   "/unknown",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestGetAssetRetention(t *testing.T) {
+	item := workflowItem("123e4567-e89b-12d3-a456-426614174000")
+	item["retentionPolicy"] = &dynamodb.AttributeValue{S: aws.String("DELETE")}
+	item["retentionDays"] = &dynamodb.AttributeValue{N: aws.String("30")}
+	item["retentionDueAt"] = &dynamodb.AttributeValue{S: aws.String("2025-02-01T10:05:00Z")}
+
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+
+	handler := &Handler{
+		DynamoDBClient: dynamoDBClientMock,
+	}
+
+	response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+		HTTPMethod:     http.MethodGet,
+		Resource:       "/assets/{guid}",
+		PathParameters: map[string]string{"guid": "123e4567-e89b-12d3-a456-426614174000"},
+	})
+
+	assert.Nil(t, err)
+	var asset Asset
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &asset))
+	assert.Equal(t, &AssetRetention{Policy: "DELETE", Days: 30, DueAt: "2025-02-01T10:05:00Z"}, asset.Retention)
+}
+
+func TestGetAssetInvalidation(t *testing.T) {
+	item := workflowItem("123e4567-e89b-12d3-a456-426614174000")
+	item["invalidation"] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		"status":      {S: aws.String("Completed")},
+		"ids":         {L: []*dynamodb.AttributeValue{{S: aws.String("I2J0I21PCUYOIK")}}},
+		"paths":       {N: aws.String("6")},
+		"requestedAt": {S: aws.String("2025-02-01T10:05:00Z")},
+		"completedAt": {S: aws.String("2025-02-01T10:07:00Z")},
+		"checks":      {N: aws.String("4")},
+	}}
+
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{Item: item}, nil)
+
+	handler := &Handler{
+		DynamoDBClient: dynamoDBClientMock,
+	}
+
+	response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+		HTTPMethod:     http.MethodGet,
+		Resource:       "/assets/{guid}",
+		PathParameters: map[string]string{"guid": "123e4567-e89b-12d3-a456-426614174000"},
+	})
+
+	assert.Nil(t, err)
+	var asset Asset
+	assert.Nil(t, json.Unmarshal([]byte(response.Body), &asset))
+	assert.Equal(t, &AssetInvalidation{
+		Status:      "Completed",
+		Ids:         []string{"I2J0I21PCUYOIK"},
+		Paths:       6,
+		RequestedAt: "2025-02-01T10:05:00Z",
+		CompletedAt: "2025-02-01T10:07:00Z",
+	}, asset.Invalidation)
+}
+
+func costItem(workflow, tenant string, total float64) map[string]*dynamodb.AttributeValue {
+	cost, _ := dynamodbattribute.MarshalMap(CostEstimate{
+		Currency: "USD",
+		Total:    total,
+		Tenant:   tenant,
+		Outputs:  []OutputCost{{Group: "HLS_GROUP", Kind: "VIDEO", Codec: "H_264", Resolution: "HD", Minutes: 2, Cost: total}},
+	})
+	return map[string]*dynamodb.AttributeValue{
+		"workflowName": {S: aws.String(workflow)},
+		"cost":         {M: cost},
+	}
+}
+
+func TestGetCosts(t *testing.T) {
+	t.Run("should sum the month's encodes by workflow and tenant", func(t *testing.T) {
+		month := func(input *dynamodb.QueryInput) bool {
+			return *input.TableName == "vod-costs" && *input.ExpressionAttributeValues[":month"].S == "2025-02"
+		}
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return month(input) && input.ExclusiveStartKey == nil
+		})).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				costItem("vod", "acme", 0.03),
+				{"workflowName": {S: aws.String("vod")}},
+			},
+			LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"month": {S: aws.String("2025-02")}, "jobId": {S: aws.String("a")}},
+		}, nil).Once()
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return month(input) && input.ExclusiveStartKey != nil
+		})).Return(&dynamodb.QueryOutput{
+			// the same asset encoded twice in the month counts twice
+			Items: []map[string]*dynamodb.AttributeValue{
+				costItem("live", "acme", 0.05),
+				costItem("vod", "unassigned", 0.01),
+				costItem("vod", "unassigned", 0.01),
+			},
+		}, nil).Once()
+
+		handler := &Handler{
+			Config:         Config{CostTable: "vod-costs"},
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Resource:              "/costs",
+			QueryStringParameters: map[string]string{"month": "2025-02"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+
+		var report CostReport
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &report))
+		assert.Equal(t, CostReport{
+			Month:    "2025-02",
+			Currency: "USD",
+			Encodes:  4,
+			Minutes:  8,
+			Total:    0.1,
+			Workflows: map[string]*CostTotal{
+				"vod":  {Encodes: 3, Minutes: 6, Total: 0.05},
+				"live": {Encodes: 1, Minutes: 2, Total: 0.05},
+			},
+			Tenants: map[string]*CostTotal{
+				"acme":       {Encodes: 2, Minutes: 4, Total: 0.08},
+				"unassigned": {Encodes: 2, Minutes: 4, Total: 0.02},
+			},
+		}, report)
+		dynamoDBClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should reject a month that is not YYYY-MM", func(t *testing.T) {
+		handler := &Handler{
+			DynamoDBClient: new(DynamoDBClientMock),
+		}
+
+		response, err := handler.HandleRequest(events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Resource:              "/costs",
+			QueryStringParameters: map[string]string{"month": "2025-2"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	})
+}
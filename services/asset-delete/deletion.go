@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const versionAttribute = "version"
+
+// Deletion is stored as the deletion attribute of the workflow record, and
+// kept on the tombstone once the asset is purged.
+type Deletion struct {
+	Status         string `json:"status"`
+	RequestedAt    string `json:"requestedAt"`
+	RequestedBy    string `json:"requestedBy"`
+	PreviousStatus string `json:"previousStatus"`
+	PurgeAt        string `json:"purgeAt"`
+	RestoredAt     string `json:"restoredAt,omitempty"`
+	RestoredBy     string `json:"restoredBy,omitempty"`
+	PurgedAt       string `json:"purgedAt,omitempty"`
+	InvalidationId string `json:"invalidationId,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// AssetRecord is the part of the workflow record the deletion needs.
+type AssetRecord struct {
+	GUID                   string    `json:"guid"`
+	WorkflowStatus         string    `json:"workflowStatus"`
+	WorkflowName           string    `json:"workflowName,omitempty"`
+	SrcBucket              string    `json:"srcBucket,omitempty"`
+	SrcVideo               string    `json:"srcVideo,omitempty"`
+	StartTime              string    `json:"startTime,omitempty"`
+	MediaPackageResourceId string    `json:"mediaPackageResourceId,omitempty"`
+	RetentionArchive       string    `json:"retentionArchive,omitempty"`
+	Version                int64     `json:"version,omitempty"`
+	StatusUpdatedAt        string    `json:"statusUpdatedAt,omitempty"`
+	Deletion               *Deletion `json:"deletion,omitempty"`
+	// Cost is the transcoding cost estimate, kept on the tombstone for the
+	// monthly cost reports.
+	Cost map[string]interface{} `json:"cost,omitempty"`
+}
+
+// Tombstone replaces the record of a purged asset.
+type Tombstone struct {
+	GUID            string                 `json:"guid"`
+	WorkflowStatus  string                 `json:"workflowStatus"`
+	WorkflowName    string                 `json:"workflowName,omitempty"`
+	SrcBucket       string                 `json:"srcBucket,omitempty"`
+	SrcVideo        string                 `json:"srcVideo,omitempty"`
+	StartTime       string                 `json:"startTime,omitempty"`
+	Version         int64                  `json:"version"`
+	StatusUpdatedAt string                 `json:"statusUpdatedAt"`
+	Deletion        *Deletion              `json:"deletion"`
+	Cost            map[string]interface{} `json:"cost,omitempty"`
+}
+
+// HistoryEvent is the workflowStatus transition written to the HistoryTable,
+// as the dynamo service does.
+type HistoryEvent struct {
+	GUID                   string `json:"guid"`
+	Version                int64  `json:"version"`
+	Timestamp              string `json:"timestamp"`
+	Status                 string `json:"status"`
+	PreviousStatus         string `json:"previousStatus,omitempty"`
+	PreviousStatusDuration int64  `json:"previousStatusDuration,omitempty"`
+	Actor                  string `json:"actor,omitempty"`
+}
+
+// delete moves the asset to PendingDeletion, and purges it when forced or
+// when there is no grace period. Deleting an asset that is already pending
+// returns its deletion unchanged unless forced.
+func (h *Handler) delete(guid string, force bool, actor string) (*DeleteResponse, error) {
+	record, err := h.getRecord(guid)
+	if err != nil {
+		return nil, fmt.Errorf("asset-delete: main.Handler.delete: %w", err)
+	}
+
+	switch {
+	case record.WorkflowStatus == StatusDeleted:
+		return nil, fmt.Errorf("asset-delete: main.Handler.delete: %s: %w", guid, ErrAssetDeleted)
+	case runningStatuses[record.WorkflowStatus]:
+		return nil, fmt.Errorf("asset-delete: main.Handler.delete: %s is %s: %w", guid, record.WorkflowStatus, ErrAssetBusy)
+	}
+
+	days := h.Config.DeletionGraceDays
+	if record.WorkflowStatus != StatusPendingDeletion {
+		now := time.Now().UTC()
+		deletion := &Deletion{
+			Status:         DeletionPending,
+			RequestedAt:    now.Format(time.RFC3339),
+			RequestedBy:    actor,
+			PreviousStatus: record.WorkflowStatus,
+			PurgeAt:        now.AddDate(0, 0, days).Format(time.RFC3339),
+		}
+		if force {
+			deletion.PurgeAt = deletion.RequestedAt
+		}
+		if err := h.transition(record, StatusPendingDeletion, deletion, actor); err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.delete: transition: %w", err)
+		}
+		slog.Info("PENDING DELETION", "guid", guid, "purgeAt", deletion.PurgeAt)
+	}
+
+	if force || days == 0 {
+		if err := h.purge(record, actor); err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.delete: purge: %w", err)
+		}
+	}
+
+	return &DeleteResponse{GUID: guid, WorkflowStatus: record.WorkflowStatus, Deletion: record.Deletion}, nil
+}
+
+// restore returns an asset pending deletion to the status it had before.
+func (h *Handler) restore(guid string, actor string) (*DeleteResponse, error) {
+	record, err := h.getRecord(guid)
+	if err != nil {
+		return nil, fmt.Errorf("asset-delete: main.Handler.restore: %w", err)
+	}
+	if record.WorkflowStatus != StatusPendingDeletion || record.Deletion == nil {
+		return nil, fmt.Errorf("asset-delete: main.Handler.restore: %s is %s: %w", guid, record.WorkflowStatus, ErrNotPendingDeletion)
+	}
+
+	deletion := *record.Deletion
+	deletion.Status = DeletionRestored
+	deletion.RestoredAt = time.Now().UTC().Format(time.RFC3339)
+	deletion.RestoredBy = actor
+	deletion.Error = ""
+	if err := h.transition(record, deletion.PreviousStatus, &deletion, actor); err != nil {
+		return nil, fmt.Errorf("asset-delete: main.Handler.restore: transition: %w", err)
+	}
+
+	slog.Info("RESTORED", "guid", guid, "workflowStatus", record.WorkflowStatus)
+	return &DeleteResponse{GUID: guid, WorkflowStatus: record.WorkflowStatus, Deletion: record.Deletion}, nil
+}
+
+// purge removes the asset and replaces its record with a tombstone. A
+// failure is stored as deletion.error and retried by the next sweep.
+func (h *Handler) purge(record *AssetRecord, actor string) error {
+	if record.Deletion == nil {
+		record.Deletion = &Deletion{Status: DeletionPending}
+	}
+
+	invalidationId, err := h.removeAsset(record)
+	if err != nil {
+		if err := h.recordPurgeError(record, err); err != nil {
+			slog.Error("PURGE ERROR NOT RECORDED", "guid", record.GUID, "error", err)
+		}
+		return fmt.Errorf("removeAsset: %w", err)
+	}
+
+	now := time.Now().UTC()
+	deletion := *record.Deletion
+	deletion.Status = DeletionPurged
+	deletion.PurgedAt = now.Format(time.RFC3339)
+	deletion.InvalidationId = invalidationId
+	deletion.Error = ""
+
+	tombstone := Tombstone{
+		GUID:            record.GUID,
+		WorkflowStatus:  StatusDeleted,
+		WorkflowName:    record.WorkflowName,
+		SrcBucket:       record.SrcBucket,
+		SrcVideo:        record.SrcVideo,
+		StartTime:       record.StartTime,
+		Version:         record.Version + 1,
+		StatusUpdatedAt: now.Format(time.RFC3339Nano),
+		Deletion:        &deletion,
+		Cost:            record.Cost,
+	}
+	item, err := dynamodbattribute.MarshalMap(tombstone)
+	if err != nil {
+		return fmt.Errorf("MarshalMap: %w", err)
+	}
+
+	condition, names, values := versionCondition(record)
+	if len(values) == 0 {
+		values = nil
+	}
+	put := &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:                 aws.String(h.Config.DynamoDBTable),
+			Item:                      item,
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		},
+	}
+	if err := h.writeRecord(put, history(record, StatusDeleted, actor, now)); err != nil {
+		return fmt.Errorf("writeRecord: %w", err)
+	}
+
+	record.WorkflowStatus = StatusDeleted
+	record.Version = tombstone.Version
+	record.StatusUpdatedAt = tombstone.StatusUpdatedAt
+	record.Deletion = &deletion
+	slog.Info("PURGED", "guid", record.GUID)
+	return nil
+}
+
+// sweep purges the assets whose grace period is over.
+func (h *Handler) sweep(ctx context.Context) (*SweepResult, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(statusIndex),
+		KeyConditionExpression: aws.String("#workflowStatus = :pending"),
+		FilterExpression:       aws.String("#deletion.#purgeAt <= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#workflowStatus": aws.String("workflowStatus"),
+			"#deletion":       aws.String("deletion"),
+			"#purgeAt":        aws.String("purgeAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending": {S: aws.String(StatusPendingDeletion)},
+			":now":     {S: aws.String(now)},
+		},
+	}
+
+	result := &SweepResult{Complete: true}
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.sweep: Query: %w", err)
+		}
+
+		var records []AssetRecord
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &records); err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.sweep: UnmarshalListOfMaps: %w", err)
+		}
+
+		for i := range records {
+			// Whatever is left is picked up by the next run
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < stopMargin {
+				result.Complete = false
+				slog.Warn("SWEEP STOPPED", "purged", result.Purged, "failed", result.Failed)
+				return result, nil
+			}
+
+			if err := h.purge(&records[i], "DeletionSweep"); err != nil {
+				slog.Error("PURGE FAILED", "guid", records[i].GUID, "error", err)
+				result.Failed++
+				continue
+			}
+			result.Purged++
+		}
+
+		if len(data.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+
+	slog.Info("SWEEP COMPLETE", "purged", result.Purged, "failed", result.Failed)
+	return result, nil
+}
+
+func (h *Handler) getRecord(guid string) (*AssetRecord, error) {
+	if guid == "" {
+		return nil, fmt.Errorf("guid is required: %w", ErrInvalidRequest)
+	}
+
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if len(data.Item) == 0 {
+		return nil, fmt.Errorf("guid %s: %w", guid, ErrAssetNotFound)
+	}
+
+	var record AssetRecord
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &record); err != nil {
+		return nil, fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	return &record, nil
+}
+
+// transition sets the workflowStatus and deletion of the record, bumping its
+// version, and updates record to match.
+func (h *Handler) transition(record *AssetRecord, status string, deletion *Deletion, actor string) error {
+	deletionValue, err := dynamodbattribute.Marshal(deletion)
+	if err != nil {
+		return fmt.Errorf("Marshal: %w", err)
+	}
+
+	now := time.Now().UTC()
+	condition, names, values := versionCondition(record)
+	names["#workflowStatus"] = aws.String("workflowStatus")
+	names["#deletion"] = aws.String("deletion")
+	names["#statusUpdatedAt"] = aws.String("statusUpdatedAt")
+	values[":status"] = &dynamodb.AttributeValue{S: aws.String(status)}
+	values[":deletion"] = deletionValue
+	values[":statusUpdatedAt"] = &dynamodb.AttributeValue{S: aws.String(now.Format(time.RFC3339Nano))}
+	values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(record.Version+1, 10))}
+
+	update := &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName: aws.String(h.Config.DynamoDBTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"guid": {S: aws.String(record.GUID)},
+			},
+			UpdateExpression:          aws.String("SET #workflowStatus = :status, #deletion = :deletion, #statusUpdatedAt = :statusUpdatedAt, #version = :version"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		},
+	}
+	if err := h.writeRecord(update, history(record, status, actor, now)); err != nil {
+		return fmt.Errorf("writeRecord: %w", err)
+	}
+
+	record.WorkflowStatus = status
+	record.Version++
+	record.StatusUpdatedAt = *values[":statusUpdatedAt"].S
+	record.Deletion = deletion
+	return nil
+}
+
+// recordPurgeError keeps the failure on the pending deletion without
+// changing its version, so a concurrent writer is not disturbed.
+func (h *Handler) recordPurgeError(record *AssetRecord, cause error) error {
+	_, err := h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(record.GUID)},
+		},
+		UpdateExpression:    aws.String("SET #deletion.#error = :error"),
+		ConditionExpression: aws.String("#workflowStatus = :pending"),
+		ExpressionAttributeNames: map[string]*string{
+			"#deletion":       aws.String("deletion"),
+			"#error":          aws.String("error"),
+			"#workflowStatus": aws.String("workflowStatus"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":error":   {S: aws.String(cause.Error())},
+			":pending": {S: aws.String(StatusPendingDeletion)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+	return nil
+}
+
+// writeRecord writes the record and, when a HistoryTable is configured, its
+// history event in one transaction, as the dynamo service does.
+func (h *Handler) writeRecord(item *dynamodb.TransactWriteItem, event *HistoryEvent) error {
+	items := []*dynamodb.TransactWriteItem{item}
+	if historyTable := h.Config.HistoryTable; historyTable != "" {
+		historyItem, err := dynamodbattribute.MarshalMap(event)
+		if err != nil {
+			return fmt.Errorf("MarshalMap: %w", err)
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:                aws.String(historyTable),
+				Item:                     historyItem,
+				ConditionExpression:      aws.String("attribute_not_exists(#guid)"),
+				ExpressionAttributeNames: map[string]*string{"#guid": aws.String("guid")},
+			},
+		})
+	}
+
+	_, err := h.DynamoDBClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if isConditionalCheckFailed(err) {
+		return fmt.Errorf("%s at version %d: %w", event.GUID, event.Version-1, ErrVersionConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("TransactWriteItems: %w", err)
+	}
+	return nil
+}
+
+func versionCondition(record *AssetRecord) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{"#version": aws.String(versionAttribute)}
+	values := map[string]*dynamodb.AttributeValue{}
+	if record.Version == 0 {
+		return "attribute_not_exists(#version)", names, values
+	}
+	values[":expected"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(record.Version, 10))}
+	return "#version = :expected", names, values
+}
+
+func history(record *AssetRecord, status, actor string, now time.Time) *HistoryEvent {
+	event := &HistoryEvent{
+		GUID:           record.GUID,
+		Version:        record.Version + 1,
+		Timestamp:      now.Format(time.RFC3339Nano),
+		Status:         status,
+		PreviousStatus: record.WorkflowStatus,
+		Actor:          actor,
+	}
+	if since, err := time.Parse(time.RFC3339Nano, record.StatusUpdatedAt); err == nil {
+		event.PreviousStatusDuration = now.Sub(since).Milliseconds()
+	}
+	return event
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if reason.Code != nil && *reason.Code == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
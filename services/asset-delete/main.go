@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/mediapackagevod"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "asset-delete"
+
+// Deleting an asset first moves it to PendingDeletion for DeletionGraceDays,
+// during which it can be restored. Once the grace period is over, or right
+// away when forced, everything the workflows created for it is removed and
+// the record is replaced by a Deleted tombstone that keeps the deletion for
+// audit.
+const (
+	StatusPendingDeletion = "PendingDeletion"
+	StatusDeleted         = "Deleted"
+
+	DeletionPending  = "Pending"
+	DeletionRestored = "Restored"
+	DeletionPurged   = "Purged"
+
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+
+	statusIndex    = "workflowStatus-startTime-index"
+	sourceKeyIndex = "srcVideo-startTime-index"
+	stopMargin     = 30 * time.Second
+)
+
+var (
+	ErrInvalidEventObject = errors.New("invalid event object")
+	ErrInvalidRequest     = errors.New("invalid delete request")
+	ErrAssetNotFound      = errors.New("asset not found")
+	ErrAssetBusy          = errors.New("asset has a running workflow")
+	ErrAssetDeleted       = errors.New("asset is already deleted")
+	ErrNotPendingDeletion = errors.New("asset is not pending deletion")
+	ErrRouteNotFound      = errors.New("route not found")
+	ErrVersionConflict    = errors.New("workflow record was modified by another writer")
+)
+
+// runningStatuses are set while a workflow is working on the asset.
+var runningStatuses = map[string]bool{
+	"Ingest":   true,
+	"Encoding": true,
+}
+
+// DeleteRequest is the payload of a direct invocation (aws lambda invoke).
+// Force skips the grace period.
+type DeleteRequest struct {
+	GUID   string `json:"guid"`
+	Action string `json:"action,omitempty"`
+	Force  bool   `json:"force,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+}
+
+type DeleteResponse struct {
+	GUID           string    `json:"guid"`
+	WorkflowStatus string    `json:"workflowStatus"`
+	Deletion       *Deletion `json:"deletion"`
+}
+
+type SweepResult struct {
+	Purged   int  `json:"purged"`
+	Failed   int  `json:"failed"`
+	Complete bool `json:"complete"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+type S3Client interface {
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
+type MediaPackageVodClient interface {
+	DeleteAsset(input *mediapackagevod.DeleteAssetInput) (*mediapackagevod.DeleteAssetOutput, error)
+}
+
+type CloudFrontClient interface {
+	CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// HistoryTable records every status transition when it is set.
+	HistoryTable string `env:"HistoryTable"`
+	Destination  string `env:"Destination" required:"true"`
+	StateBucket  string `env:"StateBucket" required:"true"`
+	// DistributionId is the CloudFront distribution invalidated when an
+	// asset is purged.
+	DistributionId string `env:"DistributionId"`
+	// DeletionGraceDays is the number of days a deleted asset can be
+	// restored; 0 purges it right away.
+	DeletionGraceDays int `env:"DeletionGraceDays" default:"7" min:"0"`
+}
+
+type Handler struct {
+	Config                Config
+	DynamoDBClient        DynamoDBClient
+	S3Client              S3Client
+	MediaPackageVodClient MediaPackageVodClient
+	CloudFrontClient      CloudFrontClient
+}
+
+func (h *Handler) HandleRequest(ctx context.Context, event map[string]interface{}) (interface{}, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("asset-delete: main.Handler.HandleRequest: json.Marshal: %w", err)
+	}
+
+	switch {
+	case event["httpMethod"] != nil:
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		return h.handleAPIRequest(request)
+	case event["detail-type"] == "Scheduled Event":
+		return h.sweep(ctx)
+	case event["guid"] != nil:
+		var request DeleteRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("asset-delete: main.Handler.HandleRequest: %v: %w", err, ErrInvalidRequest)
+		}
+		if request.Actor == "" {
+			request.Actor = "Lambda"
+		}
+
+		switch request.Action {
+		case "", ActionDelete:
+			return h.delete(request.GUID, request.Force, request.Actor)
+		case ActionRestore:
+			return h.restore(request.GUID, request.Actor)
+		}
+		return nil, fmt.Errorf("asset-delete: main.Handler.HandleRequest: action %q: %w", request.Action, ErrInvalidRequest)
+	}
+
+	return nil, ErrInvalidEventObject
+}
+
+func (h *Handler) handleAPIRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	actor := request.RequestContext.Identity.UserArn
+	if actor == "" {
+		actor = "AssetApi"
+	}
+	guid := request.PathParameters["guid"]
+
+	switch {
+	case request.HTTPMethod == http.MethodDelete && request.Resource == "/assets/{guid}":
+		force := false
+		if value := request.QueryStringParameters["force"]; value != "" {
+			var err error
+			if force, err = strconv.ParseBool(value); err != nil {
+				return errorResponse(fmt.Errorf("asset-delete: main.Handler.handleAPIRequest: force: %w", ErrInvalidRequest))
+			}
+		}
+
+		response, err := h.delete(guid, force, actor)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if response.WorkflowStatus == StatusDeleted {
+			return jsonResponse(http.StatusOK, response)
+		}
+		return jsonResponse(http.StatusAccepted, response)
+	case request.HTTPMethod == http.MethodPost && request.Resource == "/assets/{guid}/restore":
+		response, err := h.restore(guid, actor)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return jsonResponse(http.StatusOK, response)
+	}
+
+	return errorResponse(ErrRouteNotFound)
+}
+
+func jsonResponse(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("asset-delete: main.jsonResponse: json.Marshal: %w", err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(bodyJson),
+	}, nil
+}
+
+func errorResponse(err error) (events.APIGatewayProxyResponse, error) {
+	slog.Error("REQUEST FAILED", "error", err)
+
+	switch {
+	case errors.Is(err, ErrAssetNotFound), errors.Is(err, ErrRouteNotFound):
+		return jsonResponse(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+	case errors.Is(err, ErrInvalidRequest):
+		return jsonResponse(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	case errors.Is(err, ErrAssetBusy), errors.Is(err, ErrAssetDeleted), errors.Is(err, ErrNotPendingDeletion), errors.Is(err, ErrVersionConflict):
+		return jsonResponse(http.StatusConflict, ErrorResponse{Message: err.Error()})
+	}
+	return jsonResponse(http.StatusInternalServerError, ErrorResponse{Message: "internal error"})
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("asset-delete: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:                config,
+		DynamoDBClient:        dynamodb.New(sess),
+		S3Client:              s3.New(sess),
+		MediaPackageVodClient: mediapackagevod.New(sess),
+		CloudFrontClient:      cloudfront.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
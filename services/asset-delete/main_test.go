@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/mediapackagevod"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+func (m *S3ClientMock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.DeleteObjectsOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
+type MediaPackageVodClientMock struct {
+	mock.Mock
+}
+
+func (m *MediaPackageVodClientMock) DeleteAsset(input *mediapackagevod.DeleteAssetInput) (*mediapackagevod.DeleteAssetOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mediapackagevod.DeleteAssetOutput), args.Error(1)
+}
+
+type CloudFrontClientMock struct {
+	mock.Mock
+}
+
+func (m *CloudFrontClientMock) CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*cloudfront.CreateInvalidationOutput), args.Error(1)
+}
+
+type mocks struct {
+	dynamoDB        *DynamoDBClientMock
+	s3              *S3ClientMock
+	mediaPackageVod *MediaPackageVodClientMock
+	cloudFront      *CloudFrontClientMock
+	transactions    []*dynamodb.TransactWriteItemsInput
+}
+
+func newHandler(config Config) (*Handler, *mocks) {
+	m := &mocks{
+		dynamoDB:        new(DynamoDBClientMock),
+		s3:              new(S3ClientMock),
+		mediaPackageVod: new(MediaPackageVodClientMock),
+		cloudFront:      new(CloudFrontClientMock),
+	}
+	m.dynamoDB.On("TransactWriteItems", mock.Anything).
+		Run(func(args mock.Arguments) {
+			m.transactions = append(m.transactions, args.Get(0).(*dynamodb.TransactWriteItemsInput))
+		}).
+		Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+	return &Handler{
+		Config:                config,
+		DynamoDBClient:        m.dynamoDB,
+		S3Client:              m.s3,
+		MediaPackageVodClient: m.mediaPackageVod,
+		CloudFrontClient:      m.cloudFront,
+	}, m
+}
+
+// onPurge expects the removal of everything the asset owns.
+func (m *mocks) onPurge(sharedSource bool) {
+	m.s3.On("ListObjectsV2", mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return *input.Bucket == "destination"
+	})).Return(&s3.ListObjectsV2Output{Contents: []*s3.Object{
+		{Key: aws.String("guid/hls/video.m3u8")},
+		{Key: aws.String("guid/thumbnails/video.jpg")},
+	}}, nil)
+	m.s3.On("ListObjectsV2", mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return *input.Bucket == "state"
+	})).Return(&s3.ListObjectsV2Output{}, nil)
+	m.s3.On("DeleteObjects", mock.Anything).Return(&s3.DeleteObjectsOutput{}, nil)
+	m.s3.On("DeleteObject", mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+	m.mediaPackageVod.On("DeleteAsset", &mediapackagevod.DeleteAssetInput{Id: aws.String("guid")}).
+		Return(nil, awserr.New(mediapackagevod.ErrCodeNotFoundException, "not found", nil))
+
+	shared := &dynamodb.QueryOutput{}
+	if sharedSource {
+		shared.Items = []map[string]*dynamodb.AttributeValue{{"guid": {S: aws.String("other")}}}
+	}
+	m.dynamoDB.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.IndexName == sourceKeyIndex
+	})).Return(shared, nil)
+	m.cloudFront.On("CreateInvalidation", mock.Anything).
+		Return(&cloudfront.CreateInvalidationOutput{Invalidation: &cloudfront.Invalidation{Id: aws.String("invalidation")}}, nil)
+}
+
+func recordItem(status string, deletion *Deletion) *dynamodb.GetItemOutput {
+	item, _ := dynamodbattribute.MarshalMap(AssetRecord{
+		GUID:                   "guid",
+		WorkflowStatus:         status,
+		WorkflowName:           "vod",
+		SrcBucket:              "source",
+		SrcVideo:               "video.mp4",
+		StartTime:              "2025-01-02T10:00:00.000Z",
+		MediaPackageResourceId: "guid",
+		RetentionArchive:       "s3://archive/source-archive/video.mp4",
+		Version:                4,
+		StatusUpdatedAt:        "2025-01-02T10:05:00Z",
+		Deletion:               deletion,
+		Cost:                   map[string]interface{}{"currency": "USD", "total": 0.03, "tenant": "acme"},
+	})
+	return &dynamodb.GetItemOutput{Item: item}
+}
+
+func deleteRequest(query map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"httpMethod":            http.MethodDelete,
+		"resource":              "/assets/{guid}",
+		"pathParameters":        map[string]interface{}{"guid": "guid"},
+		"queryStringParameters": query,
+	}
+}
+
+func pendingDeletion() *Deletion {
+	return &Deletion{
+		Status:         DeletionPending,
+		RequestedAt:    "2025-02-01T00:00:00Z",
+		RequestedBy:    "admin",
+		PreviousStatus: "Complete",
+		PurgeAt:        "2025-02-08T00:00:00Z",
+	}
+}
+
+func TestDelete(t *testing.T) {
+	config := Config{
+		DynamoDBTable:     "vod",
+		HistoryTable:      "vod-history",
+		Destination:       "destination",
+		StateBucket:       "state",
+		DistributionId:    "distribution",
+		DeletionGraceDays: 7,
+	}
+
+	t.Run("should move the asset to pending deletion", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Complete", nil), nil)
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(nil))
+
+		assert.NoError(t, err)
+		response := output.(events.APIGatewayProxyResponse)
+		assert.Equal(t, http.StatusAccepted, response.StatusCode, response.Body)
+
+		var body DeleteResponse
+		assert.NoError(t, json.Unmarshal([]byte(response.Body), &body))
+		assert.Equal(t, StatusPendingDeletion, body.WorkflowStatus)
+		assert.Equal(t, "Complete", body.Deletion.PreviousStatus)
+		assert.Equal(t, "AssetApi", body.Deletion.RequestedBy)
+		requestedAt, _ := time.Parse(time.RFC3339, body.Deletion.RequestedAt)
+		purgeAt, _ := time.Parse(time.RFC3339, body.Deletion.PurgeAt)
+		assert.Equal(t, 7*24*time.Hour, purgeAt.Sub(requestedAt))
+
+		assert.Len(t, m.transactions, 1)
+		items := m.transactions[0].TransactItems
+		assert.Equal(t, "#version = :expected", *items[0].Update.ConditionExpression)
+		assert.Equal(t, StatusPendingDeletion, *items[0].Update.ExpressionAttributeValues[":status"].S)
+		assert.Equal(t, "5", *items[0].Update.ExpressionAttributeValues[":version"].N)
+
+		var history HistoryEvent
+		assert.NoError(t, dynamodbattribute.UnmarshalMap(items[1].Put.Item, &history))
+		assert.Equal(t, "vod-history", *items[1].Put.TableName)
+		assert.Equal(t, int64(5), history.Version)
+		assert.Equal(t, StatusPendingDeletion, history.Status)
+		assert.Equal(t, "Complete", history.PreviousStatus)
+
+		m.s3.AssertNotCalled(t, "DeleteObjects", mock.Anything)
+	})
+
+	t.Run("should purge the asset right away when forced", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Complete", nil), nil)
+		m.onPurge(false)
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(map[string]string{"force": "true"}))
+
+		assert.NoError(t, err)
+		response := output.(events.APIGatewayProxyResponse)
+		assert.Equal(t, http.StatusOK, response.StatusCode, response.Body)
+
+		var body DeleteResponse
+		assert.NoError(t, json.Unmarshal([]byte(response.Body), &body))
+		assert.Equal(t, StatusDeleted, body.WorkflowStatus)
+		assert.Equal(t, DeletionPurged, body.Deletion.Status)
+		assert.Equal(t, "invalidation", body.Deletion.InvalidationId)
+
+		m.s3.AssertCalled(t, "DeleteObjects", &s3.DeleteObjectsInput{
+			Bucket: aws.String("destination"),
+			Delete: &s3.Delete{
+				Objects: []*s3.ObjectIdentifier{{Key: aws.String("guid/hls/video.m3u8")}, {Key: aws.String("guid/thumbnails/video.jpg")}},
+				Quiet:   aws.Bool(true),
+			},
+		})
+		m.s3.AssertCalled(t, "DeleteObject", &s3.DeleteObjectInput{Bucket: aws.String("source"), Key: aws.String("video.mp4")})
+		m.s3.AssertCalled(t, "DeleteObject", &s3.DeleteObjectInput{Bucket: aws.String("archive"), Key: aws.String("source-archive/video.mp4")})
+		m.cloudFront.AssertCalled(t, "CreateInvalidation", mock.MatchedBy(func(input *cloudfront.CreateInvalidationInput) bool {
+			return *input.InvalidationBatch.Paths.Items[0] == "/guid/*"
+		}))
+
+		// Pending deletion, then the tombstone
+		assert.Len(t, m.transactions, 2)
+		put := m.transactions[1].TransactItems[0].Put
+		assert.Equal(t, "#version = :expected", *put.ConditionExpression)
+		assert.Equal(t, "5", *put.ExpressionAttributeValues[":expected"].N)
+
+		var tombstone Tombstone
+		assert.NoError(t, dynamodbattribute.UnmarshalMap(put.Item, &tombstone))
+		assert.Equal(t, StatusDeleted, tombstone.WorkflowStatus)
+		assert.Equal(t, int64(6), tombstone.Version)
+		assert.Equal(t, "Complete", tombstone.Deletion.PreviousStatus)
+		assert.Equal(t, "acme", tombstone.Cost["tenant"])
+		assert.NotContains(t, put.Item, "mediaPackageResourceId")
+	})
+
+	t.Run("should keep a source used by another asset", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Complete", nil), nil)
+		m.onPurge(true)
+
+		_, err := handler.HandleRequest(context.Background(), map[string]interface{}{"guid": "guid", "force": true})
+
+		assert.NoError(t, err)
+		m.s3.AssertNotCalled(t, "DeleteObject", &s3.DeleteObjectInput{Bucket: aws.String("source"), Key: aws.String("video.mp4")})
+	})
+
+	t.Run("should record a failed purge for the next sweep", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Complete", nil), nil)
+		m.s3.On("ListObjectsV2", mock.Anything).Return(nil, assert.AnError)
+
+		var updateInput *dynamodb.UpdateItemInput
+		m.dynamoDB.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { updateInput = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		_, err := handler.HandleRequest(context.Background(), map[string]interface{}{"guid": "guid", "force": true})
+
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.Equal(t, "SET #deletion.#error = :error", *updateInput.UpdateExpression)
+		assert.Len(t, m.transactions, 1)
+	})
+
+	t.Run("should purge right away without a grace period", func(t *testing.T) {
+		noGrace := config
+		noGrace.DeletionGraceDays = 0
+
+		handler, m := newHandler(noGrace)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Error", nil), nil)
+		m.onPurge(false)
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{"guid": "guid"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusDeleted, output.(*DeleteResponse).WorkflowStatus)
+		assert.Equal(t, "Lambda", output.(*DeleteResponse).Deletion.RequestedBy)
+	})
+
+	t.Run("should return the pending deletion when deleted again", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem(StatusPendingDeletion, pendingDeletion()), nil)
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(nil))
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, output.(events.APIGatewayProxyResponse).StatusCode)
+		assert.Empty(t, m.transactions)
+	})
+
+	t.Run("should reject an asset with a running workflow", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Encoding", nil), nil)
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(nil))
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusConflict, output.(events.APIGatewayProxyResponse).StatusCode)
+	})
+
+	t.Run("should return 404 when the asset does not exist", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(nil))
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, output.(events.APIGatewayProxyResponse).StatusCode)
+	})
+
+	t.Run("should return 409 when the record changed", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("Complete", nil), nil)
+		m.dynamoDB.ExpectedCalls = m.dynamoDB.ExpectedCalls[1:]
+		m.dynamoDB.On("TransactWriteItems", mock.Anything).Return(nil, &dynamodb.TransactionCanceledException{
+			CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("ConditionalCheckFailed")}},
+		})
+
+		output, err := handler.HandleRequest(context.Background(), deleteRequest(nil))
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusConflict, output.(events.APIGatewayProxyResponse).StatusCode)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	config := Config{DynamoDBTable: "vod"}
+
+	t.Run("should restore an asset pending deletion", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem(StatusPendingDeletion, pendingDeletion()), nil)
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+			"httpMethod":     http.MethodPost,
+			"resource":       "/assets/{guid}/restore",
+			"pathParameters": map[string]interface{}{"guid": "guid"},
+		})
+
+		assert.NoError(t, err)
+		response := output.(events.APIGatewayProxyResponse)
+		assert.Equal(t, http.StatusOK, response.StatusCode, response.Body)
+
+		var body DeleteResponse
+		assert.NoError(t, json.Unmarshal([]byte(response.Body), &body))
+		assert.Equal(t, "Complete", body.WorkflowStatus)
+		assert.Equal(t, DeletionRestored, body.Deletion.Status)
+		assert.Equal(t, "admin", body.Deletion.RequestedBy)
+
+		assert.Len(t, m.transactions[0].TransactItems, 1)
+		assert.Equal(t, "Complete", *m.transactions[0].TransactItems[0].Update.ExpressionAttributeValues[":status"].S)
+	})
+
+	t.Run("should not restore an asset that is not pending deletion", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem(StatusDeleted, pendingDeletion()), nil)
+
+		_, err := handler.HandleRequest(context.Background(), map[string]interface{}{"guid": "guid", "action": "restore"})
+
+		assert.ErrorIs(t, err, ErrNotPendingDeletion)
+	})
+
+	t.Run("should reject an unknown action", func(t *testing.T) {
+		handler, _ := newHandler(config)
+
+		_, err := handler.HandleRequest(context.Background(), map[string]interface{}{"guid": "guid", "action": "shred"})
+
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+}
+
+func TestSweep(t *testing.T) {
+	config := Config{
+		DynamoDBTable:  "vod",
+		Destination:    "destination",
+		StateBucket:    "state",
+		DistributionId: "distribution",
+	}
+
+	t.Run("should purge the assets whose grace period is over", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.onPurge(false)
+
+		due := recordItem(StatusPendingDeletion, pendingDeletion()).Item
+		var queryInput *dynamodb.QueryInput
+		m.dynamoDB.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return *input.IndexName == statusIndex
+		})).
+			Run(func(args mock.Arguments) { queryInput = args.Get(0).(*dynamodb.QueryInput) }).
+			Return(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{due}}, nil)
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+			"source":      "aws.events",
+			"detail-type": "Scheduled Event",
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, &SweepResult{Purged: 1, Complete: true}, output)
+		assert.Equal(t, StatusPendingDeletion, *queryInput.ExpressionAttributeValues[":pending"].S)
+		assert.Equal(t, "#deletion.#purgeAt <= :now", *queryInput.FilterExpression)
+
+		var tombstone Tombstone
+		assert.NoError(t, dynamodbattribute.UnmarshalMap(m.transactions[0].TransactItems[0].Put.Item, &tombstone))
+		assert.Equal(t, "admin", tombstone.Deletion.RequestedBy)
+		m.cloudFront.AssertCalled(t, "CreateInvalidation", mock.MatchedBy(func(input *cloudfront.CreateInvalidationInput) bool {
+			return *input.InvalidationBatch.CallerReference == "guid-delete-2025-02-01T00:00:00Z"
+		}))
+	})
+
+	t.Run("should return an error when the index can't be queried", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("Query", mock.Anything).Return(nil, assert.AnError)
+
+		_, err := handler.HandleRequest(context.Background(), map[string]interface{}{"detail-type": "Scheduled Event"})
+
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/mediapackagevod"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// removeAsset removes what the workflows created for the asset: its outputs
+// and thumbnails under <guid>/ in the destination bucket, its claim-checked
+// state, the MediaPackage asset, and the source video with its retention
+// archive copy. The CloudFront cache of <guid>/ is then invalidated. Every
+// step succeeds when there is nothing left to remove, so a failed purge is
+// simply run again.
+func (h *Handler) removeAsset(record *AssetRecord) (string, error) {
+	prefix := record.GUID + "/"
+	if err := h.deletePrefix(h.Config.Destination, prefix); err != nil {
+		return "", fmt.Errorf("deletePrefix: %w", err)
+	}
+	if err := h.deletePrefix(h.Config.StateBucket, prefix+"state/"); err != nil {
+		return "", fmt.Errorf("deletePrefix: %w", err)
+	}
+
+	if record.MediaPackageResourceId != "" {
+		_, err := h.MediaPackageVodClient.DeleteAsset(&mediapackagevod.DeleteAssetInput{
+			Id: aws.String(record.MediaPackageResourceId),
+		})
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == mediapackagevod.ErrCodeNotFoundException) {
+			return "", fmt.Errorf("DeleteAsset: %w", err)
+		}
+	}
+
+	if record.SrcBucket != "" && record.SrcVideo != "" {
+		shared, err := h.sourceShared(record)
+		if err != nil {
+			return "", fmt.Errorf("sourceShared: %w", err)
+		}
+		if shared {
+			slog.Info("SOURCE KEPT", "bucket", record.SrcBucket, "key", record.SrcVideo)
+		} else if err := h.deleteObject(record.SrcBucket, record.SrcVideo); err != nil {
+			return "", err
+		}
+	}
+	if archive, err := url.Parse(record.RetentionArchive); err == nil && archive.Scheme == "s3" {
+		if err := h.deleteObject(archive.Host, strings.TrimPrefix(archive.Path, "/")); err != nil {
+			return "", err
+		}
+	}
+
+	return h.invalidate(record)
+}
+
+// deletePrefix deletes every object under prefix, a page at a time.
+func (h *Handler) deletePrefix(bucket, prefix string) error {
+	if bucket == "" {
+		return nil
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		page, err := h.S3Client.ListObjectsV2(input)
+		if err != nil {
+			return fmt.Errorf("ListObjectsV2: %w", err)
+		}
+
+		if len(page.Contents) > 0 {
+			objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+			for _, object := range page.Contents {
+				objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+			}
+			output, err := h.S3Client.DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			if err != nil {
+				return fmt.Errorf("DeleteObjects: %w", err)
+			}
+			if len(output.Errors) > 0 {
+				return fmt.Errorf("DeleteObjects: s3://%s/%s: %s", bucket, aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+			}
+			slog.Info("DELETED", "bucket", bucket, "prefix", prefix, "objects", len(objects))
+		}
+
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+func (h *Handler) deleteObject(bucket, key string) error {
+	_, err := h.S3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteObject: %w", err)
+	}
+	slog.Info("DELETED", "bucket", bucket, "key", key)
+	return nil
+}
+
+// sourceShared reports whether another asset that is not being deleted was
+// ingested from the same source object, as happens when a key is uploaded
+// again.
+func (h *Handler) sourceShared(record *AssetRecord) (bool, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(sourceKeyIndex),
+		KeyConditionExpression: aws.String("#srcVideo = :srcVideo"),
+		FilterExpression:       aws.String("#srcBucket = :srcBucket AND #guid <> :guid AND NOT (#workflowStatus IN (:pending, :deleted))"),
+		ExpressionAttributeNames: map[string]*string{
+			"#srcVideo":       aws.String("srcVideo"),
+			"#srcBucket":      aws.String("srcBucket"),
+			"#guid":           aws.String("guid"),
+			"#workflowStatus": aws.String("workflowStatus"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":srcVideo":  {S: aws.String(record.SrcVideo)},
+			":srcBucket": {S: aws.String(record.SrcBucket)},
+			":guid":      {S: aws.String(record.GUID)},
+			":pending":   {S: aws.String(StatusPendingDeletion)},
+			":deleted":   {S: aws.String(StatusDeleted)},
+		},
+	}
+
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return false, fmt.Errorf("Query: %w", err)
+		}
+		if len(data.Items) > 0 {
+			return true, nil
+		}
+		if len(data.LastEvaluatedKey) == 0 {
+			return false, nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+// invalidate removes <guid>/ from the CloudFront cache. The caller reference
+// is the deletion request, so a retried purge does not invalidate twice.
+func (h *Handler) invalidate(record *AssetRecord) (string, error) {
+	distributionId := h.Config.DistributionId
+	if distributionId == "" {
+		return "", nil
+	}
+
+	output, err := h.CloudFrontClient.CreateInvalidation(&cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(distributionId),
+		InvalidationBatch: &cloudfront.InvalidationBatch{
+			CallerReference: aws.String(record.GUID + "-delete-" + record.Deletion.RequestedAt),
+			Paths: &cloudfront.Paths{
+				Quantity: aws.Int64(1),
+				Items:    []*string{aws.String("/" + record.GUID + "/*")},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("CreateInvalidation: %w", err)
+	}
+
+	invalidationId := aws.StringValue(output.Invalidation.Id)
+	slog.Info("INVALIDATION", "invalidationId", invalidationId, "path", "/"+record.GUID+"/*")
+	return invalidationId, nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+// A batch is stored in the BatchTable as one summary item ("batch") and one
+// item per asset ("asset#<guid>"), all under the batch id, so progress and
+// per-asset results are read back with a single query.
+
+const (
+	BatchPending  = "Pending"
+	BatchRunning  = "Running"
+	BatchComplete = "Complete"
+
+	AssetPending   = "Pending"
+	AssetStarted   = "Started"
+	AssetRestoring = "Restoring"
+	AssetFailed    = "Failed"
+
+	batchItem       = "batch"
+	assetItemPrefix = "asset#"
+
+	statusIndex    = "workflowStatus-startTime-index"
+	batchWriteSize = 25
+	defaultRate    = 1.0
+	continueMargin = 30 * time.Second
+)
+
+type Batch struct {
+	BatchId     string `json:"batchId"`
+	Status      string `json:"status"`
+	Filter      Filter `json:"filter"`
+	JobTemplate string `json:"jobTemplate"`
+	Total       int    `json:"total"`
+	Started     int    `json:"started"`
+	Restoring   int    `json:"restoring"`
+	Failed      int    `json:"failed"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+}
+
+type AssetResult struct {
+	GUID         string `json:"guid"`
+	Status       string `json:"status"`
+	ExecutionArn string `json:"executionArn,omitempty"`
+	Error        string `json:"error,omitempty"`
+	UpdatedAt    string `json:"updatedAt,omitempty"`
+}
+
+type BatchReport struct {
+	Batch
+	Results []AssetResult `json:"results"`
+}
+
+func batchKey(batchId string, item string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"batchId": {S: aws.String(batchId)},
+		"item":    {S: aws.String(item)},
+	}
+}
+
+func (h *Handler) getBatch(batchId string) (*Batch, error) {
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(h.Config.BatchTable),
+		Key:            batchKey(batchId, batchItem),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if len(data.Item) == 0 {
+		return nil, fmt.Errorf("batch %s: %w", batchId, ErrBatchNotFound)
+	}
+
+	var batch Batch
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &batch); err != nil {
+		return nil, fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	return &batch, nil
+}
+
+func (h *Handler) putBatch(batch *Batch) error {
+	item, err := dynamodbattribute.MarshalMap(batch)
+	if err != nil {
+		return fmt.Errorf("MarshalMap: %w", err)
+	}
+	item["item"] = &dynamodb.AttributeValue{S: aws.String(batchItem)}
+
+	_, err = h.DynamoDBClient.PutItem(&dynamodb.PutItemInput{
+		TableName:                aws.String(h.Config.BatchTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#batchId)"),
+		ExpressionAttributeNames: map[string]*string{"#batchId": aws.String("batchId")},
+	})
+	if err != nil {
+		return fmt.Errorf("PutItem: %w", err)
+	}
+	return nil
+}
+
+// queryAssets returns the batch's asset results, or only those still in
+// status when it is not empty.
+func (h *Handler) queryAssets(batchId string, status string) ([]AssetResult, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.BatchTable),
+		KeyConditionExpression: aws.String("#batchId = :batchId AND begins_with(#item, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#batchId": aws.String("batchId"),
+			"#item":    aws.String("item"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":batchId": {S: aws.String(batchId)},
+			":prefix":  {S: aws.String(assetItemPrefix)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	if status != "" {
+		input.FilterExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames["#status"] = aws.String("status")
+		input.ExpressionAttributeValues[":status"] = &dynamodb.AttributeValue{S: aws.String(status)}
+	}
+
+	results := []AssetResult{}
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("Query: %w", err)
+		}
+
+		var page []AssetResult
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &page); err != nil {
+			return nil, fmt.Errorf("UnmarshalListOfMaps: %w", err)
+		}
+		results = append(results, page...)
+
+		if len(data.LastEvaluatedKey) == 0 {
+			return results, nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+// resolveAssets expands the batch filter into the GUIDs to reprocess.
+func (h *Handler) resolveAssets(filter Filter) ([]string, error) {
+	if len(filter.GUIDs) > 0 {
+		seen := map[string]bool{}
+		guids := []string{}
+		for _, guid := range filter.GUIDs {
+			if !seen[guid] {
+				seen[guid] = true
+				guids = append(guids, guid)
+			}
+		}
+		return guids, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(statusIndex),
+		KeyConditionExpression: aws.String("#workflowStatus = :workflowStatus"),
+		ProjectionExpression:   aws.String("#guid"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":           aws.String("guid"),
+			"#workflowStatus": aws.String("workflowStatus"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":workflowStatus": {S: aws.String(filter.Status)},
+		},
+	}
+
+	from, err := parseTimeBound(filter.From, false)
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	to, err := parseTimeBound(filter.To, true)
+	if err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+	switch {
+	case from != "" && to != "":
+		input.KeyConditionExpression = aws.String(*input.KeyConditionExpression + " AND #startTime BETWEEN :from AND :to")
+	case from != "":
+		input.KeyConditionExpression = aws.String(*input.KeyConditionExpression + " AND #startTime >= :from")
+	case to != "":
+		input.KeyConditionExpression = aws.String(*input.KeyConditionExpression + " AND #startTime <= :to")
+	}
+	if from != "" || to != "" {
+		input.ExpressionAttributeNames["#startTime"] = aws.String("startTime")
+	}
+	if from != "" {
+		input.ExpressionAttributeValues[":from"] = &dynamodb.AttributeValue{S: aws.String(from)}
+	}
+	if to != "" {
+		input.ExpressionAttributeValues[":to"] = &dynamodb.AttributeValue{S: aws.String(to)}
+	}
+	if filter.EncodingProfile != 0 {
+		input.FilterExpression = aws.String("#encodingProfile = :encodingProfile")
+		input.ExpressionAttributeNames["#encodingProfile"] = aws.String("encodingProfile")
+		input.ExpressionAttributeValues[":encodingProfile"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(filter.EncodingProfile))}
+	}
+
+	guids := []string{}
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("Query: %w", err)
+		}
+		for _, item := range data.Items {
+			if item["guid"] != nil && item["guid"].S != nil {
+				guids = append(guids, *item["guid"].S)
+			}
+		}
+
+		if len(data.LastEvaluatedKey) == 0 {
+			return guids, nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+// writeAssets stores a Pending result for every GUID, retrying the items
+// DynamoDB leaves unprocessed.
+func (h *Handler) writeAssets(batchId string, guids []string, now string) error {
+	table := h.Config.BatchTable
+
+	for start := 0; start < len(guids); start += batchWriteSize {
+		end := start + batchWriteSize
+		if end > len(guids) {
+			end = len(guids)
+		}
+
+		requests := []*dynamodb.WriteRequest{}
+		for _, guid := range guids[start:end] {
+			item := batchKey(batchId, assetItemPrefix+guid)
+			item["guid"] = &dynamodb.AttributeValue{S: aws.String(guid)}
+			item["status"] = &dynamodb.AttributeValue{S: aws.String(AssetPending)}
+			item["updatedAt"] = &dynamodb.AttributeValue{S: aws.String(now)}
+			requests = append(requests, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{Item: item},
+			})
+		}
+
+		pending := map[string][]*dynamodb.WriteRequest{table: requests}
+		for attempt := 0; len(pending[table]) > 0; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			if attempt == 5 {
+				return fmt.Errorf("BatchWriteItem: %d items unprocessed", len(pending[table]))
+			}
+
+			data, err := h.DynamoDBClient.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return fmt.Errorf("BatchWriteItem: %w", err)
+			}
+			pending = data.UnprocessedItems
+			if pending == nil {
+				pending = map[string][]*dynamodb.WriteRequest{}
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateBatch sets attributes on the summary item.
+func (h *Handler) updateBatch(batchId string, values map[string]interface{}) error {
+	names := map[string]*string{}
+	attributes := map[string]*dynamodb.AttributeValue{}
+	sets := []string{}
+	for name, value := range values {
+		av, err := dynamodbattribute.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("Marshal: %w", err)
+		}
+		names["#"+name] = aws.String(name)
+		attributes[":"+name] = av
+		sets = append(sets, fmt.Sprintf("#%s = :%s", name, name))
+	}
+
+	_, err := h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(h.Config.BatchTable),
+		Key:                       batchKey(batchId, batchItem),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: attributes,
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+	return nil
+}
+
+// recordResult moves an asset out of Pending and bumps the matching counter
+// on the summary item in one transaction. An asset that is no longer Pending
+// was recorded by an overlapping invocation and is not counted twice.
+func (h *Handler) recordResult(batchId string, result AssetResult) error {
+	counter := "started"
+	switch result.Status {
+	case AssetRestoring:
+		counter = "restoring"
+	case AssetFailed:
+		counter = "failed"
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":status":    {S: aws.String(result.Status)},
+		":pending":   {S: aws.String(AssetPending)},
+		":updatedAt": {S: aws.String(result.UpdatedAt)},
+		":one":       {N: aws.String("1")},
+	}
+	update := "SET #status = :status, #updatedAt = :updatedAt"
+	if result.ExecutionArn != "" {
+		update += ", #executionArn = :executionArn"
+		values[":executionArn"] = &dynamodb.AttributeValue{S: aws.String(result.ExecutionArn)}
+	}
+	if result.Error != "" {
+		update += ", #error = :error"
+		values[":error"] = &dynamodb.AttributeValue{S: aws.String(result.Error)}
+	}
+
+	names := map[string]*string{
+		"#status":    aws.String("status"),
+		"#updatedAt": aws.String("updatedAt"),
+	}
+	if result.ExecutionArn != "" {
+		names["#executionArn"] = aws.String("executionArn")
+	}
+	if result.Error != "" {
+		names["#error"] = aws.String("error")
+	}
+
+	table := aws.String(h.Config.BatchTable)
+	_, err := h.DynamoDBClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Update: &dynamodb.Update{
+					TableName:                 table,
+					Key:                       batchKey(batchId, assetItemPrefix+result.GUID),
+					UpdateExpression:          aws.String(update),
+					ConditionExpression:       aws.String("#status = :pending"),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				Update: &dynamodb.Update{
+					TableName:        table,
+					Key:              batchKey(batchId, batchItem),
+					UpdateExpression: aws.String("SET #updatedAt = :updatedAt ADD #counter :one"),
+					ExpressionAttributeNames: map[string]*string{
+						"#updatedAt": aws.String("updatedAt"),
+						"#counter":   aws.String(counter),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":updatedAt": {S: aws.String(result.UpdatedAt)},
+						":one":       {N: aws.String("1")},
+					},
+				},
+			},
+		},
+	})
+	// Only the asset item has a condition, and it failing means the asset was
+	// recorded already. Any other reason, such as a conflicting transaction,
+	// is an error.
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("TransactWriteItems: %w", err)
+	}
+	return nil
+}
+
+// startExecution starts the Process workflow for one asset. The execution
+// name is derived from the asset and the batch, so a batch resumed after a
+// timeout does not start the same asset twice. Assets whose source is
+// archived go through the SourceRestore function instead, which starts the
+// execution once the source can be read.
+func (h *Handler) startExecution(batch *Batch, guid string) AssetResult {
+	result := AssetResult{
+		GUID:      guid,
+		Status:    AssetStarted,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	if h.Config.SourceRestore != "" {
+		archived, err := h.sourceArchived(guid)
+		if err != nil {
+			result.Status = AssetFailed
+			result.Error = err.Error()
+			return result
+		}
+		if archived {
+			return h.restoreSource(batch, result)
+		}
+	}
+
+	input, err := json.Marshal(ProcessWorkflowInput{
+		GUID:        guid,
+		JobTemplate: batch.JobTemplate,
+	})
+	if err != nil {
+		result.Status = AssetFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	stateMachineArn := h.Config.ProcessWorkflow
+	name := fmt.Sprintf("%s-%s", guid, batch.BatchId)
+	data, err := h.StepFunctionClient.StartExecution(&sfn.StartExecutionInput{
+		Name:            aws.String(name),
+		Input:           aws.String(string(input)),
+		StateMachineArn: aws.String(stateMachineArn),
+	})
+
+	var aerr awserr.Error
+	switch {
+	case errors.As(err, &aerr) && aerr.Code() == sfn.ErrCodeExecutionAlreadyExists:
+		result.ExecutionArn = strings.Replace(stateMachineArn, ":stateMachine:", ":execution:", 1) + ":" + name
+	case err != nil:
+		result.Status = AssetFailed
+		result.Error = err.Error()
+	default:
+		result.ExecutionArn = aws.StringValue(data.ExecutionArn)
+	}
+
+	return result
+}
+
+// sourceArchived reports whether the asset's source was set to be archived
+// by the Publish workflow. Whether it has moved to Glacier yet is left to
+// SourceRestore.
+func (h *Handler) sourceArchived(guid string) (bool, error) {
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		ProjectionExpression:     aws.String("#archiveSource"),
+		ExpressionAttributeNames: map[string]*string{"#archiveSource": aws.String("archiveSource")},
+	})
+	if err != nil {
+		return false, fmt.Errorf("GetItem: %w", err)
+	}
+
+	archiveSource := data.Item["archiveSource"]
+	if archiveSource == nil || archiveSource.S == nil {
+		return false, nil
+	}
+	return *archiveSource.S == "GLACIER" || *archiveSource.S == "DEEP_ARCHIVE", nil
+}
+
+// restoreSource hands the asset to the SourceRestore function with the
+// batch's execution name.
+func (h *Handler) restoreSource(batch *Batch, result AssetResult) AssetResult {
+	payload, err := json.Marshal(RestoreRequest{
+		GUID:          result.GUID,
+		JobTemplate:   batch.JobTemplate,
+		ExecutionName: fmt.Sprintf("%s-%s", result.GUID, batch.BatchId),
+	})
+	if err != nil {
+		result.Status = AssetFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	data, err := h.LambdaClient.Invoke(&lambdaservice.InvokeInput{
+		FunctionName: aws.String(h.Config.SourceRestore),
+		Payload:      payload,
+	})
+	if err == nil && data.FunctionError != nil {
+		err = fmt.Errorf("%s: %s", aws.StringValue(data.FunctionError), data.Payload)
+	}
+	var response RestoreResponse
+	if err == nil {
+		err = json.Unmarshal(data.Payload, &response)
+	}
+	if err != nil {
+		result.Status = AssetFailed
+		result.Error = fmt.Sprintf("SourceRestore: %v", err)
+		return result
+	}
+
+	if response.Status != AssetStarted {
+		result.Status = AssetRestoring
+	}
+	result.ExecutionArn = response.ExecutionArn
+	return result
+}
+
+// startInterval is the pause between two StartExecution calls, from the
+// ReprocessRate setting in executions per second.
+func (h *Handler) startInterval() time.Duration {
+	rate := h.Config.ReprocessRate
+	if rate <= 0 {
+		rate = defaultRate
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// parseTimeBound accepts a date or an RFC 3339 timestamp and returns it in
+// the startTime format. A date used as an upper bound covers the whole day.
+func parseTimeBound(value string, upper bool) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a date or RFC 3339 timestamp: %w", value, ErrInvalidRequest)
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t.Format("2006-01-02T15:04:05.000Z"), nil
+}
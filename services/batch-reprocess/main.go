@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/google/uuid"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "batch-reprocess"
+
+var (
+	ErrInvalidEventObject = errors.New("invalid event object")
+	ErrInvalidRequest     = errors.New("invalid batch request")
+	ErrBatchNotFound      = errors.New("batch not found")
+	ErrRouteNotFound      = errors.New("route not found")
+)
+
+// BatchRequest reprocesses every asset matching Filter with JobTemplate. It
+// is accepted as the body of POST /batches, or as the payload of a direct
+// invocation (aws lambda invoke), which runs the batch synchronously.
+type BatchRequest struct {
+	Filter      Filter `json:"filter"`
+	JobTemplate string `json:"jobTemplate"`
+}
+
+// Filter selects assets either by an explicit GUID list, or by workflow
+// status with an optional startTime range and encoding profile.
+type Filter struct {
+	GUIDs           []string `json:"guids,omitempty"`
+	Status          string   `json:"status,omitempty"`
+	From            string   `json:"from,omitempty"`
+	To              string   `json:"to,omitempty"`
+	EncodingProfile int      `json:"encodingProfile,omitempty"`
+}
+
+// ContinueEvent resumes a batch on a fresh invocation when the previous one
+// ran out of time.
+type ContinueEvent struct {
+	BatchId string `json:"batchId"`
+}
+
+type ProcessWorkflowInput struct {
+	GUID        string `json:"guid"`
+	JobTemplate string `json:"jobTemplate,omitempty"`
+}
+
+// RestoreRequest and RestoreResponse are the payloads of the SourceRestore
+// function.
+type RestoreRequest struct {
+	GUID          string `json:"guid"`
+	JobTemplate   string `json:"jobTemplate,omitempty"`
+	ExecutionName string `json:"executionName"`
+}
+
+type RestoreResponse struct {
+	GUID         string `json:"guid"`
+	Status       string `json:"status"`
+	ExecutionArn string `json:"executionArn,omitempty"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+type StepFunctionClient interface {
+	StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error)
+}
+
+type LambdaClient interface {
+	Invoke(input *lambdaservice.InvokeInput) (*lambdaservice.InvokeOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	BatchTable      string `env:"BatchTable" required:"true"`
+	DynamoDBTable   string `env:"DynamoDBTable" required:"true"`
+	ProcessWorkflow string `env:"ProcessWorkflow" required:"true"`
+	// SourceRestore is the function archived sources are handed to; sources
+	// are not checked for archiving when it is empty.
+	SourceRestore string `env:"SourceRestore"`
+	// ReprocessRate is the number of executions started per second.
+	ReprocessRate float64 `env:"ReprocessRate" min:"0"`
+	// FunctionName is the function itself, which a batch continues in when
+	// the invocation runs out of time.
+	FunctionName string `env:"AWS_LAMBDA_FUNCTION_NAME"`
+}
+
+type Handler struct {
+	Config             Config
+	DynamoDBClient     DynamoDBClient
+	StepFunctionClient StepFunctionClient
+	LambdaClient       LambdaClient
+}
+
+func (h *Handler) HandleRequest(ctx context.Context, event map[string]interface{}) (interface{}, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.HandleRequest: json.Marshal: %w", err)
+	}
+
+	switch {
+	case event["httpMethod"] != nil:
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		return h.handleAPIRequest(request)
+	case event["batchId"] != nil:
+		var continueEvent ContinueEvent
+		if err := json.Unmarshal(eventJson, &continueEvent); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		return h.process(ctx, continueEvent.BatchId)
+	case event["filter"] != nil:
+		var request BatchRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		batch, err := h.create(request)
+		if err != nil {
+			return nil, err
+		}
+		return h.process(ctx, batch.BatchId)
+	}
+
+	return nil, ErrInvalidEventObject
+}
+
+func (h *Handler) handleAPIRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case request.HTTPMethod == http.MethodPost && request.Resource == "/batches":
+		var batchRequest BatchRequest
+		if err := json.Unmarshal([]byte(request.Body), &batchRequest); err != nil {
+			return errorResponse(fmt.Errorf("batch-reprocess: main.Handler.handleAPIRequest: %v: %w", err, ErrInvalidRequest))
+		}
+
+		batch, err := h.create(batchRequest)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if err := h.continueAsync(batch.BatchId); err != nil {
+			return errorResponse(err)
+		}
+		return jsonResponse(http.StatusAccepted, batch)
+	case request.HTTPMethod == http.MethodGet && request.Resource == "/batches/{batchId}":
+		report, err := h.report(request.PathParameters["batchId"])
+		if err != nil {
+			return errorResponse(err)
+		}
+		return jsonResponse(http.StatusOK, report)
+	}
+
+	return errorResponse(ErrRouteNotFound)
+}
+
+// create validates the request and stores a Pending batch. Assets are
+// resolved by the first process run, so the API can answer right away.
+func (h *Handler) create(request BatchRequest) (*Batch, error) {
+	filter := request.Filter
+	switch {
+	case request.JobTemplate == "":
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: jobTemplate is required: %w", ErrInvalidRequest)
+	case len(filter.GUIDs) > 0 && (filter.Status != "" || filter.From != "" || filter.To != "" || filter.EncodingProfile != 0):
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: guids cannot be combined with other filters: %w", ErrInvalidRequest)
+	case len(filter.GUIDs) == 0 && filter.Status == "":
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: one of guids or status is required: %w", ErrInvalidRequest)
+	}
+	if _, err := parseTimeBound(filter.From, false); err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: from: %w", err)
+	}
+	if _, err := parseTimeBound(filter.To, true); err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: to: %w", err)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	batch := &Batch{
+		BatchId:     uuid.New().String(),
+		Status:      BatchPending,
+		Filter:      filter,
+		JobTemplate: request.JobTemplate,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := h.putBatch(batch); err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.create: %w", err)
+	}
+
+	slog.Info("BATCH CREATED", "batchId", batch.BatchId)
+	return batch, nil
+}
+
+// process resolves a Pending batch and starts the Process workflow for its
+// remaining assets, no faster than ReprocessRate. When the invocation is
+// about to time out it hands the rest of the batch to a new invocation.
+func (h *Handler) process(ctx context.Context, batchId string) (*Batch, error) {
+	batch, err := h.getBatch(batchId)
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.process: %w", err)
+	}
+
+	if batch.Status == BatchPending {
+		guids, err := h.resolveAssets(batch.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.process: resolveAssets: %w", err)
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		if err := h.writeAssets(batchId, guids, now); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.process: writeAssets: %w", err)
+		}
+		if err := h.updateBatch(batchId, map[string]interface{}{"status": BatchRunning, "total": len(guids), "updatedAt": now}); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.process: updateBatch: %w", err)
+		}
+		slog.Info("BATCH RESOLVED", "batchId", batchId, "assets", len(guids))
+	}
+
+	pending, err := h.queryAssets(batchId, AssetPending)
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.process: queryAssets: %w", err)
+	}
+
+	interval := h.startInterval()
+	var last time.Time
+	for _, asset := range pending {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < continueMargin {
+			if err := h.continueAsync(batchId); err != nil {
+				return nil, err
+			}
+			return h.getBatch(batchId)
+		}
+
+		if wait := time.Until(last.Add(interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+
+		result := h.startExecution(batch, asset.GUID)
+		if result.Error != "" {
+			slog.Error("REPROCESS FAILED", "batchId", batchId, "guid", asset.GUID, "error", result.Error)
+		}
+		if err := h.recordResult(batchId, result); err != nil {
+			return nil, fmt.Errorf("batch-reprocess: main.Handler.process: recordResult: %w", err)
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if err := h.updateBatch(batchId, map[string]interface{}{"status": BatchComplete, "updatedAt": now}); err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.process: updateBatch: %w", err)
+	}
+
+	batch, err = h.getBatch(batchId)
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.process: %w", err)
+	}
+	slog.Info("BATCH COMPLETE", "batchId", batchId, "started", batch.Started, "restoring", batch.Restoring, "failed", batch.Failed)
+	return batch, nil
+}
+
+// continueAsync invokes this function again, asynchronously, for batchId.
+func (h *Handler) continueAsync(batchId string) error {
+	payload, err := json.Marshal(ContinueEvent{BatchId: batchId})
+	if err != nil {
+		return fmt.Errorf("batch-reprocess: main.Handler.continueAsync: json.Marshal: %w", err)
+	}
+
+	_, err = h.LambdaClient.Invoke(&lambdaservice.InvokeInput{
+		FunctionName:   aws.String(h.Config.FunctionName),
+		InvocationType: aws.String(lambdaservice.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		return fmt.Errorf("batch-reprocess: main.Handler.continueAsync: Invoke: %w", err)
+	}
+	return nil
+}
+
+func (h *Handler) report(batchId string) (*BatchReport, error) {
+	batch, err := h.getBatch(batchId)
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.report: %w", err)
+	}
+
+	results, err := h.queryAssets(batchId, "")
+	if err != nil {
+		return nil, fmt.Errorf("batch-reprocess: main.Handler.report: queryAssets: %w", err)
+	}
+
+	return &BatchReport{Batch: *batch, Results: results}, nil
+}
+
+func jsonResponse(status int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("batch-reprocess: main.jsonResponse: json.Marshal: %w", err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(bodyJson),
+	}, nil
+}
+
+func errorResponse(err error) (events.APIGatewayProxyResponse, error) {
+	slog.Error("REQUEST FAILED", "error", err)
+
+	switch {
+	case errors.Is(err, ErrBatchNotFound), errors.Is(err, ErrRouteNotFound):
+		return jsonResponse(http.StatusNotFound, ErrorResponse{Message: err.Error()})
+	case errors.Is(err, ErrInvalidRequest):
+		return jsonResponse(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+	return jsonResponse(http.StatusInternalServerError, ErrorResponse{Message: "internal error"})
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("batch-reprocess: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:             config,
+		DynamoDBClient:     dynamodb.New(sess),
+		StepFunctionClient: sfn.New(sess),
+		LambdaClient:       lambdaservice.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.BatchWriteItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
+type StepFunctionClientMock struct {
+	mock.Mock
+}
+
+func (m *StepFunctionClientMock) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.StartExecutionOutput), args.Error(1)
+}
+
+type LambdaClientMock struct {
+	mock.Mock
+}
+
+func (m *LambdaClientMock) Invoke(input *lambdaservice.InvokeInput) (*lambdaservice.InvokeOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*lambdaservice.InvokeOutput), args.Error(1)
+}
+
+func batchItemOutput(t *testing.T, batch Batch) *dynamodb.GetItemOutput {
+	item, err := dynamodbattribute.MarshalMap(batch)
+	assert.Nil(t, err)
+	return &dynamodb.GetItemOutput{Item: item}
+}
+
+func assetItems(guids ...string) *dynamodb.QueryOutput {
+	output := &dynamodb.QueryOutput{}
+	for _, guid := range guids {
+		output.Items = append(output.Items, map[string]*dynamodb.AttributeValue{
+			"guid":   {S: aws.String(guid)},
+			"status": {S: aws.String(AssetPending)},
+		})
+	}
+	return output
+}
+
+func TestDirectInvocation(t *testing.T) {
+	config := Config{
+		ReprocessRate:   1000,
+		ProcessWorkflow: "arn:aws:states:us-east-1:123456789012:stateMachine:process",
+	}
+
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	stepFunctionClientMock := new(StepFunctionClientMock)
+
+	// GetItem returns the batch as PutItem created it, then as it is once
+	// every asset has been recorded
+	pendingOutput := &dynamodb.GetItemOutput{}
+	completeOutput := &dynamodb.GetItemOutput{}
+	dynamoDBClientMock.On("PutItem", mock.Anything).Run(func(args mock.Arguments) {
+		var batch Batch
+		pendingOutput.Item = args.Get(0).(*dynamodb.PutItemInput).Item
+		assert.Nil(t, dynamodbattribute.UnmarshalMap(pendingOutput.Item, &batch))
+		batch.Status = BatchComplete
+		batch.Total = 2
+		batch.Started = 1
+		batch.Failed = 1
+		completeOutput.Item = batchItemOutput(t, batch).Item
+	}).Return(&dynamodb.PutItemOutput{}, nil)
+	dynamoDBClientMock.On("GetItem", mock.Anything).Return(pendingOutput, nil).Once()
+	dynamoDBClientMock.On("BatchWriteItem", mock.MatchedBy(func(input *dynamodb.BatchWriteItemInput) bool {
+		for _, requests := range input.RequestItems {
+			return len(requests) == 2
+		}
+		return false
+	})).Return(&dynamodb.BatchWriteItemOutput{}, nil).Once()
+	dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+	dynamoDBClientMock.On("Query", mock.Anything).Return(assetItems("a", "b"), nil).Once()
+	dynamoDBClientMock.On("TransactWriteItems", mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+	dynamoDBClientMock.On("GetItem", mock.Anything).Return(completeOutput, nil).Once()
+
+	stepFunctionClientMock.On("StartExecution", mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+		return strings.HasPrefix(*input.Name, "a-") && *input.Input == `{"guid":"a","jobTemplate":"tmpl"}`
+	})).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:execution:a")}, nil).Once()
+	stepFunctionClientMock.On("StartExecution", mock.Anything).Return(nil, assert.AnError).Once()
+
+	handler := &Handler{
+		Config:             config,
+		DynamoDBClient:     dynamoDBClientMock,
+		StepFunctionClient: stepFunctionClientMock,
+		LambdaClient:       new(LambdaClientMock),
+	}
+
+	output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+		"filter":      map[string]interface{}{"guids": []string{"a", "b", "a"}},
+		"jobTemplate": "tmpl",
+	})
+
+	assert.Nil(t, err)
+	batch := output.(*Batch)
+	assert.Equal(t, BatchComplete, batch.Status)
+	assert.Equal(t, 1, batch.Started)
+	assert.Equal(t, 1, batch.Failed)
+	stepFunctionClientMock.AssertExpectations(t)
+	dynamoDBClientMock.AssertExpectations(t)
+
+	var recorded []string
+	for _, call := range dynamoDBClientMock.Calls {
+		if call.Method == "TransactWriteItems" {
+			input := call.Arguments.Get(0).(*dynamodb.TransactWriteItemsInput)
+			recorded = append(recorded, *input.TransactItems[0].Update.ExpressionAttributeValues[":status"].S)
+		}
+	}
+	assert.Equal(t, []string{AssetStarted, AssetFailed}, recorded)
+}
+
+func TestResolveAssets(t *testing.T) {
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.IndexName == statusIndex &&
+			*input.KeyConditionExpression == "#workflowStatus = :workflowStatus AND #startTime BETWEEN :from AND :to" &&
+			*input.FilterExpression == "#encodingProfile = :encodingProfile" &&
+			*input.ExpressionAttributeValues[":encodingProfile"].N == "1080" &&
+			input.ExclusiveStartKey == nil
+	})).Return(&dynamodb.QueryOutput{
+		Items:            assetItems("a").Items,
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("a")}},
+	}, nil).Once()
+	dynamoDBClientMock.On("Query", mock.Anything).Return(assetItems("b"), nil).Once()
+
+	handler := &Handler{
+		DynamoDBClient: dynamoDBClientMock,
+	}
+
+	guids, err := handler.resolveAssets(Filter{
+		Status:          "Complete",
+		From:            "2025-01-01",
+		To:              "2025-01-31",
+		EncodingProfile: 1080,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, guids)
+	dynamoDBClientMock.AssertExpectations(t)
+}
+
+func TestResolveAssetsInvalidTimeBound(t *testing.T) {
+	handler := &Handler{
+		DynamoDBClient: new(DynamoDBClientMock),
+	}
+
+	_, err := handler.resolveAssets(Filter{Status: "Complete", From: "yesterday"})
+
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+}
+
+func TestRecordResult(t *testing.T) {
+	canceled := func(codes ...string) error {
+		reasons := []*dynamodb.CancellationReason{}
+		for _, code := range codes {
+			reasons = append(reasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	t.Run("should skip an asset that is no longer pending", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("TransactWriteItems", mock.Anything).Return(nil, canceled("ConditionalCheckFailed", "None"))
+		handler := &Handler{DynamoDBClient: dynamoDBClientMock}
+
+		err := handler.recordResult("batch-1", AssetResult{GUID: "a", Status: AssetStarted})
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("should return other cancellations", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("TransactWriteItems", mock.Anything).Return(nil, canceled("None", "TransactionConflict"))
+		handler := &Handler{DynamoDBClient: dynamoDBClientMock}
+
+		err := handler.recordResult("batch-1", AssetResult{GUID: "a", Status: AssetStarted})
+
+		var cancellation *dynamodb.TransactionCanceledException
+		assert.ErrorAs(t, err, &cancellation)
+	})
+}
+
+func TestProcessContinuesBeforeTimeout(t *testing.T) {
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	dynamoDBClientMock.On("GetItem", mock.Anything).Return(batchItemOutput(t, Batch{
+		BatchId: "batch-1",
+		Status:  BatchRunning,
+		Total:   2,
+	}), nil)
+	dynamoDBClientMock.On("Query", mock.Anything).Return(assetItems("a", "b"), nil)
+
+	lambdaClientMock := new(LambdaClientMock)
+	lambdaClientMock.On("Invoke", mock.MatchedBy(func(input *lambdaservice.InvokeInput) bool {
+		return *input.FunctionName == "batch-reprocess" && *input.InvocationType == lambdaservice.InvocationTypeEvent && string(input.Payload) == `{"batchId":"batch-1"}`
+	})).Return(&lambdaservice.InvokeOutput{}, nil).Once()
+
+	handler := &Handler{
+		Config:             Config{FunctionName: "batch-reprocess"},
+		DynamoDBClient:     dynamoDBClientMock,
+		StepFunctionClient: new(StepFunctionClientMock),
+		LambdaClient:       lambdaClientMock,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	output, err := handler.HandleRequest(ctx, map[string]interface{}{"batchId": "batch-1"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, BatchRunning, output.(*Batch).Status)
+	lambdaClientMock.AssertExpectations(t)
+}
+
+func TestStartExecutionAlreadyExists(t *testing.T) {
+	config := Config{ProcessWorkflow: "arn:aws:states:us-east-1:123456789012:stateMachine:process"}
+
+	stepFunctionClientMock := new(StepFunctionClientMock)
+	stepFunctionClientMock.On("StartExecution", mock.Anything).Return(nil, awserr.New(sfn.ErrCodeExecutionAlreadyExists, "exists", nil))
+
+	handler := &Handler{
+		Config:             config,
+		StepFunctionClient: stepFunctionClientMock,
+	}
+
+	result := handler.startExecution(&Batch{BatchId: "batch-1", JobTemplate: "tmpl"}, "a")
+
+	assert.Equal(t, AssetStarted, result.Status)
+	assert.Equal(t, "arn:aws:states:us-east-1:123456789012:execution:process:a-batch-1", result.ExecutionArn)
+}
+
+func TestStartExecutionArchivedSource(t *testing.T) {
+	config := Config{
+		SourceRestore:   "vod-source-restore",
+		ProcessWorkflow: "arn:aws:states:us-east-1:123456789012:stateMachine:process",
+	}
+
+	for name, test := range map[string]struct {
+		archiveSource string
+		response      string
+		status        string
+	}{
+		"restoring": {"DEEP_ARCHIVE", `{"guid":"a","status":"InProgress"}`, AssetRestoring},
+		"started":   {"GLACIER", `{"guid":"a","status":"Started","executionArn":"arn:execution:a"}`, AssetStarted},
+	} {
+		t.Run("should hand an archived source to SourceRestore: "+name, func(t *testing.T) {
+			dynamoDBClientMock := new(DynamoDBClientMock)
+			dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+				"archiveSource": {S: aws.String(test.archiveSource)},
+			}}, nil)
+
+			lambdaClientMock := new(LambdaClientMock)
+			lambdaClientMock.On("Invoke", mock.MatchedBy(func(input *lambdaservice.InvokeInput) bool {
+				return *input.FunctionName == "vod-source-restore" &&
+					input.InvocationType == nil &&
+					string(input.Payload) == `{"guid":"a","jobTemplate":"tmpl","executionName":"a-batch-1"}`
+			})).Return(&lambdaservice.InvokeOutput{Payload: []byte(test.response)}, nil).Once()
+
+			handler := &Handler{
+				Config:             config,
+				DynamoDBClient:     dynamoDBClientMock,
+				StepFunctionClient: new(StepFunctionClientMock),
+				LambdaClient:       lambdaClientMock,
+			}
+
+			result := handler.startExecution(&Batch{BatchId: "batch-1", JobTemplate: "tmpl"}, "a")
+
+			assert.Equal(t, test.status, result.Status)
+			lambdaClientMock.AssertExpectations(t)
+		})
+	}
+
+	t.Run("should start sources that are not archived", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"archiveSource": {S: aws.String("DISABLED")},
+		}}, nil)
+		stepFunctionClientMock := new(StepFunctionClientMock)
+		stepFunctionClientMock.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:execution:a")}, nil)
+		lambdaClientMock := new(LambdaClientMock)
+
+		handler := &Handler{
+			Config:             config,
+			DynamoDBClient:     dynamoDBClientMock,
+			StepFunctionClient: stepFunctionClientMock,
+			LambdaClient:       lambdaClientMock,
+		}
+
+		result := handler.startExecution(&Batch{BatchId: "batch-1", JobTemplate: "tmpl"}, "a")
+
+		assert.Equal(t, AssetStarted, result.Status)
+		assert.Equal(t, "arn:execution:a", result.ExecutionArn)
+		lambdaClientMock.AssertNotCalled(t, "Invoke", mock.Anything)
+	})
+
+	t.Run("should fail the asset on a function error", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"archiveSource": {S: aws.String("GLACIER")},
+		}}, nil)
+		lambdaClientMock := new(LambdaClientMock)
+		lambdaClientMock.On("Invoke", mock.Anything).Return(&lambdaservice.InvokeOutput{
+			FunctionError: aws.String("Unhandled"),
+			Payload:       []byte(`{"errorMessage":"asset not found"}`),
+		}, nil)
+
+		handler := &Handler{
+			Config:         config,
+			DynamoDBClient: dynamoDBClientMock,
+			LambdaClient:   lambdaClientMock,
+		}
+
+		result := handler.startExecution(&Batch{BatchId: "batch-1", JobTemplate: "tmpl"}, "a")
+
+		assert.Equal(t, AssetFailed, result.Status)
+		assert.Contains(t, result.Error, "asset not found")
+	})
+}
+
+func TestAPI(t *testing.T) {
+	t.Run("should create a batch and process it asynchronously", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil)
+
+		lambdaClientMock := new(LambdaClientMock)
+		lambdaClientMock.On("Invoke", mock.Anything).Return(&lambdaservice.InvokeOutput{}, nil).Once()
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+			LambdaClient:   lambdaClientMock,
+		}
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+			"httpMethod": http.MethodPost,
+			"resource":   "/batches",
+			"body":       `{"filter":{"status":"Complete"},"jobTemplate":"tmpl"}`,
+		})
+
+		assert.Nil(t, err)
+		response := output.(events.APIGatewayProxyResponse)
+		assert.Equal(t, http.StatusAccepted, response.StatusCode)
+
+		var batch Batch
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &batch))
+		assert.Equal(t, BatchPending, batch.Status)
+		assert.NotEmpty(t, batch.BatchId)
+		lambdaClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should reject invalid requests", func(t *testing.T) {
+		handler := &Handler{}
+
+		for _, body := range []string{
+			`not json`,
+			`{"filter":{"status":"Complete"}}`,
+			`{"filter":{},"jobTemplate":"tmpl"}`,
+			`{"filter":{"guids":["a"],"status":"Complete"},"jobTemplate":"tmpl"}`,
+			`{"filter":{"status":"Complete","from":"last week"},"jobTemplate":"tmpl"}`,
+		} {
+			output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+				"httpMethod": http.MethodPost,
+				"resource":   "/batches",
+				"body":       body,
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, output.(events.APIGatewayProxyResponse).StatusCode, body)
+		}
+	})
+
+	t.Run("should report per-asset results", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(batchItemOutput(t, Batch{
+			BatchId: "batch-1",
+			Status:  BatchComplete,
+			Total:   1,
+			Started: 1,
+		}), nil)
+		dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+			return input.FilterExpression == nil
+		})).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{{
+				"guid":         {S: aws.String("a")},
+				"status":       {S: aws.String(AssetStarted)},
+				"executionArn": {S: aws.String("arn:execution:a")},
+			}},
+		}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+			"httpMethod":     http.MethodGet,
+			"resource":       "/batches/{batchId}",
+			"pathParameters": map[string]string{"batchId": "batch-1"},
+		})
+
+		assert.Nil(t, err)
+		response := output.(events.APIGatewayProxyResponse)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+
+		var report BatchReport
+		assert.Nil(t, json.Unmarshal([]byte(response.Body), &report))
+		assert.Equal(t, 1, report.Started)
+		assert.Equal(t, "arn:execution:a", report.Results[0].ExecutionArn)
+	})
+
+	t.Run("should return 404 for an unknown batch", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		output, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+			"httpMethod":     http.MethodGet,
+			"resource":       "/batches/{batchId}",
+			"pathParameters": map[string]string{"batchId": "missing"},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusNotFound, output.(events.APIGatewayProxyResponse).StatusCode)
+	})
+}
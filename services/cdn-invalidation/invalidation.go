@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// manifestExtensions are the files a player reloads; segments are only
+// invalidated when InvalidateSegments is enabled.
+var manifestExtensions = map[string]bool{
+	".m3u8": true,
+	".mpd":  true,
+	".ism":  true,
+	".ismc": true,
+}
+
+// invalidate creates the invalidations for a publish that replaced earlier
+// outputs. The first publish of an asset has nothing cached and is skipped.
+func (h *Handler) invalidate(event PublishEvent) (*Invalidation, error) {
+	distributionId := h.Config.DistributionId
+	if distributionId == "" {
+		return &Invalidation{Status: StatusNotRequired}, nil
+	}
+
+	published, err := h.previouslyPublished(event.GUID)
+	if err != nil {
+		return nil, err
+	}
+	if !published {
+		slog.Info("INVALIDATION SKIPPED", "reason", "first publish")
+		return &Invalidation{Status: StatusNotRequired}, nil
+	}
+
+	invalidation := &Invalidation{
+		Status:      StatusInProgress,
+		Segments:    h.Config.InvalidateSegments,
+		RequestedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	var paths []string
+	if invalidation.Segments {
+		// One wildcard covers every output, and uses a single one of the 15
+		// wildcard paths CloudFront allows in progress
+		paths = []string{"/" + event.GUID + "/*"}
+	} else {
+		paths, err = h.manifestPaths(event)
+		if err != nil {
+			return nil, fmt.Errorf("manifestPaths: %w", err)
+		}
+	}
+	if len(paths) == 0 {
+		return &Invalidation{Status: StatusNotRequired}, nil
+	}
+	invalidation.Paths = len(paths)
+
+	for i, batch := range batches(paths, h.Config.InvalidationBatchSize) {
+		// The caller reference is the publish and batch, so a retried state
+		// gets the invalidations it already created back instead of new ones
+		output, err := h.CloudFrontClient.CreateInvalidation(&cloudfront.CreateInvalidationInput{
+			DistributionId: aws.String(distributionId),
+			InvalidationBatch: &cloudfront.InvalidationBatch{
+				CallerReference: aws.String(fmt.Sprintf("%s-publish-%d-%d", event.GUID, event.EndTime.Unix(), i)),
+				Paths: &cloudfront.Paths{
+					Quantity: aws.Int64(int64(len(batch))),
+					Items:    aws.StringSlice(batch),
+				},
+			},
+		})
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == cloudfront.ErrCodeTooManyInvalidationsInProgress {
+			return nil, &TooManyInvalidationsError{GUID: event.GUID}
+		}
+		if err != nil {
+			// Stale caches expire on their own, so the publish goes on and the
+			// failure is kept on the record
+			slog.Error("INVALIDATION FAILED", "error", err)
+			invalidation.Status = StatusFailed
+			invalidation.Error = err.Error()
+			break
+		}
+
+		invalidation.Ids = append(invalidation.Ids, aws.StringValue(output.Invalidation.Id))
+		slog.Info("INVALIDATION", "invalidationId", aws.StringValue(output.Invalidation.Id), "paths", len(batch))
+	}
+
+	if err := h.saveInvalidation(event.GUID, invalidation); err != nil {
+		return nil, err
+	}
+	return invalidation, nil
+}
+
+// checkStatus looks up invalidations that are in progress. After
+// InvalidationMaxChecks checks they are left Unconfirmed so the publish is
+// not held up any longer.
+func (h *Handler) checkStatus(guid string, invalidation *Invalidation) (*Invalidation, error) {
+	if invalidation.Status != StatusInProgress {
+		return invalidation, nil
+	}
+
+	completed := true
+	for _, id := range invalidation.Ids {
+		output, err := h.CloudFrontClient.GetInvalidation(&cloudfront.GetInvalidationInput{
+			DistributionId: aws.String(h.Config.DistributionId),
+			Id:             aws.String(id),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GetInvalidation: %w", err)
+		}
+		if aws.StringValue(output.Invalidation.Status) != "Completed" {
+			completed = false
+			break
+		}
+	}
+
+	invalidation.Checks++
+	switch {
+	case completed:
+		invalidation.Status = StatusCompleted
+		invalidation.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	case invalidation.Checks >= h.Config.InvalidationMaxChecks:
+		slog.Warn("INVALIDATION UNCONFIRMED", "guid", guid, "invalidationIds", invalidation.Ids, "checks", invalidation.Checks)
+		invalidation.Status = StatusUnconfirmed
+	default:
+		return invalidation, nil
+	}
+
+	if err := h.saveInvalidation(guid, invalidation); err != nil {
+		return nil, err
+	}
+	return invalidation, nil
+}
+
+// previouslyPublished reports whether the asset was published before. The
+// record is read ahead of the DynamoDB Update (Publish) state, so endTime is
+// still the one of the previous publish, if any.
+func (h *Handler) previouslyPublished(guid string) (bool, error) {
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(h.Config.DynamoDBTable),
+		Key:                  map[string]*dynamodb.AttributeValue{"guid": {S: aws.String(guid)}},
+		ProjectionExpression: aws.String("#endTime"),
+		ExpressionAttributeNames: map[string]*string{
+			"#endTime": aws.String("endTime"),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("GetItem: %w", err)
+	}
+
+	endTime, ok := data.Item["endTime"]
+	return ok && aws.StringValue(endTime.S) != "", nil
+}
+
+// manifestPaths returns the manifests next to each playlist, including the
+// variant playlists, with the MP4 outputs and thumbnails, which are replaced
+// in place as well.
+func (h *Handler) manifestPaths(event PublishEvent) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(key string) {
+		if escaped := (&url.URL{Path: "/" + key}).EscapedPath(); !seen[escaped] {
+			seen[escaped] = true
+			paths = append(paths, escaped)
+		}
+	}
+
+	listed := map[string]bool{}
+	for _, playlist := range []*string{event.HlsPlaylist, event.DashPlaylist, event.MssPlaylist, event.CmafDashPlaylist, event.CmafHlsPlaylist} {
+		bucket, key, ok := parseS3Uri(aws.StringValue(playlist))
+		if !ok {
+			continue
+		}
+		add(key)
+
+		prefix := path.Dir(key) + "/"
+		if listed[prefix] {
+			continue
+		}
+		listed[prefix] = true
+
+		keys, err := h.listManifests(bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			add(key)
+		}
+	}
+
+	for _, output := range append(append([]*string{}, event.Mp4Outputs...), event.ThumbNails...) {
+		if _, key, ok := parseS3Uri(aws.StringValue(output)); ok {
+			add(key)
+		}
+	}
+
+	return paths, nil
+}
+
+// listManifests lists the manifests directly under prefix.
+func (h *Handler) listManifests(bucket, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	var keys []string
+	for {
+		page, err := h.S3Client.ListObjectsV2(input)
+		if err != nil {
+			return nil, fmt.Errorf("ListObjectsV2: %w", err)
+		}
+		for _, object := range page.Contents {
+			if manifestExtensions[path.Ext(aws.StringValue(object.Key))] {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			return keys, nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+func (h *Handler) saveInvalidation(guid string, invalidation *Invalidation) error {
+	value, err := dynamodbattribute.Marshal(invalidation)
+	if err != nil {
+		return fmt.Errorf("dynamodbattribute.Marshal: %w", err)
+	}
+
+	_, err = h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(h.Config.DynamoDBTable),
+		Key:                 map[string]*dynamodb.AttributeValue{"guid": {S: aws.String(guid)}},
+		UpdateExpression:    aws.String("SET #invalidation = :invalidation"),
+		ConditionExpression: aws.String("attribute_exists(#guid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#invalidation": aws.String("invalidation"),
+			"#guid":         aws.String("guid"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":invalidation": value,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+	return nil
+}
+
+// batches splits paths into invalidations of at most size paths.
+func batches(paths []string, size int) [][]string {
+	var result [][]string
+	for len(paths) > size {
+		result = append(result, paths[:size])
+		paths = paths[size:]
+	}
+	if len(paths) > 0 {
+		result = append(result, paths)
+	}
+	return result
+}
+
+func parseS3Uri(uri string) (string, string, bool) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", false
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	return bucket, key, ok && key != ""
+}
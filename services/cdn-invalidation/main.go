@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "cdn-invalidation"
+
+// When a reprocessed asset is published its outputs overwrite the previous
+// ones under the same <guid>/ paths, so CloudFront would keep serving the old
+// manifests until they expire. The Publish workflow invalidates them before
+// the record is updated and the notifications are sent, then waits for the
+// invalidations to complete.
+const (
+	StatusNotRequired = "NotRequired"
+	StatusInProgress  = "InProgress"
+	StatusCompleted   = "Completed"
+	StatusUnconfirmed = "Unconfirmed"
+	StatusFailed      = "Failed"
+)
+
+var (
+	ErrInvalidEventObject   = errors.New("invalid event object")
+	ErrTooManyInvalidations = errors.New("too many invalidations in progress")
+)
+
+// TooManyInvalidationsError is returned when the distribution is at its limit
+// of invalidations in progress. The handler returns it unwrapped so the
+// Lambda error type is "TooManyInvalidationsError", which the CDN
+// Invalidation state retries on.
+type TooManyInvalidationsError struct {
+	GUID string
+}
+
+func (e *TooManyInvalidationsError) Error() string {
+	return fmt.Sprintf("cdn-invalidation: guid %s: %s", e.GUID, ErrTooManyInvalidations)
+}
+
+func (e *TooManyInvalidationsError) Unwrap() error {
+	return ErrTooManyInvalidations
+}
+
+// PublishEvent is the part of the Publish workflow state the invalidation is
+// built from.
+type PublishEvent struct {
+	GUID             string    `json:"guid"`
+	DestBucket       string    `json:"destBucket"`
+	EndTime          time.Time `json:"endTime"`
+	HlsPlaylist      *string   `json:"hlsPlaylist"`
+	DashPlaylist     *string   `json:"dashPlaylist"`
+	MssPlaylist      *string   `json:"mssPlaylist"`
+	CmafDashPlaylist *string   `json:"cmafDashPlaylist"`
+	CmafHlsPlaylist  *string   `json:"cmafHlsPlaylist"`
+	Mp4Outputs       []*string `json:"mp4Outputs"`
+	ThumbNails       []*string `json:"thumbNails"`
+}
+
+// StatusRequest checks on the invalidations created for a publish.
+type StatusRequest struct {
+	GUID         string        `json:"guid"`
+	Invalidation *Invalidation `json:"invalidation"`
+}
+
+// Invalidation is stored on the workflow record as invalidation and returned
+// to the Publish workflow at $.invalidation.
+type Invalidation struct {
+	Status      string   `json:"status"`
+	Ids         []string `json:"ids,omitempty"`
+	Paths       int      `json:"paths,omitempty"`
+	Segments    bool     `json:"segments,omitempty"`
+	RequestedAt string   `json:"requestedAt,omitempty"`
+	CompletedAt string   `json:"completedAt,omitempty"`
+	Checks      int      `json:"checks,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+type S3Client interface {
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+}
+
+type CloudFrontClient interface {
+	CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error)
+	GetInvalidation(input *cloudfront.GetInvalidationInput) (*cloudfront.GetInvalidationOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// DistributionId is the CloudFront distribution invalidated; nothing is
+	// invalidated when it is empty.
+	DistributionId string `env:"DistributionId"`
+	// InvalidateSegments invalidates every output of an asset instead of
+	// its manifests alone.
+	InvalidateSegments bool `env:"InvalidateSegments"`
+	// CloudFront allows 3,000 paths in progress per distribution; smaller
+	// batches leave room for other assets published at the same time
+	InvalidationBatchSize int `env:"InvalidationBatchSize" default:"1000" min:"1"`
+	InvalidationMaxChecks int `env:"InvalidationMaxChecks" default:"20" min:"1"`
+}
+
+type Handler struct {
+	Config           Config
+	DynamoDBClient   DynamoDBClient
+	S3Client         S3Client
+	CloudFrontClient CloudFrontClient
+}
+
+func (h *Handler) HandleRequest(ctx context.Context, event map[string]interface{}) (*Invalidation, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("cdn-invalidation: main.Handler.HandleRequest: json.Marshal: %w", err)
+	}
+
+	switch {
+	case event["invalidation"] != nil:
+		var request StatusRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("cdn-invalidation: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+
+		invalidation, err := h.checkStatus(request.GUID, request.Invalidation)
+		if err != nil {
+			return nil, fmt.Errorf("cdn-invalidation: main.Handler.HandleRequest: checkStatus: %w", err)
+		}
+		return invalidation, nil
+	case event["guid"] != nil:
+		var publishEvent PublishEvent
+		if err := json.Unmarshal(eventJson, &publishEvent); err != nil {
+			return nil, fmt.Errorf("cdn-invalidation: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+
+		invalidation, err := h.invalidate(publishEvent)
+		var tooMany *TooManyInvalidationsError
+		if errors.As(err, &tooMany) {
+			return nil, tooMany
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cdn-invalidation: main.Handler.HandleRequest: invalidate: %w", err)
+		}
+		return invalidation, nil
+	}
+
+	return nil, ErrInvalidEventObject
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("cdn-invalidation: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:           config,
+		DynamoDBClient:   dynamodb.New(sess),
+		S3Client:         s3.New(sess),
+		CloudFrontClient: cloudfront.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
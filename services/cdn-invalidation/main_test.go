@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+type CloudFrontClientMock struct {
+	mock.Mock
+}
+
+func (m *CloudFrontClientMock) CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*cloudfront.CreateInvalidationOutput), args.Error(1)
+}
+
+func (m *CloudFrontClientMock) GetInvalidation(input *cloudfront.GetInvalidationInput) (*cloudfront.GetInvalidationOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*cloudfront.GetInvalidationOutput), args.Error(1)
+}
+
+type mocks struct {
+	dynamoDB      *DynamoDBClientMock
+	s3            *S3ClientMock
+	cloudFront    *CloudFrontClientMock
+	invalidations []*cloudfront.CreateInvalidationInput
+	updates       []*dynamodb.UpdateItemInput
+}
+
+func newHandler(config Config) (*Handler, *mocks) {
+	m := &mocks{
+		dynamoDB:   new(DynamoDBClientMock),
+		s3:         new(S3ClientMock),
+		cloudFront: new(CloudFrontClientMock),
+	}
+	m.dynamoDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil).Run(func(args mock.Arguments) {
+		m.updates = append(m.updates, args.Get(0).(*dynamodb.UpdateItemInput))
+	})
+	m.s3.On("ListObjectsV2", mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []*s3.Object{
+			{Key: aws.String("guid/hls/video.m3u8")},
+			{Key: aws.String("guid/hls/video_1080p.m3u8")},
+			{Key: aws.String("guid/hls/video_1080p_00001.ts")},
+		},
+	}, nil)
+
+	return &Handler{
+		Config:           config,
+		DynamoDBClient:   m.dynamoDB,
+		S3Client:         m.s3,
+		CloudFrontClient: m.cloudFront,
+	}, m
+}
+
+func (m *mocks) onCreateInvalidation() {
+	m.cloudFront.On("CreateInvalidation", mock.Anything).Return(&cloudfront.CreateInvalidationOutput{
+		Invalidation: &cloudfront.Invalidation{Id: aws.String("invalidation"), Status: aws.String("InProgress")},
+	}, nil).Run(func(args mock.Arguments) {
+		m.invalidations = append(m.invalidations, args.Get(0).(*cloudfront.CreateInvalidationInput))
+	})
+}
+
+func recordItem(endTime string) *dynamodb.GetItemOutput {
+	item := map[string]*dynamodb.AttributeValue{}
+	if endTime != "" {
+		item["endTime"] = &dynamodb.AttributeValue{S: aws.String(endTime)}
+	}
+	return &dynamodb.GetItemOutput{Item: item}
+}
+
+func publishEvent() map[string]interface{} {
+	event := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"guid": "guid",
+		"destBucket": "destination",
+		"endTime": "2024-05-02T10:00:00Z",
+		"workflowStatus": "Complete",
+		"hlsPlaylist": "s3://destination/guid/hls/video.m3u8",
+		"dashPlaylist": "s3://destination/guid/dash/video.mpd",
+		"mp4Outputs": ["s3://destination/guid/mp4/video 1080p.mp4"],
+		"thumbNails": ["s3://destination/guid/thumbnails/video_tumb.0000001.jpg"]
+	}`), &event)
+	return event
+}
+
+func TestInvalidate(t *testing.T) {
+	config := Config{
+		DynamoDBTable:         "vod",
+		DistributionId:        "distribution",
+		InvalidationBatchSize: 1000,
+	}
+
+	t.Run("should not invalidate the first publish", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem(""), nil)
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusNotRequired, output.Status)
+		m.cloudFront.AssertNotCalled(t, "CreateInvalidation", mock.Anything)
+		m.dynamoDB.AssertNotCalled(t, "UpdateItem", mock.Anything)
+	})
+
+	t.Run("should invalidate the manifests of a replaced asset", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("2024-05-01T10:00:00Z"), nil)
+		m.onCreateInvalidation()
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusInProgress, output.Status)
+		assert.Equal(t, []string{"invalidation"}, output.Ids)
+		assert.Equal(t, 5, output.Paths)
+
+		assert.Len(t, m.invalidations, 1)
+		batch := m.invalidations[0].InvalidationBatch
+		assert.Equal(t, "guid-publish-1714644000-0", *batch.CallerReference)
+		assert.Equal(t, []string{
+			"/guid/hls/video.m3u8",
+			"/guid/hls/video_1080p.m3u8",
+			"/guid/dash/video.mpd",
+			"/guid/mp4/video%201080p.mp4",
+			"/guid/thumbnails/video_tumb.0000001.jpg",
+		}, aws.StringValueSlice(batch.Paths.Items))
+		assert.Equal(t, int64(5), *batch.Paths.Quantity)
+
+		assert.Len(t, m.updates, 1)
+		assert.Equal(t, "InProgress", *m.updates[0].ExpressionAttributeValues[":invalidation"].M["status"].S)
+	})
+
+	t.Run("should invalidate the whole asset with its segments", func(t *testing.T) {
+		handler, m := newHandler(config)
+		handler.Config.InvalidateSegments = true
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("2024-05-01T10:00:00Z"), nil)
+		m.onCreateInvalidation()
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.True(t, output.Segments)
+		assert.Equal(t, []string{"/guid/*"}, aws.StringValueSlice(m.invalidations[0].InvalidationBatch.Paths.Items))
+		m.s3.AssertNotCalled(t, "ListObjectsV2", mock.Anything)
+	})
+
+	t.Run("should split the paths into batches", func(t *testing.T) {
+		handler, m := newHandler(config)
+		handler.Config.InvalidationBatchSize = 2
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("2024-05-01T10:00:00Z"), nil)
+		m.onCreateInvalidation()
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.Len(t, output.Ids, 3)
+		assert.Len(t, m.invalidations, 3)
+		assert.Equal(t, "guid-publish-1714644000-2", *m.invalidations[2].InvalidationBatch.CallerReference)
+		assert.Len(t, m.invalidations[2].InvalidationBatch.Paths.Items, 1)
+	})
+
+	t.Run("should return TooManyInvalidationsError when the distribution is at its limit", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("2024-05-01T10:00:00Z"), nil)
+		m.cloudFront.On("CreateInvalidation", mock.Anything).Return(nil, awserr.New(cloudfront.ErrCodeTooManyInvalidationsInProgress, "limit", nil))
+
+		_, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		var tooMany *TooManyInvalidationsError
+		assert.True(t, errors.As(err, &tooMany))
+		assert.ErrorIs(t, err, ErrTooManyInvalidations)
+		m.dynamoDB.AssertNotCalled(t, "UpdateItem", mock.Anything)
+	})
+
+	t.Run("should record a failed invalidation and carry on", func(t *testing.T) {
+		handler, m := newHandler(config)
+		m.dynamoDB.On("GetItem", mock.Anything).Return(recordItem("2024-05-01T10:00:00Z"), nil)
+		m.cloudFront.On("CreateInvalidation", mock.Anything).Return(nil, awserr.New(cloudfront.ErrCodeAccessDenied, "denied", nil))
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusFailed, output.Status)
+		assert.Contains(t, output.Error, "denied")
+		assert.Len(t, m.updates, 1)
+	})
+
+	t.Run("should not invalidate without a distribution", func(t *testing.T) {
+		handler, m := newHandler(config)
+		handler.Config.DistributionId = ""
+
+		output, err := handler.HandleRequest(context.Background(), publishEvent())
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusNotRequired, output.Status)
+		m.dynamoDB.AssertNotCalled(t, "GetItem", mock.Anything)
+	})
+}
+
+func TestCheckStatus(t *testing.T) {
+	config := Config{
+		DynamoDBTable:         "vod",
+		DistributionId:        "distribution",
+		InvalidationMaxChecks: 3,
+	}
+
+	statusRequest := func(checks int) map[string]interface{} {
+		return map[string]interface{}{
+			"guid": "guid",
+			"invalidation": map[string]interface{}{
+				"status": StatusInProgress,
+				"ids":    []interface{}{"first", "second"},
+				"checks": checks,
+			},
+		}
+	}
+	onGetInvalidation := func(m *mocks, id, status string) {
+		m.cloudFront.On("GetInvalidation", &cloudfront.GetInvalidationInput{
+			DistributionId: aws.String("distribution"),
+			Id:             aws.String(id),
+		}).Return(&cloudfront.GetInvalidationOutput{
+			Invalidation: &cloudfront.Invalidation{Id: aws.String(id), Status: aws.String(status)},
+		}, nil)
+	}
+
+	t.Run("should complete once every invalidation has", func(t *testing.T) {
+		handler, m := newHandler(config)
+		onGetInvalidation(m, "first", "Completed")
+		onGetInvalidation(m, "second", "Completed")
+
+		output, err := handler.HandleRequest(context.Background(), statusRequest(0))
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusCompleted, output.Status)
+		assert.NotEmpty(t, output.CompletedAt)
+		assert.Len(t, m.updates, 1)
+	})
+
+	t.Run("should keep waiting while an invalidation is in progress", func(t *testing.T) {
+		handler, m := newHandler(config)
+		onGetInvalidation(m, "first", "Completed")
+		onGetInvalidation(m, "second", "InProgress")
+
+		output, err := handler.HandleRequest(context.Background(), statusRequest(0))
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusInProgress, output.Status)
+		assert.Equal(t, 1, output.Checks)
+		assert.Empty(t, m.updates)
+	})
+
+	t.Run("should stop waiting after InvalidationMaxChecks checks", func(t *testing.T) {
+		handler, m := newHandler(config)
+		onGetInvalidation(m, "first", "InProgress")
+
+		output, err := handler.HandleRequest(context.Background(), statusRequest(2))
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusUnconfirmed, output.Status)
+		assert.Len(t, m.updates, 1)
+	})
+}
+
+func TestBatches(t *testing.T) {
+	assert.Nil(t, batches(nil, 2))
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, batches([]string{"a", "b", "c"}, 2))
+	assert.Equal(t, [][]string{{"a", "b"}}, batches([]string{"a", "b"}, 2))
+}
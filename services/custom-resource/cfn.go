@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/aws/aws-lambda-go/cfn"
@@ -80,20 +80,7 @@ func (c *CfnCustomResource) Send(event cfn.Event, responseStatus string, respons
 	if err != nil {
 		return nil, fmt.Errorf("CfnCustomResource.Send: ReadAll: failed to read response body: %v", err)
 	}
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "application/json" {
-		var prettyJSON bytes.Buffer
-		if err := json.Indent(&prettyJSON, respBodyBytes, "", "  "); err != nil {
-			log.Printf("Failed to pretty-print JSON: %v", err)
-			log.Printf("Response body: %s", respBodyBytes)
-		} else {
-			log.Printf("Response body:\n%s", prettyJSON.String())
-		}
-	} else if contentType == "text/html" {
-		log.Printf("Response body:\n%s", respBodyBytes)
-	} else {
-		log.Printf("Response body: %s", respBodyBytes)
-	}
+	slog.Debug("CFN RESPONSE BODY", "contentType", resp.Header.Get("Content-Type"), "body", string(respBodyBytes))
 
 	// Recreate the response body
 	resp.Body = io.NopCloser(bytes.NewBuffer(respBodyBytes))
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -53,11 +52,11 @@ func (c *CloudFrontHelper) AddCustomOrigin(distributionId, domainName string) er
 	}
 
 	if originExists {
-		log.Printf("CloudFrontHelper.AddCustomOrigin: Origin %s has already been added to distribution %s", originId, distributionId)
+		slog.Info("ORIGIN EXISTS", "originId", originId, "distributionId", distributionId)
 		return nil
 	}
 
-	log.Printf("CloudFrontHelper.AddCustomOrigin: Adding MediaPackage as origin to distribution %s", distributionId)
+	slog.Info("ADDING ORIGIN", "originId", originId, "distributionId", distributionId)
 
 	// Parse the domain name from the URL
 	u, err := url.Parse(domainName)
@@ -161,16 +160,7 @@ func (c *CloudFrontHelper) AddCustomOrigin(distributionId, domainName string) er
 		}
 	}
 
-	originItemJson, err := json.Marshal(config.Origins.Items)
-	if err != nil {
-		return fmt.Errorf("CloudFrontHelper.AddCustomOrigin: json.Marshal: %w", err)
-	}
-	cacheBehaviorJson, err := json.Marshal(config.CacheBehaviors.Items)
-	if err != nil {
-		return fmt.Errorf("CloudFrontHelper.AddCustomOrigin: json.Marshal: %w", err)
-	}
-	log.Printf("Origins:: %s", originItemJson)
-	log.Printf("Cache behaviors:: %s", cacheBehaviorJson)
+	slog.Debug("DISTRIBUTION UPDATED", "origins", config.Origins.Items, "cacheBehaviors", config.CacheBehaviors.Items)
 
 	return nil
 }
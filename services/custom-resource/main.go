@@ -1,11 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -15,9 +16,15 @@ import (
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
 	"github.com/aws/aws-sdk-go/service/mediapackagevod"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/google/uuid"
+
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "custom-resource"
+
 type CustomResourceResponse struct {
 	GroupId         *string
 	GroupDomainName *string
@@ -25,7 +32,12 @@ type CustomResourceResponse struct {
 	UUID            *string
 }
 
+type Config struct {
+	logging.LogConfig
+}
+
 type Handler struct {
+	Config                     Config
 	S3CustomResource           S3CustomResource
 	MediaPackageCustomResource MediaPackageCustomResource
 	MetricCustomResource       MetricCustomResource
@@ -34,13 +46,6 @@ type Handler struct {
 }
 
 func (h *Handler) HandleRequest(event cfn.Event) (*CustomResourceResponse, error) {
-	eventJson, err := json.Marshal(event)
-	if err != nil {
-		return nil, fmt.Errorf("custom-resource: main.Handler.HandleRequest: json.Marshal: %w", err)
-	}
-
-	log.Printf("REQUEST:: %s", eventJson)
-
 	config := event.ResourceProperties
 	responseData := CustomResourceResponse{}
 
@@ -105,7 +110,12 @@ func (h *Handler) HandleRequest(event cfn.Event) (*CustomResourceResponse, error
 				return nil, fmt.Errorf("custom-resource: EnableMediaPackage property must be a string")
 			}
 
-			if enableMediaPackageStr == "true" {
+			enableMediaPackage, err := strconv.ParseBool(enableMediaPackageStr)
+			if err != nil {
+				return nil, fmt.Errorf("custom-resource: EnableMediaPackage property must be true or false, got %q", enableMediaPackageStr)
+			}
+
+			if enableMediaPackage {
 				res, err := h.MediaPackageCustomResource.Create(config)
 				if err != nil {
 					return nil, fmt.Errorf("custom-resource: main.Handler.HandleRequest: Create: %w", err)
@@ -114,7 +124,7 @@ func (h *Handler) HandleRequest(event cfn.Event) (*CustomResourceResponse, error
 				responseData.GroupDomainName = &res.GroupDomainName
 			}
 		default:
-			log.Printf("custom-resource: main.Handler.HandleRequest: %s not defined as a custom resource, sending success response", resourceStr)
+			slog.Warn("UNKNOWN CUSTOM RESOURCE", "resource", resourceStr)
 		}
 	}
 
@@ -123,17 +133,14 @@ func (h *Handler) HandleRequest(event cfn.Event) (*CustomResourceResponse, error
 		return nil, fmt.Errorf("custom-resource: main.Handler.HandleRequest: Send: %w", err)
 	}
 
-	responseDataJson, err := json.Marshal(responseData)
-	if err != nil {
-		return nil, fmt.Errorf("custom-resource: main.Handler.HandleRequest: json.Marshal: %w", err)
-	}
-	log.Printf("RESPONSE:: %s", responseDataJson)
-	log.Printf("CFN STATUS:: %d", *res)
+	slog.Info("RESPONSE", "data", responseData, "cfnStatus", *res)
 
 	return &responseData, nil
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
@@ -141,6 +148,12 @@ func main() {
 		log.Fatalf("main.Handler: failed to create session: %v", err)
 	}
 
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("custom-resource: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	mediaPackageClient := mediapackagevod.New(sess)
 	CloudFrontClient := cloudfront.New(sess)
 	s3Client := s3.New(sess)
@@ -167,11 +180,12 @@ func main() {
 	}
 
 	handler := &Handler{
+		Config:                     config,
 		S3CustomResource:           s3CustomResource,
 		MediaPackageCustomResource: mediaPackageCustomResource,
 		MetricCustomResource:       metricCustomResource,
 		MediaConvertCustomResource: mediaConvertCustomResource,
 		CfnCustomResource:          cfnCustomResource,
 	}
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
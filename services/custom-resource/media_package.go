@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"log/slog"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -173,7 +174,7 @@ func (m *MediaPackageCustomResource) Create(properties map[string]interface{}) (
 			configId := "packaging-config-" + randomId + "-cmaf"
 			input = getCmafParameter(*packagingGroup.Id, configId)
 		default:
-			log.Printf("Unknown packaging configuration: %s", cfg)
+			slog.Warn("UNKNOWN PACKAGING CONFIGURATION", "configuration", cfg)
 			continue
 		}
 
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
@@ -225,7 +225,7 @@ func (m *MediaConvertCustomResource) CreateTemplates(config map[string]interface
 	for _, template := range mediaPackageTemplatesNoPreset {
 		templateJSON, err := m.GetTemplateFromS3(template.File)
 		if err != nil {
-			log.Printf("MediaConvertCustomResource.CreateTemplates: GetTemplateFromS3: Error getting template %s: %v\n", template.File, err)
+			slog.Error("TEMPLATE NOT READ", "file", template.File, "error", err)
 			return fmt.Errorf("MediaConvertCustomResource.CreateTemplates: GetTemplateFromS3: %w", err)
 		}
 
@@ -242,7 +242,7 @@ func (m *MediaConvertCustomResource) CreateTemplates(config map[string]interface
 
 		_, err = m.MediaConvertClient.CreateJobTemplate(input)
 		if err != nil {
-			log.Printf("MediaConvertCustomResource.CreateTemplates: CreateJobTemplate: Error creating template %s: %v", template.Name, err)
+			slog.Error("TEMPLATE NOT CREATED", "template", template.Name, "error", err)
 			return fmt.Errorf("MediaConvertCustomResource.CreateTemplates: CreateJobTemplate: %w", err)
 		}
 	}
@@ -250,7 +250,7 @@ func (m *MediaConvertCustomResource) CreateTemplates(config map[string]interface
 	for _, template := range qvbrTemplatesNoPreset {
 		templateJSON, err := m.GetTemplateFromS3(template.File)
 		if err != nil {
-			log.Printf("MediaConvertCustomResource.CreateTemplates: GetTemplateFromS3: Error getting template %s: %v\n", template.File, err)
+			slog.Error("TEMPLATE NOT READ", "file", template.File, "error", err)
 			return fmt.Errorf("MediaConvertCustomResource.CreateTemplates: GetTemplateFromS3: %w", err)
 		}
 
@@ -267,7 +267,7 @@ func (m *MediaConvertCustomResource) CreateTemplates(config map[string]interface
 
 		_, err = m.MediaConvertClient.CreateJobTemplate(input)
 		if err != nil {
-			log.Printf("MediaConvertCustomResource.CreateTemplates: CreateJobTemplate: Error creating template %s: %v", template.Name, err)
+			slog.Error("TEMPLATE NOT CREATED", "template", template.Name, "error", err)
 			return fmt.Errorf("MediaConvertCustomResource.CreateTemplates: CreateJobTemplate: %w", err)
 		}
 	}
@@ -38,6 +38,8 @@ type S3Client interface {
 type S3CustomResourceConfig struct {
 	ServiceToken    string
 	IngestArn       string
+	IngestQueueArn  string
+	RestoreArn      string
 	Resource        string
 	WorkflowTrigger string
 	Source          string
@@ -80,12 +82,33 @@ func (s *S3CustomResource) PutNotification(config map[string]interface{}) (*stri
 			return configurations
 		}
 
+		// In the Queue ingest mode uploads are buffered in the ingest queue
+		// instead of invoking the Lambda directly
+		notificationConfiguration := &s3.NotificationConfiguration{}
+		if s3Config.IngestQueueArn != "" {
+			for _, configuration := range generateAllConfigurations() {
+				notificationConfiguration.QueueConfigurations = append(notificationConfiguration.QueueConfigurations, &s3.QueueConfiguration{
+					Events:   configuration.Events,
+					Filter:   configuration.Filter,
+					QueueArn: aws.String(s3Config.IngestQueueArn),
+				})
+			}
+		} else {
+			notificationConfiguration.LambdaFunctionConfigurations = generateAllConfigurations()
+		}
+
+		// Completed Glacier restores resume the reprocess that requested them
+		if s3Config.RestoreArn != "" {
+			notificationConfiguration.LambdaFunctionConfigurations = append(notificationConfiguration.LambdaFunctionConfigurations, &s3.LambdaFunctionConfiguration{
+				Events:            aws.StringSlice([]string{"s3:ObjectRestore:Completed"}),
+				LambdaFunctionArn: aws.String(s3Config.RestoreArn),
+			})
+		}
+
 		_, err := s.S3Client.PutBucketNotificationConfiguration(
 			&s3.PutBucketNotificationConfigurationInput{
-				Bucket: aws.String(s3Config.Source),
-				NotificationConfiguration: &s3.NotificationConfiguration{
-					LambdaFunctionConfigurations: generateAllConfigurations(),
-				},
+				Bucket:                    aws.String(s3Config.Source),
+				NotificationConfiguration: notificationConfiguration,
 			},
 		)
 
@@ -95,3 +95,71 @@ func TestS3CustomResource(t *testing.T) {
 		})
 	}
 }
+
+type S3NotificationRecorder struct {
+	Input *s3.PutBucketNotificationConfigurationInput
+}
+
+func (r *S3NotificationRecorder) PutBucketNotificationConfiguration(input *s3.PutBucketNotificationConfigurationInput) (*s3.PutBucketNotificationConfigurationOutput, error) {
+	r.Input = input
+	return &s3.PutBucketNotificationConfigurationOutput{}, nil
+}
+
+func TestS3CustomResourceIngestQueue(t *testing.T) {
+	recorder := &S3NotificationRecorder{}
+	s3CustomResource := S3CustomResource{
+		S3Client: recorder,
+	}
+
+	_, err := s3CustomResource.PutNotification(map[string]interface{}{
+		"WorkflowTrigger": "VideoFile",
+		"IngestArn":       "arn:lambda",
+		"IngestQueueArn":  "arn:sqs",
+		"Source":          "srcBucket",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	configuration := recorder.Input.NotificationConfiguration
+	if len(configuration.LambdaFunctionConfigurations) != 0 {
+		t.Errorf("Expected no Lambda notifications, got %d", len(configuration.LambdaFunctionConfigurations))
+	}
+	if len(configuration.QueueConfigurations) != 2*len(suffixList) {
+		t.Errorf("Expected %d queue notifications, got %d", 2*len(suffixList), len(configuration.QueueConfigurations))
+	}
+	for _, queueConfiguration := range configuration.QueueConfigurations {
+		if *queueConfiguration.QueueArn != "arn:sqs" {
+			t.Errorf("Expected queue arn:sqs, got %s", *queueConfiguration.QueueArn)
+		}
+	}
+}
+
+func TestS3CustomResourceRestore(t *testing.T) {
+	recorder := &S3NotificationRecorder{}
+	s3CustomResource := S3CustomResource{
+		S3Client: recorder,
+	}
+
+	_, err := s3CustomResource.PutNotification(map[string]interface{}{
+		"WorkflowTrigger": "VideoFile",
+		"IngestArn":       "arn:lambda",
+		"RestoreArn":      "arn:restore",
+		"Source":          "srcBucket",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	configurations := recorder.Input.NotificationConfiguration.LambdaFunctionConfigurations
+	if len(configurations) != 2*len(suffixList)+1 {
+		t.Fatalf("Expected %d Lambda notifications, got %d", 2*len(suffixList)+1, len(configurations))
+	}
+	restore := configurations[len(configurations)-1]
+	if *restore.LambdaFunctionArn != "arn:restore" || *restore.Events[0] != "s3:ObjectRestore:Completed" {
+		t.Errorf("Expected s3:ObjectRestore:Completed to arn:restore, got %s to %s", *restore.Events[0], *restore.LambdaFunctionArn)
+	}
+	if restore.Filter != nil {
+		t.Errorf("Expected no filter on the restore notification")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ExecutionContext is injected into the state by the "Execution Context"
+// Pass states ahead of each DynamoDB Update, from $$.Execution and $$.State.
+type ExecutionContext struct {
+	Id        string `json:"id"`
+	StartTime string `json:"startTime"`
+	State     string `json:"state"`
+}
+
+// HistoryEvent is one workflowStatus transition of an asset. Events are
+// keyed by guid and the record version that introduced them, so they sort
+// chronologically and a retried write cannot append the same transition
+// twice.
+type HistoryEvent struct {
+	GUID           string `json:"guid"`
+	Version        int64  `json:"version"`
+	Timestamp      string `json:"timestamp"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previousStatus,omitempty"`
+	// Time spent in PreviousStatus, in milliseconds
+	PreviousStatusDuration int64  `json:"previousStatusDuration,omitempty"`
+	Execution              string `json:"execution,omitempty"`
+	Actor                  string `json:"actor,omitempty"`
+	Error                  string `json:"error,omitempty"`
+}
+
+// statusTransition applies a workflowStatus change to event: it stamps
+// statusUpdatedAt and adds the time spent in the previous status to
+// stageDurations. Durations accumulate, so an asset reprocessed twice
+// reports the total time it spent encoding.
+func statusTransition(event *DynamoEvent, current map[string]*dynamodb.AttributeValue, now time.Time) (*HistoryEvent, error) {
+	var previous struct {
+		WorkflowStatus  string           `json:"workflowStatus"`
+		StatusUpdatedAt string           `json:"statusUpdatedAt"`
+		StageDurations  map[string]int64 `json:"stageDurations"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(current, &previous); err != nil {
+		return nil, err
+	}
+
+	if event.WorkflowStatus == "" || event.WorkflowStatus == previous.WorkflowStatus {
+		return nil, nil
+	}
+
+	history := &HistoryEvent{
+		GUID:           event.GUID,
+		Timestamp:      now.Format(time.RFC3339Nano),
+		Status:         event.WorkflowStatus,
+		PreviousStatus: previous.WorkflowStatus,
+		Actor:          event.Actor,
+		Error:          event.ErrorMessage,
+	}
+	if history.Actor == "" {
+		history.Actor = event.WorkflowTrigger
+	}
+	if event.Execution != nil {
+		history.Execution = event.Execution.Id
+	}
+
+	event.StageDurations = previous.StageDurations
+	if since, err := time.Parse(time.RFC3339Nano, previous.StatusUpdatedAt); err == nil && previous.WorkflowStatus != "" {
+		history.PreviousStatusDuration = now.Sub(since).Milliseconds()
+		if event.StageDurations == nil {
+			event.StageDurations = map[string]int64{}
+		}
+		event.StageDurations[previous.WorkflowStatus] += history.PreviousStatusDuration
+	}
+	event.StatusUpdatedAt = history.Timestamp
+
+	return history, nil
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
+	"reflect"
 	"time"
-	"unicode"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,14 +14,39 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/claimcheck"
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "dynamo"
+
 type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
 	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+type S3Client interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+	claimcheck.ClaimCheckConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// HistoryTable records every status transition when it is set.
+	HistoryTable string `env:"HistoryTable"`
 }
 
 type Handler struct {
+	Config         Config
 	DynamoDBClient DynamoDBClient
+	S3Client       S3Client
 }
 
 type EventDetail struct {
@@ -82,10 +106,22 @@ type DynamoEvent struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
+	RetentionPolicy        string                      `json:"retentionPolicy,omitempty"`
+	RetentionDays          int                         `json:"retentionDays,omitempty"`
+	RetentionDueAt         string                      `json:"retentionDueAt,omitempty"`
+	Tags                   map[string]string           `json:"tags,omitempty"`
+	ContentHash            string                      `json:"contentHash,omitempty"`
+	DuplicateOf            string                      `json:"duplicateOf,omitempty"`
+	CallbackUrl            string                      `json:"callbackUrl,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
+	Cost                   *CostEstimate               `json:"cost,omitempty"`
 
 	// Output
 	HlsPlaylist            *string           `json:"hlsPlaylist"`
@@ -104,6 +140,32 @@ type DynamoEvent struct {
 	ThumbNailsUrls         []*string         `json:"thumbNailsUrls"`
 	MediaPackageResourceId string            `json:"mediaPackageResourceId"`
 	EgressEndpoints        map[string]string `json:"egressEndpoints"`
+	Version                int64             `json:"version,omitempty"`
+	StatusUpdatedAt        string            `json:"statusUpdatedAt,omitempty"`
+	StageDurations         map[string]int64  `json:"stageDurations,omitempty"`
+	Actor                  string            `json:"actor,omitempty"`
+	ErrorMessage           string            `json:"errorMessage,omitempty"`
+	Execution              *ExecutionContext `json:"execution,omitempty"`
+}
+
+// CostEstimate is the estimated transcoding cost output-validate sets on a
+// publish.
+type CostEstimate struct {
+	Currency string       `json:"currency"`
+	Total    float64      `json:"total"`
+	Tenant   string       `json:"tenant"`
+	Outputs  []OutputCost `json:"outputs"`
+}
+
+type OutputCost struct {
+	Group       string  `json:"group"`
+	Kind        string  `json:"kind"`
+	Codec       string  `json:"codec,omitempty"`
+	Resolution  string  `json:"resolution,omitempty"`
+	FrameRate   float64 `json:"frameRate,omitempty"`
+	Accelerated bool    `json:"accelerated,omitempty"`
+	Minutes     float64 `json:"minutes"`
+	Cost        float64 `json:"cost"`
 }
 
 type Warning struct {
@@ -137,9 +199,20 @@ type DynamoOutput struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
+	RetentionPolicy        string                      `json:"retentionPolicy,omitempty"`
+	RetentionDays          int                         `json:"retentionDays,omitempty"`
+	RetentionDueAt         string                      `json:"retentionDueAt,omitempty"`
+	Tags                   map[string]string           `json:"tags,omitempty"`
+	ContentHash            string                      `json:"contentHash,omitempty"`
+	DuplicateOf            string                      `json:"duplicateOf,omitempty"`
+	CallbackUrl            string                      `json:"callbackUrl,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
 
 	// Output
@@ -159,63 +232,189 @@ type DynamoOutput struct {
 	ThumbNailsUrls         []*string         `json:"thumbNailsUrls"`
 	MediaPackageResourceId string            `json:"mediaPackageResourceId"`
 	EgressEndpoints        map[string]string `json:"egressEndpoints"`
+	Version                int64             `json:"version,omitempty"`
+	StatusUpdatedAt        string            `json:"statusUpdatedAt,omitempty"`
+	StageDurations         map[string]int64  `json:"stageDurations,omitempty"`
+	Actor                  string            `json:"actor,omitempty"`
+	ErrorMessage           string            `json:"errorMessage,omitempty"`
 }
 
 func (h *Handler) HandleRequest(event DynamoEvent) (*DynamoOutput, error) {
-	eventJson, err := json.Marshal(event)
+	// Keep oversized fields out of the item and the workflow state
+	encodingJobRef, err := h.Config.Offload(h.S3Client, event.GUID, "encodingJob", event.EncodingJob)
+	if err != nil {
+		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: Offload: %w", err)
+	}
+	if encodingJobRef != nil {
+		event.EncodingJob = mediaconvert.CreateJobInput{}
+		event.EncodingJobRef = encodingJobRef
+	}
+
+	encodingOutputRef, err := h.Config.Offload(h.S3Client, event.GUID, "encodingOutput", event.EncodingOutput)
 	if err != nil {
-		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: Marshal: %w", err)
+		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: Offload: %w", err)
+	}
+	if encodingOutputRef != nil {
+		event.EncodingOutput = EventDetail{}
+		event.EncodingOutputRef = encodingOutputRef
 	}
-	log.Printf("REQUEST:: %s", eventJson)
 
 	// Update the item in DynamoDB
 
+	key := map[string]*dynamodb.AttributeValue{
+		"guid": {
+			S: aws.String(event.GUID),
+		},
+	}
+
+	current, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(h.Config.DynamoDBTable),
+		Key:                  key,
+		ProjectionExpression: aws.String("#version, #lastWrite, #workflowStatus, #statusUpdatedAt, #stageDurations"),
+		ExpressionAttributeNames: map[string]*string{
+			"#version":         aws.String(versionAttribute),
+			"#lastWrite":       aws.String(lastWriteAttribute),
+			"#workflowStatus":  aws.String("workflowStatus"),
+			"#statusUpdatedAt": aws.String("statusUpdatedAt"),
+			"#stageDurations":  aws.String("stageDurations"),
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: GetItem: %w", err)
+	}
+
+	var recorded struct {
+		Version         int64            `json:"version"`
+		LastWrite       string           `json:"lastWrite"`
+		StatusUpdatedAt string           `json:"statusUpdatedAt"`
+		StageDurations  map[string]int64 `json:"stageDurations"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(current.Item, &recorded); err != nil {
+		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: UnmarshalMap: %w", err)
+	}
+
+	// The version the workflow state carries is the one the record had when
+	// the workflow read it, so a write made since then, by another execution
+	// or by the asset API, is reported instead of overwritten
+	write := writeId(&event)
+	switch {
+	case write != "" && recorded.LastWrite == write && recorded.Version == event.Version+1:
+		// A retry of this step whose update already went through
+		slog.Info("ALREADY UPDATED", "version", recorded.Version)
+		event.Version = recorded.Version
+		event.StatusUpdatedAt = recorded.StatusUpdatedAt
+		event.StageDurations = recorded.StageDurations
+		return dynamoOutput(&event), nil
+	case recorded.Version != event.Version:
+		conflict := &VersionConflictError{GUID: event.GUID, Version: event.Version}
+		slog.Warn("CONFLICT", "error", conflict, "version", recorded.Version)
+		return nil, conflict
+	}
+
+	history, err := statusTransition(&event, current.Item, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: statusTransition: %w", err)
+	}
+
 	values, err := dynamodbattribute.MarshalMap(event)
 	if err != nil {
 		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: MarshalMap: %w", err)
 	}
 
 	delete(values, "guid")
+	delete(values, "execution")
+	if event.EndTime.IsZero() {
+		delete(values, "endTime")
+	}
+	// Steps that carry no job or job output leave the stored ones alone
+	if reflect.ValueOf(event.EncodingJob).IsZero() {
+		delete(values, "encodingJob")
+	}
+	if reflect.ValueOf(event.EncodingOutput).IsZero() {
+		delete(values, "encodingOutput")
+	}
+	if write != "" {
+		values[lastWriteAttribute] = &dynamodb.AttributeValue{S: aws.String(write)}
+	}
 
-	expression := "SET "
-	attributeValues := make(map[string]*dynamodb.AttributeValue)
-	valuesWithNumberKey := make(map[string]*dynamodb.AttributeValue)
-	counter := 1
-	for key, value := range values {
-		placeholder := fmt.Sprintf(":%d", counter)
-		key = string(unicode.ToLower(rune(key[0]))) + key[1:]
-		expression += fmt.Sprintf("%s = %s, ", key, placeholder)
-		attributeValues[placeholder] = value
-		valuesWithNumberKey[":"+strconv.Itoa(counter)] = value
-		counter++
+	// Drop references superseded by an inline value
+	remove := []string{}
+	if event.EncodingJobRef == nil && !isEmptyAttributeValue(values["encodingJob"]) {
+		remove = append(remove, "encodingJobRef")
 	}
-	if len(expression) > 2 {
-		expression = expression[:len(expression)-2]
+	if event.EncodingOutputRef == nil && !isEmptyAttributeValue(values["encodingOutput"]) {
+		remove = append(remove, "encodingOutputRef")
 	}
 
-	log.Printf("expression:: %s", expression)
-	valuesJson, _ := json.Marshal(valuesWithNumberKey)
-	log.Printf("values:: %s", valuesJson)
+	expression := buildUpdateExpression(values, remove, event.Version)
+	nextVersion := event.Version + 1
+
+	slog.Debug("UPDATE EXPRESSION", "expression", expression.Update, "names", expression.Names, "values", expression.Values)
+
+	historyTable := h.Config.HistoryTable
+	if history != nil && historyTable != "" {
+		// Record the transition in the same transaction as the update, so
+		// the history can neither miss nor duplicate a status change
+		history.Version = nextVersion
+		var historyItem map[string]*dynamodb.AttributeValue
+		historyItem, err = dynamodbattribute.MarshalMap(history)
+		if err != nil {
+			return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: MarshalMap: %w", err)
+		}
+
+		slog.Info("HISTORY", "history", history)
 
-	input := dynamodb.UpdateItemInput{
-		TableName: aws.String(os.Getenv("DynamoDBTable")),
-		Key: map[string]*dynamodb.AttributeValue{
-			"guid": {
-				S: aws.String(event.GUID),
+		_, err = h.DynamoDBClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Update: &dynamodb.Update{
+						TableName:                 aws.String(h.Config.DynamoDBTable),
+						Key:                       key,
+						UpdateExpression:          aws.String(expression.Update),
+						ConditionExpression:       aws.String(expression.Condition),
+						ExpressionAttributeNames:  expression.Names,
+						ExpressionAttributeValues: expression.Values,
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName:                aws.String(historyTable),
+						Item:                     historyItem,
+						ConditionExpression:      aws.String("attribute_not_exists(#guid)"),
+						ExpressionAttributeNames: map[string]*string{"#guid": aws.String("guid")},
+					},
+				},
 			},
-		},
-		UpdateExpression:          aws.String(expression),
-		ExpressionAttributeValues: valuesWithNumberKey,
+		})
+	} else {
+		_, err = h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(h.Config.DynamoDBTable),
+			Key:                       key,
+			UpdateExpression:          aws.String(expression.Update),
+			ConditionExpression:       aws.String(expression.Condition),
+			ExpressionAttributeNames:  expression.Names,
+			ExpressionAttributeValues: expression.Values,
+		})
+	}
+	if isConditionalCheckFailed(err) {
+		conflict := &VersionConflictError{GUID: event.GUID, Version: event.Version}
+		slog.Warn("CONFLICT", "error", conflict)
+		return nil, conflict
 	}
-
-	_, err = h.DynamoDBClient.UpdateItem(&input)
 	if err != nil {
 		return nil, fmt.Errorf("dynamo: main.Handler.HandleRequest: UpdateItem: %w", err)
 	}
 
-	log.Println("UPDATE:: Successfully updated item in DynamoDB")
+	event.Version = nextVersion
+
+	slog.Info("UPDATE", "version", nextVersion)
+
+	return dynamoOutput(&event), nil
+}
 
-	output := &DynamoOutput{
+func dynamoOutput(event *DynamoEvent) *DynamoOutput {
+	return &DynamoOutput{
 		GUID:                   event.GUID,
 		StartTime:              event.StartTime,
 		WorkflowTrigger:        event.WorkflowTrigger,
@@ -236,9 +435,17 @@ func (h *Handler) HandleRequest(event DynamoEvent) (*DynamoOutput, error) {
 		SrcVideo:               event.SrcVideo,
 		EnableMediaPackage:     event.EnableMediaPackage,
 		SrcMediainfo:           event.SrcMediainfo,
+		EncodingProfile:        event.EncodingProfile,
+		JobTemplate:            event.JobTemplate,
+		RetentionPolicy:        event.RetentionPolicy,
+		RetentionDays:          event.RetentionDays,
+		RetentionDueAt:         event.RetentionDueAt,
+		Tags:                   event.Tags,
 		EncodingJob:            event.EncodingJob,
+		EncodingJobRef:         event.EncodingJobRef,
 		EncodeJobId:            event.EncodeJobId,
 		EncodingOutput:         event.EncodingOutput,
+		EncodingOutputRef:      event.EncodingOutputRef,
 		EndTime:                event.EndTime,
 		HlsPlaylist:            event.HlsPlaylist,
 		HlsUrl:                 event.HlsUrl,
@@ -256,12 +463,17 @@ func (h *Handler) HandleRequest(event DynamoEvent) (*DynamoOutput, error) {
 		ThumbNailsUrls:         event.ThumbNailsUrls,
 		MediaPackageResourceId: event.MediaPackageResourceId,
 		EgressEndpoints:        event.EgressEndpoints,
+		Version:                event.Version,
+		StatusUpdatedAt:        event.StatusUpdatedAt,
+		StageDurations:         event.StageDurations,
+		Actor:                  event.Actor,
+		ErrorMessage:           event.ErrorMessage,
 	}
-
-	return output, nil
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
@@ -270,13 +482,20 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create session: %s", err)
 	}
-	dynamo := dynamodb.New(sess)
 
-	log.Println("DynamoDB client initialized:", dynamo)
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("dynamo: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	dynamo := dynamodb.New(sess)
 
 	handler := &Handler{
+		Config:         config,
 		DynamoDBClient: dynamo,
+		S3Client:       s3.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
@@ -1,20 +1,62 @@
 package main
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+
+	"shared/claimcheck"
 )
 
 type MockDynamoDBClient struct {
 	mock.Mock
 }
 
+func (m *MockDynamoDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *MockDynamoDBClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.TransactWriteItemsOutput), args.Error(1)
+}
+
 func (m *MockDynamoDBClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
-	m.Called(input)
-	return &dynamodb.UpdateItemOutput{}, nil
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+type MockS3Client struct {
+	mock.Mock
+}
+
+func (m *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
 }
 
 func TestHandleRequest(t *testing.T) {
@@ -133,12 +175,398 @@ func TestHandleRequest(t *testing.T) {
 				}
 			]
 		}`,
+		Version: 1,
 	}
 
+	mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
 	mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
 	
 	result, err := handler.HandleRequest(event)
 	assert.NoError(t, err)
+	assert.NotEmpty(t, result.StatusUpdatedAt)
+	output.StatusUpdatedAt = result.StatusUpdatedAt
 	assert.Equal(t, &output, result)
 
 }
+
+func TestHandleRequestClaimCheck(t *testing.T) {
+	mockDB := new(MockDynamoDBClient)
+	mockS3 := new(MockS3Client)
+	handler := Handler{
+		Config:         Config{ClaimCheckConfig: claimcheck.ClaimCheckConfig{StateBucket: "vod-state", ClaimCheckThreshold: 300}},
+		DynamoDBClient: mockDB,
+		S3Client:       mockS3,
+	}
+
+	event := DynamoEvent{
+		GUID:           "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+		WorkflowStatus: "Encoding",
+		EncodingJob: mediaconvert.CreateJobInput{
+			JobTemplate: aws.String("video-on-demand-on-aws_Ott_1080p_Avc_Aac_16x9_mvod_no_preset"),
+			Role:        aws.String("arn:aws:iam::123456789012:role/MediaConvertRole"),
+		},
+		EncodeJobId: "1740305088427-714h8k",
+	}
+
+	mockS3.On("PutObject", mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return *input.Key == "597c449e-6d32-4e88-a2b4-c956f85a3d51/state/encodingJob.json"
+	})).Return(&s3.PutObjectOutput{}, nil)
+	mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+	mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	result, err := handler.HandleRequest(event)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://vod-state/597c449e-6d32-4e88-a2b4-c956f85a3d51/state/encodingJob.json", *result.EncodingJobRef)
+	assert.Nil(t, result.EncodingJob.JobTemplate)
+	assert.Nil(t, result.EncodingOutputRef)
+	mockS3.AssertExpectations(t)
+}
+
+func TestHandleRequestVersioning(t *testing.T) {
+	event := DynamoEvent{
+		GUID:           "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+		WorkflowStatus: "Complete",
+		SrcVideo:       "clang.mp4",
+		FrameCapture:   false,
+	}
+
+	t.Run("should write with placeholders, skip empty values and bump the version", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			DynamoDBClient: mockDB,
+		}
+
+		event := event
+		event.Version = 4
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"version":        {N: aws.String("4")},
+				"workflowStatus": {S: aws.String("Complete")},
+			},
+		}, nil)
+		mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), result.Version)
+
+		input := mockDB.Calls[1].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+		assert.Equal(t, "SET #n1 = :v1, #n2 = :v2, #n3 = :v3, #n4 = :v4, #n5 = :v5, #n6 = :v6, #version = :version", *input.UpdateExpression)
+		assert.Equal(t, "#version = :expected", *input.ConditionExpression)
+		assert.Equal(t, "4", *input.ExpressionAttributeValues[":expected"].N)
+		assert.Equal(t, "5", *input.ExpressionAttributeValues[":version"].N)
+
+		names := []string{}
+		for _, name := range input.ExpressionAttributeNames {
+			names = append(names, *name)
+		}
+		assert.ElementsMatch(t, []string{"enableMediaPackage", "enableSns", "enableSqs", "frameCapture", "srcVideo", "workflowStatus", "version"}, names)
+	})
+
+	t.Run("should require a missing version on the first write", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			DynamoDBClient: mockDB,
+		}
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+		mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.Version)
+
+		input := mockDB.Calls[1].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+		assert.Equal(t, "attribute_not_exists(#version)", *input.ConditionExpression)
+	})
+
+	t.Run("should return VersionConflictError when the condition fails", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			DynamoDBClient: mockDB,
+		}
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"version": {N: aws.String("2")},
+			},
+		}, nil)
+		mockDB.On("UpdateItem", mock.Anything).Return(nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil))
+
+		event := event
+		event.Version = 2
+		_, err := handler.HandleRequest(event)
+		var conflict *VersionConflictError
+		assert.ErrorAs(t, err, &conflict)
+		assert.ErrorIs(t, err, ErrVersionConflict)
+		assert.Equal(t, int64(2), conflict.Version)
+	})
+
+	t.Run("should not write over a record that moved past the state's version", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			DynamoDBClient: mockDB,
+		}
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"version": {N: aws.String("3")},
+			},
+		}, nil)
+
+		event := event
+		event.Version = 2
+		_, err := handler.HandleRequest(event)
+		var conflict *VersionConflictError
+		assert.ErrorAs(t, err, &conflict)
+		assert.Equal(t, int64(2), conflict.Version)
+		mockDB.AssertNotCalled(t, "UpdateItem", mock.Anything)
+	})
+
+	t.Run("should let only one of two writers starting from the same version through", func(t *testing.T) {
+		table := &versionedTable{version: 1}
+		first, second := Handler{DynamoDBClient: table}, Handler{DynamoDBClient: table}
+
+		firstEvent, secondEvent := event, event
+		firstEvent.Version, secondEvent.Version = 1, 1
+		firstEvent.Execution = &ExecutionContext{Id: "execution-1", State: "DynamoDB Update (Publish)"}
+		secondEvent.Execution = &ExecutionContext{Id: "execution-2", State: "DynamoDB Update (Publish)"}
+
+		// the first writer updates the record after the second has read it
+		table.afterGet = func() {
+			result, err := first.HandleRequest(firstEvent)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), result.Version)
+		}
+
+		_, err := second.HandleRequest(secondEvent)
+		assert.ErrorIs(t, err, ErrVersionConflict)
+		assert.Equal(t, int64(2), table.version)
+		assert.Equal(t, "execution-1#DynamoDB Update (Publish)", table.lastWrite)
+		assert.Equal(t, 1, table.updates)
+
+		// and a writer reading after the update is stopped before writing
+		_, err = second.HandleRequest(secondEvent)
+		assert.ErrorIs(t, err, ErrVersionConflict)
+		assert.Equal(t, 1, table.updates)
+	})
+
+	t.Run("should not report a retried step whose update went through as a conflict", func(t *testing.T) {
+		table := &versionedTable{version: 1}
+		handler := Handler{DynamoDBClient: table}
+
+		event := event
+		event.Version = 1
+		event.Execution = &ExecutionContext{Id: "execution-1", State: "DynamoDB Update (Publish)"}
+
+		for i := 0; i < 2; i++ {
+			result, err := handler.HandleRequest(event)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), result.Version)
+		}
+		assert.Equal(t, int64(2), table.version)
+		assert.Equal(t, 1, table.updates)
+	})
+}
+
+// versionedTable holds the version of one record and applies the conditions
+// of the updates made to it, so writers can be played against each other.
+type versionedTable struct {
+	version   int64
+	lastWrite string
+	updates   int
+	// afterGet runs once, after the next GetItem has read the record
+	afterGet func()
+}
+
+func (t *versionedTable) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	output := &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{}}
+	if t.version > 0 {
+		output.Item["version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.version, 10))}
+	}
+	if t.lastWrite != "" {
+		output.Item["lastWrite"] = &dynamodb.AttributeValue{S: aws.String(t.lastWrite)}
+	}
+	if afterGet := t.afterGet; afterGet != nil {
+		t.afterGet = nil
+		afterGet()
+	}
+	return output, nil
+}
+
+func (t *versionedTable) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	var expected int64
+	if expectedValue, ok := input.ExpressionAttributeValues[":expected"]; ok {
+		expected, _ = strconv.ParseInt(*expectedValue.N, 10, 64)
+	}
+	if expected != t.version {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+
+	t.version, _ = strconv.ParseInt(*input.ExpressionAttributeValues[":version"].N, 10, 64)
+	for placeholder, name := range input.ExpressionAttributeNames {
+		if *name == "lastWrite" {
+			t.lastWrite = *input.ExpressionAttributeValues[strings.Replace(placeholder, "#n", ":v", 1)].S
+		}
+	}
+	t.updates++
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (t *versionedTable) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return nil, errors.New("versionedTable: TransactWriteItems is not supported")
+}
+
+func TestHandleRequestHistory(t *testing.T) {
+	config := Config{DynamoDBTable: "vod", HistoryTable: "vod-history"}
+
+	t.Run("should record the transition and the time spent in the previous status", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			Config:         config,
+			DynamoDBClient: mockDB,
+		}
+
+		event := DynamoEvent{
+			GUID:            "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+			WorkflowTrigger: "Video",
+			WorkflowStatus:  "Complete",
+			Version:         2,
+			Execution: &ExecutionContext{
+				Id:    "arn:aws:states:us-east-1:123456789012:execution:PublishWorkflow:1234",
+				State: "DynamoDB Update (Publish)",
+			},
+		}
+
+		updatedAt := time.Now().UTC().Add(-90 * time.Second).Format(time.RFC3339Nano)
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"version":         {N: aws.String("2")},
+				"workflowStatus":  {S: aws.String("Encoding")},
+				"statusUpdatedAt": {S: aws.String(updatedAt)},
+				"stageDurations": {M: map[string]*dynamodb.AttributeValue{
+					"Ingest": {N: aws.String("1500")},
+				}},
+			},
+		}, nil)
+		mockDB.On("TransactWriteItems", mock.Anything).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
+
+		result, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), result.Version)
+		assert.Equal(t, int64(1500), result.StageDurations["Ingest"])
+		assert.InDelta(t, 90000, result.StageDurations["Encoding"], 5000)
+
+		input := mockDB.Calls[1].Arguments.Get(0).(*dynamodb.TransactWriteItemsInput)
+		assert.Len(t, input.TransactItems, 2)
+		assert.Equal(t, "#version = :expected", *input.TransactItems[0].Update.ConditionExpression)
+
+		var history HistoryEvent
+		assert.NoError(t, dynamodbattribute.UnmarshalMap(input.TransactItems[1].Put.Item, &history))
+		assert.Equal(t, "vod-history", *input.TransactItems[1].Put.TableName)
+		assert.Equal(t, int64(3), history.Version)
+		assert.Equal(t, "Complete", history.Status)
+		assert.Equal(t, "Encoding", history.PreviousStatus)
+		assert.Equal(t, "Video", history.Actor)
+		assert.Equal(t, "arn:aws:states:us-east-1:123456789012:execution:PublishWorkflow:1234", history.Execution)
+		assert.Equal(t, result.StatusUpdatedAt, history.Timestamp)
+
+		for _, name := range input.TransactItems[0].Update.ExpressionAttributeNames {
+			assert.NotEqual(t, "execution", *name)
+		}
+	})
+
+	t.Run("should not record history when the status is unchanged", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			Config:         config,
+			DynamoDBClient: mockDB,
+		}
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"version":        {N: aws.String("1")},
+				"workflowStatus": {S: aws.String("Ingest")},
+			},
+		}, nil)
+		mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(DynamoEvent{
+			GUID:           "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+			WorkflowStatus: "Ingest",
+			Version:        1,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), result.Version)
+		assert.Empty(t, result.StatusUpdatedAt)
+		mockDB.AssertNotCalled(t, "TransactWriteItems", mock.Anything)
+	})
+
+	t.Run("should return VersionConflictError when the transaction condition fails", func(t *testing.T) {
+		mockDB := new(MockDynamoDBClient)
+		handler := Handler{
+			Config:         config,
+			DynamoDBClient: mockDB,
+		}
+
+		mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+		mockDB.On("TransactWriteItems", mock.Anything).Return(nil, &dynamodb.TransactionCanceledException{
+			Message_: aws.String("Transaction cancelled"),
+			CancellationReasons: []*dynamodb.CancellationReason{
+				{Code: aws.String("ConditionalCheckFailed")},
+				{Code: aws.String("None")},
+			},
+		})
+
+		_, err := handler.HandleRequest(DynamoEvent{
+			GUID:           "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+			WorkflowStatus: "Ingest",
+		})
+		assert.ErrorIs(t, err, ErrVersionConflict)
+	})
+}
+
+func TestHandleRequestCost(t *testing.T) {
+	mockDB := new(MockDynamoDBClient)
+	handler := Handler{
+		DynamoDBClient: mockDB,
+	}
+	mockDB.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+	mockDB.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	_, err := handler.HandleRequest(DynamoEvent{
+		GUID:           "597c449e-6d32-4e88-a2b4-c956f85a3d51",
+		WorkflowStatus: "Complete",
+		Cost: &CostEstimate{
+			Currency: "USD",
+			Total:    0.03,
+			Tenant:   "acme",
+			Outputs:  []OutputCost{{Group: "HLS_GROUP", Kind: "VIDEO", Codec: "H_264", Resolution: "HD", Minutes: 2, Cost: 0.03}},
+		},
+	})
+	assert.NoError(t, err)
+
+	input := mockDB.Calls[1].Arguments.Get(0).(*dynamodb.UpdateItemInput)
+	for placeholder, name := range input.ExpressionAttributeNames {
+		if *name != "cost" {
+			continue
+		}
+		cost := input.ExpressionAttributeValues[strings.Replace(placeholder, "#n", ":v", 1)].M
+		assert.Equal(t, "acme", *cost["tenant"].S)
+		assert.Equal(t, "0.03", *cost["total"].N)
+		assert.Equal(t, "H_264", *cost["outputs"].L[0].M["codec"].S)
+		return
+	}
+	t.Fatal("cost not written")
+}
+
+func TestIsEmptyAttributeValue(t *testing.T) {
+	assert.True(t, isEmptyAttributeValue(&dynamodb.AttributeValue{NULL: aws.Bool(true)}))
+	assert.True(t, isEmptyAttributeValue(&dynamodb.AttributeValue{S: aws.String("")}))
+	assert.True(t, isEmptyAttributeValue(&dynamodb.AttributeValue{SS: []*string{}}))
+	assert.True(t, isEmptyAttributeValue(&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"a": {S: aws.String("")}}}))
+	assert.False(t, isEmptyAttributeValue(&dynamodb.AttributeValue{N: aws.String("0")}))
+	assert.False(t, isEmptyAttributeValue(&dynamodb.AttributeValue{BOOL: aws.Bool(false)}))
+	assert.False(t, isEmptyAttributeValue(&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"Ingest": {N: aws.String("0")}}}))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// versionAttribute counts the writes of the workflow state: every update of
+// this function and every deletion or restore by asset-delete bumps it, on
+// the condition that the record is still at the version the writer read.
+// The side writers leave it alone. webhook-notification (webhookDeliveries,
+// webhookDeliveryCount), cdn-invalidation (invalidation), source-restore
+// (restore), input-validate duplicate linking (linkedSources) and
+// retention-sweeper (retention*) each write attributes that nothing else
+// writes and the workflow state does not carry, so neither side can
+// overwrite the other. They guard their writes on their own attributes
+// instead; retention-sweeper on retentionDueAt, which a republish moves.
+// Bumping the version from them would fail the next step of a running
+// workflow on a change it does not depend on.
+const versionAttribute = "version"
+
+// lastWriteAttribute records the workflow step that made the last update, so
+// a retried invocation of a step whose update already went through is told
+// apart from a conflicting write.
+const lastWriteAttribute = "lastWrite"
+
+var ErrVersionConflict = errors.New("workflow record was modified by another writer")
+
+// VersionConflictError is returned when the record's version is not the one
+// the workflow state carries: another writer changed the record since the
+// workflow read it. The handler returns it unwrapped so the Lambda error type
+// is "VersionConflictError". Retrying the same state cannot succeed, so the
+// DynamoDB Update states fail on it.
+type VersionConflictError struct {
+	GUID    string
+	Version int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("dynamo: guid %s: expected version %d: %s", e.GUID, e.Version, ErrVersionConflict)
+}
+
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// writeId identifies the workflow step an update is made by: the execution
+// and the state that invoked the function. It is empty when the event does
+// not say.
+func writeId(event *DynamoEvent) string {
+	if event.Execution == nil || event.Execution.Id == "" {
+		return ""
+	}
+	return event.Execution.Id + "#" + event.Execution.State
+}
+
+// isConditionalCheckFailed reports whether err is a failed condition on
+// UpdateItem, or on any item of a TransactWriteItems call.
+func isConditionalCheckFailed(err error) bool {
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if reason.Code != nil && *reason.Code == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// updateExpression is an UpdateItem expression with every attribute name and
+// value behind a placeholder, so names that collide with DynamoDB reserved
+// words (status, name, queue, ...) can be written.
+type updateExpression struct {
+	Update    string
+	Condition string
+	Names     map[string]*string
+	Values    map[string]*dynamodb.AttributeValue
+}
+
+// buildUpdateExpression sets every non-empty attribute in values, removes
+// the attributes listed in remove and bumps the version attribute from
+// expected, on the condition that the record is still at that version. An
+// expected version of 0 means the record has no version yet.
+func buildUpdateExpression(values map[string]*dynamodb.AttributeValue, remove []string, expected int64) updateExpression {
+	expr := updateExpression{
+		Names:  map[string]*string{},
+		Values: map[string]*dynamodb.AttributeValue{},
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sets := []string{}
+	counter := 1
+	for _, key := range keys {
+		if key == versionAttribute || isEmptyAttributeValue(values[key]) {
+			continue
+		}
+		name := fmt.Sprintf("#n%d", counter)
+		placeholder := fmt.Sprintf(":v%d", counter)
+		expr.Names[name] = aws.String(string(unicode.ToLower(rune(key[0]))) + key[1:])
+		expr.Values[placeholder] = values[key]
+		sets = append(sets, fmt.Sprintf("%s = %s", name, placeholder))
+		counter++
+	}
+
+	expr.Names["#version"] = aws.String(versionAttribute)
+	sets = append(sets, "#version = :version")
+
+	if expected == 0 {
+		expr.Condition = "attribute_not_exists(#version)"
+	} else {
+		expr.Condition = "#version = :expected"
+		expr.Values[":expected"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expected, 10))}
+	}
+	expr.Values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expected+1, 10))}
+
+	expr.Update = "SET " + strings.Join(sets, ", ")
+
+	removes := []string{}
+	for i, key := range remove {
+		name := fmt.Sprintf("#r%d", i+1)
+		expr.Names[name] = aws.String(key)
+		removes = append(removes, name)
+	}
+	if len(removes) > 0 {
+		expr.Update += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	return expr
+}
+
+// isEmptyAttributeValue reports whether av carries no data: NULL, an empty
+// string, an empty set, or a list or map whose elements are all empty.
+// Numbers and booleans are always kept, zero and false are values.
+func isEmptyAttributeValue(av *dynamodb.AttributeValue) bool {
+	switch {
+	case av == nil:
+		return true
+	case av.NULL != nil && *av.NULL:
+		return true
+	case av.S != nil:
+		return *av.S == ""
+	case av.M != nil:
+		for _, value := range av.M {
+			if !isEmptyAttributeValue(value) {
+				return false
+			}
+		}
+		return true
+	case av.L != nil:
+		for _, value := range av.L {
+			if !isEmptyAttributeValue(value) {
+				return false
+			}
+		}
+		return true
+	case av.N != nil, av.BOOL != nil:
+		return false
+	}
+	return len(av.B) == 0 && len(av.SS) == 0 && len(av.NS) == 0 && len(av.BS) == 0
+}
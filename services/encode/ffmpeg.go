@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"shared/claimcheck"
+)
+
+// FfmpegTranscoder encodes jobs with ffmpeg, for development and for
+// environments without MediaConvert. Job templates are read from JSON files
+// like the ones in custom-resource/templates, and only the subset of their
+// settings ffmpeg can follow is used: HLS, DASH ISO and file groups with
+// their destinations and segment lengths, and each output's name modifier,
+// resolution, bitrates and frame capture rate. CMAF and MS Smooth groups are
+// skipped. Outputs are written where MediaConvert would write them and the
+// job's completion is reported with the same event.
+type FfmpegTranscoder struct {
+	// Templates is the directory of job template JSON files.
+	Templates string
+	Runner    FfmpegRunner
+}
+
+// FfmpegRunner runs a job to completion or hands it to a worker that does.
+type FfmpegRunner interface {
+	Run(job *FfmpegJob) error
+}
+
+var (
+	ErrTemplateNotFound  = errors.New("job template not found")
+	ErrUnsupportedOutput = errors.New("output is not supported by ffmpeg")
+	ErrNoOutputGroups    = errors.New("job has no output groups ffmpeg supports")
+	ErrTaskNotStarted    = errors.New("ffmpeg task was not started")
+)
+
+// FfmpegJob is the part of a MediaConvert job ffmpeg encodes.
+type FfmpegJob struct {
+	Id           string               `json:"id"`
+	Input        string               `json:"input"`
+	UserMetadata map[string]string    `json:"userMetadata"`
+	OutputGroups []*FfmpegOutputGroup `json:"outputGroups"`
+}
+
+// FfmpegOutputGroup is an output group. Type is the group type as the
+// completion event reports it, HLS_GROUP, DASH_ISO_GROUP or FILE_GROUP.
+type FfmpegOutputGroup struct {
+	Type          string          `json:"type"`
+	Destination   string          `json:"destination"`
+	SegmentLength int64           `json:"segmentLength,omitempty"`
+	Outputs       []*FfmpegOutput `json:"outputs"`
+}
+
+// FfmpegOutput is an output of a group. Outputs without a video codec are
+// audio only, and without an audio bitrate video only.
+type FfmpegOutput struct {
+	NameModifier string `json:"nameModifier,omitempty"`
+	VideoCodec   string `json:"videoCodec,omitempty"`
+	Width        int64  `json:"width,omitempty"`
+	Height       int64  `json:"height,omitempty"`
+	VideoBitrate int64  `json:"videoBitrate,omitempty"`
+	AudioBitrate int64  `json:"audioBitrate,omitempty"`
+	// FrameRate is the capture rate of a frame capture output, 1/5 for a
+	// frame every 5 seconds.
+	FrameRate string `json:"frameRate,omitempty"`
+}
+
+func (t *FfmpegTranscoder) GetJobTemplate(name string) (*mediaconvert.JobTemplate, error) {
+	files, err := filepath.Glob(filepath.Join(t.Templates, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Glob: %w", err)
+	}
+
+	// the stack creates the templates with its name as a prefix
+	var match *mediaconvert.JobTemplate
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("ReadFile: %w", err)
+		}
+		var template mediaconvert.JobTemplate
+		if err := json.Unmarshal(data, &template); err != nil {
+			return nil, fmt.Errorf("%s: json.Unmarshal: %w", file, err)
+		}
+		templateName := aws.StringValue(template.Name)
+		if templateName == name {
+			return &template, nil
+		}
+		if templateName != "" && strings.HasSuffix(name, templateName) {
+			match = &template
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("GetJobTemplate: %s: %w", name, ErrTemplateNotFound)
+	}
+	return match, nil
+}
+
+func (t *FfmpegTranscoder) CreateJob(job *mediaconvert.CreateJobInput) (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("rand.Read: %w", err)
+	}
+	id := fmt.Sprintf("%d-ffmpeg%s", time.Now().Unix(), hex.EncodeToString(suffix))
+
+	ffmpegJob, err := newFfmpegJob(id, job)
+	if err != nil {
+		return "", fmt.Errorf("newFfmpegJob: %w", err)
+	}
+	if err := t.Runner.Run(ffmpegJob); err != nil {
+		return "", fmt.Errorf("Run: %w", err)
+	}
+	return id, nil
+}
+
+// newFfmpegJob picks the settings ffmpeg follows out of a job built from a
+// job template.
+func newFfmpegJob(id string, job *mediaconvert.CreateJobInput) (*FfmpegJob, error) {
+	if job.Settings == nil || len(job.Settings.Inputs) == 0 {
+		return nil, fmt.Errorf("job has no input")
+	}
+	ffmpegJob := &FfmpegJob{
+		Id:           id,
+		Input:        aws.StringValue(job.Settings.Inputs[0].FileInput),
+		UserMetadata: aws.StringValueMap(job.UserMetadata),
+	}
+
+	for _, group := range job.Settings.OutputGroups {
+		name := aws.StringValue(group.Name)
+		settings := group.OutputGroupSettings
+		if settings == nil {
+			return nil, fmt.Errorf("output group %s has no settings", name)
+		}
+		var ffmpegGroup FfmpegOutputGroup
+		switch aws.StringValue(settings.Type) {
+		case "HLS_GROUP_SETTINGS":
+			if settings.HlsGroupSettings == nil {
+				return nil, fmt.Errorf("output group %s has no HlsGroupSettings", name)
+			}
+			ffmpegGroup = FfmpegOutputGroup{
+				Type:          "HLS_GROUP",
+				Destination:   aws.StringValue(settings.HlsGroupSettings.Destination),
+				SegmentLength: aws.Int64Value(settings.HlsGroupSettings.SegmentLength),
+			}
+		case "DASH_ISO_GROUP_SETTINGS":
+			if settings.DashIsoGroupSettings == nil {
+				return nil, fmt.Errorf("output group %s has no DashIsoGroupSettings", name)
+			}
+			ffmpegGroup = FfmpegOutputGroup{
+				Type:          "DASH_ISO_GROUP",
+				Destination:   aws.StringValue(settings.DashIsoGroupSettings.Destination),
+				SegmentLength: aws.Int64Value(settings.DashIsoGroupSettings.SegmentLength),
+			}
+		case "FILE_GROUP_SETTINGS":
+			if settings.FileGroupSettings == nil {
+				return nil, fmt.Errorf("output group %s has no FileGroupSettings", name)
+			}
+			ffmpegGroup = FfmpegOutputGroup{
+				Type:        "FILE_GROUP",
+				Destination: aws.StringValue(settings.FileGroupSettings.Destination),
+			}
+		default:
+			slog.Warn("FFMPEG UNSUPPORTED OUTPUT GROUP", "type", aws.StringValue(settings.Type))
+			continue
+		}
+
+		for _, output := range group.Outputs {
+			ffmpegOutput, err := newFfmpegOutput(output)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			ffmpegGroup.Outputs = append(ffmpegGroup.Outputs, ffmpegOutput)
+		}
+		ffmpegJob.OutputGroups = append(ffmpegJob.OutputGroups, &ffmpegGroup)
+	}
+
+	if len(ffmpegJob.OutputGroups) == 0 {
+		return nil, ErrNoOutputGroups
+	}
+	return ffmpegJob, nil
+}
+
+func newFfmpegOutput(output *mediaconvert.Output) (*FfmpegOutput, error) {
+	if output.VideoDescription == nil && len(output.AudioDescriptions) == 0 {
+		// presets are stored in MediaConvert, not in the template
+		return nil, fmt.Errorf("output %s with preset %s: %w", aws.StringValue(output.NameModifier), aws.StringValue(output.Preset), ErrUnsupportedOutput)
+	}
+	ffmpegOutput := &FfmpegOutput{NameModifier: aws.StringValue(output.NameModifier)}
+
+	if video := output.VideoDescription; video != nil && video.CodecSettings != nil {
+		ffmpegOutput.Width = aws.Int64Value(video.Width)
+		ffmpegOutput.Height = aws.Int64Value(video.Height)
+
+		codec := video.CodecSettings
+		switch aws.StringValue(codec.Codec) {
+		case "H_264":
+			ffmpegOutput.VideoCodec = "libx264"
+			if codec.H264Settings != nil {
+				ffmpegOutput.VideoBitrate = bitrate(codec.H264Settings.MaxBitrate, codec.H264Settings.Bitrate)
+			}
+		case "H_265":
+			ffmpegOutput.VideoCodec = "libx265"
+			if codec.H265Settings != nil {
+				ffmpegOutput.VideoBitrate = bitrate(codec.H265Settings.MaxBitrate, codec.H265Settings.Bitrate)
+			}
+		case "FRAME_CAPTURE":
+			ffmpegOutput.FrameRate = "1/5"
+			if capture := codec.FrameCaptureSettings; capture != nil {
+				ffmpegOutput.FrameRate = fmt.Sprintf("%d/%d", aws.Int64Value(capture.FramerateNumerator), aws.Int64Value(capture.FramerateDenominator))
+			}
+		default:
+			return nil, fmt.Errorf("output %s with codec %s: %w", ffmpegOutput.NameModifier, aws.StringValue(codec.Codec), ErrUnsupportedOutput)
+		}
+	}
+
+	for _, audio := range output.AudioDescriptions {
+		if audio.CodecSettings != nil && audio.CodecSettings.AacSettings != nil {
+			ffmpegOutput.AudioBitrate = aws.Int64Value(audio.CodecSettings.AacSettings.Bitrate)
+			break
+		}
+	}
+	if ffmpegOutput.AudioBitrate == 0 && len(output.AudioDescriptions) > 0 {
+		ffmpegOutput.AudioBitrate = 96000
+	}
+	return ffmpegOutput, nil
+}
+
+// bitrate is the QVBR or CBR bitrate of a codec, whichever is set.
+func bitrate(maxBitrate *int64, bitrate *int64) int64 {
+	if aws.Int64Value(maxBitrate) > 0 {
+		return aws.Int64Value(maxBitrate)
+	}
+	return aws.Int64Value(bitrate)
+}
+
+// baseName is the name MediaConvert gives outputs before the name modifier,
+// the input file name without its extension.
+func (j *FfmpegJob) baseName() string {
+	name := path.Base(j.Input)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// FfmpegLocalRunner encodes the job in this process before CreateJob
+// returns. ffmpeg must be on the PATH, which it is not in the function's
+// image, so the function always starts a task and the local runner serves
+// tests and development hosts with ffmpeg installed.
+type FfmpegLocalRunner struct {
+	Worker *FfmpegWorker
+}
+
+func (r *FfmpegLocalRunner) Run(job *FfmpegJob) error {
+	return r.Worker.Run(job)
+}
+
+type ECSClient interface {
+	RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error)
+}
+
+// FfmpegTaskRunner starts a Fargate task that runs the encode image built
+// from Dockerfile.ffmpeg. A container override is limited to 8 KB, which a
+// job with a few dozen outputs passes, so the job is written to JobBucket
+// under <guid>/ffmpeg/<job id>.json and the task gets its s3:// reference in
+// its FfmpegJob environment variable.
+type FfmpegTaskRunner struct {
+	Client         ECSClient
+	S3Client       claimcheck.Writer
+	JobBucket      string
+	Cluster        string
+	TaskDefinition string
+	Container      string
+	Subnets        []string
+	SecurityGroups []string
+}
+
+func (r *FfmpegTaskRunner) Run(job *FfmpegJob) error {
+	jobJson, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	key := fmt.Sprintf("%s/ffmpeg/%s.json", job.UserMetadata["guid"], job.Id)
+	_, err = r.S3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(r.JobBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(jobJson),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("PutObject: %w", err)
+	}
+
+	data, err := r.Client.RunTask(&ecs.RunTaskInput{
+		Cluster:        aws.String(r.Cluster),
+		TaskDefinition: aws.String(r.TaskDefinition),
+		LaunchType:     aws.String(ecs.LaunchTypeFargate),
+		Count:          aws.Int64(1),
+		StartedBy:      aws.String(job.Id),
+		NetworkConfiguration: &ecs.NetworkConfiguration{
+			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+				Subnets:        aws.StringSlice(r.Subnets),
+				SecurityGroups: aws.StringSlice(r.SecurityGroups),
+			},
+		},
+		Overrides: &ecs.TaskOverride{
+			ContainerOverrides: []*ecs.ContainerOverride{{
+				Name: aws.String(r.Container),
+				Environment: []*ecs.KeyValuePair{{
+					Name:  aws.String("FfmpegJob"),
+					Value: aws.String(fmt.Sprintf("s3://%s/%s", r.JobBucket, key)),
+				}},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("RunTask: %w", err)
+	}
+	if len(data.Tasks) == 0 {
+		reasons := []string{}
+		for _, failure := range data.Failures {
+			reasons = append(reasons, aws.StringValue(failure.Reason))
+		}
+		return fmt.Errorf("%s: %w", strings.Join(reasons, ", "), ErrTaskNotStarted)
+	}
+	slog.Info("FFMPEG TASK", "taskArn", aws.StringValue(data.Tasks[0].TaskArn))
+	return nil
+}
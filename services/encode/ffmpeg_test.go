@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *S3ClientMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+type EventBridgeClientMock struct {
+	mock.Mock
+}
+
+func (m *EventBridgeClientMock) PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*eventbridge.PutEventsOutput), args.Error(1)
+}
+
+type ECSClientMock struct {
+	mock.Mock
+}
+
+func (m *ECSClientMock) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ecs.RunTaskOutput), args.Error(1)
+}
+
+// fakeFfmpeg stands in for ffmpeg and ffprobe: it writes the files an
+// ffmpeg command names and records the commands.
+type fakeFfmpeg struct {
+	commands [][]string
+	fail     bool
+}
+
+func (f *fakeFfmpeg) exec(_ context.Context, name string, args ...string) ([]byte, error) {
+	if name == "ffprobe" {
+		return []byte("12.5\n"), nil
+	}
+	f.commands = append(f.commands, args)
+	if f.fail {
+		return nil, assert.AnError
+	}
+
+	out := args[len(args)-1]
+	files := []string{out}
+	switch {
+	case strings.Contains(out, "%07d"):
+		files = []string{strings.Replace(out, "%07d", "0000000", 1), strings.Replace(out, "%07d", "0000001", 1)}
+	case strings.HasSuffix(out, ".m3u8"):
+		files = append(files, strings.TrimSuffix(out, ".m3u8")+"_00001.ts")
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte(name), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+const ffmpegTemplate = `{
+	"Name": "_Ott_720p_Avc_Aac_16x9_qvbr_no_preset",
+	"Settings": {
+		"OutputGroups": [
+			{
+				"Name": "Apple HLS",
+				"OutputGroupSettings": {"Type": "HLS_GROUP_SETTINGS", "HlsGroupSettings": {"SegmentLength": 3}},
+				"Outputs": [
+					{
+						"NameModifier": "_720p",
+						"ContainerSettings": {"Container": "M3U8"},
+						"VideoDescription": {"Width": 1280, "Height": 720, "CodecSettings": {"Codec": "H_264", "H264Settings": {"RateControlMode": "QVBR", "MaxBitrate": 6000000}}},
+						"AudioDescriptions": [{"CodecSettings": {"Codec": "AAC", "AacSettings": {"Bitrate": 96000}}}]
+					}
+				]
+			},
+			{
+				"Name": "File Group",
+				"OutputGroupSettings": {"Type": "FILE_GROUP_SETTINGS", "FileGroupSettings": {}},
+				"Outputs": [
+					{
+						"NameModifier": "_Mp4_720p",
+						"ContainerSettings": {"Container": "MP4"},
+						"VideoDescription": {"Width": 1280, "Height": 720, "CodecSettings": {"Codec": "H_264", "H264Settings": {"Bitrate": 4500000}}},
+						"AudioDescriptions": [{"CodecSettings": {"Codec": "AAC", "AacSettings": {"Bitrate": 128000}}}]
+					}
+				]
+			},
+			{
+				"Name": "CMAF",
+				"OutputGroupSettings": {"Type": "CMAF_GROUP_SETTINGS", "CmafGroupSettings": {}},
+				"Outputs": [{"NameModifier": "_cmaf", "Preset": "System-Ott_Cmaf"}]
+			}
+		]
+	}
+}`
+
+func TestFfmpegTranscoder(t *testing.T) {
+	templates := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(templates, "720p.json"), []byte(ffmpegTemplate), 0o644))
+
+	event := EncodeInput{
+		GUID:               "GUID",
+		WorkflowName:       "vod",
+		JobTemplate:        "vod_Ott_720p_Avc_Aac_16x9_qvbr_no_preset",
+		SrcVideo:           "uploads/video.mp4",
+		SrcBucket:          "src",
+		DestBucket:         "dest",
+		FrameCapture:       true,
+		FrameCaptureWidth:  1280,
+		FrameCaptureHeight: 720,
+	}
+
+	newHandler := func(ffmpeg *fakeFfmpeg) (*Handler, *S3ClientMock, *EventBridgeClientMock) {
+		s3ClientMock := new(S3ClientMock)
+		s3ClientMock.On("GetObject", mock.Anything).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("video"))}, nil)
+		s3ClientMock.On("PutObject", mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		eventBridgeClientMock.On("PutEvents", mock.Anything).Return(&eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil)
+
+		worker := &FfmpegWorker{
+			S3Client:          s3ClientMock,
+			EventBridgeClient: eventBridgeClientMock,
+			Exec:              ffmpeg.exec,
+			WorkDir:           t.TempDir(),
+		}
+		return &Handler{
+			Config:     Config{MediaConvertRole: "Role"},
+			S3Client:   s3ClientMock,
+			Transcoder: &FfmpegTranscoder{Templates: templates, Runner: &FfmpegLocalRunner{Worker: worker}},
+		}, s3ClientMock, eventBridgeClientMock
+	}
+
+	jobStateChange := func(t *testing.T, eventBridgeClientMock *EventBridgeClientMock) JobStateChange {
+		input := eventBridgeClientMock.Calls[0].Arguments.Get(0).(*eventbridge.PutEventsInput)
+		require.Len(t, input.Entries, 1)
+		assert.Equal(t, "vod.ffmpeg", aws.StringValue(input.Entries[0].Source))
+		assert.Equal(t, "MediaConvert Job State Change", aws.StringValue(input.Entries[0].DetailType))
+
+		var detail JobStateChange
+		require.NoError(t, json.Unmarshal([]byte(aws.StringValue(input.Entries[0].Detail)), &detail))
+		return detail
+	}
+
+	t.Run("should encode the job template's outputs and report them like MediaConvert", func(t *testing.T) {
+		ffmpeg := &fakeFfmpeg{}
+		handler, s3ClientMock, eventBridgeClientMock := newHandler(ffmpeg)
+
+		res, err := handler.HandleRequest(event)
+		require.NoError(t, err)
+		assert.Contains(t, res.EncodeJobId, "-ffmpeg")
+		assert.Equal(t, "Encoding", res.WorkflowStatus)
+
+		keys := []string{}
+		for _, call := range s3ClientMock.Calls {
+			if input, ok := call.Arguments.Get(0).(*s3.PutObjectInput); ok {
+				keys = append(keys, aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key))
+			}
+		}
+		sort.Strings(keys)
+		assert.Equal(t, []string{
+			"dest/GUID/hls/video.m3u8",
+			"dest/GUID/hls/video_720p.m3u8",
+			"dest/GUID/hls/video_720p_00001.ts",
+			"dest/GUID/mp4/video_Mp4_720p.mp4",
+			"dest/GUID/thumbnails/video_thumb.0000000.jpg",
+			"dest/GUID/thumbnails/video_thumb.0000001.jpg",
+		}, keys)
+
+		hls := ffmpeg.commands[0]
+		assert.Contains(t, strings.Join(hls, " "), "-c:v libx264 -vf scale=1280:720 -b:v 6000000 -maxrate 6000000 -bufsize 12000000 -c:a aac -b:a 96000 -f hls -hls_playlist_type vod -hls_time 3")
+		assert.Contains(t, strings.Join(ffmpeg.commands[2], " "), "-vf fps=1/5,scale=1280:720")
+
+		detail := jobStateChange(t, eventBridgeClientMock)
+		assert.Equal(t, "COMPLETE", detail.Status)
+		assert.Equal(t, res.EncodeJobId, detail.JobId)
+		assert.Equal(t, "GUID", detail.UserMetadata["guid"])
+		assert.Equal(t, "vod", detail.UserMetadata["workflow"])
+		assert.NotEmpty(t, detail.UserMetadata["submittedAt"])
+		require.Len(t, detail.OutputGroupDetails, 3)
+		assert.Equal(t, "HLS_GROUP", detail.OutputGroupDetails[0].Type)
+		assert.Equal(t, []string{"s3://dest/GUID/hls/video.m3u8"}, detail.OutputGroupDetails[0].PlaylistFilePaths)
+		assert.Equal(t, &OutputDetail{
+			OutputFilePaths: []string{"s3://dest/GUID/hls/video_720p.m3u8"},
+			DurationInMs:    12500,
+			VideoDetails:    &VideoDetail{WidthInPx: 1280, HeightInPx: 720, AverageBitrate: 6000000},
+		}, detail.OutputGroupDetails[0].OutputDetails[0])
+		assert.Equal(t, []string{"s3://dest/GUID/mp4/video_Mp4_720p.mp4"}, detail.OutputGroupDetails[1].OutputDetails[0].OutputFilePaths)
+		assert.Equal(t, []string{"s3://dest/GUID/thumbnails/video_thumb.0000001.jpg"}, detail.OutputGroupDetails[2].OutputDetails[0].OutputFilePaths)
+	})
+
+	t.Run("should report an ERROR event when ffmpeg fails", func(t *testing.T) {
+		handler, _, eventBridgeClientMock := newHandler(&fakeFfmpeg{fail: true})
+
+		_, err := handler.HandleRequest(event)
+		assert.ErrorIs(t, err, assert.AnError)
+
+		detail := jobStateChange(t, eventBridgeClientMock)
+		assert.Equal(t, "ERROR", detail.Status)
+		assert.EqualValues(t, ffmpegErrorCode, detail.ErrorCode)
+		assert.Equal(t, "GUID", detail.UserMetadata["guid"])
+	})
+
+	t.Run("should fail when the job template isn't found", func(t *testing.T) {
+		handler, _, _ := newHandler(&fakeFfmpeg{})
+		missing := event
+		missing.JobTemplate = "vod_Ott_2160p"
+
+		_, err := handler.HandleRequest(missing)
+		assert.ErrorIs(t, err, ErrTemplateNotFound)
+	})
+
+	t.Run("should fail outputs that use a preset", func(t *testing.T) {
+		_, err := newFfmpegJob("job", &mediaconvert.CreateJobInput{
+			Settings: &mediaconvert.JobSettings{
+				Inputs: []*mediaconvert.Input{{FileInput: aws.String("s3://src/video.mp4")}},
+				OutputGroups: []*mediaconvert.OutputGroup{{
+					Name: aws.String("File Group"),
+					OutputGroupSettings: &mediaconvert.OutputGroupSettings{
+						Type:              aws.String("FILE_GROUP_SETTINGS"),
+						FileGroupSettings: &mediaconvert.FileGroupSettings{Destination: aws.String("s3://dest/GUID/mp4/")},
+					},
+					Outputs: []*mediaconvert.Output{{Preset: aws.String("System-Generic_Hd_Mp4_Avc_Aac_16x9_1920x1080p_24Hz_6Mbps")}},
+				}},
+			},
+		})
+		assert.ErrorIs(t, err, ErrUnsupportedOutput)
+	})
+
+	t.Run("should fail output groups without their settings", func(t *testing.T) {
+		for _, settings := range []*mediaconvert.OutputGroupSettings{
+			nil,
+			{Type: aws.String("HLS_GROUP_SETTINGS")},
+			{Type: aws.String("DASH_ISO_GROUP_SETTINGS")},
+			{Type: aws.String("FILE_GROUP_SETTINGS")},
+		} {
+			_, err := newFfmpegJob("job", &mediaconvert.CreateJobInput{
+				Settings: &mediaconvert.JobSettings{
+					Inputs: []*mediaconvert.Input{{FileInput: aws.String("s3://src/video.mp4")}},
+					OutputGroups: []*mediaconvert.OutputGroup{{
+						Name:                aws.String("Group"),
+						OutputGroupSettings: settings,
+					}},
+				},
+			})
+			assert.ErrorContains(t, err, "output group Group has no")
+		}
+	})
+
+	t.Run("should start a task with the job", func(t *testing.T) {
+		ecsClientMock := new(ECSClientMock)
+		var input *ecs.RunTaskInput
+		ecsClientMock.On("RunTask", mock.Anything).Return(&ecs.RunTaskOutput{
+			Tasks: []*ecs.Task{{TaskArn: aws.String("arn:aws:ecs:us-east-1:123456789012:task/vod/1")}},
+		}, nil).Run(func(args mock.Arguments) {
+			input = args.Get(0).(*ecs.RunTaskInput)
+		})
+		s3ClientMock := new(S3ClientMock)
+		var object *s3.PutObjectInput
+		s3ClientMock.On("PutObject", mock.Anything).Return(&s3.PutObjectOutput{}, nil).Run(func(args mock.Arguments) {
+			object = args.Get(0).(*s3.PutObjectInput)
+		})
+		runner := &FfmpegTaskRunner{Client: ecsClientMock, S3Client: s3ClientMock, JobBucket: "state", Cluster: "vod", TaskDefinition: "vod-ffmpeg", Container: "ffmpeg", Subnets: []string{"subnet-1"}}
+
+		job := &FfmpegJob{Id: "job", Input: "s3://src/video.mp4", UserMetadata: map[string]string{"guid": "GUID"}}
+		require.NoError(t, runner.Run(job))
+		assert.Equal(t, "state", aws.StringValue(object.Bucket))
+		assert.Equal(t, "GUID/ffmpeg/job.json", aws.StringValue(object.Key))
+		body, err := io.ReadAll(object.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"id":"job","input":"s3://src/video.mp4","userMetadata":{"guid":"GUID"},"outputGroups":null}`, string(body))
+		override := input.Overrides.ContainerOverrides[0]
+		assert.Equal(t, "ffmpeg", aws.StringValue(override.Name))
+		assert.Equal(t, "FfmpegJob", aws.StringValue(override.Environment[0].Name))
+		assert.Equal(t, "s3://state/GUID/ffmpeg/job.json", aws.StringValue(override.Environment[0].Value))
+
+		ecsClientMock = new(ECSClientMock)
+		ecsClientMock.On("RunTask", mock.Anything).Return(&ecs.RunTaskOutput{
+			Failures: []*ecs.Failure{{Reason: aws.String("RESOURCE:MEMORY")}},
+		}, nil)
+		runner.Client = ecsClientMock
+		assert.ErrorIs(t, runner.Run(job), ErrTaskNotStarted)
+	})
+}
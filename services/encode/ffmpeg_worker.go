@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The ffmpeg worker reports a job the way MediaConvert does, so the
+// EncodeComplete and EncodeError rules and output-validate handle both the
+// same; only the source differs.
+const (
+	defaultFfmpegEventSource = "vod.ffmpeg"
+	jobStateChange           = "MediaConvert Job State Change"
+	// ffmpegErrorCode is reported for every failed job, as MediaConvert's
+	// error codes don't map to ffmpeg failures.
+	ffmpegErrorCode = 1999
+)
+
+// JobStateChange is the detail of a MediaConvert Job State Change event.
+type JobStateChange struct {
+	Timestamp          int64                `json:"timestamp"`
+	Queue              string               `json:"queue"`
+	JobId              string               `json:"jobId"`
+	Status             string               `json:"status"`
+	ErrorCode          int64                `json:"errorCode,omitempty"`
+	ErrorMessage       string               `json:"errorMessage,omitempty"`
+	UserMetadata       map[string]string    `json:"userMetadata"`
+	OutputGroupDetails []*OutputGroupDetail `json:"outputGroupDetails,omitempty"`
+}
+
+type OutputGroupDetail struct {
+	OutputDetails     []*OutputDetail `json:"outputDetails"`
+	PlaylistFilePaths []string        `json:"playlistFilePaths,omitempty"`
+	Type              string          `json:"type"`
+}
+
+type OutputDetail struct {
+	OutputFilePaths []string     `json:"outputFilePaths,omitempty"`
+	DurationInMs    int64        `json:"durationInMs"`
+	VideoDetails    *VideoDetail `json:"videoDetails,omitempty"`
+}
+
+type VideoDetail struct {
+	WidthInPx  int64 `json:"widthInPx"`
+	HeightInPx int64 `json:"heightInPx"`
+	// AverageBitrate is the target bitrate, in bits per second, which ffmpeg
+	// encodes to.
+	AverageBitrate int64 `json:"averageBitrate,omitempty"`
+}
+
+type FfmpegS3Client interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type EventBridgeClient interface {
+	PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error)
+}
+
+// FfmpegWorker encodes a job: it downloads the source, runs ffmpeg for each
+// output group, uploads what ffmpeg wrote to the group's destination and
+// puts the job state change event on the bus.
+type FfmpegWorker struct {
+	S3Client          FfmpegS3Client
+	EventBridgeClient EventBridgeClient
+	// Exec runs a command and returns its standard output; ffmpeg and
+	// ffprobe are run from the PATH when it is nil.
+	Exec func(ctx context.Context, name string, args ...string) ([]byte, error)
+	// WorkDir holds the source and outputs while the job runs, the system
+	// temporary directory when empty.
+	WorkDir string
+	// EventSource is the source of the job events, vod.ffmpeg when empty.
+	EventSource string
+}
+
+// Run encodes the job and reports its completion or failure. The event is
+// sent either way; the error is the job's or the event's.
+func (w *FfmpegWorker) Run(job *FfmpegJob) error {
+	detail, err := w.encode(context.Background(), job)
+	if err != nil {
+		slog.Error("FFMPEG FAILED", "jobId", job.Id, "error", err)
+		detail = &JobStateChange{
+			JobId:        job.Id,
+			Status:       "ERROR",
+			ErrorCode:    ffmpegErrorCode,
+			ErrorMessage: err.Error(),
+			UserMetadata: job.UserMetadata,
+		}
+	}
+	detail.Timestamp = time.Now().UnixMilli()
+	detail.Queue = "ffmpeg"
+
+	if putErr := w.putEvent(detail); putErr != nil {
+		return fmt.Errorf("putEvent: %w", putErr)
+	}
+	return err
+}
+
+func (w *FfmpegWorker) encode(ctx context.Context, job *FfmpegJob) (*JobStateChange, error) {
+	dir, err := os.MkdirTemp(w.WorkDir, job.Id)
+	if err != nil {
+		return nil, fmt.Errorf("MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input"+filepath.Ext(job.Input))
+	if err := w.download(job.Input, input); err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	durationInMs, err := w.duration(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("duration: %w", err)
+	}
+
+	detail := &JobStateChange{JobId: job.Id, Status: "COMPLETE", UserMetadata: job.UserMetadata}
+	base := job.baseName()
+	for i, group := range job.OutputGroups {
+		groupDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(groupDir, 0o755); err != nil {
+			return nil, fmt.Errorf("Mkdir: %w", err)
+		}
+
+		for _, args := range group.commands(input, groupDir, base) {
+			slog.Debug("FFMPEG", "command", strings.Join(args, " "))
+			if _, err := w.exec(ctx, "ffmpeg", args...); err != nil {
+				return nil, fmt.Errorf("ffmpeg: %w", err)
+			}
+		}
+		if group.Type == "HLS_GROUP" {
+			if err := os.WriteFile(filepath.Join(groupDir, base+".m3u8"), group.masterPlaylist(base), 0o644); err != nil {
+				return nil, fmt.Errorf("WriteFile: %w", err)
+			}
+		}
+
+		files, err := w.upload(groupDir, group.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("upload: %w", err)
+		}
+		detail.OutputGroupDetails = append(detail.OutputGroupDetails, group.detail(base, durationInMs, files))
+	}
+	return detail, nil
+}
+
+// commands returns the ffmpeg arguments that write the group's outputs to
+// dir: one run per output, except DASH where every output goes in one
+// manifest.
+func (g *FfmpegOutputGroup) commands(input string, dir string, base string) [][]string {
+	in := []string{"-hide_banner", "-y", "-i", input}
+
+	if g.Type == "DASH_ISO_GROUP" {
+		args := append([]string{}, in...)
+		var audioBitrate int64
+		n := 0
+		for _, output := range g.Outputs {
+			if output.AudioBitrate > audioBitrate {
+				audioBitrate = output.AudioBitrate
+			}
+			if output.VideoCodec == "" {
+				continue
+			}
+			args = append(args, "-map", "0:v:0", fmt.Sprintf("-c:v:%d", n), output.VideoCodec)
+			if output.VideoBitrate > 0 {
+				args = append(args, fmt.Sprintf("-b:v:%d", n), strconv.FormatInt(output.VideoBitrate, 10))
+			}
+			if output.Width > 0 && output.Height > 0 {
+				args = append(args, fmt.Sprintf("-s:v:%d", n), fmt.Sprintf("%dx%d", output.Width, output.Height))
+			}
+			n++
+		}
+		if audioBitrate > 0 {
+			args = append(args, "-map", "0:a:0?", "-c:a", "aac", "-b:a", strconv.FormatInt(audioBitrate, 10))
+		}
+		args = append(args, "-f", "dash", "-use_template", "1", "-use_timeline", "1")
+		if g.SegmentLength > 0 {
+			args = append(args, "-seg_duration", strconv.FormatInt(g.SegmentLength, 10))
+		}
+		args = append(args,
+			"-init_seg_name", base+"-init-$RepresentationID$.mp4",
+			"-media_seg_name", base+"-$RepresentationID$-$Number%05d$.mp4",
+			filepath.Join(dir, base+".mpd"))
+		return [][]string{args}
+	}
+
+	commands := [][]string{}
+	for _, output := range g.Outputs {
+		name := filepath.Join(dir, base+output.NameModifier)
+		args := append([]string{}, in...)
+
+		if output.FrameRate != "" {
+			filter := "fps=" + output.FrameRate
+			if scale := output.scale(); scale != "" {
+				filter += "," + scale
+			}
+			commands = append(commands, append(args, "-vf", filter, "-q:v", "3", "-start_number", "0", name+".%07d.jpg"))
+			continue
+		}
+
+		args = append(args, output.codecArgs()...)
+		switch g.Type {
+		case "HLS_GROUP":
+			args = append(args, "-f", "hls", "-hls_playlist_type", "vod")
+			if g.SegmentLength > 0 {
+				args = append(args, "-hls_time", strconv.FormatInt(g.SegmentLength, 10))
+			}
+			args = append(args, "-hls_segment_filename", name+"_%05d.ts", name+".m3u8")
+		default:
+			args = append(args, "-movflags", "+faststart", name+".mp4")
+		}
+		commands = append(commands, args)
+	}
+	return commands
+}
+
+func (o *FfmpegOutput) scale() string {
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		return fmt.Sprintf("scale=%d:%d", o.Width, o.Height)
+	case o.Width > 0:
+		return fmt.Sprintf("scale=%d:-2", o.Width)
+	case o.Height > 0:
+		return fmt.Sprintf("scale=-2:%d", o.Height)
+	}
+	return ""
+}
+
+func (o *FfmpegOutput) codecArgs() []string {
+	args := []string{"-vn"}
+	if o.VideoCodec != "" {
+		args = []string{"-c:v", o.VideoCodec}
+		if scale := o.scale(); scale != "" {
+			args = append(args, "-vf", scale)
+		}
+		if o.VideoBitrate > 0 {
+			rate := strconv.FormatInt(o.VideoBitrate, 10)
+			args = append(args, "-b:v", rate, "-maxrate", rate, "-bufsize", strconv.FormatInt(2*o.VideoBitrate, 10))
+		}
+	}
+	if o.AudioBitrate > 0 {
+		return append(args, "-c:a", "aac", "-b:a", strconv.FormatInt(o.AudioBitrate, 10))
+	}
+	return append(args, "-an")
+}
+
+// masterPlaylist lists the group's variant playlists, which ffmpeg writes
+// one at a time.
+func (g *FfmpegOutputGroup) masterPlaylist(base string) []byte {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, output := range g.Outputs {
+		if output.FrameRate != "" {
+			continue
+		}
+		playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", output.VideoBitrate+output.AudioBitrate))
+		if output.Width > 0 && output.Height > 0 {
+			playlist.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", output.Width, output.Height))
+		}
+		playlist.WriteString("\n" + base + output.NameModifier + ".m3u8\n")
+	}
+	return []byte(playlist.String())
+}
+
+// detail is the group's entry in the completion event, with the s3:// paths
+// of the uploaded files.
+func (g *FfmpegOutputGroup) detail(base string, durationInMs int64, files []string) *OutputGroupDetail {
+	detail := &OutputGroupDetail{Type: g.Type, OutputDetails: []*OutputDetail{}}
+	switch g.Type {
+	case "HLS_GROUP":
+		detail.PlaylistFilePaths = []string{g.Destination + base + ".m3u8"}
+	case "DASH_ISO_GROUP":
+		detail.PlaylistFilePaths = []string{g.Destination + base + ".mpd"}
+	}
+
+	for _, output := range g.Outputs {
+		outputDetail := &OutputDetail{DurationInMs: durationInMs}
+		if output.VideoCodec != "" {
+			outputDetail.VideoDetails = &VideoDetail{WidthInPx: output.Width, HeightInPx: output.Height, AverageBitrate: output.VideoBitrate}
+		}
+
+		name := g.Destination + base + output.NameModifier
+		switch {
+		case output.FrameRate != "":
+			// MediaConvert reports the last capture
+			for _, file := range files {
+				if strings.HasPrefix(file, name+".") && strings.HasSuffix(file, ".jpg") {
+					outputDetail.OutputFilePaths = []string{file}
+				}
+			}
+		case g.Type == "HLS_GROUP":
+			outputDetail.OutputFilePaths = []string{name + ".m3u8"}
+		case g.Type == "FILE_GROUP":
+			outputDetail.OutputFilePaths = []string{name + ".mp4"}
+		}
+		detail.OutputDetails = append(detail.OutputDetails, outputDetail)
+	}
+	return detail
+}
+
+func (w *FfmpegWorker) exec(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if w.Exec != nil {
+		return w.Exec(ctx, name, args...)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// duration is the source's duration in milliseconds as ffprobe reads it.
+func (w *FfmpegWorker) duration(ctx context.Context, input string) (int64, error) {
+	output, err := w.exec(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %w", err)
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ParseFloat: %w", err)
+	}
+	return int64(seconds * 1000), nil
+}
+
+func (w *FfmpegWorker) download(source string, file string) error {
+	bucket, key, err := splitS3Url(source)
+	if err != nil {
+		return err
+	}
+	data, err := w.S3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("GetObject: %w", err)
+	}
+	defer data.Body.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("Create: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, data.Body); err != nil {
+		return fmt.Errorf("Copy: %w", err)
+	}
+	return nil
+}
+
+// upload puts every file in dir under destination and returns their s3://
+// paths in name order.
+func (w *FfmpegWorker) upload(dir string, destination string) ([]string, error) {
+	bucket, prefix, err := splitS3Url(destination)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ReadDir: %w", err)
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Open: %w", err)
+		}
+		_, err = w.S3Client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(prefix + entry.Name()),
+			Body:        f,
+			ContentType: aws.String(contentType(entry.Name())),
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("PutObject: %w", err)
+		}
+		files = append(files, fmt.Sprintf("s3://%s/%s%s", bucket, prefix, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func contentType(name string) string {
+	switch filepath.Ext(name) {
+	case ".m3u8":
+		return "application/x-mpegURL"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".ts":
+		return "video/MP2T"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (w *FfmpegWorker) putEvent(detail *JobStateChange) error {
+	detailJson, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	source := w.EventSource
+	if source == "" {
+		source = defaultFfmpegEventSource
+	}
+
+	data, err := w.EventBridgeClient.PutEvents(&eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			Source:     aws.String(source),
+			DetailType: aws.String(jobStateChange),
+			Detail:     aws.String(string(detailJson)),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("PutEvents: %w", err)
+	}
+	if aws.Int64Value(data.FailedEntryCount) > 0 {
+		entry := data.Entries[0]
+		return fmt.Errorf("PutEvents: %s: %s", aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+	}
+	slog.Info("FFMPEG EVENT", "jobId", detail.JobId, "status", detail.Status)
+	return nil
+}
+
+// splitS3Url splits s3://bucket/key into its bucket and key.
+func splitS3Url(url string) (string, string, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(url, "s3://"), "/")
+	if !strings.HasPrefix(url, "s3://") || !ok || bucket == "" {
+		return "", "", fmt.Errorf("%q is not an s3:// url", url)
+	}
+	return bucket, key, nil
+}
@@ -7,6 +7,7 @@ require (
 	github.com/aws/aws-lambda-go v1.47.0
 	github.com/aws/aws-sdk-go v1.55.6
 	github.com/stretchr/testify v1.7.2
+	shared v0.0.0
 )
 
 require (
@@ -16,3 +17,5 @@ require (
 	github.com/stretchr/objx v0.1.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace shared => ../shared
@@ -1,18 +1,29 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"time"
 
 	"dario.cat/mergo"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/claimcheck"
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "encode"
+
 type EncodeInput struct {
 	GUID                   string `json:"guid"`
 	StartTime              string `json:"startTime"`
@@ -41,6 +52,7 @@ type EncodeInput struct {
 	FrameCaptureWidth      int    `json:"frameCaptureWidth"`
 	JobTemplate            string `json:"jobTemplate"`
 	IsCustomTemplate       bool   `json:"isCustomTemplate"`
+	Version                int64  `json:"version,omitempty"`
 }
 
 type EncodeResponse struct {
@@ -71,7 +83,9 @@ type EncodeResponse struct {
 	FrameCaptureWidth      int                         `json:"frameCaptureWidth"`
 	JobTemplate            string                      `json:"jobTemplate"`
 	IsCustomTemplate       bool                        `json:"isCustomTemplate"`
+	Version                int64                       `json:"version,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 }
 
@@ -80,27 +94,60 @@ type MediaConvertClient interface {
 	CreateJob(input *mediaconvert.CreateJobInput) (*mediaconvert.CreateJobOutput, error)
 }
 
+type S3Client interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+	claimcheck.ClaimCheckConfig
+
+	MediaConvertRole string `env:"MediaConvertRole" requiredIf:"Transcoder=MEDIACONVERT"`
+	Transcoder       string `env:"Transcoder" default:"MEDIACONVERT" enum:"MEDIACONVERT,FFMPEG"`
+	FfmpegTemplates  string `env:"FfmpegTemplates"`
+	// FfmpegCluster runs ffmpeg in Fargate tasks, which are handed their job
+	// through FfmpegJobBucket. The function's image has no ffmpeg to run it
+	// itself.
+	FfmpegCluster        string   `env:"FfmpegCluster" requiredIf:"Transcoder=FFMPEG"`
+	FfmpegJobBucket      string   `env:"FfmpegJobBucket" requiredIf:"FfmpegCluster"`
+	FfmpegTaskDefinition string   `env:"FfmpegTaskDefinition"`
+	FfmpegContainer      string   `env:"FfmpegContainer"`
+	FfmpegSubnets        []string `env:"FfmpegSubnets"`
+	FfmpegSecurityGroups []string `env:"FfmpegSecurityGroups"`
+	FfmpegEventSource    string   `env:"FfmpegEventSource" default:"vod.ffmpeg"`
+}
+
+// TaskConfig is read by the ffmpeg task, which is started with the s3://
+// reference of the job to run in FfmpegJob.
+type TaskConfig struct {
+	logging.LogConfig
+
+	FfmpegJob         string `env:"FfmpegJob"`
+	FfmpegEventSource string `env:"FfmpegEventSource" default:"vod.ffmpeg"`
+}
+
 type Handler struct {
+	Config             Config
 	MediaConvertClient MediaConvertClient
+	S3Client           S3Client
+	// Transcoder overrides the backend jobs are submitted to, MediaConvert
+	// through MediaConvertClient by default.
+	Transcoder Transcoder
 }
 
 func (h *Handler) HandleRequest(event EncodeInput) (*EncodeResponse, error) {
-	eventJson, err := json.Marshal(event)
-	if err != nil {
-		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: json.Marshal: %w", err)
-	}
-	log.Printf("REQUEST:: %s", eventJson)
-
 	inputPath := fmt.Sprintf("s3://%s/%s", event.SrcBucket, event.SrcVideo)
 	outputPath := fmt.Sprintf("s3://%s/%s", event.DestBucket, event.GUID)
 
 	// init job to create
 	job := mediaconvert.CreateJobInput{
 		JobTemplate: &event.JobTemplate,
-		Role:        aws.String(os.Getenv("MediaConvertRole")),
+		Role:        aws.String(h.Config.MediaConvertRole),
 		UserMetadata: map[string]*string{
 			"guid":     aws.String(event.GUID),
 			"workflow": aws.String(event.WorkflowName),
+			// output-validate times the transcode from it
+			"submittedAt": aws.String(time.Now().UTC().Format(time.RFC3339)),
 		},
 		Settings: &mediaconvert.JobSettings{
 			Inputs: []*mediaconvert.Input{
@@ -136,19 +183,14 @@ func (h *Handler) HandleRequest(event EncodeInput) (*EncodeResponse, error) {
 	mssGroup := getMssGroup(outputPath)
 	frameCaptureGroup := getFrameGroup(event, outputPath)
 
-	template, err := h.MediaConvertClient.GetJobTemplate(&mediaconvert.GetJobTemplateInput{
-		Name: aws.String(event.JobTemplate),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: GetJobTemplate: %w", err)
-	}
-	templateJson, err := json.Marshal(template)
+	transcoder := h.transcoder()
+	template, err := transcoder.GetJobTemplate(event.JobTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: json.Marshal: %w", err)
+		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: %w", err)
 	}
-	log.Printf("TEMPLATE:: %s", templateJson)
+	slog.Debug("TEMPLATE", "template", template)
 
-	for _, group := range template.JobTemplate.Settings.OutputGroups {
+	for _, group := range template.Settings.OutputGroups {
 		found := false
 		var defaultGroup *mediaconvert.OutputGroup
 		switch *group.OutputGroupSettings.Type {
@@ -170,7 +212,7 @@ func (h *Handler) HandleRequest(event EncodeInput) (*EncodeResponse, error) {
 		}
 
 		if found {
-			log.Printf("%s found in Job Template", *defaultGroup.Name)
+			slog.Debug("OUTPUT GROUP", "name", *defaultGroup.Name)
 			outputGroup := defaultGroup
 			err := mergo.MergeWithOverwrite(outputGroup, group)
 			if err != nil {
@@ -194,22 +236,26 @@ func (h *Handler) HandleRequest(event EncodeInput) (*EncodeResponse, error) {
 		job.Settings.Inputs[0].TimecodeSource = aws.String("ZEROBASED")
 	}
 
-	data, err := h.MediaConvertClient.CreateJob(&job)
+	jobId, err := transcoder.CreateJob(&job)
 	if err != nil {
-		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: CreateJob: %w", err)
+		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: %w", err)
 	}
+	slog.Info("JOB", "jobId", jobId)
 
-	dataJson, err := json.Marshal(data)
+	encodingJobRef, err := h.Config.Offload(h.S3Client, event.GUID, "encodingJob", job)
 	if err != nil {
-		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: json.Marshal: %w", err)
+		return nil, fmt.Errorf("encode: main.Handler.HandleRequest: Offload: %w", err)
+	}
+	if encodingJobRef != nil {
+		slog.Info("ENCODING JOB OFFLOADED", "ref", *encodingJobRef)
+		job = mediaconvert.CreateJobInput{}
 	}
-	log.Printf("JOB:: %s", dataJson)
 
 	EncodeReponse := EncodeResponse{
 		GUID:                   event.GUID,
 		StartTime:              event.StartTime,
 		WorkflowTrigger:        event.WorkflowTrigger,
-		WorkflowStatus:         event.WorkflowStatus,
+		WorkflowStatus:         "Encoding",
 		WorkflowName:           event.WorkflowName,
 		SrcBucket:              event.SrcBucket,
 		DestBucket:             event.DestBucket,
@@ -234,7 +280,9 @@ func (h *Handler) HandleRequest(event EncodeInput) (*EncodeResponse, error) {
 		JobTemplate:            event.JobTemplate,
 		IsCustomTemplate:       event.IsCustomTemplate,
 		EncodingJob:            job,
-		EncodeJobId:            *data.Job.Id,
+		EncodingJobRef:         encodingJobRef,
+		EncodeJobId:            jobId,
+		Version:                event.Version,
 	}
 
 	return &EncodeReponse, nil
@@ -357,6 +405,8 @@ func getFrameGroup(event EncodeInput, ouputPath string) *mediaconvert.OutputGrou
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(
 		&aws.Config{
 			Region: aws.String(os.Getenv("AWS_REGION")),
@@ -366,11 +416,60 @@ func main() {
 		log.Fatalf("encode: main: session.NewSession: %v", err)
 	}
 
+	// the ffmpeg task runs the job it was started with and exits
+	var taskConfig TaskConfig
+	if err := envconfig.Load(&taskConfig, ssm.New(sess)); err != nil {
+		log.Fatalf("encode: main: envconfig.Load: %v", err)
+	}
+	if taskConfig.FfmpegJob != "" {
+		logging.SetLevel(taskConfig.LogLevel)
+		s3Client := s3.New(sess)
+		var job FfmpegJob
+		if err := claimcheck.Load(s3Client, taskConfig.FfmpegJob, &job); err != nil {
+			log.Fatalf("encode: main: claimcheck.Load: %v", err)
+		}
+		worker := &FfmpegWorker{
+			S3Client:          s3Client,
+			EventBridgeClient: eventbridge.New(sess),
+			EventSource:       taskConfig.FfmpegEventSource,
+		}
+		slog.SetDefault(slog.Default().With("jobId", job.Id, "guid", job.UserMetadata["guid"], "workflowName", job.UserMetadata["workflow"]))
+		if err := worker.Run(&job); err != nil {
+			log.Fatalf("encode: main: FfmpegWorker.Run: %v", err)
+		}
+		return
+	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("encode: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	mediaConvertClient := mediaconvert.New(sess)
+	s3Client := s3.New(sess)
 
 	handler := Handler{
+		Config:             config,
 		MediaConvertClient: mediaConvertClient,
+		S3Client:           s3Client,
+	}
+
+	if config.Transcoder == TranscoderFfmpeg {
+		handler.Transcoder = &FfmpegTranscoder{
+			Templates: config.FfmpegTemplates,
+			Runner: &FfmpegTaskRunner{
+				Client:         ecs.New(sess),
+				S3Client:       s3Client,
+				JobBucket:      config.FfmpegJobBucket,
+				Cluster:        config.FfmpegCluster,
+				TaskDefinition: config.FfmpegTaskDefinition,
+				Container:      config.FfmpegContainer,
+				Subnets:        config.FfmpegSubnets,
+				SecurityGroups: config.FfmpegSecurityGroups,
+			},
+		}
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
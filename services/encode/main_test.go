@@ -7,8 +7,11 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+
+	"shared/claimcheck"
 )
 
 type MediaConvertClientMock struct {
@@ -31,8 +34,19 @@ func (m *MediaConvertClientMock) GetJobTemplate(input *mediaconvert.GetJobTempla
 	return args.Get(0).(*mediaconvert.GetJobTemplateOutput), args.Error(1)
 }
 
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
 func TestEncode(t *testing.T) {
-	os.Setenv("MediaConvertRole", "Role")
 	os.Setenv("Workflow", "vod")
 
 	t.Run("should success when FrameCapture is disabled", func(t *testing.T) {
@@ -68,6 +82,7 @@ func TestEncode(t *testing.T) {
 
 		mediaConvertClientMock := new(MediaConvertClientMock)
 		handler := Handler{
+			Config:             Config{MediaConvertRole: "Role"},
 			MediaConvertClient: mediaConvertClientMock,
 		}
 
@@ -80,6 +95,7 @@ func TestEncode(t *testing.T) {
 		}
 		assert.Equal(t, "12345", res.EncodeJobId)
 		assert.Equal(t, "HLS_GROUP_SETTINGS", *res.EncodingJob.Settings.OutputGroups[0].OutputGroupSettings.Type)
+		assert.Equal(t, "Encoding", res.WorkflowStatus)
 	})
 	t.Run("should succeed when FrameCapture is enabled", func(t *testing.T) {
 		template := mediaconvert.GetJobTemplateOutput{
@@ -115,6 +131,7 @@ func TestEncode(t *testing.T) {
 
 		mediaConvertClientMock := new(MediaConvertClientMock)
 		handler := Handler{
+			Config:             Config{MediaConvertRole: "Role"},
 			MediaConvertClient: mediaConvertClientMock,
 		}
 
@@ -168,6 +185,7 @@ func TestEncode(t *testing.T) {
 		}
 		mediaConvertClientMock := new(MediaConvertClientMock)
 		handler := Handler{
+			Config:             Config{MediaConvertRole: "Role"},
 			MediaConvertClient: mediaConvertClientMock,
 		}
 
@@ -200,6 +218,7 @@ func TestEncode(t *testing.T) {
 
 		mediaConvertClientMock := new(MediaConvertClientMock)
 		handler := Handler{
+			Config:             Config{MediaConvertRole: "Role"},
 			MediaConvertClient: mediaConvertClientMock,
 		}
 		mediaConvertClientMock.On("GetJobTemplate", mock.Anything).Return(nil, assert.AnError)
@@ -235,6 +254,7 @@ func TestEncode(t *testing.T) {
 
 		mediaConvertClientMock := new(MediaConvertClientMock)
 		handler := Handler{
+			Config:             Config{MediaConvertRole: "Role"},
 			MediaConvertClient: mediaConvertClientMock,
 		}
 
@@ -244,4 +264,59 @@ func TestEncode(t *testing.T) {
 		_, err := handler.HandleRequest(event)
 		assert.Error(t, err)
 	})
+
+	t.Run("should offload encodingJob to the StateBucket when it exceeds the threshold", func(t *testing.T) {
+		template := mediaconvert.GetJobTemplateOutput{
+			JobTemplate: &mediaconvert.JobTemplate{
+				Settings: &mediaconvert.JobTemplateSettings{
+					OutputGroups: []*mediaconvert.OutputGroup{
+						{
+							OutputGroupSettings: &mediaconvert.OutputGroupSettings{
+								Type: aws.String("HLS_GROUP_SETTINGS"),
+							},
+							Name: aws.String("test-output-group"),
+						},
+					},
+				},
+			},
+		}
+
+		data := mediaconvert.CreateJobOutput{
+			Job: &mediaconvert.Job{
+				Id: aws.String("12345"),
+			},
+		}
+
+		event := EncodeInput{
+			GUID:                   "GUID",
+			JobTemplate:            "JobTemplate",
+			SrcVideo:               "video.mp4",
+			SrcBucket:              "src",
+			DestBucket:             "dest",
+			AcceleratedTranscoding: "DISABLED",
+		}
+
+		mediaConvertClientMock := new(MediaConvertClientMock)
+		s3ClientMock := new(S3ClientMock)
+		handler := Handler{
+			Config: Config{
+				MediaConvertRole: "Role",
+				ClaimCheckConfig: claimcheck.ClaimCheckConfig{StateBucket: "vod-state", ClaimCheckThreshold: 10},
+			},
+			MediaConvertClient: mediaConvertClientMock,
+			S3Client:           s3ClientMock,
+		}
+
+		mediaConvertClientMock.On("GetJobTemplate", mock.Anything).Return(&template, nil)
+		mediaConvertClientMock.On("CreateJob", mock.Anything).Return(&data, nil)
+		s3ClientMock.On("PutObject", mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+			return *input.Bucket == "vod-state" && *input.Key == "GUID/state/encodingJob.json"
+		})).Return(&s3.PutObjectOutput{}, nil)
+
+		res, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Equal(t, "s3://vod-state/GUID/state/encodingJob.json", *res.EncodingJobRef)
+		assert.Nil(t, res.EncodingJob.Settings)
+		s3ClientMock.AssertExpectations(t)
+	})
 }
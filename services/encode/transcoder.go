@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+)
+
+// The Transcoder setting picks the backend encode submits jobs to. The job
+// is built from the job template the same way for every backend; each one
+// reports completion with a MediaConvert Job State Change event that
+// output-validate reads.
+const (
+	TranscoderMediaConvert = "MEDIACONVERT"
+	TranscoderFfmpeg       = "FFMPEG"
+)
+
+// Transcoder resolves job templates and submits encoding jobs.
+type Transcoder interface {
+	GetJobTemplate(name string) (*mediaconvert.JobTemplate, error)
+	// CreateJob submits the job and returns its id.
+	CreateJob(job *mediaconvert.CreateJobInput) (string, error)
+}
+
+// MediaConvertTranscoder submits jobs to AWS Elemental MediaConvert.
+type MediaConvertTranscoder struct {
+	Client MediaConvertClient
+}
+
+func (t *MediaConvertTranscoder) GetJobTemplate(name string) (*mediaconvert.JobTemplate, error) {
+	data, err := t.Client.GetJobTemplate(&mediaconvert.GetJobTemplateInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetJobTemplate: %w", err)
+	}
+	return data.JobTemplate, nil
+}
+
+func (t *MediaConvertTranscoder) CreateJob(job *mediaconvert.CreateJobInput) (string, error) {
+	data, err := t.Client.CreateJob(job)
+	if err != nil {
+		return "", fmt.Errorf("CreateJob: %w", err)
+	}
+	return aws.StringValue(data.Job.Id), nil
+}
+
+// transcoder is the configured backend, MediaConvert when none is set.
+func (h *Handler) transcoder() Transcoder {
+	if h.Transcoder != nil {
+		return h.Transcoder
+	}
+	return &MediaConvertTranscoder{Client: h.MediaConvertClient}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// An upload names its own webhook endpoint as x-amz-meta-callback-url, and
+// webhook-notification POSTs to it from inside the account. Anyone who can
+// upload could otherwise point it at the instance metadata service or
+// another internal host, so only https URLs of public hosts are stored.
+var (
+	ErrCallbackScheme  = errors.New("callback url must be https")
+	ErrCallbackAddress = errors.New("callback url host is not a public address")
+)
+
+// Resolver looks up the addresses of a callback host; *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// callbackUrl returns the webhook endpoint set on the upload as
+// x-amz-meta-callback-url, or "" when it is missing, not an https URL or
+// its host is not public.
+func (h *Handler) callbackUrl(object *s3.HeadObjectOutput) string {
+	value := aws.StringValue(object.Metadata[callbackUrlMetadataKey])
+	if value == "" {
+		return ""
+	}
+
+	if err := h.checkCallbackUrl(value); err != nil {
+		slog.Warn("INVALID CALLBACK URL", "callbackUrl", value, "error", err)
+		return ""
+	}
+
+	return value
+}
+
+// checkCallbackUrl returns an error unless value is an https URL whose host
+// is, or only resolves to, public addresses.
+func (h *Handler) checkCallbackUrl(value string) error {
+	callback, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("url.Parse: %w", err)
+	}
+	if callback.Scheme != "https" {
+		return ErrCallbackScheme
+	}
+	host := callback.Hostname()
+	if host == "" {
+		return fmt.Errorf("no host: %w", ErrCallbackAddress)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = h.Resolver.LookupIP(context.Background(), "ip", host)
+		if err != nil {
+			return fmt.Errorf("LookupIP: %w", err)
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("%s has no addresses: %w", host, ErrCallbackAddress)
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("%s is %s: %w", host, ip, ErrCallbackAddress)
+		}
+	}
+
+	return nil
+}
+
+// publicIP reports whether ip is outside the loopback, private, link-local,
+// multicast and unspecified ranges.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Uploads are fingerprinted so that the same content uploaded under another
+// key is recognised. Single-part uploads use their ETag, which is the MD5 of
+// the content; multipart ETags are not, so those uploads must carry a SHA-256
+// of the content as x-amz-meta-sha256 object metadata to be fingerprinted.
+// What happens to a duplicate is decided by DuplicatePolicy:
+//
+//	PROCEED        ingest the upload as a new asset, recording duplicateOf
+//	LINK           add the key to the linkedSources of the existing asset
+//	               and stop the workflow
+//	SHORT_CIRCUIT  record the upload as a Duplicate of the existing asset
+//	               and stop the workflow
+//
+// The stack always sets DuplicatePolicy, to PROCEED by default, so deployed
+// functions fingerprint every upload. Detection is off only when the
+// function runs without it, as in its unit tests.
+const (
+	DuplicatePolicyProceed      = "PROCEED"
+	DuplicatePolicyLink         = "LINK"
+	DuplicatePolicyShortCircuit = "SHORT_CIRCUIT"
+
+	contentHashIndex = "contentHash-startTime-index"
+
+	sha256MetadataKey = "Sha256"
+)
+
+// checkDuplicate fingerprints the source video and applies DuplicatePolicy
+// when an earlier asset has the same content.
+func (h *Handler) checkDuplicate(data *InputValidateData, object *s3.HeadObjectOutput) error {
+	policy := h.Config.DuplicatePolicy
+	if policy == "" {
+		return nil
+	}
+
+	contentHash := contentHash(object)
+	if contentHash == "" {
+		slog.Info("DUPLICATE CHECK SKIPPED", "srcVideo", data.SrcVideo, "reason", "no fingerprint")
+		return nil
+	}
+	data.ContentHash = contentHash
+
+	original, err := h.findOriginal(contentHash, data.GUID)
+	if err != nil {
+		return err
+	}
+	if original == "" {
+		return nil
+	}
+	data.DuplicateOf = original
+
+	switch policy {
+	case DuplicatePolicyLink:
+		if err := h.linkSource(original, data.SrcBucket, data.SrcVideo); err != nil {
+			return err
+		}
+	case DuplicatePolicyShortCircuit:
+		data.WorkflowStatus = "Duplicate"
+	default:
+		policy = DuplicatePolicyProceed
+	}
+	data.DuplicateAction = policy
+	slog.Info("DUPLICATE", "srcVideo", data.SrcVideo, "original", original, "policy", policy)
+
+	return nil
+}
+
+// contentHash returns the fingerprint of the object, or "" when it has none.
+func contentHash(object *s3.HeadObjectOutput) string {
+	etag := strings.Trim(aws.StringValue(object.ETag), `"`)
+	if etag != "" && !strings.Contains(etag, "-") {
+		return "md5:" + strings.ToLower(etag)
+	}
+	if sha := aws.StringValue(object.Metadata[sha256MetadataKey]); sha != "" {
+		return "sha256:" + strings.ToLower(sha)
+	}
+
+	return ""
+}
+
+// findOriginal returns the guid of the earliest other asset with the given
+// fingerprint, or "" when there is none. Assets that were themselves
+// recorded as duplicates are skipped.
+func (h *Handler) findOriginal(contentHash, guid string) (string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(contentHashIndex),
+		KeyConditionExpression: aws.String("#contentHash = :contentHash"),
+		FilterExpression:       aws.String("#guid <> :guid AND #workflowStatus <> :duplicate"),
+		ExpressionAttributeNames: map[string]*string{
+			"#contentHash":    aws.String("contentHash"),
+			"#guid":           aws.String("guid"),
+			"#workflowStatus": aws.String("workflowStatus"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":contentHash": {S: aws.String(contentHash)},
+			":guid":        {S: aws.String(guid)},
+			":duplicate":   {S: aws.String("Duplicate")},
+		},
+		ScanIndexForward: aws.Bool(true),
+	}
+
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return "", fmt.Errorf("Query: %w", err)
+		}
+		for _, item := range data.Items {
+			if item["guid"] != nil && item["guid"].S != nil {
+				return *item["guid"].S, nil
+			}
+		}
+
+		if len(data.LastEvaluatedKey) == 0 {
+			return "", nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+// linkSource appends the source to the linkedSources of the asset.
+func (h *Handler) linkSource(guid, bucket, key string) error {
+	_, err := h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		UpdateExpression:    aws.String("SET #linkedSources = list_append(if_not_exists(#linkedSources, :empty), :source)"),
+		ConditionExpression: aws.String("attribute_exists(#guid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":          aws.String("guid"),
+			"#linkedSources": aws.String("linkedSources"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":empty": {L: []*dynamodb.AttributeValue{}},
+			":source": {L: []*dynamodb.AttributeValue{{M: map[string]*dynamodb.AttributeValue{
+				"bucket":   {S: aws.String(bucket)},
+				"key":      {S: aws.String(key)},
+				"linkedAt": {S: aws.String(time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))},
+			}}}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+
+	return nil
+}
@@ -1,20 +1,38 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "input-validate"
+
+// HeadObject returns metadata keys in canonical header form
+const (
+	callbackUrlMetadataKey = "Callback-Url"
+	tagsMetadataKey        = "Tags"
 )
 
 var (
 	ErrEventWorkflowTriggerNotDefined = errors.New("event.workflowTrigger is not defined")
+	ErrEventRecordCount               = errors.New("event must carry exactly one S3 record")
 )
 
 // InputValidateEvent represents the input event structure
@@ -25,73 +43,182 @@ type InputValidateEvent struct {
 }
 
 type InputValidateData struct {
-	GUID                   string `json:"guid"`
-	StartTime              string `json:"startTime"`
-	WorkflowTrigger        string `json:"workflowTrigger"`
-	WorkflowStatus         string `json:"workflowStatus"`
-	WorkflowName           string `json:"workflowName"`
-	SrcBucket              string `json:"srcBucket"`
-	DestBucket             string `json:"destBucket"`
-	CloudFront             string `json:"cloudFront"`
-	FrameCapture           bool   `json:"frameCapture"`
-	ArchiveSource          string `json:"archiveSource"`
-	JobTemplate2160p       string `json:"jobTemplate_2160p"`
-	JobTemplate1080p       string `json:"jobTemplate_1080p"`
-	JobTemplate720p        string `json:"jobTemplate_720p"`
-	InputRotate            string `json:"inputRotate"`
-	AcceleratedTranscoding string `json:"acceleratedTranscoding"`
-	EnableSns              bool   `json:"enableSns"`
-	EnableSqs              bool   `json:"enableSqs"`
-	SrcVideo               string `json:"srcVideo"`
-	EnableMediaPackage     bool   `json:"enableMediaPackage"`
+	GUID                   string            `json:"guid"`
+	StartTime              string            `json:"startTime"`
+	WorkflowTrigger        string            `json:"workflowTrigger"`
+	WorkflowStatus         string            `json:"workflowStatus"`
+	WorkflowName           string            `json:"workflowName"`
+	SrcBucket              string            `json:"srcBucket"`
+	DestBucket             string            `json:"destBucket"`
+	CloudFront             string            `json:"cloudFront"`
+	FrameCapture           bool              `json:"frameCapture"`
+	ArchiveSource          string            `json:"archiveSource"`
+	JobTemplate2160p       string            `json:"jobTemplate_2160p"`
+	JobTemplate1080p       string            `json:"jobTemplate_1080p"`
+	JobTemplate720p        string            `json:"jobTemplate_720p"`
+	InputRotate            string            `json:"inputRotate"`
+	AcceleratedTranscoding string            `json:"acceleratedTranscoding"`
+	EnableSns              bool              `json:"enableSns"`
+	EnableSqs              bool              `json:"enableSqs"`
+	SrcVideo               string            `json:"srcVideo"`
+	EnableMediaPackage     bool              `json:"enableMediaPackage"`
+	ContentHash            string            `json:"contentHash,omitempty"`
+	DuplicateOf            string            `json:"duplicateOf,omitempty"`
+	DuplicateAction        string            `json:"duplicateAction"`
+	CallbackUrl            string            `json:"callbackUrl,omitempty"`
+	RetentionPolicy        string            `json:"retentionPolicy,omitempty"`
+	RetentionDays          int               `json:"retentionDays,omitempty"`
+	Tags                   map[string]string `json:"tags,omitempty"`
 }
 
-func Handler(event InputValidateEvent) (*InputValidateData, error) {
-	log.Printf("newest version")
+type S3Client interface {
+	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+}
 
-	eventJson, err := json.Marshal(event)
-	if err != nil {
-		return nil, fmt.Errorf("input-validate: main.Handler: Marshal: %w", err)
-	}
-	log.Printf("REQUEST:: %s", eventJson)
+type DynamoDBClient interface {
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
 
-	frameCapture := os.Getenv("FrameCapture") == "true"
-	enableSns := os.Getenv("EnableSns") == "true"
-	enableSqs := os.Getenv("EnableSqs") == "true"
-	enableMediaPackage := os.Getenv("EnableMediaPackage") == "true"
+// Config holds the workflow settings every ingest starts from.
+type Config struct {
+	logging.LogConfig
 
+	WorkflowName           string `env:"WorkflowName" required:"true"`
+	Source                 string `env:"Source" required:"true"`
+	Destination            string `env:"Destination" required:"true"`
+	CloudFront             string `env:"CloudFront"`
+	FrameCapture           bool   `env:"FrameCapture"`
+	ArchiveSource          string `env:"ArchiveSource" default:"DISABLED" enum:"DISABLED,GLACIER,DEEP_ARCHIVE"`
+	JobTemplate2160p       string `env:"MediaConvert_Template_2160p" required:"true"`
+	JobTemplate1080p       string `env:"MediaConvert_Template_1080p" required:"true"`
+	JobTemplate720p        string `env:"MediaConvert_Template_720p" required:"true"`
+	InputRotate            string `env:"InputRotate" default:"DEGREE_0" enum:"DEGREE_0,DEGREES_90,DEGREES_180,DEGREES_270,AUTO"`
+	AcceleratedTranscoding string `env:"AcceleratedTranscoding" default:"DISABLED" enum:"ENABLED,DISABLED,PREFERRED"`
+	EnableSns              bool   `env:"EnableSns"`
+	EnableSqs              bool   `env:"EnableSqs"`
+	EnableMediaPackage     bool   `env:"EnableMediaPackage"`
+	// DuplicatePolicy turns duplicate detection on, which looks uploads up
+	// in DynamoDBTable. The stack sets it to PROCEED by default.
+	DuplicatePolicy     string `env:"DuplicatePolicy" enum:"PROCEED,LINK,SHORT_CIRCUIT"`
+	DynamoDBTable       string `env:"DynamoDBTable" requiredIf:"DuplicatePolicy"`
+	SourceRetention     string `env:"SourceRetention" default:"KEEP" enum:"KEEP,DELETE,ARCHIVE"`
+	SourceRetentionDays int    `env:"SourceRetentionDays" min:"0"`
+}
+
+type Handler struct {
+	Config         Config
+	S3Client       S3Client
+	DynamoDBClient DynamoDBClient
+	Resolver       Resolver
+}
+
+func (h *Handler) HandleRequest(event InputValidateEvent) (*InputValidateData, error) {
 	inputValidateData := InputValidateData{
 		GUID:                   event.GUID,
 		StartTime:              time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
 		WorkflowTrigger:        event.WorkflowTrigger,
 		WorkflowStatus:         "Ingest",
-		WorkflowName:           os.Getenv("WorkflowName"),
-		SrcBucket:              os.Getenv("Source"),
-		DestBucket:             os.Getenv("Destination"),
-		CloudFront:             os.Getenv("CloudFront"),
-		FrameCapture:           frameCapture,
-		ArchiveSource:          os.Getenv("ArchiveSource"),
-		JobTemplate2160p:       os.Getenv("JMediaConvert_Template_2160p"),
-		JobTemplate1080p:       os.Getenv("MediaConvert_Template_1080p"),
-		JobTemplate720p:        os.Getenv("MediaConvert_Template_720p"),
-		InputRotate:            os.Getenv("InputRotate"),
-		AcceleratedTranscoding: os.Getenv("AcceleratedTranscoding"),
-		EnableSns:              enableSns,
-		EnableSqs:              enableSqs,
-		EnableMediaPackage:     enableMediaPackage,
+		WorkflowName:           h.Config.WorkflowName,
+		SrcBucket:              h.Config.Source,
+		DestBucket:             h.Config.Destination,
+		CloudFront:             h.Config.CloudFront,
+		FrameCapture:           h.Config.FrameCapture,
+		ArchiveSource:          h.Config.ArchiveSource,
+		JobTemplate2160p:       h.Config.JobTemplate2160p,
+		JobTemplate1080p:       h.Config.JobTemplate1080p,
+		JobTemplate720p:        h.Config.JobTemplate720p,
+		InputRotate:            h.Config.InputRotate,
+		AcceleratedTranscoding: h.Config.AcceleratedTranscoding,
+		EnableSns:              h.Config.EnableSns,
+		EnableSqs:              h.Config.EnableSqs,
+		EnableMediaPackage:     h.Config.EnableMediaPackage,
 	}
 
 	switch event.WorkflowTrigger {
 	case "Video":
-		inputValidateData.SrcVideo = strings.Replace(event.Records[0].S3.Object.Key, "+", " ", -1)
+		// step-functions starts one execution per record of an S3 event
+		if len(event.Records) != 1 {
+			return nil, fmt.Errorf("input-validate: main.Handler.HandleRequest: %d records: %w", len(event.Records), ErrEventRecordCount)
+		}
+		// S3 event keys are URL encoded, with spaces as '+'
+		srcVideo, err := url.QueryUnescape(event.Records[0].S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("input-validate: main.Handler.HandleRequest: QueryUnescape: %w", err)
+		}
+		inputValidateData.SrcVideo = srcVideo
 	default:
-		return nil, fmt.Errorf("input-validate: main.Handler: %w", ErrEventWorkflowTriggerNotDefined)
+		return nil, fmt.Errorf("input-validate: main.Handler.HandleRequest: %w", ErrEventWorkflowTriggerNotDefined)
+	}
+
+	object, err := h.S3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(inputValidateData.SrcBucket),
+		Key:    aws.String(inputValidateData.SrcVideo),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("input-validate: main.Handler.HandleRequest: HeadObject: %w", err)
+	}
+	inputValidateData.CallbackUrl = h.callbackUrl(object)
+	inputValidateData.Tags = tags(object)
+	inputValidateData.RetentionPolicy, inputValidateData.RetentionDays = h.retention(object)
+
+	if err := h.checkDuplicate(&inputValidateData, object); err != nil {
+		return nil, fmt.Errorf("input-validate: main.Handler.HandleRequest: checkDuplicate: %w", err)
 	}
 
 	return &inputValidateData, nil
 
 }
 
+// tags returns the asset tags set on the upload as x-amz-meta-tags, URL
+// query encoded like x-amz-tagging ("team=news&show=daily"). They are kept on
+// the workflow record and applied to the MediaPackage asset.
+func tags(object *s3.HeadObjectOutput) map[string]string {
+	value := aws.StringValue(object.Metadata[tagsMetadataKey])
+	if value == "" {
+		return nil
+	}
+
+	query, err := url.ParseQuery(value)
+	if err != nil {
+		slog.Warn("INVALID TAGS", "tags", value)
+		return nil
+	}
+
+	tags := map[string]string{}
+	for key, values := range query {
+		if key != "" {
+			tags[key] = values[0]
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
 func main() {
-	lambda.Start(Handler)
+	slog.SetDefault(logging.New(serviceName))
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create session: %s", err)
+	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("input-validate: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := Handler{
+		Config:         config,
+		S3Client:       s3.New(sess),
+		DynamoDBClient: dynamodb.New(sess),
+		Resolver:       net.DefaultResolver,
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
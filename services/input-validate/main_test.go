@@ -1,30 +1,39 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"shared/envconfig"
 )
 
 func TestHandler(t *testing.T) {
-	os.Setenv("WorkflowName", "TestWorkflow")
-	os.Setenv("Source", "source_bucket")
-	os.Setenv("Destination", "destination-bucket")
-	os.Setenv("CloudFront", "cloudfront-url")
-	os.Setenv("FrameCapture", "true")
-	os.Setenv("EnableSns", "true")
-	os.Setenv("EnableSqs", "true")
-	os.Setenv("EnableMediaPackage", "true")
-	os.Setenv("ArchiveSource", "true")
-	os.Setenv("JMediaConvert_Template_2160p", "template-2160p")
-	os.Setenv("MediaConvert_Template_1080p", "template-1080p")
-	os.Setenv("MediaConvert_Template_720p", "template-720p")
-	os.Setenv("InputRotate", "DEGREE_0")
-	os.Setenv("AcceleratedTranscoding", "DISABLED")
+	config := Config{
+		WorkflowName:           "TestWorkflow",
+		Source:                 "source_bucket",
+		Destination:            "destination-bucket",
+		CloudFront:             "cloudfront-url",
+		FrameCapture:           true,
+		EnableSns:              true,
+		EnableSqs:              true,
+		EnableMediaPackage:     true,
+		ArchiveSource:          "GLACIER",
+		JobTemplate2160p:       "template-2160p",
+		JobTemplate1080p:       "template-1080p",
+		JobTemplate720p:        "template-720p",
+		InputRotate:            "DEGREE_0",
+		AcceleratedTranscoding: "DISABLED",
+	}
 
 	cases := []struct {
 		name          string
@@ -58,7 +67,7 @@ func TestHandler(t *testing.T) {
 				DestBucket:             "destination-bucket",
 				CloudFront:             "cloudfront-url",
 				FrameCapture:           true,
-				ArchiveSource:          "true",
+				ArchiveSource:          "GLACIER",
 				JobTemplate2160p:       "template-2160p",
 				JobTemplate1080p:       "template-1080p",
 				JobTemplate720p:        "template-720p",
@@ -76,14 +85,30 @@ func TestHandler(t *testing.T) {
 				GUID:            "1234",
 				WorkflowTrigger: "InvalidTrigger",
 			},
-			expectedError: fmt.Errorf("input-validate: main.Handler: %w", ErrEventWorkflowTriggerNotDefined),
+			expectedError: fmt.Errorf("input-validate: main.Handler.HandleRequest: %w", ErrEventWorkflowTriggerNotDefined),
+			expectedData:  nil,
+		},
+		{
+			name: "Video WorkflowTrigger without a single record",
+			event: InputValidateEvent{
+				GUID:            "1234",
+				WorkflowTrigger: "Video",
+			},
+			expectedError: fmt.Errorf("input-validate: main.Handler.HandleRequest: 0 records: %w", ErrEventRecordCount),
 			expectedData:  nil,
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			data, err := Handler(c.event)
+			s3ClientMock := new(S3ClientMock)
+			s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+
+			handler := &Handler{
+				Config:   config,
+				S3Client: s3ClientMock,
+			}
+			data, err := handler.HandleRequest(c.event)
 			if c.expectedError != nil {
 				assert.Equal(t, c.expectedError, err)
 			} else {
@@ -111,3 +136,310 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func TestDuplicateDetection(t *testing.T) {
+	event := InputValidateEvent{
+		GUID:            "new-guid",
+		WorkflowTrigger: "Video",
+		Records: []events.S3EventRecord{{
+			S3: events.S3Entity{Object: events.S3Object{Key: "folder/copy%20of+video.mp4"}},
+		}},
+	}
+	original := &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{{"guid": {S: aws.String("original-guid")}}},
+	}
+
+	cases := []struct {
+		name           string
+		policy         string
+		head           *s3.HeadObjectOutput
+		query          *dynamodb.QueryOutput
+		expectedHash   string
+		expectedOf     string
+		expectedAction string
+		expectedStatus string
+		expectLink     bool
+	}{
+		{
+			name:           "single part upload fingerprinted by its ETag",
+			policy:         DuplicatePolicyProceed,
+			head:           &s3.HeadObjectOutput{ETag: aws.String(`"D41D8CD98F00B204E9800998ECF8427E"`)},
+			query:          original,
+			expectedHash:   "md5:d41d8cd98f00b204e9800998ecf8427e",
+			expectedOf:     "original-guid",
+			expectedAction: DuplicatePolicyProceed,
+			expectedStatus: "Ingest",
+		},
+		{
+			name:   "multipart upload fingerprinted by its sha256 metadata",
+			policy: DuplicatePolicyShortCircuit,
+			head: &s3.HeadObjectOutput{
+				ETag:     aws.String(`"9b2cf535f27731c974343645a3985328-3"`),
+				Metadata: map[string]*string{"Sha256": aws.String("ABC123")},
+			},
+			query:          original,
+			expectedHash:   "sha256:abc123",
+			expectedOf:     "original-guid",
+			expectedAction: DuplicatePolicyShortCircuit,
+			expectedStatus: "Duplicate",
+		},
+		{
+			name:           "duplicate linked to the existing asset",
+			policy:         DuplicatePolicyLink,
+			head:           &s3.HeadObjectOutput{ETag: aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`)},
+			query:          original,
+			expectedHash:   "md5:d41d8cd98f00b204e9800998ecf8427e",
+			expectedOf:     "original-guid",
+			expectedAction: DuplicatePolicyLink,
+			expectedStatus: "Ingest",
+			expectLink:     true,
+		},
+		{
+			name:           "new content",
+			policy:         DuplicatePolicyShortCircuit,
+			head:           &s3.HeadObjectOutput{ETag: aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`)},
+			query:          &dynamodb.QueryOutput{},
+			expectedHash:   "md5:d41d8cd98f00b204e9800998ecf8427e",
+			expectedStatus: "Ingest",
+		},
+		{
+			name:           "multipart upload without sha256 metadata",
+			policy:         DuplicatePolicyShortCircuit,
+			head:           &s3.HeadObjectOutput{ETag: aws.String(`"9b2cf535f27731c974343645a3985328-3"`)},
+			expectedStatus: "Ingest",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s3ClientMock := new(S3ClientMock)
+			s3ClientMock.On("HeadObject", mock.MatchedBy(func(input *s3.HeadObjectInput) bool {
+				return *input.Key == "folder/copy of video.mp4"
+			})).Return(c.head, nil)
+
+			dynamoDBClientMock := new(DynamoDBClientMock)
+			if c.query != nil {
+				dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+					return *input.IndexName == contentHashIndex &&
+						*input.ExpressionAttributeValues[":contentHash"].S == c.expectedHash &&
+						*input.ExpressionAttributeValues[":guid"].S == "new-guid"
+				})).Return(c.query, nil)
+			}
+			if c.expectLink {
+				dynamoDBClientMock.On("UpdateItem", mock.MatchedBy(func(input *dynamodb.UpdateItemInput) bool {
+					source := input.ExpressionAttributeValues[":source"].L[0].M
+					return *input.Key["guid"].S == "original-guid" &&
+						*source["key"].S == "folder/copy of video.mp4"
+				})).Return(&dynamodb.UpdateItemOutput{}, nil)
+			}
+
+			handler := &Handler{
+				Config:         Config{DuplicatePolicy: c.policy, DynamoDBTable: "table"},
+				S3Client:       s3ClientMock,
+				DynamoDBClient: dynamoDBClientMock,
+			}
+
+			data, err := handler.HandleRequest(event)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expectedHash, data.ContentHash)
+			assert.Equal(t, c.expectedOf, data.DuplicateOf)
+			assert.Equal(t, c.expectedAction, data.DuplicateAction)
+			assert.Equal(t, c.expectedStatus, data.WorkflowStatus)
+			s3ClientMock.AssertExpectations(t)
+			dynamoDBClientMock.AssertExpectations(t)
+		})
+	}
+
+	t.Run("should fail when the source cannot be read", func(t *testing.T) {
+		s3ClientMock := new(S3ClientMock)
+		s3ClientMock.On("HeadObject", mock.Anything).Return(nil, assert.AnError)
+
+		handler := &Handler{
+			Config:         Config{DuplicatePolicy: DuplicatePolicyProceed},
+			S3Client:       s3ClientMock,
+			DynamoDBClient: new(DynamoDBClientMock),
+		}
+
+		_, err := handler.HandleRequest(event)
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+}
+
+// ResolverMock answers a lookup with the addresses of the host, or a not
+// found error for unknown hosts.
+type ResolverMock map[string][]net.IP
+
+func (m ResolverMock) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, ok := m[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestCallbackUrl(t *testing.T) {
+	handler := &Handler{Resolver: ResolverMock{
+		"cms.example.com": {net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")},
+		"localhost":       {net.ParseIP("127.0.0.1")},
+		"cms.internal":    {net.ParseIP("203.0.113.11"), net.ParseIP("10.0.12.7")},
+		"empty.example":   {},
+	}}
+
+	cases := map[string]string{
+		"https://cms.example.com/hooks/vod":        "https://cms.example.com/hooks/vod",
+		"https://cms.example.com:8443/hooks":       "https://cms.example.com:8443/hooks",
+		"https://203.0.113.10/hooks":               "https://203.0.113.10/hooks",
+		"http://cms.example.com/hooks":             "",
+		"ftp://cms.example.com/hooks":              "",
+		"https://localhost/hooks":                  "",
+		"https://cms.internal/hooks":               "",
+		"https://empty.example/hooks":              "",
+		"https://unknown.example/hooks":            "",
+		"https://169.254.169.254/latest/meta-data": "",
+		"https://[fd00:ec2::254]/latest/meta-data": "",
+		"https://127.0.0.1/hooks":                  "",
+		"https://[::1]/hooks":                      "",
+		"https://[::ffff:192.168.1.10]/hooks":      "",
+		"https://0.0.0.0/hooks":                    "",
+		"https://172.16.0.1/hooks":                 "",
+		"https:///hooks":                           "",
+		"not a url":                                "",
+		"":                                         "",
+	}
+
+	for value, expected := range cases {
+		object := &s3.HeadObjectOutput{Metadata: map[string]*string{}}
+		if value != "" {
+			object.Metadata[callbackUrlMetadataKey] = aws.String(value)
+		}
+		assert.Equal(t, expected, handler.callbackUrl(object), value)
+	}
+}
+
+func TestTags(t *testing.T) {
+	cases := map[string]map[string]string{
+		"team=news&show=daily+news": {"team": "news", "show": "daily news"},
+		"team=news&team=sport":      {"team": "news"},
+		"=untagged":                 nil,
+		"team=%zz":                  nil,
+		"":                          nil,
+	}
+
+	for value, expected := range cases {
+		object := &s3.HeadObjectOutput{Metadata: map[string]*string{}}
+		if value != "" {
+			object.Metadata[tagsMetadataKey] = aws.String(value)
+		}
+		assert.Equal(t, expected, tags(object), value)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	handler := &Handler{Config: Config{SourceRetention: RetentionDelete, SourceRetentionDays: 30}}
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		policy   string
+		days     int
+	}{
+		{"global setting", map[string]string{}, RetentionDelete, 30},
+		{"per asset policy", map[string]string{retentionMetadataKey: "archive"}, RetentionArchive, 30},
+		{"per asset days", map[string]string{retentionDaysMetadataKey: "7"}, RetentionDelete, 7},
+		{"per asset keep", map[string]string{retentionMetadataKey: "KEEP", retentionDaysMetadataKey: "7"}, RetentionKeep, 0},
+		{"invalid metadata", map[string]string{retentionMetadataKey: "SHRED", retentionDaysMetadataKey: "-1"}, RetentionDelete, 30},
+	}
+
+	for _, c := range cases {
+		object := &s3.HeadObjectOutput{Metadata: map[string]*string{}}
+		for key, value := range c.metadata {
+			object.Metadata[key] = aws.String(value)
+		}
+
+		policy, days := handler.retention(object)
+		assert.Equal(t, c.policy, policy, c.name)
+		assert.Equal(t, c.days, days, c.name)
+	}
+
+	t.Run("should keep when nothing is set", func(t *testing.T) {
+		handler := &Handler{Config: Config{SourceRetention: RetentionKeep}}
+
+		policy, days := handler.retention(&s3.HeadObjectOutput{})
+		assert.Equal(t, RetentionKeep, policy)
+		assert.Equal(t, 0, days)
+	})
+}
+
+func TestConfig(t *testing.T) {
+	setEnv := func(t *testing.T) {
+		t.Setenv("WorkflowName", "vod")
+		t.Setenv("Source", "vod-source")
+		t.Setenv("Destination", "vod-destination")
+		t.Setenv("FrameCapture", "true")
+		t.Setenv("MediaConvert_Template_2160p", "vod_Ott_2160p_Avc_Aac_16x9_qvbr_no_preset")
+		t.Setenv("MediaConvert_Template_1080p", "vod_Ott_1080p_Avc_Aac_16x9_qvbr_no_preset")
+		t.Setenv("MediaConvert_Template_720p", "vod_Ott_720p_Avc_Aac_16x9_qvbr_no_preset")
+		t.Setenv("SourceRetentionDays", "30")
+	}
+
+	t.Run("should read the stack settings", func(t *testing.T) {
+		setEnv(t)
+
+		var config Config
+		assert.NoError(t, envconfig.Load(&config, nil))
+		assert.Equal(t, "vod_Ott_2160p_Avc_Aac_16x9_qvbr_no_preset", config.JobTemplate2160p)
+		assert.True(t, config.FrameCapture)
+		assert.Equal(t, "DISABLED", config.ArchiveSource)
+		assert.Equal(t, "DEGREE_0", config.InputRotate)
+		assert.Equal(t, RetentionKeep, config.SourceRetention)
+		assert.Equal(t, 30, config.SourceRetentionDays)
+	})
+
+	t.Run("should list every invalid setting", func(t *testing.T) {
+		setEnv(t)
+		t.Setenv("Destination", "")
+		t.Setenv("ArchiveSource", "true")
+		t.Setenv("AcceleratedTranscoding", "Preferred")
+		t.Setenv("EnableSns", "Yes")
+
+		var config Config
+		err := envconfig.Load(&config, nil)
+		assert.ErrorIs(t, err, envconfig.ErrInvalid)
+		assert.EqualError(t, err, `invalid configuration: Destination is required; `+
+			`ArchiveSource: "true" is not one of DISABLED, GLACIER, DEEP_ARCHIVE; `+
+			`AcceleratedTranscoding: "Preferred" is not one of ENABLED, DISABLED, PREFERRED; `+
+			`EnableSns: "Yes" is not true or false`)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// What happens to the source video once the asset is published is decided
+// by its retention policy:
+//
+//	KEEP     the source is kept
+//	DELETE   the source is deleted RetentionDays after publishing
+//	ARCHIVE  the source is copied to the retention archive and deleted
+//	         RetentionDays after publishing
+//
+// SourceRetention and SourceRetentionDays set the policy of every upload;
+// an upload overrides them with x-amz-meta-retention and
+// x-amz-meta-retention-days object metadata. The retention-sweeper service
+// applies the policies once they are due.
+const (
+	RetentionKeep    = "KEEP"
+	RetentionDelete  = "DELETE"
+	RetentionArchive = "ARCHIVE"
+
+	retentionMetadataKey     = "Retention"
+	retentionDaysMetadataKey = "Retention-Days"
+)
+
+// retention returns the policy and the number of days after publishing it
+// applies, preferring the upload's metadata over the global settings.
+// Invalid metadata is ignored.
+func (h *Handler) retention(object *s3.HeadObjectOutput) (string, int) {
+	policy := h.Config.SourceRetention
+	if value := aws.StringValue(object.Metadata[retentionMetadataKey]); value != "" {
+		if override := validRetentionPolicy(value, "x-amz-meta-retention"); override != "" {
+			policy = override
+		}
+	}
+	if policy == "" || policy == RetentionKeep {
+		return RetentionKeep, 0
+	}
+
+	days := h.Config.SourceRetentionDays
+	if value := aws.StringValue(object.Metadata[retentionDaysMetadataKey]); value != "" {
+		if override := validRetentionDays(value, "x-amz-meta-retention-days"); override >= 0 {
+			days = override
+		}
+	}
+
+	return policy, days
+}
+
+func validRetentionPolicy(value, setting string) string {
+	policy := strings.ToUpper(strings.TrimSpace(value))
+	switch policy {
+	case "", RetentionKeep, RetentionDelete, RetentionArchive:
+		return policy
+	}
+
+	slog.Warn("INVALID RETENTION", "setting", setting, "value", value)
+	return ""
+}
+
+// validRetentionDays returns -1 for a missing or invalid value.
+func validRetentionDays(value, setting string) int {
+	if value == "" {
+		return -1
+	}
+
+	days, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || days < 0 {
+		slog.Warn("INVALID RETENTION", "setting", setting, "value", value)
+		return -1
+	}
+	return days
+}
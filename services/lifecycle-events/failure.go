@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	executionStatusChange = "Step Functions Execution Status Change"
+	jobStateChange        = "MediaConvert Job State Change"
+)
+
+// ExecutionStatusChange is the detail of a Step Functions execution event.
+type ExecutionStatusChange struct {
+	ExecutionArn    string `json:"executionArn"`
+	StateMachineArn string `json:"stateMachineArn"`
+	Status          string `json:"status"`
+	Input           string `json:"input"`
+	Error           string `json:"error"`
+	Cause           string `json:"cause"`
+}
+
+// JobStateChange is the detail of a MediaConvert job event.
+type JobStateChange struct {
+	JobId        string `json:"jobId"`
+	Status       string `json:"status"`
+	ErrorCode    int64  `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+	UserMetadata struct {
+		GUID     string `json:"guid"`
+		Workflow string `json:"workflow"`
+	} `json:"userMetadata"`
+}
+
+// failureEvent returns the Failed event for a failed, timed out or aborted
+// workflow execution or a MediaConvert job error, or nil for other events.
+func failureEvent(event events.EventBridgeEvent) (*LifecycleEvent, error) {
+	switch event.DetailType {
+	case executionStatusChange:
+		var detail ExecutionStatusChange
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		if detail.Status == "RUNNING" || detail.Status == "SUCCEEDED" {
+			return nil, nil
+		}
+
+		failed := newEvent(executionGuid(detail.Input), "")
+		failed.ExecutionArn = detail.ExecutionArn
+		failed.Error = &EventError{
+			Stage: workflowStage(detail.StateMachineArn),
+			Error: strings.TrimSpace(detail.Status + " " + detail.Error),
+			Cause: detail.Cause,
+			code:  executionErrorCode(detail),
+		}
+		return failed, nil
+
+	case jobStateChange:
+		var detail JobStateChange
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		if detail.Status != "ERROR" {
+			return nil, nil
+		}
+
+		failed := newEvent(detail.UserMetadata.GUID, detail.UserMetadata.Workflow)
+		failed.JobId = detail.JobId
+		failed.Error = &EventError{
+			Stage: "Encode",
+			Error: fmt.Sprintf("MediaConvert error %d", detail.ErrorCode),
+			Cause: detail.ErrorMessage,
+			code:  strconv.FormatInt(detail.ErrorCode, 10),
+		}
+		return failed, nil
+	}
+
+	return nil, nil
+}
+
+// executionErrorCode is the error the execution failed with, or its status
+// when it timed out or was aborted.
+func executionErrorCode(detail ExecutionStatusChange) string {
+	if detail.Error != "" {
+		return detail.Error
+	}
+	return detail.Status
+}
+
+// executionGuid returns the guid from the input of an Ingest or Process
+// execution, or from the MediaConvert event that started a Publish execution.
+func executionGuid(input string) string {
+	var execution struct {
+		GUID   string `json:"guid"`
+		Detail struct {
+			UserMetadata struct {
+				GUID string `json:"guid"`
+			} `json:"userMetadata"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal([]byte(input), &execution); err != nil {
+		return ""
+	}
+	if execution.GUID != "" {
+		return execution.GUID
+	}
+	return execution.Detail.UserMetadata.GUID
+}
+
+// workflowStage names the workflow from its state machine, <stack>-<workflow>.
+func workflowStage(stateMachineArn string) string {
+	name := stateMachineArn[strings.LastIndex(stateMachineArn, ":")+1:]
+	workflow := name[strings.LastIndex(name, "-")+1:]
+	if workflow == "" {
+		return name
+	}
+	return strings.ToUpper(workflow[:1]) + workflow[1:]
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/emf"
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "lifecycle-events"
+
+// Every stage transition of an asset is put on the LifecycleEventBus as an
+// event with source EventSource, the stage as detail-type and LifecycleEvent
+// as detail. The state machines invoke this function with a StageInput after
+// each stage; failures arrive as EventBridge events for failed executions
+// and MediaConvert job errors.
+
+// SchemaVersion is the version of the LifecycleEvent detail. It changes only
+// when a field is renamed or removed, or its meaning changes.
+const SchemaVersion = "1"
+
+const (
+	DetailTypeIngested        = "Ingested"
+	DetailTypeProfileSelected = "ProfileSelected"
+	DetailTypeEncodeSubmitted = "EncodeSubmitted"
+	DetailTypeEncodeComplete  = "EncodeComplete"
+	DetailTypePublished       = "Published"
+	DetailTypeFailed          = "Failed"
+)
+
+var (
+	ErrInvalidDetailType = errors.New("unknown lifecycle detail type")
+	ErrPutEvents         = errors.New("event was not put on the bus")
+)
+
+type EventBridgeClient interface {
+	PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+	emf.MetricsConfig
+
+	// WorkflowName is the workflow of the events whose state does not name
+	// one.
+	WorkflowName      string `env:"WorkflowName" required:"true"`
+	LifecycleEventBus string `env:"LifecycleEventBus" required:"true"`
+	EventSource       string `env:"EventSource" default:"video-on-demand"`
+}
+
+type Handler struct {
+	Config            Config
+	EventBridgeClient EventBridgeClient
+}
+
+// StageInput is passed by the state machines: the detail type of the stage
+// that just finished, the workflow state and the execution id.
+type StageInput struct {
+	DetailType  string        `json:"detailType"`
+	Event       WorkflowState `json:"event"`
+	ExecutionId string        `json:"executionId"`
+}
+
+type WorkflowState struct {
+	GUID            string            `json:"guid"`
+	WorkflowStatus  string            `json:"workflowStatus"`
+	WorkflowName    string            `json:"workflowName"`
+	SrcBucket       string            `json:"srcBucket"`
+	SrcVideo        string            `json:"srcVideo"`
+	EncodingProfile int               `json:"encodingProfile,omitempty"`
+	JobTemplate     string            `json:"jobTemplate,omitempty"`
+	EncodeJobId     string            `json:"encodeJobId"`
+	HlsUrl          *string           `json:"hlsUrl"`
+	DashUrl         *string           `json:"dashUrl"`
+	CmafHlsUrl      *string           `json:"cmafHlsUrl"`
+	CmafDashUrl     *string           `json:"cmafDashUrl"`
+	MssUrl          *string           `json:"mssUrl"`
+	Mp4Urls         []*string         `json:"mp4Urls"`
+	EgressEndpoints map[string]string `json:"egressEndpoints"`
+}
+
+// LifecycleEvent is the detail of every lifecycle event. Fields that do not
+// apply to a stage are left out.
+type LifecycleEvent struct {
+	Version         string         `json:"version"`
+	GUID            string         `json:"guid"`
+	WorkflowName    string         `json:"workflowName"`
+	Status          string         `json:"status,omitempty"`
+	Source          *EventSource   `json:"source,omitempty"`
+	EncodingProfile int            `json:"encodingProfile,omitempty"`
+	JobTemplate     string         `json:"jobTemplate,omitempty"`
+	JobId           string         `json:"jobId,omitempty"`
+	Playback        *EventPlayback `json:"playback,omitempty"`
+	Error           *EventError    `json:"error,omitempty"`
+	ExecutionArn    string         `json:"executionArn,omitempty"`
+	Timestamp       string         `json:"timestamp"`
+}
+
+type EventSource struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type EventPlayback struct {
+	Hls          string            `json:"hls,omitempty"`
+	Dash         string            `json:"dash,omitempty"`
+	CmafHls      string            `json:"cmafHls,omitempty"`
+	CmafDash     string            `json:"cmafDash,omitempty"`
+	Mss          string            `json:"mss,omitempty"`
+	Mp4          []string          `json:"mp4,omitempty"`
+	MediaPackage map[string]string `json:"mediaPackage,omitempty"`
+}
+
+type EventError struct {
+	Stage string `json:"stage"`
+	Error string `json:"error,omitempty"`
+	Cause string `json:"cause,omitempty"`
+
+	// code is the error name or MediaConvert error code the failure is
+	// counted under in the WorkflowFailures metric.
+	code string
+}
+
+// HandleRequest puts the lifecycle event for a state machine invocation, or
+// the Failed event for an EventBridge event.
+func (h *Handler) HandleRequest(raw json.RawMessage) (*LifecycleEvent, error) {
+	var probe struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("lifecycle-events: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+	}
+
+	var detailType string
+	var detail *LifecycleEvent
+	var err error
+	if probe.DetailType != "" {
+		var event events.EventBridgeEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, fmt.Errorf("lifecycle-events: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		detailType = DetailTypeFailed
+		detail, err = failureEvent(event)
+	} else {
+		var input StageInput
+		if err := json.Unmarshal(raw, &input); err != nil {
+			return nil, fmt.Errorf("lifecycle-events: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+		detailType = input.DetailType
+		detail, err = stageEvent(input)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lifecycle-events: main.Handler.HandleRequest: %w", err)
+	}
+	if detail == nil {
+		// Not a failure of this stack's workflows
+		return nil, nil
+	}
+	if detail.WorkflowName == "" {
+		detail.WorkflowName = h.Config.WorkflowName
+	}
+	if detail.Error != nil {
+		h.Config.PutMetrics(serviceName, map[string]string{
+			"workflow":  detail.WorkflowName,
+			"stage":     detail.Error.Stage,
+			"errorCode": detail.Error.code,
+		}, map[string]interface{}{
+			"guid":         detail.GUID,
+			"executionArn": detail.ExecutionArn,
+			"jobId":        detail.JobId,
+		}, emf.Metric{Name: "WorkflowFailures", Value: 1, Unit: emf.UnitCount})
+	}
+
+	if err := h.putEvent(detailType, detail); err != nil {
+		return nil, fmt.Errorf("lifecycle-events: main.Handler.HandleRequest: putEvent: %w", err)
+	}
+
+	return detail, nil
+}
+
+func stageEvent(input StageInput) (*LifecycleEvent, error) {
+	state := input.Event
+	detail := newEvent(state.GUID, state.WorkflowName)
+	detail.Status = state.WorkflowStatus
+	detail.ExecutionArn = input.ExecutionId
+	if state.SrcVideo != "" {
+		detail.Source = &EventSource{Bucket: state.SrcBucket, Key: state.SrcVideo}
+	}
+
+	switch input.DetailType {
+	case DetailTypeIngested:
+	case DetailTypeProfileSelected:
+		detail.EncodingProfile = state.EncodingProfile
+		detail.JobTemplate = state.JobTemplate
+	case DetailTypeEncodeSubmitted, DetailTypeEncodeComplete:
+		detail.EncodingProfile = state.EncodingProfile
+		detail.JobTemplate = state.JobTemplate
+		detail.JobId = state.EncodeJobId
+	case DetailTypePublished:
+		detail.EncodingProfile = state.EncodingProfile
+		detail.JobTemplate = state.JobTemplate
+		detail.JobId = state.EncodeJobId
+		detail.Playback = &EventPlayback{
+			Hls:          aws.StringValue(state.HlsUrl),
+			Dash:         aws.StringValue(state.DashUrl),
+			CmafHls:      aws.StringValue(state.CmafHlsUrl),
+			CmafDash:     aws.StringValue(state.CmafDashUrl),
+			Mss:          aws.StringValue(state.MssUrl),
+			Mp4:          aws.StringValueSlice(state.Mp4Urls),
+			MediaPackage: state.EgressEndpoints,
+		}
+		if len(detail.Playback.MediaPackage) == 0 {
+			detail.Playback.MediaPackage = nil
+		}
+	default:
+		return nil, fmt.Errorf("%q: %w", input.DetailType, ErrInvalidDetailType)
+	}
+
+	return detail, nil
+}
+
+func newEvent(guid, workflowName string) *LifecycleEvent {
+	return &LifecycleEvent{
+		Version:      SchemaVersion,
+		GUID:         guid,
+		WorkflowName: workflowName,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func (h *Handler) putEvent(detailType string, detail *LifecycleEvent) error {
+	detailJson, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	data, err := h.EventBridgeClient.PutEvents(&eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: aws.String(h.Config.LifecycleEventBus),
+			Source:       aws.String(h.Config.EventSource),
+			DetailType:   aws.String(detailType),
+			Detail:       aws.String(string(detailJson)),
+			Resources:    aws.StringSlice(resources(detail)),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("PutEvents: %w", err)
+	}
+	if aws.Int64Value(data.FailedEntryCount) > 0 {
+		entry := data.Entries[0]
+		return fmt.Errorf("%s: %s: %w", aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage), ErrPutEvents)
+	}
+
+	slog.Info("EVENT", "detailType", detailType, "status", detail.Status)
+	return nil
+}
+
+func resources(detail *LifecycleEvent) []string {
+	if detail.ExecutionArn == "" {
+		return []string{}
+	}
+	return []string{detail.ExecutionArn}
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create session: %s", err)
+	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("lifecycle-events: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := Handler{
+		Config:            config,
+		EventBridgeClient: eventbridge.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
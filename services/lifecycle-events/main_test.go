@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"shared/logging"
+)
+
+type EventBridgeClientMock struct {
+	mock.Mock
+}
+
+func (m *EventBridgeClientMock) PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*eventbridge.PutEventsOutput), args.Error(1)
+}
+
+func stageRequest(t *testing.T, detailType string) json.RawMessage {
+	raw, err := json.Marshal(map[string]interface{}{
+		"detailType":  detailType,
+		"executionId": "arn:aws:states:us-east-1:123456789012:execution:vod-process:guid",
+		"event": map[string]interface{}{
+			"guid":            "guid",
+			"workflowStatus":  "Complete",
+			"workflowName":    "vod",
+			"srcBucket":       "source",
+			"srcVideo":        "video.mp4",
+			"encodingProfile": 1080,
+			"jobTemplate":     "vod_Ott_1080p_Avc_Aac_16x9_qvbr_no_preset",
+			"encodeJobId":     "job",
+			"hlsUrl":          "https://cdn/guid/hls/video.m3u8",
+			"mp4Urls":         []string{"https://cdn/guid/mp4/video.mp4"},
+		},
+	})
+	assert.NoError(t, err)
+	return raw
+}
+
+func TestStageEvents(t *testing.T) {
+	config := Config{LifecycleEventBus: "vod-lifecycle", EventSource: "video-on-demand"}
+
+	for _, detailType := range []string{
+		DetailTypeIngested,
+		DetailTypeProfileSelected,
+		DetailTypeEncodeSubmitted,
+		DetailTypeEncodeComplete,
+		DetailTypePublished,
+	} {
+		t.Run("should put "+detailType, func(t *testing.T) {
+			eventBridgeClientMock := new(EventBridgeClientMock)
+			handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+			var entry *eventbridge.PutEventsRequestEntry
+			eventBridgeClientMock.On("PutEvents", mock.Anything).
+				Run(func(args mock.Arguments) {
+					entry = args.Get(0).(*eventbridge.PutEventsInput).Entries[0]
+				}).
+				Return(&eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil)
+
+			res, err := handler.HandleRequest(stageRequest(t, detailType))
+			assert.NoError(t, err)
+			assert.Equal(t, "vod-lifecycle", aws.StringValue(entry.EventBusName))
+			assert.Equal(t, "video-on-demand", aws.StringValue(entry.Source))
+			assert.Equal(t, detailType, aws.StringValue(entry.DetailType))
+			assert.Equal(t, []string{"arn:aws:states:us-east-1:123456789012:execution:vod-process:guid"}, aws.StringValueSlice(entry.Resources))
+
+			var detail LifecycleEvent
+			assert.NoError(t, json.Unmarshal([]byte(aws.StringValue(entry.Detail)), &detail))
+			assert.Equal(t, SchemaVersion, detail.Version)
+			assert.Equal(t, "guid", detail.GUID)
+			assert.Equal(t, "video.mp4", detail.Source.Key)
+			assert.Equal(t, res.GUID, detail.GUID)
+
+			switch detailType {
+			case DetailTypeIngested:
+				assert.Zero(t, detail.EncodingProfile)
+				assert.Empty(t, detail.JobId)
+			case DetailTypeProfileSelected:
+				assert.Equal(t, 1080, detail.EncodingProfile)
+				assert.Empty(t, detail.JobId)
+			case DetailTypePublished:
+				assert.Equal(t, "job", detail.JobId)
+				assert.Equal(t, "https://cdn/guid/hls/video.m3u8", detail.Playback.Hls)
+				assert.Equal(t, []string{"https://cdn/guid/mp4/video.mp4"}, detail.Playback.Mp4)
+			default:
+				assert.Equal(t, "job", detail.JobId)
+				assert.Nil(t, detail.Playback)
+			}
+		})
+	}
+
+	t.Run("should fail on unknown detail type", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		_, err := handler.HandleRequest(stageRequest(t, "Encoded"))
+		assert.ErrorIs(t, err, ErrInvalidDetailType)
+		eventBridgeClientMock.AssertNotCalled(t, "PutEvents", mock.Anything)
+	})
+
+	t.Run("should fail when the entry is rejected", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		eventBridgeClientMock.On("PutEvents", mock.Anything).Return(&eventbridge.PutEventsOutput{
+			FailedEntryCount: aws.Int64(1),
+			Entries: []*eventbridge.PutEventsResultEntry{{
+				ErrorCode:    aws.String("InternalFailure"),
+				ErrorMessage: aws.String("internal failure"),
+			}},
+		}, nil)
+
+		_, err := handler.HandleRequest(stageRequest(t, DetailTypeIngested))
+		assert.ErrorIs(t, err, ErrPutEvents)
+	})
+
+	t.Run("should fail on put events fails", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		eventBridgeClientMock.On("PutEvents", mock.Anything).Return(nil, assert.AnError)
+
+		_, err := handler.HandleRequest(stageRequest(t, DetailTypeIngested))
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+}
+
+func TestFailedEvents(t *testing.T) {
+	config := Config{WorkflowName: "vod"}
+
+	execution := func(status, input string) json.RawMessage {
+		detail, _ := json.Marshal(map[string]string{
+			"executionArn":    "arn:aws:states:us-east-1:123456789012:execution:vod-publish:exec",
+			"stateMachineArn": "arn:aws:states:us-east-1:123456789012:stateMachine:vod-publish",
+			"status":          status,
+			"input":           input,
+			"error":           "States.TaskFailed",
+			"cause":           "boom",
+		})
+		raw, _ := json.Marshal(map[string]interface{}{
+			"detail-type": executionStatusChange,
+			"source":      "aws.states",
+			"detail":      json.RawMessage(detail),
+		})
+		return raw
+	}
+
+	t.Run("should put Failed for a failed execution", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		var entry *eventbridge.PutEventsRequestEntry
+		eventBridgeClientMock.On("PutEvents", mock.Anything).
+			Run(func(args mock.Arguments) {
+				entry = args.Get(0).(*eventbridge.PutEventsInput).Entries[0]
+			}).
+			Return(&eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil)
+
+		res, err := handler.HandleRequest(execution("FAILED", `{"detail":{"userMetadata":{"guid":"guid"}}}`))
+		assert.NoError(t, err)
+		assert.Equal(t, DetailTypeFailed, aws.StringValue(entry.DetailType))
+		assert.Equal(t, "guid", res.GUID)
+		assert.Equal(t, "vod", res.WorkflowName)
+		assert.Equal(t, "Publish", res.Error.Stage)
+		assert.Equal(t, "FAILED States.TaskFailed", res.Error.Error)
+		assert.Equal(t, "boom", res.Error.Cause)
+	})
+
+	t.Run("should ignore a succeeded execution", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		res, err := handler.HandleRequest(execution("SUCCEEDED", `{"guid":"guid"}`))
+		assert.NoError(t, err)
+		assert.Nil(t, res)
+		eventBridgeClientMock.AssertNotCalled(t, "PutEvents", mock.Anything)
+	})
+
+	t.Run("should put Failed for a MediaConvert error", func(t *testing.T) {
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+
+		eventBridgeClientMock.On("PutEvents", mock.Anything).Return(&eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil)
+
+		raw := json.RawMessage(`{"detail-type":"MediaConvert Job State Change","source":"aws.mediaconvert","detail":{"jobId":"job","status":"ERROR","errorCode":1010,"errorMessage":"bad input","userMetadata":{"guid":"guid","workflow":"vod"}}}`)
+		res, err := handler.HandleRequest(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, "guid", res.GUID)
+		assert.Equal(t, "job", res.JobId)
+		assert.Equal(t, "Encode", res.Error.Stage)
+		assert.Equal(t, "bad input", res.Error.Cause)
+	})
+
+	t.Run("should count failures by stage and error code", func(t *testing.T) {
+		var buf bytes.Buffer
+		output := logging.Output
+		logging.Output = &buf
+		defer func() { logging.Output = output }()
+
+		eventBridgeClientMock := new(EventBridgeClientMock)
+		handler := &Handler{Config: config, EventBridgeClient: eventBridgeClientMock}
+		eventBridgeClientMock.On("PutEvents", mock.Anything).Return(&eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil)
+
+		_, err := handler.HandleRequest(execution("FAILED", `{"guid":"guid"}`))
+		assert.NoError(t, err)
+		_, err = handler.HandleRequest(execution("TIMED_OUT", `{"guid":"guid"}`))
+		assert.NoError(t, err)
+		_, err = handler.HandleRequest(json.RawMessage(`{"detail-type":"MediaConvert Job State Change","source":"aws.mediaconvert","detail":{"jobId":"job","status":"ERROR","errorCode":1010,"userMetadata":{"guid":"guid","workflow":"vod"}}}`))
+		assert.NoError(t, err)
+
+		var failures []map[string]interface{}
+		decoder := json.NewDecoder(&buf)
+		for decoder.More() {
+			var document map[string]interface{}
+			assert.NoError(t, decoder.Decode(&document))
+			if document["_aws"] != nil {
+				failures = append(failures, document)
+			}
+		}
+		if assert.Len(t, failures, 3) {
+			assert.Equal(t, []interface{}{"Publish", "States.TaskFailed", "guid", float64(1)}, []interface{}{failures[0]["stage"], failures[0]["errorCode"], failures[0]["guid"], failures[0]["WorkflowFailures"]})
+			assert.Equal(t, "States.TaskFailed", failures[1]["errorCode"])
+			assert.Equal(t, []interface{}{"Encode", "1010", "vod"}, []interface{}{failures[2]["stage"], failures[2]["errorCode"], failures[2]["workflow"]})
+		}
+	})
+}
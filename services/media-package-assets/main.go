@@ -1,23 +1,31 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
 	"github.com/aws/aws-sdk-go/service/mediapackagevod"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "media-package-assets"
+
 type EventDetail struct {
 	Timestamp          int64                `json:"timestamp"`
 	AccountId          string               `json:"accountId"`
@@ -75,10 +83,20 @@ type MediaPackageAssetsEvent struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
+	RetentionPolicy        string                      `json:"retentionPolicy,omitempty"`
+	RetentionDays          int                         `json:"retentionDays,omitempty"`
+	RetentionDueAt         string                      `json:"retentionDueAt,omitempty"`
+	Tags                   map[string]string           `json:"tags,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
+	Cost                   json.RawMessage             `json:"cost,omitempty"`
+	Version                int64                       `json:"version,omitempty"`
 
 	// Output
 	HlsPlaylist            *string           `json:"hlsPlaylist"`
@@ -109,64 +127,127 @@ type UserMetadata struct {
 	Workflow string `json:"workflow"`
 }
 
+var ErrNoHlsOutput = errors.New("no HLS output to ingest")
+
+// assetIdPattern matches the characters MediaPackage does not allow in an
+// asset ID.
+var assetIdPattern = regexp.MustCompile(`[^0-9A-Za-z_-]`)
+
 type MediaPackageVodClient interface {
 	CreateAsset(input *mediapackagevod.CreateAssetInput) (*mediapackagevod.CreateAssetOutput, error)
+	DeleteAsset(input *mediapackagevod.DeleteAssetInput) (*mediapackagevod.DeleteAssetOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	GroupId             string `env:"GroupId" required:"true"`
+	GroupDomainName     string `env:"GroupDomainName" required:"true"`
+	MediaPackageVodRole string `env:"MediaPackageVodRole" required:"true"`
 }
 
 type Handler struct {
+	Config                Config
 	MediaPackageVodClient MediaPackageVodClient
 }
 
 func (h *Handler) HanleRequest(event MediaPackageAssetsEvent) (*MediaPackageAssetsEvent, error) {
-	eventJson, _ := json.Marshal(event)
-	log.Printf("REQUEST:: %s", eventJson)
-
-	randomBytes := make([]byte, 16)
-	_, err := rand.Read(randomBytes)
+	playlist, err := sourcePlaylist(event)
 	if err != nil {
-		log.Fatalf("Failed to generate random bytes: %v", err)
+		return nil, fmt.Errorf("media-package-assets: main.Handler.HandleRequest: %s: %w", event.GUID, err)
 	}
-	randomId := hex.EncodeToString(randomBytes)
-
-	arn, err := buildArnFromUri(*event.HlsPlaylist)
+	arn, err := buildArnFromUri(playlist)
 	if err != nil {
 		return nil, fmt.Errorf("media-package-assets: main.Handler.HandleRequest: buildArnFromUri: %w", err)
 	}
+
+	// A reprocess, or a retry, replaces the asset ingested before. Assets
+	// ingested before IDs were derived from the GUID have a random ID.
+	assetId := assetId(event.GUID)
+	previous := []string{assetId}
+	if event.MediaPackageResourceId != "" && event.MediaPackageResourceId != assetId {
+		previous = append(previous, event.MediaPackageResourceId)
+	}
+	for _, id := range previous {
+		if err := h.deleteAsset(id); err != nil {
+			return nil, fmt.Errorf("media-package-assets: main.Handler.HandleRequest: deleteAsset: %w", err)
+		}
+	}
+
 	input := &mediapackagevod.CreateAssetInput{
-		Id:               aws.String(randomId),
-		PackagingGroupId: aws.String(os.Getenv("GroupId")),
+		Id:               aws.String(assetId),
+		PackagingGroupId: aws.String(h.Config.GroupId),
 		SourceArn:        aws.String(arn),
-		SourceRoleArn:    aws.String(os.Getenv("MediaPackageVodRole")),
-		ResourceId:       aws.String(os.Getenv(randomId)),
-	}
-	input.Tags = map[string]*string{
-		"SolutionId": aws.String("vod-solution"),
+		SourceRoleArn:    aws.String(h.Config.MediaPackageVodRole),
+		ResourceId:       aws.String(assetId),
+		Tags:             assetTags(event.Tags),
 	}
 
-	inputJson, _ := json.Marshal(input)
-	log.Printf("Ingesting asset:: %s", inputJson)
+	slog.Info("INGESTING ASSET", "assetId", aws.StringValue(input.Id), "packagingGroupId", aws.StringValue(input.PackagingGroupId))
 
 	res, err := h.MediaPackageVodClient.CreateAsset(input)
 	if err != nil {
 		return nil, fmt.Errorf("media-package-assets: main.Handler.HandleRequest: CreateAsset: %w", err)
 	}
 
-	event.MediaPackageResourceId = randomId
-	event.EgressEndpoints, err = convertEndpoint(res.EgressEndpoints, event.CloudFront)
+	event.MediaPackageResourceId = assetId
+	event.EgressEndpoints, err = h.convertEndpoint(res.EgressEndpoints, event.CloudFront)
 	if err != nil {
 		return nil, fmt.Errorf("media-package-assets: main.Handler.HandleRequest: convertEndpoint: %w", err)
 	}
 
-	endpointJson, _ := json.Marshal(event.EgressEndpoints)
-	log.Printf("ENDPOINTS:: %s", endpointJson)
+	slog.Info("ENDPOINTS", "endpoints", event.EgressEndpoints)
 
 	return &event, nil
 }
 
+// sourcePlaylist returns the HLS playlist MediaPackage ingests, preferring
+// the CMAF one when the job template produced both.
+func sourcePlaylist(event MediaPackageAssetsEvent) (string, error) {
+	for _, playlist := range []*string{event.CmafHlsPlaylist, event.HlsPlaylist} {
+		if aws.StringValue(playlist) != "" {
+			return *playlist, nil
+		}
+	}
+	return "", ErrNoHlsOutput
+}
+
+// assetId is the MediaPackage asset and resource ID of the workflow, so
+// that each asset has one MediaPackage asset across reprocesses.
+func assetId(guid string) string {
+	return assetIdPattern.ReplaceAllString(guid, "-")
+}
+
+// assetTags adds the workflow record tags to the solution tag.
+func assetTags(tags map[string]string) map[string]*string {
+	assetTags := map[string]*string{}
+	for key, value := range tags {
+		assetTags[key] = aws.String(value)
+	}
+	assetTags["SolutionId"] = aws.String("vod-solution")
+	return assetTags
+}
+
+func (h *Handler) deleteAsset(id string) error {
+	_, err := h.MediaPackageVodClient.DeleteAsset(&mediapackagevod.DeleteAssetInput{
+		Id: aws.String(id),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == mediapackagevod.ErrCodeNotFoundException {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("DeleteAsset: %w", err)
+	}
+
+	slog.Info("DELETED PREVIOUS ASSET", "assetId", id)
+	return nil
+}
+
 func buildArnFromUri(s3Uri string) (string, error) {
 	const S3_URI_ID = "s3://"
 
-	if s3Uri[:len(S3_URI_ID)] != S3_URI_ID {
+	if !strings.HasPrefix(s3Uri, S3_URI_ID) {
 		return "", fmt.Errorf("invalid S3 URI: %s", s3Uri)
 	}
 
@@ -174,8 +255,8 @@ func buildArnFromUri(s3Uri string) (string, error) {
 	return fmt.Sprintf("arn:aws:s3:::%s", source), nil
 }
 
-func convertEndpoint(egressEndpoints []*mediapackagevod.EgressEndpoint, cloudFrontEndpoint string) (map[string]string, error) {
-	url, err := url.Parse(os.Getenv("GroupDomainName"))
+func (h *Handler) convertEndpoint(egressEndpoints []*mediapackagevod.EgressEndpoint, cloudFrontEndpoint string) (map[string]string, error) {
+	url, err := url.Parse(h.Config.GroupDomainName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CloudFront endpoint: %s", err)
 	}
@@ -199,17 +280,27 @@ func convertEndpoint(egressEndpoints []*mediapackagevod.EgressEndpoint, cloudFro
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
 	if err != nil {
 		log.Fatalf("Error creating session: %s", err)
 	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("media-package-assets: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	mediaPackageVodClient := mediapackagevod.New(sess)
 
 	handler := &Handler{
+		Config:                config,
 		MediaPackageVodClient: mediaPackageVodClient,
 	}
 
-	lambda.Start(handler.HanleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HanleRequest))
 }
@@ -2,10 +2,10 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/mediapackagevod"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -23,13 +23,24 @@ func (m *MediaPackageVodClientMock) CreateAsset(input *mediapackagevod.CreateAss
 	return args.Get(0).(*mediapackagevod.CreateAssetOutput), args.Error(1)
 }
 
+func (m *MediaPackageVodClientMock) DeleteAsset(input *mediapackagevod.DeleteAssetInput) (*mediapackagevod.DeleteAssetOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mediapackagevod.DeleteAssetOutput), args.Error(1)
+}
+
+var errAssetNotFound = awserr.New(mediapackagevod.ErrCodeNotFoundException, "asset not found", nil)
+
 const domainName = "https://random-id.egress.mediapackage-vod.ap-southeast-1.amazonaws.com"
 
 func TestMediaPackageAssets(t *testing.T) {
-	os.Setenv("DistributionId", "distributionId")
-	os.Setenv("GroupId", "groupId")
-	os.Setenv("GroupDomainName", domainName)
-	os.Setenv("MediaPackageVodRole", "role")
+	config := Config{
+		GroupId:             "groupId",
+		GroupDomainName:     domainName,
+		MediaPackageVodRole: "role",
+	}
 
 	t.Run("should success with valid parameters", func(t *testing.T) {
 		event := MediaPackageAssetsEvent{
@@ -60,15 +71,24 @@ func TestMediaPackageAssets(t *testing.T) {
 
 		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
 		handler := &Handler{
+			Config:                config,
 			MediaPackageVodClient: mediaPackageVodClientMock,
 		}
 
-		mediaPackageVodClientMock.On("CreateAsset", mock.Anything).Return(&createAssetResponse, nil)
+		mediaPackageVodClientMock.On("DeleteAsset", mock.Anything).Return(nil, errAssetNotFound)
+		var createInput *mediapackagevod.CreateAssetInput
+		mediaPackageVodClientMock.On("CreateAsset", mock.Anything).
+			Run(func(args mock.Arguments) { createInput = args.Get(0).(*mediapackagevod.CreateAssetInput) }).
+			Return(&createAssetResponse, nil)
 
 		res, err := handler.HanleRequest(event)
 		if err != nil {
 			t.Errorf("expect no error, got %v", err)
 		}
+		assert.Equal(t, "guid", *createInput.Id)
+		assert.Equal(t, "guid", *createInput.ResourceId)
+		assert.Equal(t, "arn:aws:s3:::my-bucket/video.m3u8", *createInput.SourceArn)
+		assert.Equal(t, "guid", res.MediaPackageResourceId)
 		assert.Equal(t, event.GUID, res.GUID)
 		assert.Equal(t, event.SrcVideo, res.SrcVideo)
 		assert.Equal(t, "https://random-id.cloudfront.net/out/index.m3u8", res.EgressEndpoints["HLS"])
@@ -84,15 +104,110 @@ func TestMediaPackageAssets(t *testing.T) {
 
 		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
 		handler := &Handler{
+			Config:                config,
 			MediaPackageVodClient: mediaPackageVodClientMock,
 		}
 
+		mediaPackageVodClientMock.On("DeleteAsset", mock.Anything).Return(nil, errAssetNotFound)
 		mediaPackageVodClientMock.On("CreateAsset", mock.Anything).Return(nil, assert.AnError)
 
 		_, err := handler.HanleRequest(event)
 		assert.NotNil(t, err)
 	})
 
+	t.Run("should prefer the CMAF HLS output", func(t *testing.T) {
+		event := MediaPackageAssetsEvent{
+			GUID:            "guid",
+			HlsPlaylist:     aws.String("s3://my-bucket/hls/video.m3u8"),
+			CmafHlsPlaylist: aws.String("s3://my-bucket/cmaf/video.m3u8"),
+		}
+
+		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
+		handler := &Handler{
+			Config:                config,
+			MediaPackageVodClient: mediaPackageVodClientMock,
+		}
+
+		mediaPackageVodClientMock.On("DeleteAsset", mock.Anything).Return(nil, errAssetNotFound)
+		var createInput *mediapackagevod.CreateAssetInput
+		mediaPackageVodClientMock.On("CreateAsset", mock.Anything).
+			Run(func(args mock.Arguments) { createInput = args.Get(0).(*mediapackagevod.CreateAssetInput) }).
+			Return(&mediapackagevod.CreateAssetOutput{}, nil)
+
+		_, err := handler.HanleRequest(event)
+		assert.Nil(t, err)
+		assert.Equal(t, "arn:aws:s3:::my-bucket/cmaf/video.m3u8", *createInput.SourceArn)
+	})
+
+	t.Run("should fail without an HLS output", func(t *testing.T) {
+		event := MediaPackageAssetsEvent{
+			GUID:         "guid",
+			DashPlaylist: aws.String("s3://my-bucket/dash/video.mpd"),
+		}
+
+		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
+		handler := &Handler{
+			Config:                config,
+			MediaPackageVodClient: mediaPackageVodClientMock,
+		}
+
+		_, err := handler.HanleRequest(event)
+		assert.ErrorIs(t, err, ErrNoHlsOutput)
+		mediaPackageVodClientMock.AssertNotCalled(t, "CreateAsset", mock.Anything)
+	})
+
+	t.Run("should replace the asset of a reprocessed workflow", func(t *testing.T) {
+		event := MediaPackageAssetsEvent{
+			GUID:                   "guid",
+			HlsPlaylist:            aws.String("s3://my-bucket/video.m3u8"),
+			MediaPackageResourceId: "5f0e8a0d9c1b2a3f4e5d6c7b8a9f0e1d",
+			Tags:                   map[string]string{"team": "news"},
+		}
+
+		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
+		handler := &Handler{
+			Config:                config,
+			MediaPackageVodClient: mediaPackageVodClientMock,
+		}
+
+		mediaPackageVodClientMock.On("DeleteAsset", &mediapackagevod.DeleteAssetInput{Id: aws.String("guid")}).Return(&mediapackagevod.DeleteAssetOutput{}, nil)
+		mediaPackageVodClientMock.On("DeleteAsset", &mediapackagevod.DeleteAssetInput{Id: aws.String("5f0e8a0d9c1b2a3f4e5d6c7b8a9f0e1d")}).Return(nil, errAssetNotFound)
+		var createInput *mediapackagevod.CreateAssetInput
+		mediaPackageVodClientMock.On("CreateAsset", mock.Anything).
+			Run(func(args mock.Arguments) { createInput = args.Get(0).(*mediapackagevod.CreateAssetInput) }).
+			Return(&mediapackagevod.CreateAssetOutput{}, nil)
+
+		res, err := handler.HanleRequest(event)
+		assert.Nil(t, err)
+		assert.Equal(t, "guid", res.MediaPackageResourceId)
+		assert.Equal(t, map[string]*string{"team": aws.String("news"), "SolutionId": aws.String("vod-solution")}, createInput.Tags)
+		mediaPackageVodClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should fail when the previous asset can't be deleted", func(t *testing.T) {
+		event := MediaPackageAssetsEvent{
+			GUID:        "guid",
+			HlsPlaylist: aws.String("s3://my-bucket/video.m3u8"),
+		}
+
+		mediaPackageVodClientMock := new(MediaPackageVodClientMock)
+		handler := &Handler{
+			Config:                config,
+			MediaPackageVodClient: mediaPackageVodClientMock,
+		}
+
+		mediaPackageVodClientMock.On("DeleteAsset", mock.Anything).Return(nil, assert.AnError)
+
+		_, err := handler.HanleRequest(event)
+		assert.ErrorIs(t, err, assert.AnError)
+		mediaPackageVodClientMock.AssertNotCalled(t, "CreateAsset", mock.Anything)
+	})
+
+	t.Run("should derive a valid asset ID from the GUID", func(t *testing.T) {
+		assert.Equal(t, "123e4567-e89b-12d3-a456-426614174000", assetId("123e4567-e89b-12d3-a456-426614174000"))
+		assert.Equal(t, "my-upload-1", assetId("my upload.1"))
+	})
+
 	t.Run("should correctly parse s3Uri without subfolders", func(t *testing.T) {
 		arn, err := buildArnFromUri("s3://my-bucket/video.m3u8")
 		assert.Nil(t, err)
@@ -106,5 +221,7 @@ func TestMediaPackageAssets(t *testing.T) {
 	t.Run("should fail when s3Uri is not in correct format", func(t *testing.T) {
 		_, err := buildArnFromUri("my-bucket/video.m3u8")
 		assert.NotNil(t, err)
+		_, err = buildArnFromUri("s3")
+		assert.NotNil(t, err)
 	})
 }
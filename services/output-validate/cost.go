@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+
+	"shared/claimcheck"
+)
+
+// The estimated MediaConvert cost of a publish is stored on the record as
+// cost. Each output is priced per minute by its kind: video outputs by
+// codec and resolution, with multipliers above 30 fps and for accelerated
+// transcoding, audio-only outputs and frame captures at their own rates.
+// The prices come from the CostPriceTable JSON, merged over the defaults
+// below, and the tenant is the value of the TenantTag asset tag. Each encode
+// is also recorded in the CostTable under the month its job completed in,
+// which the asset API's cost report sums.
+
+const (
+	OutputVideo        = "VIDEO"
+	OutputAudio        = "AUDIO"
+	OutputFrameCapture = "FRAME_CAPTURE"
+
+	defaultTenantTag = "tenant"
+	noTenant         = "unassigned"
+
+	// defaultPriceCodec prices the codecs the table does not list, and the
+	// outputs whose settings are not on the record.
+	defaultPriceCodec = "default"
+
+	highFrameRate = 30
+)
+
+// PriceTable is what MediaConvert charges per output minute.
+type PriceTable struct {
+	Currency string `json:"currency"`
+	// Video is the price by codec, as named in the job settings, and
+	// resolution, at up to 30 fps.
+	Video                   map[string]map[string]float64 `json:"video"`
+	Audio                   float64                       `json:"audio"`
+	FrameCapture            float64                       `json:"frameCapture"`
+	HighFrameRateMultiplier float64                       `json:"highFrameRateMultiplier"`
+	AcceleratedMultiplier   float64                       `json:"acceleratedMultiplier"`
+}
+
+// defaultPriceTable is close to the on-demand professional tier prices in
+// us-east-1. Set CostPriceTable to the prices of the account's region and
+// pricing plan.
+func defaultPriceTable() PriceTable {
+	return PriceTable{
+		Currency: "USD",
+		Video: map[string]map[string]float64{
+			defaultPriceCodec: {ResolutionSD: 0.0075, ResolutionHD: 0.015, ResolutionUHD: 0.03},
+			"H_264":           {ResolutionSD: 0.0075, ResolutionHD: 0.015, ResolutionUHD: 0.03},
+			"H_265":           {ResolutionSD: 0.0113, ResolutionHD: 0.0225, ResolutionUHD: 0.045},
+			"AV1":             {ResolutionSD: 0.0113, ResolutionHD: 0.0225, ResolutionUHD: 0.045},
+		},
+		Audio:                   0.0025,
+		FrameCapture:            0.0075,
+		HighFrameRateMultiplier: 2,
+		AcceleratedMultiplier:   1.6,
+	}
+}
+
+type CostEstimate struct {
+	Currency string       `json:"currency"`
+	Total    float64      `json:"total"`
+	Tenant   string       `json:"tenant"`
+	Outputs  []OutputCost `json:"outputs"`
+}
+
+type OutputCost struct {
+	Group       string  `json:"group"`
+	Kind        string  `json:"kind"`
+	Codec       string  `json:"codec,omitempty"`
+	Resolution  string  `json:"resolution,omitempty"`
+	FrameRate   float64 `json:"frameRate,omitempty"`
+	Accelerated bool    `json:"accelerated,omitempty"`
+	Minutes     float64 `json:"minutes"`
+	Cost        float64 `json:"cost"`
+}
+
+// UnmarshalText merges the CostPriceTable JSON over the default prices. A
+// table with unknown keys or negative prices fails the cold start rather
+// than every estimate.
+func (t *PriceTable) UnmarshalText(text []byte) error {
+	// the JSON is decoded as plain fields rather than through UnmarshalText
+	type plainPriceTable PriceTable
+	table := defaultPriceTable()
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode((*plainPriceTable)(&table)); err != nil {
+		return err
+	}
+
+	if table.Currency == "" {
+		return fmt.Errorf("currency is empty")
+	}
+	if table.Video[defaultPriceCodec] == nil {
+		return fmt.Errorf("video has no %s prices", defaultPriceCodec)
+	}
+	prices := map[string]float64{
+		"audio":                   table.Audio,
+		"frameCapture":            table.FrameCapture,
+		"highFrameRateMultiplier": table.HighFrameRateMultiplier,
+		"acceleratedMultiplier":   table.AcceleratedMultiplier,
+	}
+	for codec, resolutions := range table.Video {
+		for resolution, price := range resolutions {
+			prices[fmt.Sprintf("video.%s.%s", codec, resolution)] = price
+		}
+	}
+	for name, price := range prices {
+		if price < 0 {
+			return fmt.Errorf("%s is negative", name)
+		}
+	}
+
+	*t = table
+	return nil
+}
+
+// priceTable is the CostPriceTable, or the defaults when it is not set. A
+// table that was set always has default video prices.
+func (h *Handler) priceTable() PriceTable {
+	if h.Config.CostPriceTable.Video == nil {
+		return defaultPriceTable()
+	}
+	return h.Config.CostPriceTable
+}
+
+func (h *Handler) tenant(tags map[string]string) string {
+	key := h.Config.TenantTag
+	if key == "" {
+		key = defaultTenantTag
+	}
+	if value := tags[key]; value != "" {
+		return value
+	}
+	return noTenant
+}
+
+// estimateCost prices the outputs of a MediaConvert job. Jobs run by other
+// transcoders are not estimated, nor are jobs whose settings or acceleration
+// status could not be read, which are logged rather than failing the
+// publish.
+func (h *Handler) estimateCost(data *DynamoData, job *mediaconvert.CreateJobInput, acceleration string) *CostEstimate {
+	if data.Transcoder != TranscoderMediaConvert || job == nil || acceleration == "" {
+		return nil
+	}
+
+	table := h.priceTable()
+	sourceFrameRate := mediainfoFrameRate(data.SrcMediainfo)
+
+	estimate := &CostEstimate{
+		Currency: table.Currency,
+		Tenant:   h.tenant(data.Tags),
+		Outputs:  []OutputCost{},
+	}
+	for i, group := range data.EncodingOutput.OutputGroupDetails {
+		for j, output := range group.OutputDetails {
+			if output.DurationInMs <= 0 {
+				continue
+			}
+			cost := OutputCost{
+				Group:   group.Type,
+				Kind:    OutputAudio,
+				Minutes: float64(output.DurationInMs) / float64(time.Minute/time.Millisecond),
+			}
+
+			settings := jobOutput(job.Settings, i, j)
+			if output.VideoDetails != nil {
+				cost.Kind = OutputVideo
+				cost.Codec = defaultPriceCodec
+				cost.Resolution = outputResolution(output.VideoDetails)
+				cost.FrameRate = sourceFrameRate
+				if settings != nil && settings.VideoDescription != nil && settings.VideoDescription.CodecSettings != nil {
+					codec := settings.VideoDescription.CodecSettings
+					cost.Codec = aws.StringValue(codec.Codec)
+					if rate := specifiedFrameRate(codec); rate > 0 {
+						cost.FrameRate = rate
+					}
+				}
+				if cost.Codec == "FRAME_CAPTURE" {
+					cost.Kind = OutputFrameCapture
+					cost.Codec, cost.Resolution, cost.FrameRate = "", "", 0
+				}
+			}
+
+			var price float64
+			switch cost.Kind {
+			case OutputVideo:
+				prices, ok := table.Video[cost.Codec]
+				if !ok {
+					prices = table.Video[defaultPriceCodec]
+				}
+				price = prices[cost.Resolution]
+				if cost.FrameRate > highFrameRate {
+					price *= table.HighFrameRateMultiplier
+				}
+				if acceleration == mediaconvert.AccelerationStatusAccelerated {
+					cost.Accelerated = true
+					price *= table.AcceleratedMultiplier
+				}
+			case OutputAudio:
+				price = table.Audio
+			case OutputFrameCapture:
+				price = table.FrameCapture
+			}
+
+			cost.Cost = roundCost(cost.Minutes * price)
+			cost.Minutes = roundCost(cost.Minutes)
+			estimate.Total += cost.Cost
+			estimate.Outputs = append(estimate.Outputs, cost)
+		}
+	}
+	estimate.Total = roundCost(estimate.Total)
+
+	return estimate
+}
+
+// encodingJob is the job the asset was encoded with, read back from the
+// StateBucket when it was claim-checked.
+func (h *Handler) encodingJob(data *DynamoData) (*mediaconvert.CreateJobInput, error) {
+	job := data.EncodingJob
+	if data.EncodingJobRef != nil {
+		if err := claimcheck.Load(h.S3Client, *data.EncodingJobRef, &job); err != nil {
+			return nil, fmt.Errorf("claimcheck.Load: %w", err)
+		}
+	}
+	return &job, nil
+}
+
+// accelerationStatus is the acceleration MediaConvert reports for the job,
+// ACCELERATED or NOT_ACCELERATED, which the job is billed and counted by. A
+// PREFERRED job runs without acceleration when the source does not allow
+// it, so the status is used rather than the mode the job was submitted
+// with. Jobs submitted without acceleration and jobs of other transcoders
+// are NOT_APPLICABLE.
+func (h *Handler) accelerationStatus(data *DynamoData) (string, error) {
+	if data.Transcoder != TranscoderMediaConvert || data.AcceleratedTranscoding == "" || data.AcceleratedTranscoding == "DISABLED" {
+		return mediaconvert.AccelerationStatusNotApplicable, nil
+	}
+
+	job, err := h.MediaConvertClient.GetJob(&mediaconvert.GetJobInput{
+		Id: aws.String(data.EncodingOutput.JobId),
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetJob: %w", err)
+	}
+	return aws.StringValue(job.Job.AccelerationStatus), nil
+}
+
+// CostEntry is the estimate of one encode. Entries are keyed on the month
+// the job completed in and the job id, so a retried publish overwrites its
+// entry and a reprocessed asset counts in every month it was encoded in.
+type CostEntry struct {
+	Month        string        `json:"month"`
+	JobId        string        `json:"jobId"`
+	GUID         string        `json:"guid"`
+	WorkflowName string        `json:"workflowName"`
+	CompletedAt  string        `json:"completedAt"`
+	Cost         *CostEstimate `json:"cost"`
+}
+
+// recordCost stores the estimate in the CostTable, when it is set.
+func (h *Handler) recordCost(data *DynamoData, completedAt time.Time) error {
+	if h.Config.CostTable == "" || data.Cost == nil {
+		return nil
+	}
+
+	item, err := dynamodbattribute.MarshalMap(CostEntry{
+		Month:        completedAt.UTC().Format("2006-01"),
+		JobId:        data.EncodingOutput.JobId,
+		GUID:         data.GUID,
+		WorkflowName: data.WorkflowName,
+		CompletedAt:  completedAt.UTC().Format(time.RFC3339),
+		Cost:         data.Cost,
+	})
+	if err != nil {
+		return fmt.Errorf("MarshalMap: %w", err)
+	}
+
+	_, err = h.DynamoDBClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(h.Config.CostTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("PutItem: %w", err)
+	}
+	return nil
+}
+
+// jobOutput is the settings of an output of the job, found at the same
+// positions as its output details in the completion event.
+func jobOutput(settings *mediaconvert.JobSettings, group, output int) *mediaconvert.Output {
+	if settings == nil || group >= len(settings.OutputGroups) {
+		return nil
+	}
+	outputs := settings.OutputGroups[group].Outputs
+	if output >= len(outputs) {
+		return nil
+	}
+	return outputs[output]
+}
+
+// specifiedFrameRate is the frame rate set in the codec settings, 0 when the
+// output follows the source.
+func specifiedFrameRate(codec *mediaconvert.VideoCodecSettings) float64 {
+	var control *string
+	var numerator, denominator *int64
+	switch {
+	case codec.H264Settings != nil:
+		control, numerator, denominator = codec.H264Settings.FramerateControl, codec.H264Settings.FramerateNumerator, codec.H264Settings.FramerateDenominator
+	case codec.H265Settings != nil:
+		control, numerator, denominator = codec.H265Settings.FramerateControl, codec.H265Settings.FramerateNumerator, codec.H265Settings.FramerateDenominator
+	case codec.Av1Settings != nil:
+		control, numerator, denominator = codec.Av1Settings.FramerateControl, codec.Av1Settings.FramerateNumerator, codec.Av1Settings.FramerateDenominator
+	case codec.Mpeg2Settings != nil:
+		control, numerator, denominator = codec.Mpeg2Settings.FramerateControl, codec.Mpeg2Settings.FramerateNumerator, codec.Mpeg2Settings.FramerateDenominator
+	default:
+		return 0
+	}
+	if aws.StringValue(control) != "SPECIFIED" || aws.Int64Value(denominator) == 0 {
+		return 0
+	}
+	return float64(aws.Int64Value(numerator)) / float64(aws.Int64Value(denominator))
+}
+
+// mediainfoFrameRate is the frame rate of the source's first video track, 0
+// when mediainfo did not report one.
+func mediainfoFrameRate(srcMediainfo string) float64 {
+	var mediainfo struct {
+		Video []struct {
+			Framerate float64 `json:"framerate"`
+		} `json:"video"`
+	}
+	if err := json.Unmarshal([]byte(srcMediainfo), &mediainfo); err != nil || len(mediainfo.Video) == 0 {
+		return 0
+	}
+	return mediainfo.Video[0].Framerate
+}
+
+// roundCost keeps six decimals, below a thousandth of a cent.
+func roundCost(value float64) float64 {
+	return math.Round(value*1e6) / 1e6
+}
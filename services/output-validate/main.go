@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -16,8 +17,16 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/claimcheck"
+	"shared/emf"
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "output-validate"
+
 type EventDetail struct {
 	Timestamp          int64                `json:"timestamp"`
 	AccountId          string               `json:"accountId"`
@@ -75,26 +84,38 @@ type DynamoData struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
+	RetentionPolicy        string                      `json:"retentionPolicy,omitempty"`
+	RetentionDays          int                         `json:"retentionDays,omitempty"`
+	RetentionDueAt         string                      `json:"retentionDueAt,omitempty"`
+	Tags                   map[string]string           `json:"tags,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
+	Transcoder             string                      `json:"transcoder,omitempty"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
+	Cost                   *CostEstimate               `json:"cost,omitempty"`
+	Version                int64                       `json:"version,omitempty"`
 
 	// Output
-	HlsPlaylist      *string   `json:"hlsPlaylist"`
-	HlsUrl           *string   `json:"hlsUrl"`
-	DashPlaylist     *string   `json:"dashPlaylist"`
-	DashUrl          *string   `json:"dashUrl"`
-	Mp4Outputs       []*string `json:"mp4Outputs"`
-	Mp4Urls          []*string `json:"mp4Urls"`
-	MssPlaylist      *string   `json:"mssPlaylist"`
-	MssUrl           *string   `json:"mssUrl"`
-	CmafDashPlaylist *string   `json:"cmafDashPlaylist"`
-	CmafDashUrl      *string   `json:"cmafDashUrl"`
-	CmafHlsPlaylist  *string   `json:"cmafHlsPlaylist"`
-	CmafHlsUrl       *string   `json:"cmafHlsUrl"`
-	ThumbNails       []*string `json:"thumbNails"`
-	ThumbNailsUrls   []*string `json:"thumbNailsUrls"`
+	HlsPlaylist            *string   `json:"hlsPlaylist"`
+	HlsUrl                 *string   `json:"hlsUrl"`
+	DashPlaylist           *string   `json:"dashPlaylist"`
+	DashUrl                *string   `json:"dashUrl"`
+	Mp4Outputs             []*string `json:"mp4Outputs"`
+	Mp4Urls                []*string `json:"mp4Urls"`
+	MssPlaylist            *string   `json:"mssPlaylist"`
+	MssUrl                 *string   `json:"mssUrl"`
+	CmafDashPlaylist       *string   `json:"cmafDashPlaylist"`
+	CmafDashUrl            *string   `json:"cmafDashUrl"`
+	CmafHlsPlaylist        *string   `json:"cmafHlsPlaylist"`
+	CmafHlsUrl             *string   `json:"cmafHlsUrl"`
+	ThumbNails             []*string `json:"thumbNails"`
+	ThumbNailsUrls         []*string `json:"thumbNailsUrls"`
+	MediaPackageResourceId string    `json:"mediaPackageResourceId,omitempty"`
 }
 
 type Warning struct {
@@ -105,32 +126,62 @@ type Warning struct {
 type UserMetadata struct {
 	GUID     string `json:"guid"`
 	Workflow string `json:"workflow"`
+	// SubmittedAt is when encode submitted the job, in RFC 3339.
+	SubmittedAt string `json:"submittedAt,omitempty"`
 }
 
 type DynamoDBClient interface {
 	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+}
+type MediaConvertClient interface {
+	GetJob(input *mediaconvert.GetJobInput) (*mediaconvert.GetJobOutput, error)
 }
 type S3Client interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error)
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+	emf.MetricsConfig
+	claimcheck.ClaimCheckConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// FfmpegEventSource is the source of the ffmpeg backend's job events,
+	// vod.ffmpeg when empty.
+	FfmpegEventSource string `env:"FfmpegEventSource"`
+	// CostPriceTable is the JSON merged over the default prices.
+	CostPriceTable PriceTable `env:"CostPriceTable"`
+	// CostTable records the estimate of every encode when it is set.
+	CostTable string `env:"CostTable"`
+	// TenantTag is the asset tag naming the tenant, tenant when empty.
+	TenantTag string `env:"TenantTag"`
 }
 
 type Handler struct {
-	DynamoDBClient DynamoDBClient
-	S3Client       S3Client
+	Config             Config
+	DynamoDBClient     DynamoDBClient
+	S3Client           S3Client
+	MediaConvertClient MediaConvertClient
 }
 
 func (h *Handler) HandleRequest(event events.EventBridgeEvent) (*DynamoData, error) {
-	eventJson, _ := json.Marshal(event)
-	log.Printf("REQUEST:: %s", eventJson)
-
 	var eventDetail EventDetail
 	err := json.Unmarshal(event.Detail, &eventDetail)
 	if err != nil {
 		return nil, fmt.Errorf("output-validate: main.Handler.HandleRequest: json.Unmarshal: %w", err)
 	}
+	backend, err := h.transcoder(event.Source)
+	if err != nil {
+		return nil, fmt.Errorf("output-validate: main.Handler.HandleRequest: %w", err)
+	}
 
+	// the version read here is the one DynamoDB Update (Publish) expects
 	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(os.Getenv("DynamoDBTable")),
+		TableName:      aws.String(h.Config.DynamoDBTable),
+		ConsistentRead: aws.Bool(true),
 		Key: map[string]*dynamodb.AttributeValue{
 			"guid": {
 				S: aws.String(eventDetail.UserMetadata.GUID),
@@ -153,15 +204,17 @@ func (h *Handler) HandleRequest(event events.EventBridgeEvent) (*DynamoData, err
 	}
 
 	dynamoData.EncodingOutput = eventDetail
+	dynamoData.Transcoder = backend
 	dynamoData.EndTime = time.Now().UTC()
 	dynamoData.WorkflowStatus = "Complete"
+	dynamoData.RetentionDueAt = retentionDueAt(dynamoData.RetentionPolicy, dynamoData.RetentionDays, dynamoData.EndTime)
 
 	if len(eventDetail.OutputGroupDetails) == 0 {
 		return nil, fmt.Errorf("output-validate: main.Handler.HandleRequest: no output group details found")
 	}
 
 	for _, outputGroupDetail := range eventDetail.OutputGroupDetails {
-		log.Printf("%s found in outputs", outputGroupDetail.Type)
+		slog.Debug("OUTPUT GROUP", "type", outputGroupDetail.Type)
 
 		switch outputGroupDetail.Type {
 		case "HLS_GROUP":
@@ -223,15 +276,56 @@ func (h *Handler) HandleRequest(event events.EventBridgeEvent) (*DynamoData, err
 		dynamoData.ThumbNailsUrls = thumbNailsUrls
 	}
 
+	// the cost and the metrics are taken from the same job settings and
+	// acceleration status
+	job, err := h.encodingJob(&dynamoData)
+	if err != nil {
+		slog.Warn("ENCODING JOB NOT READ", "error", err)
+	}
+	acceleration, err := h.accelerationStatus(&dynamoData)
+	if err != nil {
+		slog.Warn("ACCELERATION STATUS UNKNOWN", "error", err)
+	}
+	dynamoData.Cost = h.estimateCost(&dynamoData, job, acceleration)
+	// the entry is billed in the month MediaConvert completed the job
+	completedAt := event.Time
+	if eventDetail.Timestamp > 0 {
+		completedAt = time.UnixMilli(eventDetail.Timestamp)
+	}
+	if err := h.recordCost(&dynamoData, completedAt); err != nil {
+		return nil, fmt.Errorf("output-validate: main.Handler.HandleRequest: recordCost: %w", err)
+	}
+	h.putWorkflowMetrics(&dynamoData, job, acceleration)
+
+	encodingOutputRef, err := h.Config.Offload(h.S3Client, dynamoData.GUID, "encodingOutput", dynamoData.EncodingOutput)
+	if err != nil {
+		return nil, fmt.Errorf("output-validate: main.Handler.HandleRequest: Offload: %w", err)
+	}
+	if encodingOutputRef != nil {
+		dynamoData.EncodingOutput = EventDetail{}
+		dynamoData.EncodingOutputRef = encodingOutputRef
+	}
+
 	return &dynamoData, nil
 }
 
+// retentionDueAt is when the retention-sweeper applies a DELETE or ARCHIVE
+// policy, counted from this publish; a reprocess moves it.
+func retentionDueAt(policy string, days int, publishedAt time.Time) string {
+	if policy == "" || policy == "KEEP" {
+		return ""
+	}
+	return publishedAt.AddDate(0, 0, days).UTC().Format(time.RFC3339)
+}
+
 func buildUrl(s3Path string) string {
 	s := strings.Split(s3Path, "/")
 	return fmt.Sprintf("%s/%s/%s", s[len(s)-3], s[len(s)-2], s[len(s)-1])
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(
 		&aws.Config{
 			Region: aws.String(os.Getenv("AWS_REGION")),
@@ -241,13 +335,21 @@ func main() {
 		log.Fatalf("Failed to create session: %s", err)
 	}
 
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("output-validate: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	dynamoClient := dynamodb.New(sess)
 	s3Client := s3.New(sess)
 
 	handler := Handler{
-		DynamoDBClient: dynamoClient,
-		S3Client:       s3Client,
+		Config:             config,
+		DynamoDBClient:     dynamoClient,
+		S3Client:           s3Client,
+		MediaConvertClient: mediaconvert.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
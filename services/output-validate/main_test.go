@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"shared/claimcheck"
+	"shared/emf"
+	"shared/envconfig"
+	"shared/logging"
 )
 
 type DynamoClientMock struct {
@@ -28,6 +40,43 @@ func (m *DynamoClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetI
 	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
 }
 
+func (m *DynamoClientMock) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.PutItemOutput), args.Error(1)
+}
+
+type MediaConvertClientMock struct {
+	mock.Mock
+}
+
+func (m *MediaConvertClientMock) GetJob(input *mediaconvert.GetJobInput) (*mediaconvert.GetJobOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*mediaconvert.GetJobOutput), args.Error(1)
+}
+
+// accelerationStatus reports every job with status.
+func accelerationStatus(status string) *MediaConvertClientMock {
+	mediaConvertClientMock := new(MediaConvertClientMock)
+	mediaConvertClientMock.On("GetJob", mock.Anything).Return(&mediaconvert.GetJobOutput{
+		Job: &mediaconvert.Job{AccelerationStatus: aws.String(status)},
+	}, nil)
+	return mediaConvertClientMock
+}
+
+func (m *S3ClientMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
 func (m *S3ClientMock) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
 	args := m.Called(input)
 	if args.Get(0) == nil {
@@ -36,6 +85,14 @@ func (m *S3ClientMock) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsO
 	return args.Get(0).(*s3.ListObjectsOutput), args.Error(1)
 }
 
+func (m *S3ClientMock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
 func TestOutputValidate(t *testing.T) {
 	t.Run("should success on parsing CMAF MSS output", func(t *testing.T) {
 		dynamoClientMock := new(DynamoClientMock)
@@ -258,4 +315,397 @@ func TestOutputValidate(t *testing.T) {
 		assert.Equal(t, *res.ThumbNailsUrls[0], "https://cloudfront/12345/thumbnails/dude3.000.jpg")
 	})
 
+	t.Run("should offload encodingOutput to the StateBucket when it exceeds the threshold", func(t *testing.T) {
+		dynamoClientMock := new(DynamoClientMock)
+		s3ClientMock := new(S3ClientMock)
+
+		handler := Handler{
+			Config:         Config{ClaimCheckConfig: claimcheck.ClaimCheckConfig{StateBucket: "vod-state", ClaimCheckThreshold: 300}},
+			DynamoDBClient: dynamoClientMock,
+			S3Client:       s3ClientMock,
+		}
+
+		hlsDashBytes, _ := json.Marshal(HlsDash)
+		event := events.CloudWatchEvent{
+			Detail: hlsDashBytes,
+		}
+
+		data := &dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"guid": {
+					S: aws.String("guid"),
+				},
+				"cloudFront": {
+					S: aws.String("cloudfront"),
+				},
+				"frameCapture": {
+					BOOL: aws.Bool(false),
+				},
+			},
+		}
+
+		dynamoClientMock.On("GetItem", mock.Anything).Return(data, nil)
+		s3ClientMock.On("PutObject", mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+			return *input.Bucket == "vod-state" && *input.Key == "guid/state/encodingOutput.json"
+		})).Return(&s3.PutObjectOutput{}, nil)
+
+		res, err := handler.HandleRequest(event)
+		assert.Nil(t, err)
+		assert.Equal(t, "s3://vod-state/guid/state/encodingOutput.json", *res.EncodingOutputRef)
+		assert.Empty(t, res.EncodingOutput.OutputGroupDetails)
+		assert.Equal(t, "https://cloudfront/12345/hls/dude.m3u8", *res.HlsUrl)
+		s3ClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should record the transcoder that completed the job", func(t *testing.T) {
+		hlsBytes, _ := json.Marshal(HlsDash)
+		data := &dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"guid":       {S: aws.String("guid")},
+				"cloudFront": {S: aws.String("cloudfront")},
+			},
+		}
+
+		for source, backend := range map[string]string{"aws.mediaconvert": "MEDIACONVERT", "vod.ffmpeg": "FFMPEG"} {
+			dynamoClientMock := new(DynamoClientMock)
+			dynamoClientMock.On("GetItem", mock.Anything).Return(data, nil)
+			s3ClientMock := new(S3ClientMock)
+			handler := Handler{
+				DynamoDBClient: dynamoClientMock,
+				S3Client:       s3ClientMock,
+			}
+
+			res, err := handler.HandleRequest(events.CloudWatchEvent{Source: source, Detail: hlsBytes})
+			assert.Nil(t, err)
+			assert.Equal(t, backend, res.Transcoder)
+			assert.Equal(t, "https://cloudfront/12345/hls/dude.m3u8", *res.HlsUrl)
+		}
+
+		handler := Handler{DynamoDBClient: new(DynamoClientMock)}
+		_, err := handler.HandleRequest(events.CloudWatchEvent{Source: "aws.elastictranscoder", Detail: hlsBytes})
+		assert.ErrorIs(t, err, ErrUnknownSource)
+	})
+}
+
+func TestRetentionDueAt(t *testing.T) {
+	publishedAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, "2026-11-18T12:00:00Z", retentionDueAt("DELETE", 30, publishedAt))
+	assert.Equal(t, "2026-10-19T12:00:00Z", retentionDueAt("ARCHIVE", 0, publishedAt))
+	assert.Equal(t, "", retentionDueAt("KEEP", 30, publishedAt))
+	assert.Equal(t, "", retentionDueAt("", 0, publishedAt))
+}
+
+// metricDocuments runs fn and returns the EMF documents it wrote.
+func metricDocuments(t *testing.T, fn func()) []map[string]interface{} {
+	var buf bytes.Buffer
+	output := logging.Output
+	logging.Output = &buf
+	defer func() { logging.Output = output }()
+
+	fn()
+
+	var documents []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var document map[string]interface{}
+		if json.Unmarshal([]byte(line), &document) == nil && document["_aws"] != nil {
+			documents = append(documents, document)
+		}
+	}
+	return documents
+}
+
+func TestWorkflowMetrics(t *testing.T) {
+	startTime := time.Now().UTC().Add(-10 * time.Minute)
+	submittedAt := startTime.Add(5 * time.Minute).Truncate(time.Second)
+	detail := EventDetail{
+		JobId:     "job-1",
+		Status:    "COMPLETE",
+		Timestamp: submittedAt.Add(90 * time.Second).UnixMilli(),
+		UserMetadata: UserMetadata{
+			GUID:        "guid",
+			Workflow:    "vod",
+			SubmittedAt: submittedAt.Format(time.RFC3339),
+		},
+		OutputGroupDetails: []*OutputGroupDetail{{
+			Type:              "HLS_GROUP",
+			PlaylistFilePaths: []*string{aws.String("s3://vod-destination/guid/hls/dude.m3u8")},
+			OutputDetails: []*OutputDetail{
+				{DurationInMs: 60000, VideoDetails: &VideoDetail{WidthInPx: 1920, HeightInPx: 1080, AverageBitrate: 5000000}},
+				{DurationInMs: 60000, VideoDetails: &VideoDetail{WidthInPx: 1280, HeightInPx: 720, AverageBitrate: 3000000}},
+				{DurationInMs: 60000, VideoDetails: &VideoDetail{WidthInPx: 640, HeightInPx: 360, AverageBitrate: 1000000}},
+				{DurationInMs: 60000},
+			},
+		}},
+	}
+	detailBytes, _ := json.Marshal(detail)
+
+	dynamoClientMock := new(DynamoClientMock)
+	dynamoClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"guid":                   {S: aws.String("guid")},
+			"workflowName":           {S: aws.String("vod")},
+			"startTime":              {S: aws.String(startTime.Format("2006-01-02T15:04:05.000Z"))},
+			"encodingProfile":        {N: aws.String("1080")},
+			"acceleratedTranscoding": {S: aws.String("PREFERRED")},
+			"destBucket":             {S: aws.String("vod-destination")},
+			"cloudFront":             {S: aws.String("cloudfront")},
+		},
+	}, nil)
+	handler := Handler{
+		Config:             Config{MetricsConfig: emf.MetricsConfig{MetricsNamespace: "VideoOnDemand"}},
+		DynamoDBClient:     dynamoClientMock,
+		S3Client:           new(S3ClientMock),
+		MediaConvertClient: accelerationStatus(mediaconvert.AccelerationStatusAccelerated),
+	}
+
+	documents := metricDocuments(t, func() {
+		res, err := handler.HandleRequest(events.CloudWatchEvent{Source: "aws.mediaconvert", Detail: detailBytes})
+		assert.Nil(t, err)
+		assert.NotNil(t, res)
+	})
+
+	assert.Len(t, documents, 4)
+	workflow := documents[0]
+	assert.Equal(t, "vod", workflow["workflow"])
+	assert.Equal(t, "1080", workflow["encodingProfile"])
+	assert.Equal(t, "guid", workflow["guid"])
+	assert.InDelta(t, 600, workflow["WorkflowDuration"], 5)
+	assert.Equal(t, float64(90), workflow["TranscodeTime"])
+	assert.Equal(t, float64(67500000), workflow["OutputBytes"])
+	assert.Equal(t, map[string]interface{}{
+		"Namespace":  "VideoOnDemand",
+		"Dimensions": []interface{}{[]interface{}{"encodingProfile", "workflow"}, []interface{}{"workflow"}},
+		"Metrics": []interface{}{
+			map[string]interface{}{"Name": "WorkflowDuration", "Unit": "Seconds"},
+			map[string]interface{}{"Name": "TranscodeTime", "Unit": "Seconds"},
+			map[string]interface{}{"Name": "OutputBytes", "Unit": "Bytes"},
+		},
+	}, workflow["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0])
+
+	cost := documents[1]
+	assert.Equal(t, "unassigned", cost["tenant"])
+	assert.Equal(t, 0.0625, cost["EstimatedCost"])
+
+	minutes := map[string]interface{}{}
+	for _, document := range documents[2:] {
+		// the status MediaConvert reports, not the PREFERRED mode requested
+		assert.Equal(t, "ACCELERATED", document["acceleration"])
+		minutes[document["resolution"].(string)] = document["EncodeMinutes"]
+	}
+	assert.Equal(t, map[string]interface{}{"HD": float64(2), "SD": float64(1)}, minutes)
+
+	assert.Equal(t, map[string]float64{ResolutionUHD: 0.5}, encodedMinutes(EventDetail{
+		OutputGroupDetails: []*OutputGroupDetail{{OutputDetails: []*OutputDetail{
+			{DurationInMs: 30000, VideoDetails: &VideoDetail{WidthInPx: 2160, HeightInPx: 3840}},
+		}}},
+	}))
+
+	// the audio bitrate comes from the output's settings
+	assert.Equal(t, int64(2620000), outputBytes(EventDetail{
+		OutputGroupDetails: []*OutputGroupDetail{{OutputDetails: []*OutputDetail{
+			{DurationInMs: 10000, VideoDetails: &VideoDetail{WidthInPx: 1280, HeightInPx: 720, AverageBitrate: 2000000}},
+		}}},
+	}, &mediaconvert.CreateJobInput{Settings: &mediaconvert.JobSettings{
+		OutputGroups: []*mediaconvert.OutputGroup{{Outputs: []*mediaconvert.Output{{
+			AudioDescriptions: []*mediaconvert.AudioDescription{{CodecSettings: &mediaconvert.AudioCodecSettings{
+				AacSettings: &mediaconvert.AacSettings{Bitrate: aws.Int64(96000)},
+			}}},
+		}}}},
+	}}))
+}
+
+func TestEstimateCost(t *testing.T) {
+	detail := EventDetail{
+		OutputGroupDetails: []*OutputGroupDetail{
+			{
+				Type: "HLS_GROUP",
+				OutputDetails: []*OutputDetail{
+					{DurationInMs: 120000, VideoDetails: &VideoDetail{WidthInPx: 1920, HeightInPx: 1080}},
+					{DurationInMs: 120000, VideoDetails: &VideoDetail{WidthInPx: 3840, HeightInPx: 2160}},
+					{DurationInMs: 120000},
+				},
+			},
+			{
+				Type: "FILE_GROUP",
+				OutputDetails: []*OutputDetail{
+					{DurationInMs: 120000, VideoDetails: &VideoDetail{WidthInPx: 1280, HeightInPx: 720}},
+				},
+			},
+		},
+	}
+	job := mediaconvert.CreateJobInput{
+		Settings: &mediaconvert.JobSettings{
+			OutputGroups: []*mediaconvert.OutputGroup{
+				{Outputs: []*mediaconvert.Output{
+					{VideoDescription: &mediaconvert.VideoDescription{CodecSettings: &mediaconvert.VideoCodecSettings{
+						Codec: aws.String("H_264"),
+						H264Settings: &mediaconvert.H264Settings{
+							FramerateControl:     aws.String("SPECIFIED"),
+							FramerateNumerator:   aws.Int64(60000),
+							FramerateDenominator: aws.Int64(1001),
+						},
+					}}},
+					{VideoDescription: &mediaconvert.VideoDescription{CodecSettings: &mediaconvert.VideoCodecSettings{
+						Codec:        aws.String("H_265"),
+						H265Settings: &mediaconvert.H265Settings{FramerateControl: aws.String("INITIALIZE_FROM_SOURCE")},
+					}}},
+					{},
+				}},
+				{Outputs: []*mediaconvert.Output{
+					{VideoDescription: &mediaconvert.VideoDescription{CodecSettings: &mediaconvert.VideoCodecSettings{
+						Codec: aws.String("FRAME_CAPTURE"),
+					}}},
+				}},
+			},
+		},
+	}
+	// estimateCost reads the job and its acceleration status as HandleRequest
+	// does
+	estimateCost := func(handler *Handler, data *DynamoData) *CostEstimate {
+		job, err := handler.encodingJob(data)
+		require.NoError(t, err)
+		acceleration, err := handler.accelerationStatus(data)
+		require.NoError(t, err)
+		return handler.estimateCost(data, job, acceleration)
+	}
+	record := func() *DynamoData {
+		return &DynamoData{
+			GUID:           "guid",
+			Transcoder:     TranscoderMediaConvert,
+			SrcMediainfo:   `{"video":[{"framerate":25}]}`,
+			Tags:           map[string]string{"tenant": "acme"},
+			EncodingJob:    job,
+			EncodingOutput: detail,
+		}
+	}
+
+	t.Run("should price each output by kind, codec, resolution and frame rate", func(t *testing.T) {
+		handler := Handler{S3Client: new(S3ClientMock)}
+
+		estimate := estimateCost(&handler, record())
+		assert.Equal(t, "USD", estimate.Currency)
+		assert.Equal(t, "acme", estimate.Tenant)
+		assert.Equal(t, []OutputCost{
+			{Group: "HLS_GROUP", Kind: OutputVideo, Codec: "H_264", Resolution: ResolutionHD, FrameRate: 60000.0 / 1001, Minutes: 2, Cost: 0.06},
+			{Group: "HLS_GROUP", Kind: OutputVideo, Codec: "H_265", Resolution: ResolutionUHD, FrameRate: 25, Minutes: 2, Cost: 0.09},
+			{Group: "HLS_GROUP", Kind: OutputAudio, Minutes: 2, Cost: 0.005},
+			{Group: "FILE_GROUP", Kind: OutputFrameCapture, Minutes: 2, Cost: 0.015},
+		}, estimate.Outputs)
+		assert.Equal(t, 0.17, estimate.Total)
+	})
+
+	t.Run("should apply the configured price table and tenant tag", func(t *testing.T) {
+		var table PriceTable
+		require.NoError(t, table.UnmarshalText([]byte(`{"currency":"EUR","video":{"H_265":{"UHD":0.1}},"acceleratedMultiplier":2}`)))
+		handler := Handler{
+			Config: Config{
+				CostPriceTable: table,
+				TenantTag:      "customer",
+			},
+			S3Client:           new(S3ClientMock),
+			MediaConvertClient: accelerationStatus(mediaconvert.AccelerationStatusAccelerated),
+		}
+
+		data := record()
+		data.AcceleratedTranscoding = "ENABLED"
+		estimate := estimateCost(&handler, data)
+		assert.Equal(t, "EUR", estimate.Currency)
+		assert.Equal(t, noTenant, estimate.Tenant)
+		assert.Equal(t, 0.4, estimate.Outputs[1].Cost)
+		assert.True(t, estimate.Outputs[1].Accelerated)
+		// the codecs left out of the table keep their default prices
+		assert.Equal(t, 0.12, estimate.Outputs[0].Cost)
+	})
+
+	t.Run("should price PREFERRED jobs by the acceleration they ran with", func(t *testing.T) {
+		mediaConvertClientMock := accelerationStatus(mediaconvert.AccelerationStatusNotAccelerated)
+		handler := Handler{S3Client: new(S3ClientMock), MediaConvertClient: mediaConvertClientMock}
+
+		data := record()
+		data.AcceleratedTranscoding = "PREFERRED"
+		data.EncodingOutput.JobId = "job-1"
+		estimate := estimateCost(&handler, data)
+		assert.Equal(t, 0.17, estimate.Total)
+		assert.False(t, estimate.Outputs[0].Accelerated)
+		mediaConvertClientMock.AssertCalled(t, "GetJob", &mediaconvert.GetJobInput{Id: aws.String("job-1")})
+
+		handler.MediaConvertClient = accelerationStatus(mediaconvert.AccelerationStatusAccelerated)
+		assert.True(t, estimateCost(&handler, data).Outputs[0].Accelerated)
+	})
+
+	t.Run("should reject an invalid price table at cold start", func(t *testing.T) {
+		t.Setenv("DynamoDBTable", "vod")
+		for _, table := range []string{
+			`{"video":`,
+			`{"vidoe":{"H_264":{"HD":0.01}}}`,
+			`{"audio":-1}`,
+			`{"video":{"default":null}}`,
+		} {
+			t.Setenv("CostPriceTable", table)
+			var config Config
+			assert.ErrorIs(t, envconfig.Load(&config, nil), envconfig.ErrInvalid, table)
+		}
+
+		t.Setenv("CostPriceTable", `{"currency":"EUR"}`)
+		var config Config
+		require.NoError(t, envconfig.Load(&config, nil))
+		assert.Equal(t, "EUR", config.CostPriceTable.Currency)
+		assert.Equal(t, defaultPriceTable().Video, config.CostPriceTable.Video)
+	})
+
+	t.Run("should read an offloaded encodingJob from the StateBucket", func(t *testing.T) {
+		s3ClientMock := new(S3ClientMock)
+		jobBytes, _ := json.Marshal(job)
+		s3ClientMock.On("GetObject", &s3.GetObjectInput{
+			Bucket: aws.String("vod-state"),
+			Key:    aws.String("guid/state/encodingJob.json"),
+		}).Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(jobBytes))}, nil)
+		handler := Handler{S3Client: s3ClientMock}
+
+		data := record()
+		data.EncodingJob = mediaconvert.CreateJobInput{}
+		data.EncodingJobRef = aws.String("s3://vod-state/guid/state/encodingJob.json")
+		assert.Equal(t, 0.17, estimateCost(&handler, data).Total)
+		s3ClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should record the estimate under the month the job completed", func(t *testing.T) {
+		dynamoClientMock := new(DynamoClientMock)
+		var input *dynamodb.PutItemInput
+		dynamoClientMock.On("PutItem", mock.Anything).Return(&dynamodb.PutItemOutput{}, nil).Run(func(args mock.Arguments) {
+			input = args.Get(0).(*dynamodb.PutItemInput)
+		})
+		handler := Handler{Config: Config{CostTable: "vod-costs"}, DynamoDBClient: dynamoClientMock}
+
+		data := record()
+		data.WorkflowName = "vod"
+		data.EncodingOutput.JobId = "job-1"
+		data.Cost = &CostEstimate{Currency: "USD", Total: 0.005, Tenant: "acme", Outputs: []OutputCost{{Group: "HLS_GROUP", Kind: OutputAudio, Minutes: 2, Cost: 0.005}}}
+		require.NoError(t, handler.recordCost(data, time.Date(2024, 3, 31, 23, 59, 0, 0, time.UTC)))
+
+		assert.Equal(t, "vod-costs", aws.StringValue(input.TableName))
+		var entry CostEntry
+		require.NoError(t, dynamodbattribute.UnmarshalMap(input.Item, &entry))
+		assert.Equal(t, CostEntry{
+			Month:        "2024-03",
+			JobId:        "job-1",
+			GUID:         "guid",
+			WorkflowName: "vod",
+			CompletedAt:  "2024-03-31T23:59:00Z",
+			Cost:         data.Cost,
+		}, entry)
+
+		handler.Config.CostTable = ""
+		require.NoError(t, handler.recordCost(data, time.Now()))
+		dynamoClientMock.AssertNumberOfCalls(t, "PutItem", 1)
+	})
+
+	t.Run("should not estimate jobs of other transcoders", func(t *testing.T) {
+		handler := Handler{S3Client: new(S3ClientMock)}
+
+		data := record()
+		data.Transcoder = TranscoderFfmpeg
+		assert.Nil(t, estimateCost(&handler, data))
+	})
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+
+	"shared/emf"
+)
+
+// The resolutions MediaConvert bills outputs by, from the shorter side of
+// the frame.
+const (
+	ResolutionSD  = "SD"
+	ResolutionHD  = "HD"
+	ResolutionUHD = "UHD"
+)
+
+// outputResolution is SD below 720 lines, HD up to 1080 and UHD above.
+func outputResolution(video *VideoDetail) string {
+	lines := min(video.WidthInPx, video.HeightInPx)
+	switch {
+	case lines < 720:
+		return ResolutionSD
+	case lines <= 1080:
+		return ResolutionHD
+	}
+	return ResolutionUHD
+}
+
+// encodedMinutes is the duration of the job's video outputs in minutes, by
+// resolution. Outputs without video, such as audio renditions, are left out.
+func encodedMinutes(detail EventDetail) map[string]float64 {
+	minutes := map[string]float64{}
+	for _, group := range detail.OutputGroupDetails {
+		for _, output := range group.OutputDetails {
+			if output.VideoDetails == nil || output.DurationInMs <= 0 {
+				continue
+			}
+			minutes[outputResolution(output.VideoDetails)] += float64(output.DurationInMs) / float64(time.Minute/time.Millisecond)
+		}
+	}
+	return minutes
+}
+
+// outputBytes is the size of the job's outputs, from their duration and
+// average bitrate: the video bitrate MediaConvert reports for each output
+// and the audio bitrate of its settings. Manifests and frame captures are
+// left out.
+func outputBytes(detail EventDetail, job *mediaconvert.CreateJobInput) int64 {
+	var bits float64
+	for i, group := range detail.OutputGroupDetails {
+		for j, output := range group.OutputDetails {
+			var bitrate float64
+			if output.VideoDetails != nil {
+				bitrate += output.VideoDetails.AverageBitrate
+			}
+			if job != nil {
+				bitrate += audioBitrate(jobOutput(job.Settings, i, j))
+			}
+			bits += bitrate * float64(output.DurationInMs) / float64(time.Second/time.Millisecond)
+		}
+	}
+	return int64(bits / 8)
+}
+
+// audioBitrate is the sum of the bitrates of the output's audio tracks.
+func audioBitrate(output *mediaconvert.Output) float64 {
+	if output == nil {
+		return 0
+	}
+	var bitrate int64
+	for _, audio := range output.AudioDescriptions {
+		codec := audio.CodecSettings
+		switch {
+		case codec == nil:
+		case codec.AacSettings != nil:
+			bitrate += aws.Int64Value(codec.AacSettings.Bitrate)
+		case codec.Ac3Settings != nil:
+			bitrate += aws.Int64Value(codec.Ac3Settings.Bitrate)
+		case codec.Eac3Settings != nil:
+			bitrate += aws.Int64Value(codec.Eac3Settings.Bitrate)
+		case codec.Mp2Settings != nil:
+			bitrate += aws.Int64Value(codec.Mp2Settings.Bitrate)
+		case codec.Mp3Settings != nil:
+			bitrate += aws.Int64Value(codec.Mp3Settings.Bitrate)
+		case codec.OpusSettings != nil:
+			bitrate += aws.Int64Value(codec.OpusSettings.Bitrate)
+		}
+	}
+	return float64(bitrate)
+}
+
+// putWorkflowMetrics publishes the metrics of a completed encode: the time
+// since the workflow started, the time since the job was submitted, the
+// encoded minutes by resolution and acceleration status, the output size and
+// the estimated cost by tenant.
+func (h *Handler) putWorkflowMetrics(data *DynamoData, job *mediaconvert.CreateJobInput, acceleration string) {
+	dimensions := map[string]string{
+		"workflow":        data.WorkflowName,
+		"encodingProfile": strconv.Itoa(data.EncodingProfile),
+	}
+	properties := map[string]interface{}{
+		"guid":       data.GUID,
+		"jobId":      data.EncodingOutput.JobId,
+		"transcoder": data.Transcoder,
+	}
+
+	var metrics []emf.Metric
+	if startTime, err := time.Parse(time.RFC3339, data.StartTime); err == nil {
+		metrics = append(metrics, emf.Metric{Name: "WorkflowDuration", Value: data.EndTime.Sub(startTime).Seconds(), Unit: emf.UnitSeconds})
+	}
+	if submittedAt, err := time.Parse(time.RFC3339, data.EncodingOutput.UserMetadata.SubmittedAt); err == nil {
+		completedAt := data.EndTime
+		if data.EncodingOutput.Timestamp > 0 {
+			completedAt = time.UnixMilli(data.EncodingOutput.Timestamp)
+		}
+		metrics = append(metrics, emf.Metric{Name: "TranscodeTime", Value: completedAt.Sub(submittedAt).Seconds(), Unit: emf.UnitSeconds})
+	}
+	metrics = append(metrics, emf.Metric{Name: "OutputBytes", Value: float64(outputBytes(data.EncodingOutput, job)), Unit: emf.UnitBytes})
+	h.Config.PutMetrics(serviceName, dimensions, properties, metrics...)
+
+	if data.Cost != nil {
+		h.Config.PutMetrics(serviceName, map[string]string{
+			"workflow": data.WorkflowName,
+			"tenant":   data.Cost.Tenant,
+		}, properties, emf.Metric{Name: "EstimatedCost", Value: data.Cost.Total, Unit: emf.UnitNone})
+	}
+
+	for resolution, minutes := range encodedMinutes(data.EncodingOutput) {
+		h.Config.PutMetrics(serviceName, map[string]string{
+			"workflow":        data.WorkflowName,
+			"encodingProfile": strconv.Itoa(data.EncodingProfile),
+			"resolution":      resolution,
+			"acceleration":    acceleration,
+		}, properties, emf.Metric{Name: "EncodeMinutes", Value: minutes, Unit: emf.UnitNone})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Encoding jobs run on MediaConvert or on the encode service's ffmpeg
+// backend, which reports its jobs with the same MediaConvert Job State
+// Change detail under its own source.
+const (
+	TranscoderMediaConvert = "MEDIACONVERT"
+	TranscoderFfmpeg       = "FFMPEG"
+
+	mediaConvertSource       = "aws.mediaconvert"
+	defaultFfmpegEventSource = "vod.ffmpeg"
+)
+
+var ErrUnknownSource = errors.New("event is not from a known transcoder")
+
+// transcoder is the backend that sent a completion event. Events without a
+// source are MediaConvert's, as before the backends were pluggable.
+func (h *Handler) transcoder(source string) (string, error) {
+	ffmpegSource := h.Config.FfmpegEventSource
+	if ffmpegSource == "" {
+		ffmpegSource = defaultFfmpegEventSource
+	}
+
+	switch source {
+	case mediaConvertSource, "":
+		return TranscoderMediaConvert, nil
+	case ffmpegSource:
+		return TranscoderFfmpeg, nil
+	}
+	return "", fmt.Errorf("%s: %w", source, ErrUnknownSource)
+}
@@ -4,18 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "profiler"
+
 type ProfilerInput struct {
-	GUID        string `json:"guid"`
+	GUID        string  `json:"guid"`
 	JobTemplate *string `json:"jobTemplate,omitempty"`
 }
 
@@ -47,6 +55,7 @@ type ProfilerOutput struct {
 	FrameCaptureWidth      int    `json:"frameCaptureWidth"`
 	JobTemplate            string `json:"jobTemplate"`
 	IsCustomTemplate       bool   `json:"isCustomTemplate"`
+	Version                int64  `json:"version,omitempty"`
 }
 
 type MediaInfo struct {
@@ -90,19 +99,22 @@ type DynamoDBClient interface {
 	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
 }
 
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+}
+
 type Handler struct {
+	Config         Config
 	DynamoDBClient DynamoDBClient
 }
 
 func (h *Handler) HandleRequest(event ProfilerInput) (*ProfilerOutput, error) {
-	eventJson, err := json.Marshal(event)
-	if err != nil {
-		return nil, fmt.Errorf("profiler: main.Handler: json.Marshal: %w", err)
-	}
-	log.Printf("REQUEST:: %s", eventJson)
-
+	// the version read here is the one DynamoDB Update (Process) expects
 	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(os.Getenv("DynamoDBTable")),
+		TableName:      aws.String(h.Config.DynamoDBTable),
+		ConsistentRead: aws.Bool(true),
 		Key: map[string]*dynamodb.AttributeValue{
 			"guid": {
 				S: aws.String(event.GUID),
@@ -113,11 +125,7 @@ func (h *Handler) HandleRequest(event ProfilerInput) (*ProfilerOutput, error) {
 		return nil, fmt.Errorf("profiler: main.Handler: GetItem: %w", err)
 	}
 
-	dataJson, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("profiler: main.Handler: json.Marshal: %w", err)
-	}
-	log.Printf("Dynamo Data:: %s", dataJson)
+	slog.Debug("RECORD", "item", data.Item)
 
 	// Check if the item was found
 	if data.Item == nil {
@@ -145,13 +153,14 @@ func (h *Handler) HandleRequest(event ProfilerInput) (*ProfilerOutput, error) {
 		SrcVideo:               getStringValue(data.Item, "srcVideo"),
 		EnableMediaPackage:     getBoolValue(data.Item, "enableMediaPackage"),
 		SrcMediainfo:           getStringValue(data.Item, "srcMediainfo"),
+		Version:                getIntValue(data.Item, "version"),
 	}
 
 	formatedSrcMediainfo := output.SrcMediainfo
 	formatedSrcMediainfo = strings.ReplaceAll(formatedSrcMediainfo, "\n", "")
 	formatedSrcMediainfo = strings.ReplaceAll(formatedSrcMediainfo, `\"`, `"`)
 	formatedSrcMediainfo = strings.ReplaceAll(formatedSrcMediainfo, " ", "")
-	log.Printf("SRC MEDIAINFO:: %s", formatedSrcMediainfo)
+	slog.Debug("SRC MEDIAINFO", "srcMediainfo", formatedSrcMediainfo)
 
 	// Parse mediainfo if available
 	var mediainfo MediaInfo
@@ -162,8 +171,6 @@ func (h *Handler) HandleRequest(event ProfilerInput) (*ProfilerOutput, error) {
 		}
 	}
 
-	log.Printf("MediaInfo:: %+v", mediainfo)
-
 	output.SrcHeight = mediainfo.Video[0].Height
 	output.SrcWidth = mediainfo.Video[0].Width
 
@@ -198,18 +205,13 @@ func (h *Handler) HandleRequest(event ProfilerInput) (*ProfilerOutput, error) {
 			720:  output.JobTemplate720p,
 		}
 		output.JobTemplate = jobTemplates[encodingProfile]
-		log.Printf("Chosen template:: %s", output.JobTemplate)
+		slog.Info("ENCODING PROFILE", "encodingProfile", encodingProfile, "jobTemplate", output.JobTemplate)
 		output.IsCustomTemplate = false
 	} else {
 		output.IsCustomTemplate = true
 	}
-	
 
-	outputJson, err := json.Marshal(output)
-	if err != nil {
-		return nil, fmt.Errorf("profiler: main.Handler: json.Marshal: %w", err)
-	}
-	log.Printf("RESPONSE:: %s", outputJson)
+	slog.Debug("RESPONSE", "output", output)
 
 	return output, nil
 }
@@ -228,7 +230,17 @@ func getBoolValue(item map[string]*dynamodb.AttributeValue, key string) bool {
 	return false
 }
 
+func getIntValue(item map[string]*dynamodb.AttributeValue, key string) int64 {
+	if val, exists := item[key]; exists && val.N != nil {
+		n, _ := strconv.ParseInt(*val.N, 10, 64)
+		return n
+	}
+	return 0
+}
+
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
@@ -236,9 +248,16 @@ func main() {
 		log.Fatalf("Failed to create session: %s", err)
 	}
 
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("profiler: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	handler := Handler{
+		Config:         config,
 		DynamoDBClient: dynamodb.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
@@ -44,6 +44,9 @@ func TestProfiler(t *testing.T) {
 				"frameCapture": {
 					BOOL: aws.Bool(true),
 				},
+				"version": {
+					N: aws.String("3"),
+				},
 			},
 		}, nil)
 
@@ -61,6 +64,7 @@ func TestProfiler(t *testing.T) {
 		assert.Equal(t, "tmpl2", output.JobTemplate1080p)
 		assert.Equal(t, "tmpl3", output.JobTemplate720p)
 		assert.Equal(t, true, output.FrameCapture)
+		assert.Equal(t, int64(3), output.Version)
 	})
 
 	t.Run("should retuirn error when db get fails", func(t *testing.T) {
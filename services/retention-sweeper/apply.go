@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CopyObject copies objects up to 5 GB; larger sources are copied in parts.
+const (
+	maxCopySize  = 5 * 1024 * 1024 * 1024
+	copyPartSize = 512 * 1024 * 1024
+)
+
+var (
+	ErrNoArchiveBucket = errors.New("RetentionArchiveBucket is not set")
+	ErrSourceArchived  = errors.New("source is in Glacier and must be restored to be copied")
+	ErrUnknownPolicy   = errors.New("unknown retention policy")
+)
+
+// apply enforces the asset's policy and returns its retentionStatus and, for
+// ARCHIVE, the s3:// location of the copy.
+func (h *Handler) apply(asset RetentionAsset) (string, string, error) {
+	switch asset.RetentionPolicy {
+	case RetentionDelete:
+		if err := h.deleteSource(asset); err != nil {
+			return "", "", err
+		}
+		return StatusDeleted, "", nil
+	case RetentionArchive:
+		bucket := h.Config.RetentionArchiveBucket
+		if bucket == "" {
+			return "", "", ErrNoArchiveBucket
+		}
+		key := h.Config.RetentionArchivePrefix + asset.SrcVideo
+
+		object, err := h.S3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(asset.SrcBucket),
+			Key:    aws.String(asset.SrcVideo),
+		})
+		var aerr awserr.RequestFailure
+		if errors.As(err, &aerr) && aerr.StatusCode() == 404 {
+			// Removed by hand, or by an earlier run that could not record it
+			return StatusMissing, "", nil
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("HeadObject: %w", err)
+		}
+		switch aws.StringValue(object.StorageClass) {
+		case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+			return "", "", ErrSourceArchived
+		}
+
+		if err := h.copySource(asset, object, bucket, key); err != nil {
+			return "", "", err
+		}
+		if err := h.deleteSource(asset); err != nil {
+			return "", "", err
+		}
+		return StatusArchived, fmt.Sprintf("s3://%s/%s", bucket, key), nil
+	}
+
+	return "", "", fmt.Errorf("%q: %w", asset.RetentionPolicy, ErrUnknownPolicy)
+}
+
+func (h *Handler) deleteSource(asset RetentionAsset) error {
+	_, err := h.S3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(asset.SrcBucket),
+		Key:    aws.String(asset.SrcVideo),
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteObject: %w", err)
+	}
+	return nil
+}
+
+// copySource copies the source to the archive, keeping its metadata.
+func (h *Handler) copySource(asset RetentionAsset, object *s3.HeadObjectOutput, bucket, key string) error {
+	copySource := url.PathEscape(asset.SrcBucket + "/" + asset.SrcVideo)
+
+	size := aws.Int64Value(object.ContentLength)
+	if size <= maxCopySize {
+		_, err := h.S3Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(copySource),
+		})
+		if err != nil {
+			return fmt.Errorf("CopyObject: %w", err)
+		}
+		return nil
+	}
+
+	upload, err := h.S3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: object.ContentType,
+		Metadata:    object.Metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("CreateMultipartUpload: %w", err)
+	}
+
+	parts := []*s3.CompletedPart{}
+	for start, number := int64(0), int64(1); start < size; start, number = start+copyPartSize, number+1 {
+		end := min(start+copyPartSize, size) - 1
+		part, err := h.S3Client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(number),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			h.S3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(key),
+				UploadId: upload.UploadId,
+			})
+			return fmt.Errorf("UploadPartCopy: %w", err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	_, err = h.S3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("CompleteMultipartUpload: %w", err)
+	}
+	return nil
+}
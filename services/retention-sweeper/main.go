@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "retention-sweeper"
+
+// The sweeper runs on a schedule and applies the retention policy of every
+// published asset whose retentionDueAt has passed. Policies are set at
+// ingest by input-validate and the due date at publish by output-validate.
+// Applied policies are recorded as retentionStatus and retentionAppliedAt,
+// and retentionDueAt is removed, which takes the asset out of the index.
+// A failure is recorded as retentionError and retried on the next run.
+const (
+	RetentionDelete  = "DELETE"
+	RetentionArchive = "ARCHIVE"
+
+	StatusDeleted  = "Deleted"
+	StatusArchived = "Archived"
+	StatusMissing  = "Missing"
+
+	retentionIndex = "retentionPolicy-retentionDueAt-index"
+	stopMargin     = 30 * time.Second
+)
+
+type DynamoDBClient interface {
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+type S3Client interface {
+	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// RetentionArchiveBucket is where ARCHIVE sources are copied; they are
+	// recorded as errors while it is empty.
+	RetentionArchiveBucket string `env:"RetentionArchiveBucket"`
+	RetentionArchivePrefix string `env:"RetentionArchivePrefix"`
+}
+
+type Handler struct {
+	Config         Config
+	DynamoDBClient DynamoDBClient
+	S3Client       S3Client
+}
+
+// RetentionAsset is the part of the workflow record in the retention index.
+type RetentionAsset struct {
+	GUID            string `json:"guid"`
+	SrcBucket       string `json:"srcBucket"`
+	SrcVideo        string `json:"srcVideo"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	RetentionDueAt  string `json:"retentionDueAt"`
+}
+
+type SweepResult struct {
+	Applied  int  `json:"applied"`
+	Failed   int  `json:"failed"`
+	Complete bool `json:"complete"`
+}
+
+func (h *Handler) HandleRequest(ctx context.Context, event json.RawMessage) (*SweepResult, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	result := &SweepResult{Complete: true}
+	for _, policy := range []string{RetentionDelete, RetentionArchive} {
+		assets, err := h.dueAssets(policy, now)
+		if err != nil {
+			return nil, fmt.Errorf("retention-sweeper: main.Handler.HandleRequest: dueAssets: %w", err)
+		}
+
+		for _, asset := range assets {
+			// Whatever is left is picked up by the next run
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < stopMargin {
+				result.Complete = false
+				slog.Warn("SWEEP STOPPED", "applied", result.Applied, "failed", result.Failed)
+				return result, nil
+			}
+
+			status, location, err := h.apply(asset)
+			if err != nil {
+				slog.Error("RETENTION FAILED", "guid", asset.GUID, "error", err)
+				result.Failed++
+				if err := h.recordError(asset, err); err != nil {
+					return nil, fmt.Errorf("retention-sweeper: main.Handler.HandleRequest: recordError: %w", err)
+				}
+				continue
+			}
+
+			result.Applied++
+			slog.Info("RETENTION APPLIED", "guid", asset.GUID, "status", status, "bucket", asset.SrcBucket, "key", asset.SrcVideo)
+			if err := h.recordApplied(asset, status, location); err != nil {
+				return nil, fmt.Errorf("retention-sweeper: main.Handler.HandleRequest: recordApplied: %w", err)
+			}
+		}
+	}
+
+	slog.Info("SWEEP COMPLETE", "applied", result.Applied, "failed", result.Failed)
+	return result, nil
+}
+
+// dueAssets returns the published assets with the policy that are due.
+func (h *Handler) dueAssets(policy, now string) ([]RetentionAsset, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(retentionIndex),
+		KeyConditionExpression: aws.String("#retentionPolicy = :policy AND #retentionDueAt <= :now"),
+		FilterExpression:       aws.String("#workflowStatus = :complete"),
+		ExpressionAttributeNames: map[string]*string{
+			"#retentionPolicy": aws.String("retentionPolicy"),
+			"#retentionDueAt":  aws.String("retentionDueAt"),
+			"#workflowStatus":  aws.String("workflowStatus"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":policy":   {S: aws.String(policy)},
+			":now":      {S: aws.String(now)},
+			":complete": {S: aws.String("Complete")},
+		},
+	}
+
+	assets := []RetentionAsset{}
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("Query: %w", err)
+		}
+
+		var page []RetentionAsset
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &page); err != nil {
+			return nil, fmt.Errorf("UnmarshalListOfMaps: %w", err)
+		}
+		assets = append(assets, page...)
+
+		if len(data.LastEvaluatedKey) == 0 {
+			return assets, nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+// recordApplied stores the outcome, unless a reprocess moved the due date
+// in the meantime.
+func (h *Handler) recordApplied(asset RetentionAsset, status, location string) error {
+	update := "SET #retentionStatus = :status, #retentionAppliedAt = :appliedAt REMOVE #retentionDueAt, #retentionError"
+	names := map[string]*string{
+		"#retentionStatus":    aws.String("retentionStatus"),
+		"#retentionAppliedAt": aws.String("retentionAppliedAt"),
+		"#retentionDueAt":     aws.String("retentionDueAt"),
+		"#retentionError":     aws.String("retentionError"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":status":    {S: aws.String(status)},
+		":appliedAt": {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		":dueAt":     {S: aws.String(asset.RetentionDueAt)},
+	}
+	if location != "" {
+		update = "SET #retentionStatus = :status, #retentionAppliedAt = :appliedAt, #retentionArchive = :archive REMOVE #retentionDueAt, #retentionError"
+		names["#retentionArchive"] = aws.String("retentionArchive")
+		values[":archive"] = &dynamodb.AttributeValue{S: aws.String(location)}
+	}
+
+	return h.updateAsset(asset.GUID, update, names, values)
+}
+
+func (h *Handler) recordError(asset RetentionAsset, cause error) error {
+	return h.updateAsset(asset.GUID, "SET #retentionError = :error", map[string]*string{
+		"#retentionError": aws.String("retentionError"),
+		"#retentionDueAt": aws.String("retentionDueAt"),
+	}, map[string]*dynamodb.AttributeValue{
+		":error": {S: aws.String(cause.Error())},
+		":dueAt": {S: aws.String(asset.RetentionDueAt)},
+	})
+}
+
+func (h *Handler) updateAsset(guid, update string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	_, err := h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("#retentionDueAt = :dueAt"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		slog.Info("RETENTION SKIPPED", "guid", guid, "reason", "republished")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+
+	return nil
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("retention-sweeper: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:         config,
+		DynamoDBClient: dynamodb.New(sess),
+		S3Client:       s3.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
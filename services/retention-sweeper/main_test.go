@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.CreateMultipartUploadOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.UploadPartCopyOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.CompleteMultipartUploadOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.AbortMultipartUploadOutput), args.Error(1)
+}
+
+func newHandler(config Config) (*Handler, *DynamoDBClientMock, *S3ClientMock) {
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	s3ClientMock := new(S3ClientMock)
+	return &Handler{
+		Config:         config,
+		DynamoDBClient: dynamoDBClientMock,
+		S3Client:       s3ClientMock,
+	}, dynamoDBClientMock, s3ClientMock
+}
+
+func dueItems(policy string) *dynamodb.QueryOutput {
+	return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+		"guid":            {S: aws.String("guid")},
+		"srcBucket":       {S: aws.String("source")},
+		"srcVideo":        {S: aws.String("path/video 1.mp4")},
+		"retentionPolicy": {S: aws.String(policy)},
+		"retentionDueAt":  {S: aws.String("2024-01-31T00:00:00Z")},
+	}}}
+}
+
+func onQuery(dynamoDBClientMock *DynamoDBClientMock, policy string, output *dynamodb.QueryOutput) {
+	dynamoDBClientMock.On("Query", mock.MatchedBy(func(input *dynamodb.QueryInput) bool {
+		return *input.ExpressionAttributeValues[":policy"].S == policy
+	})).Return(output, nil)
+}
+
+func TestHandleRequest(t *testing.T) {
+	config := Config{
+		DynamoDBTable:          "vod",
+		RetentionArchiveBucket: "archive",
+		RetentionArchivePrefix: "sources/",
+	}
+
+	t.Run("should delete a source that is due", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		onQuery(dynamoDBClientMock, RetentionDelete, dueItems(RetentionDelete))
+		onQuery(dynamoDBClientMock, RetentionArchive, &dynamodb.QueryOutput{})
+		s3ClientMock.On("DeleteObject", &s3.DeleteObjectInput{
+			Bucket: aws.String("source"),
+			Key:    aws.String("path/video 1.mp4"),
+		}).Return(&s3.DeleteObjectOutput{}, nil)
+
+		var updateInput *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { updateInput = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, &SweepResult{Applied: 1, Complete: true}, result)
+		assert.Equal(t, StatusDeleted, *updateInput.ExpressionAttributeValues[":status"].S)
+		assert.Equal(t, "2024-01-31T00:00:00Z", *updateInput.ExpressionAttributeValues[":dueAt"].S)
+		assert.Contains(t, *updateInput.UpdateExpression, "REMOVE #retentionDueAt")
+		s3ClientMock.AssertNotCalled(t, "CopyObject", mock.Anything)
+	})
+
+	t.Run("should copy a source to the archive before deleting it", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		onQuery(dynamoDBClientMock, RetentionDelete, &dynamodb.QueryOutput{})
+		onQuery(dynamoDBClientMock, RetentionArchive, dueItems(RetentionArchive))
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(1024)}, nil)
+		s3ClientMock.On("CopyObject", &s3.CopyObjectInput{
+			Bucket:     aws.String("archive"),
+			Key:        aws.String("sources/path/video 1.mp4"),
+			CopySource: aws.String("source%2Fpath%2Fvideo%201.mp4"),
+		}).Return(&s3.CopyObjectOutput{}, nil)
+		s3ClientMock.On("DeleteObject", mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+
+		var updateInput *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { updateInput = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Applied)
+		assert.Equal(t, StatusArchived, *updateInput.ExpressionAttributeValues[":status"].S)
+		assert.Equal(t, "s3://archive/sources/path/video 1.mp4", *updateInput.ExpressionAttributeValues[":archive"].S)
+		s3ClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should copy a large source in parts", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		onQuery(dynamoDBClientMock, RetentionDelete, &dynamodb.QueryOutput{})
+		onQuery(dynamoDBClientMock, RetentionArchive, dueItems(RetentionArchive))
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(maxCopySize + 1)}, nil)
+		s3ClientMock.On("CreateMultipartUpload", mock.Anything).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil)
+
+		var ranges []string
+		s3ClientMock.On("UploadPartCopy", mock.Anything).
+			Run(func(args mock.Arguments) {
+				ranges = append(ranges, *args.Get(0).(*s3.UploadPartCopyInput).CopySourceRange)
+			}).
+			Return(&s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String("etag")}}, nil)
+
+		var completeInput *s3.CompleteMultipartUploadInput
+		s3ClientMock.On("CompleteMultipartUpload", mock.Anything).
+			Run(func(args mock.Arguments) { completeInput = args.Get(0).(*s3.CompleteMultipartUploadInput) }).
+			Return(&s3.CompleteMultipartUploadOutput{}, nil)
+		s3ClientMock.On("DeleteObject", mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		_, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Len(t, ranges, 11)
+		assert.Equal(t, "bytes=0-536870911", ranges[0])
+		assert.Equal(t, "bytes=5368709120-5368709120", ranges[10])
+		assert.Len(t, completeInput.MultipartUpload.Parts, 11)
+		s3ClientMock.AssertNotCalled(t, "CopyObject", mock.Anything)
+	})
+
+	t.Run("should record a source that is already gone", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		onQuery(dynamoDBClientMock, RetentionDelete, &dynamodb.QueryOutput{})
+		onQuery(dynamoDBClientMock, RetentionArchive, dueItems(RetentionArchive))
+		s3ClientMock.On("HeadObject", mock.Anything).
+			Return(nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "request"))
+
+		var updateInput *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { updateInput = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		_, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, StatusMissing, *updateInput.ExpressionAttributeValues[":status"].S)
+		s3ClientMock.AssertNotCalled(t, "DeleteObject", mock.Anything)
+	})
+
+	t.Run("should record an error and keep the source", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		handler.Config.RetentionArchiveBucket = ""
+		onQuery(dynamoDBClientMock, RetentionDelete, &dynamodb.QueryOutput{})
+		onQuery(dynamoDBClientMock, RetentionArchive, dueItems(RetentionArchive))
+
+		var updateInput *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { updateInput = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		result, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, &SweepResult{Failed: 1, Complete: true}, result)
+		assert.Equal(t, "SET #retentionError = :error", *updateInput.UpdateExpression)
+		assert.Equal(t, ErrNoArchiveBucket.Error(), *updateInput.ExpressionAttributeValues[":error"].S)
+		s3ClientMock.AssertNotCalled(t, "DeleteObject", mock.Anything)
+	})
+
+	t.Run("should keep a due date moved by a reprocess", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock := newHandler(config)
+		onQuery(dynamoDBClientMock, RetentionDelete, dueItems(RetentionDelete))
+		onQuery(dynamoDBClientMock, RetentionArchive, &dynamodb.QueryOutput{})
+		s3ClientMock.On("DeleteObject", mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Return(nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition", nil))
+
+		result, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Applied)
+	})
+
+	t.Run("should return an error when the index can't be queried", func(t *testing.T) {
+		handler, dynamoDBClientMock, _ := newHandler(config)
+		dynamoDBClientMock.On("Query", mock.Anything).Return(nil, errors.New("query error"))
+
+		_, err := handler.HandleRequest(context.Background(), []byte("{}"))
+
+		assert.Error(t, err)
+	})
+}
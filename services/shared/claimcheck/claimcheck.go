@@ -0,0 +1,90 @@
+// Package claimcheck keeps large fields out of the workflow state. Fields
+// such as encodingJob and encodingOutput grow with the number of outputs in a
+// job and can push the workflow state past the Step Functions (256 KB) and
+// DynamoDB item (400 KB) limits. When a field is larger than
+// ClaimCheckThreshold it is written to the StateBucket and only its s3://
+// reference is carried in the state and stored on the record. Services that
+// need the field read it back with Load.
+package claimcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type ClaimCheckConfig struct {
+	// StateBucket holds the claim-checked fields, which stay inline when it
+	// is empty.
+	StateBucket         string `env:"StateBucket"`
+	ClaimCheckThreshold int    `env:"ClaimCheckThreshold" default:"32768" min:"1"`
+}
+
+type Writer interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type Reader interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// Offload stores value under <guid>/state/<field>.json and returns its
+// reference. A nil reference means the value is small enough to stay inline,
+// or that no StateBucket is configured.
+func (c ClaimCheckConfig) Offload(client Writer, guid string, field string, value interface{}) (*string, error) {
+	if c.StateBucket == "" {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	if len(body) <= c.ClaimCheckThreshold {
+		return nil, nil
+	}
+
+	key := fmt.Sprintf("%s/state/%s.json", guid, field)
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(c.StateBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PutObject: %w", err)
+	}
+
+	return aws.String(fmt.Sprintf("s3://%s/%s", c.StateBucket, key)), nil
+}
+
+// Load reads the field stored under ref into value.
+func Load(client Reader, ref string, value interface{}) error {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(ref, "s3://"), "/")
+	if !ok || !strings.HasPrefix(ref, "s3://") {
+		return fmt.Errorf("invalid reference %s", ref)
+	}
+
+	object, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("GetObject: %w", err)
+	}
+	defer object.Body.Close()
+
+	body, err := io.ReadAll(object.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if err := json.Unmarshal(body, value); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
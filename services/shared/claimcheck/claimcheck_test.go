@@ -0,0 +1,70 @@
+package claimcheck
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bucket is an in-memory S3 bucket.
+type bucket map[string][]byte
+
+func (b bucket) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	b[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (b bucket) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := b[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, assert.AnError
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func TestClaimCheck(t *testing.T) {
+	job := map[string]interface{}{"Settings": map[string]interface{}{"OutputGroups": []interface{}{"hls", "dash"}}}
+
+	t.Run("Large fields are offloaded and loaded back", func(t *testing.T) {
+		store := bucket{}
+		config := ClaimCheckConfig{StateBucket: "vod-state", ClaimCheckThreshold: 10}
+
+		ref, err := config.Offload(store, "guid-1", "encodingJob", job)
+		require.NoError(t, err)
+		assert.Equal(t, "s3://vod-state/guid-1/state/encodingJob.json", aws.StringValue(ref))
+
+		var loaded map[string]interface{}
+		require.NoError(t, Load(store, *ref, &loaded))
+		assert.Equal(t, job, loaded)
+	})
+
+	t.Run("Small fields stay inline", func(t *testing.T) {
+		store := bucket{}
+		config := ClaimCheckConfig{StateBucket: "vod-state", ClaimCheckThreshold: 1024}
+
+		ref, err := config.Offload(store, "guid-1", "encodingJob", job)
+		require.NoError(t, err)
+		assert.Nil(t, ref)
+		assert.Empty(t, store)
+	})
+
+	t.Run("Fields stay inline without a StateBucket", func(t *testing.T) {
+		ref, err := ClaimCheckConfig{ClaimCheckThreshold: 10}.Offload(bucket{}, "guid-1", "encodingJob", job)
+		require.NoError(t, err)
+		assert.Nil(t, ref)
+	})
+
+	t.Run("Invalid references are rejected", func(t *testing.T) {
+		var loaded map[string]interface{}
+		assert.EqualError(t, Load(bucket{}, "vod-state/guid-1/state/encodingJob.json", &loaded), "invalid reference vod-state/guid-1/state/encodingJob.json")
+	})
+}
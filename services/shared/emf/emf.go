@@ -0,0 +1,80 @@
+// Package emf writes workflow metrics to the log in the CloudWatch Embedded
+// Metric Format. CloudWatch Logs extracts them into the MetricsNamespace
+// namespace (VideoOnDemand by default), read into MetricsConfig, which Config
+// embeds, so no PutMetricData call is made on the workflow's path. Each
+// metric is published under all of its dimensions and under workflow alone,
+// which is what the stack's alarms use.
+package emf
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"time"
+
+	"shared/logging"
+)
+
+// CloudWatch units of the workflow metrics.
+const (
+	UnitSeconds = "Seconds"
+	UnitBytes   = "Bytes"
+	UnitCount   = "Count"
+	UnitNone    = "None"
+)
+
+type MetricsConfig struct {
+	MetricsNamespace string `env:"MetricsNamespace" default:"VideoOnDemand"`
+}
+
+type Metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// PutMetrics writes one EMF document of the service with metrics under
+// dimensions. The properties are written with it, searchable in the log but
+// not dimensions.
+func (c MetricsConfig) PutMetrics(service string, dimensions map[string]string, properties map[string]interface{}, metrics ...Metric) {
+	document := map[string]interface{}{"service": service}
+	for key, value := range properties {
+		document[key] = value
+	}
+
+	keys := make([]string, 0, len(dimensions))
+	for key, value := range dimensions {
+		if value == "" {
+			value = "unknown"
+		}
+		document[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dimensionSets := [][]string{keys}
+	if _, ok := dimensions["workflow"]; ok && len(keys) > 1 {
+		dimensionSets = append(dimensionSets, []string{"workflow"})
+	}
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, metric := range metrics {
+		document[metric.Name] = metric.Value
+		definitions = append(definitions, map[string]string{"Name": metric.Name, "Unit": metric.Unit})
+	}
+
+	document["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []interface{}{map[string]interface{}{
+			"Namespace":  c.MetricsNamespace,
+			"Dimensions": dimensionSets,
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(document)
+	if err != nil {
+		slog.Warn("METRICS NOT WRITTEN", "error", err)
+		return
+	}
+	logging.Output.Write(append(line, '\n'))
+}
@@ -0,0 +1,42 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"shared/logging"
+)
+
+func TestPutMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	output := logging.Output
+	logging.Output = &buf
+	defer func() { logging.Output = output }()
+
+	config := MetricsConfig{MetricsNamespace: "VideoOnDemand"}
+	config.PutMetrics("output-validate",
+		map[string]string{"workflow": "vod", "encodingProfile": ""},
+		map[string]interface{}{"guid": "guid-1"},
+		Metric{Name: "WorkflowDuration", Value: 90, Unit: UnitSeconds},
+	)
+
+	var document map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &document))
+	assert.Equal(t, "output-validate", document["service"])
+	assert.Equal(t, "guid-1", document["guid"])
+	assert.Equal(t, "vod", document["workflow"])
+	assert.Equal(t, "unknown", document["encodingProfile"])
+	assert.Equal(t, float64(90), document["WorkflowDuration"])
+
+	metrics := document["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "VideoOnDemand", metrics["Namespace"])
+	assert.Equal(t, []interface{}{
+		[]interface{}{"encodingProfile", "workflow"},
+		[]interface{}{"workflow"},
+	}, metrics["Dimensions"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"Name": "WorkflowDuration", "Unit": "Seconds"}}, metrics["Metrics"])
+}
@@ -0,0 +1,260 @@
+// Package envconfig reads a service's settings into its Config struct once,
+// at cold start. A field is tagged with the environment variable it comes
+// from, and optionally with:
+//   - default: the value used when the variable is unset or empty
+//   - required:"true": the variable must be set
+//   - enum: the comma-separated values allowed
+//   - min: the smallest number allowed
+//   - requiredIf: the variable must be set when another one is, written as
+//     the other variable's name, or as name=value when it must hold a value
+//
+// Fields are strings, bools, integers, floats, string slices, which are read
+// as comma-separated lists, or types that parse themselves from text, such
+// as slog.Level. The settings the other shared packages need are grouped in
+// structs that Config embeds. A value written as ssm:<name> is read from SSM
+// Parameter Store, decrypted when it is a SecureString. Load reports every
+// missing or invalid setting in a single error, which main fails the cold
+// start with.
+package envconfig
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	ssmPrefix = "ssm:"
+	// ssmBatchSize is the most names a GetParameters call accepts.
+	ssmBatchSize = 10
+)
+
+var ErrInvalid = errors.New("invalid configuration")
+
+type SSMClient interface {
+	GetParameters(input *ssm.GetParametersInput) (*ssm.GetParametersOutput, error)
+}
+
+// ssmCache holds the parameters read for the life of the execution
+// environment, so a changed parameter is picked up by the next cold start.
+var ssmCache = struct {
+	sync.Mutex
+	values map[string]string
+}{values: map[string]string{}}
+
+// Load fills the struct config points to from the environment. The SSM
+// client is only used when a value is an ssm: reference.
+func Load(config interface{}, ssmClient SSMClient) error {
+	fields := configFields(reflect.ValueOf(config).Elem())
+
+	texts := map[string]string{}
+	var names []string
+	for _, field := range fields {
+		texts[field.name] = os.Getenv(field.name)
+		if parameter, ok := strings.CutPrefix(texts[field.name], ssmPrefix); ok {
+			names = append(names, parameter)
+		}
+	}
+
+	var problems []string
+	parameters, err := ssmParameters(ssmClient, names)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, field := range fields {
+		text := texts[field.name]
+		if parameter, ok := strings.CutPrefix(text, ssmPrefix); ok {
+			if err != nil {
+				continue
+			}
+			resolved, found := parameters[parameter]
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: SSM parameter %s not found", field.name, parameter))
+				continue
+			}
+			text = resolved
+		}
+		if text == "" {
+			text = field.tag.Get("default")
+		}
+		texts[field.name] = text
+	}
+
+	for _, field := range fields {
+		text := texts[field.name]
+		if strings.HasPrefix(text, ssmPrefix) {
+			continue
+		}
+		if text == "" {
+			if field.tag.Get("required") == "true" {
+				problems = append(problems, fmt.Sprintf("%s is required", field.name))
+			} else if condition, ok := field.tag.Lookup("requiredIf"); ok {
+				if problem := checkRequiredIf(field.name, condition, texts); problem != "" {
+					problems = append(problems, problem)
+				}
+			}
+			continue
+		}
+
+		if err := setField(field.value, text, field.tag); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field.name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+type configField struct {
+	name  string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+// configFields lists the fields read from the environment, including those
+// of embedded structs.
+func configFields(value reflect.Value) []configField {
+	var fields []configField
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(value.Field(i))...)
+			continue
+		}
+		if name := field.Tag.Get("env"); name != "" {
+			fields = append(fields, configField{name: name, value: value.Field(i), tag: field.Tag})
+		}
+	}
+	return fields
+}
+
+// checkRequiredIf reports a missing setting whose condition on another
+// variable holds.
+func checkRequiredIf(name, condition string, texts map[string]string) string {
+	other, want, hasValue := strings.Cut(condition, "=")
+	switch {
+	case hasValue && texts[other] == want:
+		return fmt.Sprintf("%s is required when %s is %s", name, other, want)
+	case !hasValue && texts[other] != "":
+		return fmt.Sprintf("%s is required when %s is set", name, other)
+	}
+	return ""
+}
+
+func setField(field reflect.Value, text string, tag reflect.StructTag) error {
+	if enum := tag.Get("enum"); enum != "" && !slices.Contains(strings.Split(enum, ","), text) {
+		return fmt.Errorf("%q is not one of %s", text, strings.ReplaceAll(enum, ",", ", "))
+	}
+
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalText([]byte(text)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", text)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", text)
+		}
+		if err := checkMin(float64(n), tag); err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", text)
+		}
+		if err := checkMin(f, tag); err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+func checkMin(value float64, tag reflect.StructTag) error {
+	text := tag.Get("min")
+	if text == "" {
+		return nil
+	}
+	floor, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("invalid min %q", text)
+	}
+	if value < floor {
+		return fmt.Errorf("%v is less than %s", value, text)
+	}
+	return nil
+}
+
+// ssmParameters reads the named parameters that are not cached yet.
+func ssmParameters(client SSMClient, names []string) (map[string]string, error) {
+	ssmCache.Lock()
+	defer ssmCache.Unlock()
+
+	var missing []string
+	for _, name := range names {
+		if _, ok := ssmCache.values[name]; !ok && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 && client == nil {
+		return nil, fmt.Errorf("no SSM client to read %s", strings.Join(missing, ", "))
+	}
+
+	for start := 0; start < len(missing); start += ssmBatchSize {
+		batch := missing[start:min(start+ssmBatchSize, len(missing))]
+		output, err := client.GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(batch),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("GetParameters: %w", err)
+		}
+		for _, parameter := range output.Parameters {
+			ssmCache.values[aws.StringValue(parameter.Name)] = aws.StringValue(parameter.Value)
+		}
+	}
+
+	parameters := map[string]string{}
+	for _, name := range names {
+		if value, ok := ssmCache.values[name]; ok {
+			parameters[name] = value
+		}
+	}
+	return parameters, nil
+}
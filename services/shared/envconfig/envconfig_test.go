@@ -0,0 +1,152 @@
+package envconfig
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type SSMClientMock struct {
+	mock.Mock
+}
+
+func (m *SSMClientMock) GetParameters(input *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ssm.GetParametersOutput), args.Error(1)
+}
+
+// levelConfig stands in for the settings structs the other shared packages
+// have services embed.
+type levelConfig struct {
+	Level slog.Level `env:"TestLevel" default:"INFO" enum:"DEBUG,INFO,WARN,ERROR"`
+}
+
+type testConfig struct {
+	levelConfig
+
+	Table    string   `env:"TestTable" required:"true"`
+	Mode     string   `env:"TestMode" default:"ENABLED" enum:"ENABLED,DISABLED"`
+	Enabled  bool     `env:"TestEnabled"`
+	Days     int      `env:"TestDays" default:"30" min:"1"`
+	Rate     float64  `env:"TestRate" default:"0.5"`
+	Subnets  []string `env:"TestSubnets"`
+	Secret   string   `env:"TestSecret"`
+	Role     string   `env:"TestRole" requiredIf:"TestMode=DISABLED"`
+	Cluster  string   `env:"TestCluster"`
+	Task     string   `env:"TestTask" requiredIf:"TestCluster"`
+	Internal string
+}
+
+func resetSSMCache() {
+	ssmCache.Lock()
+	defer ssmCache.Unlock()
+	ssmCache.values = map[string]string{}
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Values are parsed and defaults applied", func(t *testing.T) {
+		t.Setenv("TestTable", "vod")
+		t.Setenv("TestEnabled", "true")
+		t.Setenv("TestSubnets", "subnet-1, subnet-2,")
+		t.Setenv("TestLevel", "WARN")
+
+		var config testConfig
+		require.NoError(t, Load(&config, nil))
+		assert.Equal(t, testConfig{
+			levelConfig: levelConfig{Level: slog.LevelWarn},
+			Table:       "vod",
+			Mode:        "ENABLED",
+			Enabled:     true,
+			Days:        30,
+			Rate:        0.5,
+			Subnets:     []string{"subnet-1", "subnet-2"},
+		}, config)
+	})
+
+	t.Run("Every invalid setting is reported", func(t *testing.T) {
+		t.Setenv("TestMode", "Enabled")
+		t.Setenv("TestEnabled", "yes")
+		t.Setenv("TestDays", "0")
+		t.Setenv("TestRate", "fast")
+		t.Setenv("TestLevel", "verbose")
+
+		var config testConfig
+		err := Load(&config, nil)
+		assert.ErrorIs(t, err, ErrInvalid)
+		assert.EqualError(t, err, `invalid configuration: TestLevel: "verbose" is not one of DEBUG, INFO, WARN, ERROR; `+
+			`TestTable is required; `+
+			`TestMode: "Enabled" is not one of ENABLED, DISABLED; `+
+			`TestEnabled: "yes" is not true or false; `+
+			`TestDays: 0 is less than 1; `+
+			`TestRate: "fast" is not a number`)
+	})
+
+	t.Run("Conditional settings are required when their condition holds", func(t *testing.T) {
+		t.Setenv("TestTable", "vod")
+		t.Setenv("TestMode", "DISABLED")
+		t.Setenv("TestCluster", "vod")
+
+		var config testConfig
+		assert.EqualError(t, Load(&config, nil), `invalid configuration: `+
+			`TestRole is required when TestMode is DISABLED; `+
+			`TestTask is required when TestCluster is set`)
+
+		t.Setenv("TestMode", "ENABLED")
+		t.Setenv("TestCluster", "")
+		require.NoError(t, Load(&config, nil))
+	})
+
+	t.Run("SSM parameters are read once", func(t *testing.T) {
+		resetSSMCache()
+		t.Setenv("TestTable", "ssm:/vod/table")
+		t.Setenv("TestSecret", "ssm:/vod/secret")
+
+		ssmClientMock := new(SSMClientMock)
+		ssmClientMock.On("GetParameters", &ssm.GetParametersInput{
+			Names:          aws.StringSlice([]string{"/vod/table", "/vod/secret"}),
+			WithDecryption: aws.Bool(true),
+		}).Return(&ssm.GetParametersOutput{Parameters: []*ssm.Parameter{
+			{Name: aws.String("/vod/table"), Value: aws.String("vod-table")},
+			{Name: aws.String("/vod/secret"), Value: aws.String("s3cr3t")},
+		}}, nil).Once()
+
+		for i := 0; i < 2; i++ {
+			var config testConfig
+			require.NoError(t, Load(&config, ssmClientMock))
+			assert.Equal(t, "vod-table", config.Table)
+			assert.Equal(t, "s3cr3t", config.Secret)
+		}
+		ssmClientMock.AssertExpectations(t)
+	})
+
+	t.Run("Missing SSM parameters are reported", func(t *testing.T) {
+		resetSSMCache()
+		t.Setenv("TestTable", "ssm:/vod/table")
+
+		ssmClientMock := new(SSMClientMock)
+		ssmClientMock.On("GetParameters", mock.Anything).Return(&ssm.GetParametersOutput{InvalidParameters: aws.StringSlice([]string{"/vod/table"})}, nil)
+
+		var config testConfig
+		assert.EqualError(t, Load(&config, ssmClientMock), "invalid configuration: TestTable: SSM parameter /vod/table not found")
+	})
+
+	t.Run("SSM errors are reported", func(t *testing.T) {
+		resetSSMCache()
+		t.Setenv("TestTable", "ssm:/vod/table")
+
+		ssmClientMock := new(SSMClientMock)
+		ssmClientMock.On("GetParameters", mock.Anything).Return(nil, errors.New("AccessDenied"))
+
+		var config testConfig
+		assert.EqualError(t, Load(&config, ssmClientMock), "invalid configuration: GetParameters: AccessDenied")
+	})
+}
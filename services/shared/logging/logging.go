@@ -0,0 +1,208 @@
+// Package logging writes a service's logs as JSON lines through log/slog.
+// Each invocation gets a logger carrying the service name, the Lambda request
+// id and, when the event holds them, the asset guid, workflowName and Step
+// Functions execution ARN, so one asset can be followed across the workflows
+// with a single CloudWatch Logs Insights query. LOG_LEVEL sets the minimum
+// level: DEBUG, INFO (the default), WARN or ERROR. It is read with the rest
+// of the settings into LogConfig, which every Config embeds, and main applies
+// it with SetLevel once the configuration is loaded.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// maxLogValue is the largest field, in bytes, written as is. Longer strings
+// are truncated and larger objects and lists are replaced by their size.
+const maxLogValue = 2048
+
+const redacted = "[REDACTED]"
+
+type LogConfig struct {
+	LogLevel slog.Level `env:"LOG_LEVEL" default:"INFO" enum:"DEBUG,INFO,WARN,ERROR"`
+}
+
+// level is the minimum level of every logger, INFO until main sets the
+// configured one.
+var level = new(slog.LevelVar)
+
+// Output is where the log lines are written.
+var Output io.Writer = os.Stdout
+
+// sensitiveKey matches the fields whose values are never written.
+var sensitiveKey = regexp.MustCompile(`(?i)(secret|token|password|authorization|signature|credential|api-?key|cookie)`)
+
+// requestFields are where the correlation attributes are found in the events
+// the services receive: at the top level of workflow tasks, under event for
+// the lifecycle notifications, in the job user metadata of MediaConvert and
+// ffmpeg job events and in the path of asset API requests.
+var requestFields = []struct {
+	attr  string
+	paths [][]string
+}{
+	{"guid", [][]string{{"guid"}, {"event", "guid"}, {"detail", "userMetadata", "guid"}, {"pathParameters", "guid"}}},
+	{"workflowName", [][]string{{"workflowName"}, {"event", "workflowName"}, {"detail", "userMetadata", "workflow"}}},
+	{"executionArn", [][]string{{"executionArn"}, {"executionId"}, {"execution", "id"}, {"event", "execution", "id"}}},
+}
+
+// SetLevel sets the minimum level of every logger.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// New returns a logger for the service.
+func New(service string) *slog.Logger {
+	handler := slog.NewJSONHandler(Output, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+	return slog.New(handler).With("service", service)
+}
+
+// Wrap wraps a Lambda handler function so every invocation logs through a
+// default logger bound to that request, including the lines written with the
+// log package.
+func Wrap(service string, handlerFunc interface{}) lambda.Handler {
+	return &loggingHandler{service: service, handler: lambda.NewHandler(handlerFunc)}
+}
+
+type loggingHandler struct {
+	service string
+	handler lambda.Handler
+}
+
+func (h *loggingHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	logger := New(h.service).With(requestAttrs(ctx, payload)...)
+	slog.SetDefault(logger)
+
+	// the event can hold whole records and jobs, which are only logged at
+	// DEBUG
+	logger.Debug("REQUEST", "event", json.RawMessage(payload))
+	response, err := h.handler.Invoke(ctx, payload)
+	if err != nil {
+		logger.Error("FAILED", "error", err)
+	}
+	return response, err
+}
+
+func requestAttrs(ctx context.Context, payload []byte) []any {
+	var attrs []any
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		attrs = append(attrs, "requestId", lc.AwsRequestID)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return attrs
+	}
+	for _, field := range requestFields {
+		for _, path := range field.paths {
+			if value, ok := lookupField(event, path).(string); ok && value != "" {
+				attrs = append(attrs, field.attr, value)
+				break
+			}
+		}
+	}
+	return attrs
+}
+
+func lookupField(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// redactAttr drops sensitive attributes and bounds the size of the others.
+// Values other than strings and errors are written as their redacted JSON.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+		return a
+	}
+	if sensitiveKey.MatchString(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, truncate(a.Value.String()))
+	case slog.KindAny:
+		if _, ok := a.Value.Any().(error); ok {
+			return a
+		}
+		return slog.Any(a.Key, redact(jsonValue(a.Value.Any())))
+	}
+	return a
+}
+
+// jsonValue is value decoded from its JSON encoding into maps, lists and
+// scalars, or its text when it has none.
+func jsonValue(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return string(data)
+	}
+	return decoded
+}
+
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if sensitiveKey.MatchString(key) {
+				out[key] = redacted
+				continue
+			}
+			out[key] = redactField(field)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactField(item)
+		}
+		return out
+	case string:
+		return truncate(v)
+	}
+	return value
+}
+
+func redactField(value interface{}) interface{} {
+	value = redact(value)
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		if data, err := json.Marshal(value); err == nil && len(data) > maxLogValue {
+			return fmt.Sprintf("[%d bytes omitted]", len(data))
+		}
+	}
+	return value
+}
+
+func truncate(value string) string {
+	if len(value) <= maxLogValue {
+		return value
+	}
+	return fmt.Sprintf("%s...[%d bytes omitted]", strings.ToValidUTF8(value[:maxLogValue], ""), len(value)-maxLogValue)
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"shared/envconfig"
+)
+
+// logLines captures the lines written while fn runs.
+func logLines(t *testing.T, fn func()) []map[string]interface{} {
+	var buf bytes.Buffer
+	output, defaultLogger := Output, slog.Default()
+	Output = &buf
+	defer func() {
+		Output = output
+		slog.SetDefault(defaultLogger)
+	}()
+
+	fn()
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+// testEvent stands in for the events the services receive.
+type testEvent struct {
+	Guid string `json:"guid"`
+}
+
+func TestLogging(t *testing.T) {
+	t.Run("Invocation lines carry the request attributes", func(t *testing.T) {
+		ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+		payload := []byte(`{"guid":"guid-1","workflowName":"vod","execution":{"id":"arn:aws:states:us-east-1:123456789012:execution:Process:guid-1"}}`)
+		handler := Wrap("encode", func(event testEvent) (string, error) {
+			slog.Info("JOB", "jobId", "job-1")
+			return "", errors.New("boom")
+		})
+
+		SetLevel(slog.LevelDebug)
+		defer SetLevel(slog.LevelInfo)
+		lines := logLines(t, func() {
+			_, err := handler.Invoke(ctx, payload)
+			assert.EqualError(t, err, "boom")
+		})
+
+		require.Len(t, lines, 3)
+		assert.Equal(t, "DEBUG", lines[0]["level"])
+		assert.Equal(t, []interface{}{"REQUEST", "JOB", "FAILED"}, []interface{}{lines[0]["msg"], lines[1]["msg"], lines[2]["msg"]})
+		for _, line := range lines {
+			assert.Equal(t, "encode", line["service"])
+			assert.Equal(t, "request-1", line["requestId"])
+			assert.Equal(t, "guid-1", line["guid"])
+			assert.Equal(t, "vod", line["workflowName"])
+			assert.Equal(t, "arn:aws:states:us-east-1:123456789012:execution:Process:guid-1", line["executionArn"])
+		}
+		assert.Equal(t, "job-1", lines[1]["jobId"])
+		assert.Equal(t, "ERROR", lines[2]["level"])
+		assert.Equal(t, "boom", lines[2]["error"])
+	})
+
+	t.Run("The event is only logged at DEBUG", func(t *testing.T) {
+		handler := Wrap("encode", func(event testEvent) (string, error) {
+			return "", nil
+		})
+
+		lines := logLines(t, func() {
+			_, err := handler.Invoke(context.Background(), []byte(`{"guid":"guid-1"}`))
+			require.NoError(t, err)
+		})
+		assert.Empty(t, lines)
+	})
+
+	t.Run("Job events are correlated from the user metadata", func(t *testing.T) {
+		attrs := requestAttrs(context.Background(), []byte(`{"source":"aws.mediaconvert","detail":{"userMetadata":{"guid":"guid-1","workflow":"vod"}}}`))
+		assert.Equal(t, []any{"guid", "guid-1", "workflowName", "vod"}, attrs)
+	})
+
+	t.Run("Sensitive and large fields are redacted", func(t *testing.T) {
+		long := strings.Repeat("a", maxLogValue+10)
+		large := map[string]interface{}{}
+		for i := 0; i < 100; i++ {
+			large[strings.Repeat("k", i+1)] = strings.Repeat("v", 50)
+		}
+
+		lines := logLines(t, func() {
+			New("encode").Info("REQUEST",
+				"authToken", "secret-value",
+				"event", map[string]interface{}{
+					"guid":        "guid-1",
+					"size":        12345678901234,
+					"headers":     map[string]string{"Authorization": "Bearer abc"},
+					"srcVideo":    long,
+					"encodingJob": large,
+				},
+			)
+		})
+
+		require.Len(t, lines, 1)
+		assert.Equal(t, "[REDACTED]", lines[0]["authToken"])
+		event := lines[0]["event"].(map[string]interface{})
+		assert.Equal(t, "guid-1", event["guid"])
+		assert.Equal(t, float64(12345678901234), event["size"])
+		assert.Equal(t, map[string]interface{}{"Authorization": "[REDACTED]"}, event["headers"])
+		assert.Equal(t, strings.Repeat("a", maxLogValue)+"...[10 bytes omitted]", event["srcVideo"])
+		assert.Regexp(t, `^\[\d+ bytes omitted\]$`, event["encodingJob"])
+	})
+
+	t.Run("LOG_LEVEL sets the minimum level", func(t *testing.T) {
+		t.Setenv("LOG_LEVEL", "WARN")
+		var config LogConfig
+		require.NoError(t, envconfig.Load(&config, nil))
+		SetLevel(config.LogLevel)
+		defer SetLevel(slog.LevelInfo)
+
+		lines := logLines(t, func() {
+			logger := New("encode")
+			logger.Debug("TEMPLATE")
+			logger.Info("JOB")
+			logger.Warn("FFMPEG UNSUPPORTED OUTPUT GROUP")
+		})
+		require.Len(t, lines, 1)
+		assert.Equal(t, "WARN", lines[0]["level"])
+	})
+}
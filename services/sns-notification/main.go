@@ -5,15 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "sns-notification"
+
 var ErrWorkflowStatusNotDefined = errors.New("workflow Status not defined")
 
 var NOT_APPLICABLE_PROPERTIES = []string{
@@ -35,8 +45,21 @@ type SNSClient interface {
 	Publish(input *sns.PublishInput) (*sns.PublishOutput, error)
 }
 
+type Config struct {
+	logging.LogConfig
+
+	SnsTopic string `env:"SnsTopic" required:"true"`
+	// TemplateBucket holds the message templates that override the
+	// defaults, under TemplatePrefix.
+	TemplateBucket string `env:"TemplateBucket"`
+	TemplatePrefix string `env:"TemplatePrefix"`
+}
+
 type Handler struct {
+	config    Config
 	snsClient SNSClient
+	s3Client  S3Client
+	templates map[string]*template.Template
 }
 
 type SNSNotificationEvent struct {
@@ -60,9 +83,17 @@ type SNSNotificationEvent struct {
 	SrcVideo               string `json:"srcVideo"`
 	EnableMediaPackage     bool   `json:"enableMediaPackage"`
 	SrcMediainfo           string `json:"srcMediainfo"`
+	EncodingProfile        int    `json:"encodingProfile,omitempty"`
+	ErrorMessage           string `json:"errorMessage,omitempty"`
 
 	EncodeJobId            string            `json:"encodeJobId"`
 	EndTime                time.Time         `json:"endTime"`
+	HlsUrl                 string            `json:"hlsUrl"`
+	DashUrl                string            `json:"dashUrl"`
+	CmafHlsUrl             string            `json:"cmafHlsUrl"`
+	CmafDashUrl            string            `json:"cmafDashUrl"`
+	MssUrl                 string            `json:"mssUrl"`
+	Mp4Urls                []string          `json:"mp4Urls"`
 	ThumbNails             []*string         `json:"thumbNails"`
 	ThumbNailsUrls         []*string         `json:"thumbNailsUrls"`
 	MediaPackageResourceId string            `json:"mediaPackageResourceId"`
@@ -93,9 +124,12 @@ type SNSNotificationOutput struct {
 }
 
 type Message struct {
-	Status   string `json:"workflowStatus"`
-	GUID     string `json:"guid"`
-	SrcVideo string `json:"srcVideo"`
+	Status          string `json:"workflowStatus"`
+	GUID            string `json:"guid"`
+	SrcVideo        string `json:"srcVideo"`
+	EncodingProfile int    `json:"encodingProfile,omitempty"`
+	EncodeJobId     string `json:"encodeJobId,omitempty"`
+	ErrorMessage    string `json:"errorMessage,omitempty"`
 }
 
 type CompleteMessage struct {
@@ -128,15 +162,13 @@ type CompleteMessage struct {
 }
 
 func (h *Handler) HandleRequest(event SNSNotificationEvent) (*SNSNotificationOutput, error) {
-	eventJSON, err := json.Marshal(event)
-	if err != nil {
-		return nil, fmt.Errorf("sns-notification: main.Handler: Marshal: %w", err)
+	templateName, ok := notificationTemplates[event.WorkflowStatus]
+	if !ok {
+		return nil, ErrWorkflowStatusNotDefined
 	}
-	log.Printf("REQUEST:: %s", eventJSON)
-
-	var message interface{}
 	subject := "Workflow Status:: " + event.WorkflowStatus + ":: " + event.GUID
 
+	var message interface{}
 	if event.WorkflowStatus == "Complete" {
 		message = CompleteMessage{
 			GUID:                   event.GUID,
@@ -165,27 +197,48 @@ func (h *Handler) HandleRequest(event SNSNotificationEvent) (*SNSNotificationOut
 			MediaPackageResourceId: event.MediaPackageResourceId,
 			EgressEndpoints:        event.EgressEndpoints,
 		}
-
-	} else if event.WorkflowStatus == "Ingest" {
+	} else {
 		message = Message{
-			Status:   event.WorkflowStatus,
-			GUID:     event.GUID,
-			SrcVideo: event.SrcVideo,
+			Status:          event.WorkflowStatus,
+			GUID:            event.GUID,
+			SrcVideo:        event.SrcVideo,
+			EncodingProfile: event.EncodingProfile,
+			EncodeJobId:     event.EncodeJobId,
+			ErrorMessage:    event.ErrorMessage,
 		}
-	} else {
-		return nil, ErrWorkflowStatusNotDefined
 	}
 
 	messageJson, err := json.MarshalIndent(message, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("sns-notification: main.Handler: Marshal: %w", err)
 	}
-	log.Printf("MESSAGE:: %s", messageJson)
+	slog.Debug("MESSAGE", "message", message)
+
+	body, err := h.renderBody(templateName, event)
+	if err != nil {
+		return nil, fmt.Errorf("sns-notification: main.Handler: renderBody: %w", err)
+	}
+
+	// Email subscribers get the readable body, machine subscribers the JSON
+	structured, err := json.Marshal(map[string]string{
+		"default":    body,
+		"email":      body,
+		"email-json": string(messageJson),
+		"sqs":        string(messageJson),
+		"lambda":     string(messageJson),
+		"http":       string(messageJson),
+		"https":      string(messageJson),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sns-notification: main.Handler: Marshal: %w", err)
+	}
 
 	_, err = h.snsClient.Publish(&sns.PublishInput{
-		Message:          aws.String(string(messageJson)),
-		Subject:          aws.String(subject),
-		TopicArn:         aws.String(os.Getenv("SnsTopic")),
+		Message:           aws.String(string(structured)),
+		MessageStructure:  aws.String("json"),
+		MessageAttributes: messageAttributes(event),
+		Subject:           aws.String(subject),
+		TopicArn:          aws.String(h.config.SnsTopic),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("sns-notification: main.Handler: Publish: %w", err)
@@ -216,16 +269,52 @@ func (h *Handler) HandleRequest(event SNSNotificationEvent) (*SNSNotificationOut
 
 }
 
+// messageAttributes lets subscribers filter on status, workflowName and
+// encodingProfile. SNS rejects empty attribute values, so those are left out.
+func messageAttributes(event SNSNotificationEvent) map[string]*sns.MessageAttributeValue {
+	attributes := map[string]*sns.MessageAttributeValue{
+		"status": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(event.WorkflowStatus),
+		},
+	}
+	if event.WorkflowName != "" {
+		attributes["workflowName"] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(event.WorkflowName),
+		}
+	}
+	if event.EncodingProfile != 0 {
+		attributes["encodingProfile"] = &sns.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(event.EncodingProfile)),
+		}
+	}
+
+	return attributes
+}
+
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess := session.Must(session.NewSession(
 		&aws.Config{
 			Region: aws.String(os.Getenv("AWS_REGION")),
 		},
 	))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("sns-notification: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	snsClient := sns.New(sess)
 	handler := Handler{
+		config:    config,
 		snsClient: snsClient,
+		s3Client:  s3.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -141,3 +147,156 @@ func TestHandleRequest(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, &output, result)
 }
+
+type mockS3Client struct {
+	mock.Mock
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+func publishedMessage(t *testing.T, input *sns.PublishInput) map[string]string {
+	var message map[string]string
+	assert.Equal(t, "json", *input.MessageStructure)
+	assert.Nil(t, json.Unmarshal([]byte(*input.Message), &message))
+	return message
+}
+
+func TestNotificationStatuses(t *testing.T) {
+	cases := []struct {
+		status   string
+		event    SNSNotificationEvent
+		expected []string
+	}{
+		{
+			status: "Encoding",
+			event:  SNSNotificationEvent{EncodingProfile: 1080, EncodeJobId: "job-1"},
+			expected: []string{
+				"The video is being transcoded.",
+				"Profile:   1080p",
+				"Job:       job-1",
+			},
+		},
+		{
+			status: "Complete",
+			event: SNSNotificationEvent{
+				EndTime: time.Date(2025, 2, 23, 10, 10, 0, 0, time.UTC),
+				HlsUrl:  "https://cdn/guid/hls/video.m3u8",
+				Mp4Urls: []string{"https://cdn/guid/mp4/video.mp4"},
+			},
+			expected: []string{
+				"ready for playback",
+				"Completed: 2025-02-23T10:10:00Z",
+				"HLS:       https://cdn/guid/hls/video.m3u8",
+				"MP4:       https://cdn/guid/mp4/video.mp4",
+			},
+		},
+		{
+			status:   "Error",
+			event:    SNSNotificationEvent{ErrorMessage: "MediaConvert job failed"},
+			expected: []string{"Processing of the video failed.", "Error:     MediaConvert job failed"},
+		},
+		{
+			status:   "Cancelled",
+			expected: []string{"Processing of the video was cancelled."},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.status, func(t *testing.T) {
+			mockSns := new(mockSnsClient)
+			handler := Handler{
+				snsClient: mockSns,
+			}
+
+			var published *sns.PublishInput
+			mockSns.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+				published = args.Get(0).(*sns.PublishInput)
+			}).Return(&sns.PublishOutput{}, nil)
+
+			event := c.event
+			event.GUID = "597c449e-6d32-4e88-a2b4-c956f85a3d51"
+			event.WorkflowStatus = c.status
+			event.WorkflowName = "vod"
+			event.SrcBucket = "source"
+			event.SrcVideo = "video.mp4"
+
+			_, err := handler.HandleRequest(event)
+			assert.NoError(t, err)
+
+			message := publishedMessage(t, published)
+			assert.Contains(t, message["email"], "s3://source/video.mp4")
+			for _, expected := range c.expected {
+				assert.Contains(t, message["email"], expected)
+			}
+
+			var machine map[string]interface{}
+			assert.Nil(t, json.Unmarshal([]byte(message["sqs"]), &machine))
+			assert.Equal(t, c.status, machine["workflowStatus"])
+
+			assert.Equal(t, c.status, *published.MessageAttributes["status"].StringValue)
+			assert.Equal(t, "vod", *published.MessageAttributes["workflowName"].StringValue)
+		})
+	}
+
+	t.Run("should reject unknown statuses", func(t *testing.T) {
+		handler := Handler{
+			snsClient: new(mockSnsClient),
+		}
+
+		_, err := handler.HandleRequest(SNSNotificationEvent{WorkflowStatus: "Unknown"})
+		assert.ErrorIs(t, err, ErrWorkflowStatusNotDefined)
+	})
+}
+
+func TestMessageAttributes(t *testing.T) {
+	attributes := messageAttributes(SNSNotificationEvent{
+		WorkflowStatus:  "Complete",
+		EncodingProfile: 720,
+	})
+
+	assert.Equal(t, "Number", *attributes["encodingProfile"].DataType)
+	assert.Equal(t, "720", *attributes["encodingProfile"].StringValue)
+	assert.NotContains(t, attributes, "workflowName")
+}
+
+func TestTemplateOverride(t *testing.T) {
+	mockS3 := new(mockS3Client)
+	mockS3.On("GetObject", mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "notifications/ingest.tmpl"
+	})).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader("Uploaded {{.SrcVideo}}")),
+	}, nil).Once()
+	mockS3.On("GetObject", mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "notifications/cancelled.tmpl"
+	})).Return(nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)).Once()
+
+	var published []*sns.PublishInput
+	mockSns := new(mockSnsClient)
+	mockSns.On("Publish", mock.Anything).Run(func(args mock.Arguments) {
+		published = append(published, args.Get(0).(*sns.PublishInput))
+	}).Return(&sns.PublishOutput{}, nil)
+
+	handler := Handler{
+		config:    Config{TemplateBucket: "templates", TemplatePrefix: "notifications/"},
+		snsClient: mockSns,
+		s3Client:  mockS3,
+	}
+
+	// The override is read once and reused
+	for i := 0; i < 2; i++ {
+		_, err := handler.HandleRequest(SNSNotificationEvent{WorkflowStatus: "Ingest", SrcVideo: "video.mp4"})
+		assert.NoError(t, err)
+	}
+	_, err := handler.HandleRequest(SNSNotificationEvent{WorkflowStatus: "Cancelled", GUID: "guid"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Uploaded video.mp4", publishedMessage(t, published[1])["email"])
+	assert.Contains(t, publishedMessage(t, published[2])["email"], "was cancelled")
+	mockS3.AssertExpectations(t)
+}
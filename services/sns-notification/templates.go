@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Email bodies are rendered with text/template from the notification event.
+// A template can be replaced by uploading <TemplatePrefix><name>.tmpl to
+// TemplateBucket, where name is one of the keys of defaultTemplates.
+// Templates are read once per container.
+
+// notificationTemplates maps workflow statuses to template names.
+var notificationTemplates = map[string]string{
+	"Ingest":     "ingest",
+	"Encoding":   "processing",
+	"Processing": "processing",
+	"Complete":   "complete",
+	"Error":      "error",
+	"Cancelled":  "cancelled",
+}
+
+const assetDetails = `Asset:     {{.GUID}}
+Workflow:  {{.WorkflowName}}
+Source:    s3://{{.SrcBucket}}/{{.SrcVideo}}
+Started:   {{.StartTime}}
+`
+
+var defaultTemplates = map[string]string{
+	"ingest": `A new video has been uploaded and is being ingested.
+
+` + assetDetails,
+
+	"processing": `The video is being transcoded.
+
+` + assetDetails + `{{if .EncodingProfile}}Profile:   {{.EncodingProfile}}p
+{{end}}{{if .EncodeJobId}}Job:       {{.EncodeJobId}}
+{{end}}`,
+
+	"complete": `The video has been processed and is ready for playback.
+
+` + assetDetails + `Completed: {{.EndTime.Format "2006-01-02T15:04:05Z07:00"}}
+{{if .HlsUrl}}
+HLS:       {{.HlsUrl}}{{end}}{{if .DashUrl}}
+DASH:      {{.DashUrl}}{{end}}{{if .CmafHlsUrl}}
+CMAF HLS:  {{.CmafHlsUrl}}{{end}}{{if .CmafDashUrl}}
+CMAF DASH: {{.CmafDashUrl}}{{end}}{{if .MssUrl}}
+MSS:       {{.MssUrl}}{{end}}{{range .Mp4Urls}}
+MP4:       {{.}}{{end}}{{range $type, $url := .EgressEndpoints}}
+MediaPackage {{$type}}: {{$url}}{{end}}
+`,
+
+	"error": `Processing of the video failed.
+
+` + assetDetails + `{{if .ErrorMessage}}
+Error:     {{.ErrorMessage}}
+{{end}}`,
+
+	"cancelled": `Processing of the video was cancelled.
+
+` + assetDetails,
+}
+
+type S3Client interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// renderBody executes the named template with the event.
+func (h *Handler) renderBody(name string, event SNSNotificationEvent) (string, error) {
+	tmpl, err := h.template(name)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, event); err != nil {
+		return "", fmt.Errorf("template %s: Execute: %w", name, err)
+	}
+
+	return body.String(), nil
+}
+
+// template returns the override for name from TemplateBucket, or the
+// default when there is none.
+func (h *Handler) template(name string) (*template.Template, error) {
+	if tmpl, ok := h.templates[name]; ok {
+		return tmpl, nil
+	}
+
+	text := defaultTemplates[name]
+	if bucket := h.config.TemplateBucket; bucket != "" {
+		override, err := h.readTemplate(bucket, h.config.TemplatePrefix+name+".tmpl")
+		if err != nil {
+			return nil, err
+		}
+		if override != "" {
+			text = override
+		}
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: Parse: %w", name, err)
+	}
+
+	if h.templates == nil {
+		h.templates = map[string]*template.Template{}
+	}
+	h.templates[name] = tmpl
+
+	return tmpl, nil
+}
+
+// readTemplate returns the content of the object, or "" when it does not exist.
+func (h *Handler) readTemplate(bucket, key string) (string, error) {
+	object, err := h.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return "", nil
+		}
+		return "", fmt.Errorf("GetObject: %w", err)
+	}
+	defer object.Body.Close()
+
+	text, err := io.ReadAll(object.Body)
+	if err != nil {
+		return "", fmt.Errorf("ReadAll: %w", err)
+	}
+
+	return string(text), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "source-restore"
+
+var (
+	ErrInvalidEventObject = errors.New("invalid event object")
+	ErrInvalidRequest     = errors.New("invalid restore request")
+	ErrAssetNotFound      = errors.New("asset not found")
+)
+
+// RestoreRequest reprocesses an asset whose source may have been archived.
+// Tier and Days default to the RestoreTier and RestoreDays settings;
+// ExecutionName lets a caller such as batch-reprocess keep its own names.
+type RestoreRequest struct {
+	GUID          string `json:"guid"`
+	JobTemplate   string `json:"jobTemplate,omitempty"`
+	Tier          string `json:"tier,omitempty"`
+	Days          int64  `json:"days,omitempty"`
+	ExecutionName string `json:"executionName,omitempty"`
+}
+
+// RestoreResponse tells the caller whether the Process workflow was started
+// right away or will be once the source is restored.
+type RestoreResponse struct {
+	GUID         string `json:"guid"`
+	Status       string `json:"status"`
+	ExecutionArn string `json:"executionArn,omitempty"`
+}
+
+// RestoreEvent is the S3 notification for a completed restore. The
+// glacierEventData block is missing from events.S3EventRecord.
+type RestoreEvent struct {
+	Records []RestoreEventRecord `json:"Records"`
+}
+
+type RestoreEventRecord struct {
+	events.S3EventRecord
+	GlacierEventData struct {
+		RestoreEventData struct {
+			LifecycleRestorationExpiryTime string `json:"lifecycleRestorationExpiryTime"`
+		} `json:"restoreEventData"`
+	} `json:"glacierEventData"`
+}
+
+type ProcessWorkflowInput struct {
+	GUID        string `json:"guid"`
+	JobTemplate string `json:"jobTemplate,omitempty"`
+}
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+}
+
+type S3Client interface {
+	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error)
+}
+
+type StepFunctionClient interface {
+	StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable   string `env:"DynamoDBTable" required:"true"`
+	ProcessWorkflow string `env:"ProcessWorkflow" required:"true"`
+	// RestoreTier and RestoreDays are used for the requests that do not set
+	// them, Standard and 7 days when they are empty.
+	RestoreTier string `env:"RestoreTier" enum:"Expedited,Standard,Bulk"`
+	RestoreDays int64  `env:"RestoreDays" min:"1"`
+}
+
+type Handler struct {
+	Config             Config
+	DynamoDBClient     DynamoDBClient
+	S3Client           S3Client
+	StepFunctionClient StepFunctionClient
+}
+
+func (h *Handler) HandleRequest(ctx context.Context, event map[string]interface{}) (interface{}, error) {
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("source-restore: main.Handler.HandleRequest: json.Marshal: %w", err)
+	}
+
+	switch {
+	case event["Records"] != nil:
+		var restoreEvent RestoreEvent
+		if err := json.Unmarshal(eventJson, &restoreEvent); err != nil {
+			return nil, fmt.Errorf("source-restore: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+
+		// Every record is tried; a redelivered notification only resumes the
+		// assets that are still waiting
+		var errs []error
+		for _, record := range restoreEvent.Records {
+			if err := h.completeRestore(record); err != nil {
+				slog.Error("RESTORE COMPLETION FAILED", "bucket", record.S3.Bucket.Name, "key", record.S3.Object.URLDecodedKey, "error", err)
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("source-restore: main.Handler.HandleRequest: %d of %d records failed: %w", len(errs), len(restoreEvent.Records), errors.Join(errs...))
+		}
+		return nil, nil
+	case event["guid"] != nil:
+		var request RestoreRequest
+		if err := json.Unmarshal(eventJson, &request); err != nil {
+			return nil, fmt.Errorf("source-restore: main.Handler.HandleRequest: %v: %w", err, ErrInvalidRequest)
+		}
+		if request.ExecutionName == "" {
+			attempt := request.GUID
+			if lc, ok := lambdacontext.FromContext(ctx); ok {
+				attempt = lc.AwsRequestID
+			}
+			request.ExecutionName = executionName(request.GUID, attempt)
+		}
+
+		response, err := h.requestRestore(request)
+		if err != nil {
+			return nil, fmt.Errorf("source-restore: main.Handler.HandleRequest: requestRestore: %w", err)
+		}
+		return response, nil
+	}
+
+	return nil, ErrInvalidEventObject
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("source-restore: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := &Handler{
+		Config:             config,
+		DynamoDBClient:     dynamodb.New(sess),
+		S3Client:           s3.New(sess),
+		StepFunctionClient: sfn.New(sess),
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
+}
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.RestoreObjectOutput), args.Error(1)
+}
+
+type StepFunctionClientMock struct {
+	mock.Mock
+}
+
+func (m *StepFunctionClientMock) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.StartExecutionOutput), args.Error(1)
+}
+
+func newHandler(config Config) (*Handler, *DynamoDBClientMock, *S3ClientMock, *StepFunctionClientMock) {
+	dynamoDBClientMock := new(DynamoDBClientMock)
+	s3ClientMock := new(S3ClientMock)
+	stepFunctionClientMock := new(StepFunctionClientMock)
+	return &Handler{
+		Config:             config,
+		DynamoDBClient:     dynamoDBClientMock,
+		S3Client:           s3ClientMock,
+		StepFunctionClient: stepFunctionClientMock,
+	}, dynamoDBClientMock, s3ClientMock, stepFunctionClientMock
+}
+
+func assetItem() *dynamodb.GetItemOutput {
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"guid":      {S: aws.String("guid")},
+		"srcBucket": {S: aws.String("source")},
+		"srcVideo":  {S: aws.String("path/video 1.mp4")},
+	}}
+}
+
+func request(t *testing.T, request RestoreRequest) map[string]interface{} {
+	raw, err := json.Marshal(request)
+	assert.NoError(t, err)
+	var event map[string]interface{}
+	assert.NoError(t, json.Unmarshal(raw, &event))
+	return event
+}
+
+func TestRequestRestore(t *testing.T) {
+	config := Config{
+		DynamoDBTable:   "vod",
+		ProcessWorkflow: "arn:aws:states:us-east-1:123456789012:stateMachine:vod-process",
+	}
+
+	t.Run("should restore an archived source", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock, stepFunctionClientMock := newHandler(config)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(assetItem(), nil)
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassDeepArchive)}, nil)
+
+		var restoreInput *s3.RestoreObjectInput
+		s3ClientMock.On("RestoreObject", mock.Anything).
+			Run(func(args mock.Arguments) { restoreInput = args.Get(0).(*s3.RestoreObjectInput) }).
+			Return(&s3.RestoreObjectOutput{}, nil)
+
+		var update *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { update = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		res, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid", JobTemplate: "template", Tier: s3.TierBulk}))
+		assert.NoError(t, err)
+		assert.Equal(t, RestoreInProgress, res.(*RestoreResponse).Status)
+
+		assert.Equal(t, "path/video 1.mp4", aws.StringValue(restoreInput.Key))
+		assert.Equal(t, s3.TierBulk, aws.StringValue(restoreInput.RestoreRequest.GlacierJobParameters.Tier))
+		assert.Equal(t, int64(defaultRestoreDays), aws.Int64Value(restoreInput.RestoreRequest.Days))
+
+		restore := update.ExpressionAttributeValues[":restore"].M
+		assert.Equal(t, RestoreInProgress, aws.StringValue(restore["status"].S))
+		assert.Equal(t, "template", aws.StringValue(restore["jobTemplate"].S))
+		assert.Equal(t, executionName("guid", "guid"), aws.StringValue(restore["executionName"].S))
+		stepFunctionClientMock.AssertNotCalled(t, "StartExecution", mock.Anything)
+	})
+
+	t.Run("should wait on a restore already in progress", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock, _ := newHandler(config)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(assetItem(), nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{
+			StorageClass: aws.String(s3.StorageClassGlacier),
+			Restore:      aws.String(`ongoing-request="true"`),
+		}, nil)
+
+		res, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid"}))
+		assert.NoError(t, err)
+		assert.Equal(t, RestoreInProgress, res.(*RestoreResponse).Status)
+		s3ClientMock.AssertNotCalled(t, "RestoreObject", mock.Anything)
+	})
+
+	t.Run("should treat RestoreAlreadyInProgress as in progress", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock, _ := newHandler(config)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(assetItem(), nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassGlacier)}, nil)
+		s3ClientMock.On("RestoreObject", mock.Anything).Return(nil, awserr.New(errCodeRestoreAlreadyInProgress, "in progress", nil))
+
+		res, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid"}))
+		assert.NoError(t, err)
+		assert.Equal(t, RestoreInProgress, res.(*RestoreResponse).Status)
+	})
+
+	for name, object := range map[string]*s3.HeadObjectOutput{
+		"not archived": {StorageClass: aws.String(s3.StorageClassStandard)},
+		"restored":     {StorageClass: aws.String(s3.StorageClassGlacier), Restore: aws.String(`ongoing-request="false", expiry-date="Fri, 23 Dec 2026 00:00:00 GMT"`)},
+	} {
+		t.Run("should start the reprocess when the source is "+name, func(t *testing.T) {
+			handler, dynamoDBClientMock, s3ClientMock, stepFunctionClientMock := newHandler(config)
+			dynamoDBClientMock.On("GetItem", mock.Anything).Return(assetItem(), nil)
+			s3ClientMock.On("HeadObject", mock.Anything).Return(object, nil)
+
+			var start *sfn.StartExecutionInput
+			stepFunctionClientMock.On("StartExecution", mock.Anything).
+				Run(func(args mock.Arguments) { start = args.Get(0).(*sfn.StartExecutionInput) }).
+				Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+
+			res, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid", JobTemplate: "template", ExecutionName: "guid-batch"}))
+			assert.NoError(t, err)
+			assert.Equal(t, &RestoreResponse{GUID: "guid", Status: RestoreStarted, ExecutionArn: "arn"}, res)
+			assert.Equal(t, "guid-batch", aws.StringValue(start.Name))
+			assert.JSONEq(t, `{"guid":"guid","jobTemplate":"template"}`, aws.StringValue(start.Input))
+			s3ClientMock.AssertNotCalled(t, "RestoreObject", mock.Anything)
+			dynamoDBClientMock.AssertNotCalled(t, "UpdateItem", mock.Anything)
+		})
+	}
+
+	t.Run("should reject Expedited for DEEP_ARCHIVE", func(t *testing.T) {
+		handler, dynamoDBClientMock, s3ClientMock, _ := newHandler(config)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(assetItem(), nil)
+		s3ClientMock.On("HeadObject", mock.Anything).Return(&s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassDeepArchive)}, nil)
+
+		_, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid", Tier: s3.TierExpedited}))
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+
+	t.Run("should reject an unknown tier", func(t *testing.T) {
+		handler, _, _, _ := newHandler(config)
+
+		_, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid", Tier: "Fast"}))
+		assert.ErrorIs(t, err, ErrInvalidRequest)
+	})
+
+	t.Run("should fail for an unknown asset", func(t *testing.T) {
+		handler, dynamoDBClientMock, _, _ := newHandler(config)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		_, err := handler.HandleRequest(context.TODO(), request(t, RestoreRequest{GUID: "guid"}))
+		assert.ErrorIs(t, err, ErrAssetNotFound)
+	})
+}
+
+func TestCompleteRestore(t *testing.T) {
+	config := Config{
+		DynamoDBTable:   "vod",
+		ProcessWorkflow: "arn:aws:states:us-east-1:123456789012:stateMachine:vod-process",
+	}
+
+	event := func(eventName string) map[string]interface{} {
+		var event map[string]interface{}
+		json.Unmarshal([]byte(`{"Records":[{"eventName":"`+eventName+`","s3":{"bucket":{"name":"source"},"object":{"key":"path/video+1.mp4"}},"glacierEventData":{"restoreEventData":{"lifecycleRestorationExpiryTime":"2026-10-26T00:00:00.000Z"}}}]}`), &event)
+		return event
+	}
+
+	t.Run("should resume the waiting reprocess", func(t *testing.T) {
+		handler, dynamoDBClientMock, _, stepFunctionClientMock := newHandler(config)
+
+		var query *dynamodb.QueryInput
+		dynamoDBClientMock.On("Query", mock.Anything).
+			Run(func(args mock.Arguments) { query = args.Get(0).(*dynamodb.QueryInput) }).
+			Return(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+				"guid": {S: aws.String("guid")},
+				"restore": {M: map[string]*dynamodb.AttributeValue{
+					"status":        {S: aws.String(RestoreInProgress)},
+					"jobTemplate":   {S: aws.String("template")},
+					"executionName": {S: aws.String("guid-restore")},
+				}},
+			}}}, nil)
+
+		var start *sfn.StartExecutionInput
+		stepFunctionClientMock.On("StartExecution", mock.Anything).
+			Run(func(args mock.Arguments) { start = args.Get(0).(*sfn.StartExecutionInput) }).
+			Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+
+		var update *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).
+			Run(func(args mock.Arguments) { update = args.Get(0).(*dynamodb.UpdateItemInput) }).
+			Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		_, err := handler.HandleRequest(context.TODO(), event("ObjectRestore:Completed"))
+		assert.NoError(t, err)
+		assert.Equal(t, "path/video 1.mp4", aws.StringValue(query.ExpressionAttributeValues[":srcVideo"].S))
+		assert.Equal(t, "guid-restore", aws.StringValue(start.Name))
+
+		saved := update.ExpressionAttributeValues[":restore"].M
+		assert.Equal(t, RestoreCompleted, aws.StringValue(saved["status"].S))
+		assert.Equal(t, "arn", aws.StringValue(saved["executionArn"].S))
+		assert.Equal(t, "2026-10-26T00:00:00Z", aws.StringValue(saved["expiresAt"].S))
+	})
+
+	t.Run("should ignore other events", func(t *testing.T) {
+		handler, dynamoDBClientMock, _, _ := newHandler(config)
+
+		_, err := handler.HandleRequest(context.TODO(), event("ObjectCreated:Put"))
+		assert.NoError(t, err)
+		dynamoDBClientMock.AssertNotCalled(t, "Query", mock.Anything)
+	})
+
+	t.Run("should fail when the execution cannot start", func(t *testing.T) {
+		handler, dynamoDBClientMock, _, stepFunctionClientMock := newHandler(config)
+		dynamoDBClientMock.On("Query", mock.Anything).Return(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{{
+			"guid":    {S: aws.String("guid")},
+			"restore": {M: map[string]*dynamodb.AttributeValue{"status": {S: aws.String(RestoreInProgress)}, "executionName": {S: aws.String("guid-restore")}}},
+		}}}, nil)
+		stepFunctionClientMock.On("StartExecution", mock.Anything).Return(nil, assert.AnError)
+
+		_, err := handler.HandleRequest(context.TODO(), event("ObjectRestore:Completed"))
+		assert.ErrorIs(t, err, assert.AnError)
+		dynamoDBClientMock.AssertNotCalled(t, "UpdateItem", mock.Anything)
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+// A source in GLACIER or DEEP_ARCHIVE cannot be read by MediaConvert, so a
+// reprocess of it first restores a temporary copy. The request is kept in
+// the restore attribute of the workflow record until S3 reports the restore
+// complete, and the Process workflow is then started with it. A later
+// request for the same asset replaces the waiting one.
+const (
+	RestoreStarted    = "Started"
+	RestoreInProgress = "InProgress"
+	RestoreCompleted  = "Completed"
+
+	defaultRestoreDays = 7
+	srcVideoIndex      = "srcVideo-startTime-index"
+
+	// Not in the SDK's error code constants
+	errCodeRestoreAlreadyInProgress = "RestoreAlreadyInProgress"
+)
+
+// Restore is the restore attribute of the workflow record.
+type Restore struct {
+	Status        string `json:"status"`
+	Tier          string `json:"tier"`
+	Days          int64  `json:"days"`
+	JobTemplate   string `json:"jobTemplate,omitempty"`
+	ExecutionName string `json:"executionName"`
+	RequestedAt   string `json:"requestedAt"`
+	CompletedAt   string `json:"completedAt,omitempty"`
+	ExpiresAt     string `json:"expiresAt,omitempty"`
+	ExecutionArn  string `json:"executionArn,omitempty"`
+}
+
+type restoreAsset struct {
+	GUID      string   `json:"guid"`
+	SrcBucket string   `json:"srcBucket"`
+	SrcVideo  string   `json:"srcVideo"`
+	Restore   *Restore `json:"restore"`
+}
+
+// requestRestore starts the Process workflow when the source can be read,
+// and otherwise restores it and records the reprocess to resume.
+func (h *Handler) requestRestore(request RestoreRequest) (*RestoreResponse, error) {
+	tier, days, err := h.restoreOptions(request)
+	if err != nil {
+		return nil, err
+	}
+
+	asset, err := h.getAsset(request.GUID)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := h.S3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(asset.SrcBucket),
+		Key:    aws.String(asset.SrcVideo),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("HeadObject: %w", err)
+	}
+
+	storageClass := aws.StringValue(object.StorageClass)
+	archived := storageClass == s3.StorageClassGlacier || storageClass == s3.StorageClassDeepArchive
+	restore := aws.StringValue(object.Restore)
+	if !archived || strings.Contains(restore, `ongoing-request="false"`) {
+		executionArn, err := h.startProcess(request.GUID, request.JobTemplate, request.ExecutionName)
+		if err != nil {
+			return nil, err
+		}
+		return &RestoreResponse{GUID: request.GUID, Status: RestoreStarted, ExecutionArn: executionArn}, nil
+	}
+
+	if storageClass == s3.StorageClassDeepArchive && tier == s3.TierExpedited {
+		return nil, fmt.Errorf("tier %s is not available for %s: %w", tier, storageClass, ErrInvalidRequest)
+	}
+
+	if !strings.Contains(restore, `ongoing-request="true"`) {
+		_, err := h.S3Client.RestoreObject(&s3.RestoreObjectInput{
+			Bucket: aws.String(asset.SrcBucket),
+			Key:    aws.String(asset.SrcVideo),
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(days),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+			},
+		})
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == errCodeRestoreAlreadyInProgress) {
+			return nil, fmt.Errorf("RestoreObject: %w", err)
+		}
+	}
+
+	if err := h.saveRestore(request.GUID, &Restore{
+		Status:        RestoreInProgress,
+		Tier:          tier,
+		Days:          days,
+		JobTemplate:   request.JobTemplate,
+		ExecutionName: request.ExecutionName,
+		RequestedAt:   time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return nil, err
+	}
+
+	slog.Info("RESTORE REQUESTED", "guid", request.GUID, "bucket", asset.SrcBucket, "key", asset.SrcVideo, "storageClass", storageClass, "tier", tier)
+	return &RestoreResponse{GUID: request.GUID, Status: RestoreInProgress}, nil
+}
+
+// completeRestore starts the Process workflow for every asset waiting on
+// the restored object.
+func (h *Handler) completeRestore(record RestoreEventRecord) error {
+	if !strings.HasPrefix(record.EventName, "ObjectRestore:Completed") {
+		return nil
+	}
+
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.URLDecodedKey
+	assets, err := h.waitingAssets(bucket, key)
+	if err != nil {
+		return err
+	}
+	if len(assets) == 0 {
+		slog.Info("RESTORE COMPLETED", "bucket", bucket, "key", key, "reason", "no reprocess waiting")
+		return nil
+	}
+
+	expiresAt := ""
+	if expiry, err := time.Parse(time.RFC3339, record.GlacierEventData.RestoreEventData.LifecycleRestorationExpiryTime); err == nil {
+		expiresAt = expiry.UTC().Format(time.RFC3339)
+	}
+
+	for _, asset := range assets {
+		restore := asset.Restore
+		executionArn, err := h.startProcess(asset.GUID, restore.JobTemplate, restore.ExecutionName)
+		if err != nil {
+			return err
+		}
+
+		restore.Status = RestoreCompleted
+		restore.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+		restore.ExpiresAt = expiresAt
+		restore.ExecutionArn = executionArn
+		if err := h.saveRestore(asset.GUID, restore); err != nil {
+			return err
+		}
+		slog.Info("RESTORE COMPLETED", "guid", asset.GUID, "reprocessExecutionArn", executionArn)
+	}
+
+	return nil
+}
+
+// restoreOptions applies the RestoreTier and RestoreDays defaults.
+func (h *Handler) restoreOptions(request RestoreRequest) (string, int64, error) {
+	if request.GUID == "" {
+		return "", 0, fmt.Errorf("guid is required: %w", ErrInvalidRequest)
+	}
+
+	tier := request.Tier
+	if tier == "" {
+		tier = h.Config.RestoreTier
+	}
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	switch tier {
+	case s3.TierExpedited, s3.TierStandard, s3.TierBulk:
+	default:
+		return "", 0, fmt.Errorf("tier %q: %w", tier, ErrInvalidRequest)
+	}
+
+	days := request.Days
+	if days == 0 {
+		days = h.Config.RestoreDays
+	}
+	if days == 0 {
+		days = defaultRestoreDays
+	}
+	if days < 0 {
+		return "", 0, fmt.Errorf("days %d: %w", days, ErrInvalidRequest)
+	}
+
+	return tier, days, nil
+}
+
+func (h *Handler) getAsset(guid string) (*restoreAsset, error) {
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		ProjectionExpression: aws.String("#guid, #srcBucket, #srcVideo"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":      aws.String("guid"),
+			"#srcBucket": aws.String("srcBucket"),
+			"#srcVideo":  aws.String("srcVideo"),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if len(data.Item) == 0 {
+		return nil, fmt.Errorf("asset %s: %w", guid, ErrAssetNotFound)
+	}
+
+	var asset restoreAsset
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &asset); err != nil {
+		return nil, fmt.Errorf("UnmarshalMap: %w", err)
+	}
+	return &asset, nil
+}
+
+// waitingAssets returns the assets created from the object that have a
+// restore in progress.
+func (h *Handler) waitingAssets(bucket, key string) ([]restoreAsset, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(h.Config.DynamoDBTable),
+		IndexName:              aws.String(srcVideoIndex),
+		KeyConditionExpression: aws.String("#srcVideo = :srcVideo"),
+		FilterExpression:       aws.String("#srcBucket = :srcBucket AND #restore.#status = :inProgress"),
+		ProjectionExpression:   aws.String("#guid, #srcBucket, #srcVideo, #restore"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":      aws.String("guid"),
+			"#srcBucket": aws.String("srcBucket"),
+			"#srcVideo":  aws.String("srcVideo"),
+			"#restore":   aws.String("restore"),
+			"#status":    aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":srcVideo":   {S: aws.String(key)},
+			":srcBucket":  {S: aws.String(bucket)},
+			":inProgress": {S: aws.String(RestoreInProgress)},
+		},
+	}
+
+	assets := []restoreAsset{}
+	for {
+		data, err := h.DynamoDBClient.Query(input)
+		if err != nil {
+			return nil, fmt.Errorf("Query: %w", err)
+		}
+
+		var page []restoreAsset
+		if err := dynamodbattribute.UnmarshalListOfMaps(data.Items, &page); err != nil {
+			return nil, fmt.Errorf("UnmarshalListOfMaps: %w", err)
+		}
+		assets = append(assets, page...)
+
+		if len(data.LastEvaluatedKey) == 0 {
+			return assets, nil
+		}
+		input.ExclusiveStartKey = data.LastEvaluatedKey
+	}
+}
+
+func (h *Handler) saveRestore(guid string, restore *Restore) error {
+	value, err := dynamodbattribute.Marshal(restore)
+	if err != nil {
+		return fmt.Errorf("dynamodbattribute.Marshal: %w", err)
+	}
+
+	_, err = h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		UpdateExpression:    aws.String("SET #restore = :restore"),
+		ConditionExpression: aws.String("attribute_exists(#guid)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":    aws.String("guid"),
+			"#restore": aws.String("restore"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":restore": value,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+
+	return nil
+}
+
+// startProcess starts the Process workflow, treating an execution that
+// already exists under the same name as a redelivered event.
+func (h *Handler) startProcess(guid, jobTemplate, name string) (string, error) {
+	input, err := json.Marshal(ProcessWorkflowInput{
+		GUID:        guid,
+		JobTemplate: jobTemplate,
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	stateMachineArn := h.Config.ProcessWorkflow
+	data, err := h.StepFunctionClient.StartExecution(&sfn.StartExecutionInput{
+		Name:            aws.String(name),
+		Input:           aws.String(string(input)),
+		StateMachineArn: aws.String(stateMachineArn),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == sfn.ErrCodeExecutionAlreadyExists {
+		return strings.Replace(stateMachineArn, ":stateMachine:", ":execution:", 1) + ":" + name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("StartExecution: %w", err)
+	}
+
+	return aws.StringValue(data.ExecutionArn), nil
+}
+
+// executionName is a GUID plus 16 hex digits of the attempt, as the
+// step-functions service names its executions.
+func executionName(guid string, attempt string) string {
+	sum := sha256.Sum256([]byte(attempt))
+	return fmt.Sprintf("%s-%s", guid, hex.EncodeToString(sum[:])[:16])
+}
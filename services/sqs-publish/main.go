@@ -1,24 +1,52 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/claimcheck"
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "sqs-publish"
+
+var (
+	ErrInvalidSchema   = errors.New("unknown message schema")
+	ErrMessageTooLarge = errors.New("message exceeds the SQS size limit and no StateBucket is configured")
 )
 
 type SqsClient interface {
 	SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
 }
+
+// Config embeds ClaimCheckConfig, whose StateBucket also takes the bodies
+// too large for SQS.
+type Config struct {
+	logging.LogConfig
+	claimcheck.ClaimCheckConfig
+
+	SqsQueue         string `env:"SqsQueue" required:"true"`
+	SqsMessageSchema string `env:"SqsMessageSchema" default:"record" enum:"record,public"`
+}
+
 type Handler struct {
+	Config    Config
 	SqsClient SqsClient
+	S3Client  S3Client
 }
 
 type EventDetail struct {
@@ -78,10 +106,15 @@ type SqsPublishEvent struct {
 	SrcVideo               string                      `json:"srcVideo"`
 	EnableMediaPackage     bool                        `json:"enableMediaPackage"`
 	SrcMediainfo           string                      `json:"srcMediainfo"`
+	EncodingProfile        int                         `json:"encodingProfile,omitempty"`
+	JobTemplate            string                      `json:"jobTemplate,omitempty"`
 	EncodingJob            mediaconvert.CreateJobInput `json:"encodingJob"`
+	EncodingJobRef         *string                     `json:"encodingJobRef,omitempty"`
 	EncodeJobId            string                      `json:"encodeJobId"`
 	EncodingOutput         EventDetail                 `json:"encodingOutput"`
+	EncodingOutputRef      *string                     `json:"encodingOutputRef,omitempty"`
 	EndTime                time.Time                   `json:"endTime"`
+	Version                int64                       `json:"version,omitempty"`
 
 	// Output
 	HlsPlaylist            *string           `json:"hlsPlaylist"`
@@ -113,21 +146,44 @@ type UserMetadata struct {
 }
 
 func (h *Handler) HandleRequest(event SqsPublishEvent) (*SqsPublishEvent, error) {
-	eventJSON, err := json.Marshal(event)
+	body, err := h.messageBody(event)
 	if err != nil {
-		return nil, fmt.Errorf("sqs-publish: main.Handler: Marshal: %w", err)
+		return nil, fmt.Errorf("sqs-publish: main.Handler: messageBody: %w", err)
 	}
-	log.Printf("REQUEST:: %s", eventJSON)
 
-	_, err = h.SqsClient.SendMessage(&sqs.SendMessageInput{
-		MessageBody: aws.String(string(eventJSON)),
-		QueueUrl:    aws.String(os.Getenv("SqsQueue")),
-	})
+	attributes := messageAttributes(event)
+	if messageSize(body, attributes) > maxMessageSize {
+		attributes[extendedPayloadSize] = extendedPayloadSizeAttribute(body)
+		body, err = h.claimCheck(event, body)
+		if err != nil {
+			return nil, fmt.Errorf("sqs-publish: main.Handler: claimCheck: %w", err)
+		}
+	}
 
-	return &event, err
+	queueUrl := h.Config.SqsQueue
+	input := &sqs.SendMessageInput{
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: attributes,
+		QueueUrl:          aws.String(queueUrl),
+	}
+	if strings.HasSuffix(queueUrl, ".fifo") {
+		// Messages of one asset stay in order; a retried publish of the
+		// same status is dropped by SQS
+		input.MessageGroupId = aws.String(event.GUID)
+		input.MessageDeduplicationId = aws.String(event.GUID + "-" + event.WorkflowStatus)
+	}
+
+	_, err = h.SqsClient.SendMessage(input)
+	if err != nil {
+		return nil, fmt.Errorf("sqs-publish: main.Handler: SendMessage: %w", err)
+	}
+
+	return &event, nil
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	})
@@ -135,11 +191,19 @@ func main() {
 		log.Fatalf("sqs-publish: main: NewSession: %v", err)
 	}
 
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("sqs-publish: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	sqsClient := sqs.New(sess)
 
 	handler := &Handler{
+		Config:    config,
 		SqsClient: sqsClient,
+		S3Client:  s3.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
 }
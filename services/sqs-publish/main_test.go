@@ -1,9 +1,15 @@
 package main
 
 import (
-	"os"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -22,10 +28,11 @@ func (m *SqsClientMock) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessa
 }
 
 func TestSqsPublish(t *testing.T) {
-	os.Setenv("SqsQueue", "https://sqs.amazonaws.com/1234")
+	config := Config{SqsQueue: "https://sqs.amazonaws.com/1234"}
 	t.Run("should success on sqs send message", func(t *testing.T) {
 		sqsClientMock := new(SqsClientMock)
 		handler := &Handler{
+			Config:    config,
 			SqsClient: sqsClientMock,
 		}
 
@@ -46,6 +53,7 @@ func TestSqsPublish(t *testing.T) {
 	t.Run("should fail on sqs send message fails", func(t *testing.T) {
 		sqsClientMock := new(SqsClientMock)
 		handler := &Handler{
+			Config:    config,
 			SqsClient: sqsClientMock,
 		}
 
@@ -59,6 +67,221 @@ func TestSqsPublish(t *testing.T) {
 
 		_, err := handler.HandleRequest(event)
 		assert.Error(t, err)
-		
+
+	})
+}
+
+type S3ClientMock struct {
+	mock.Mock
+}
+
+func (m *S3ClientMock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
+func (m *S3ClientMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	if output, ok := args.Get(0).(func(*s3.GetObjectInput) *s3.GetObjectOutput); ok {
+		return output(input), args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+func completeEvent() SqsPublishEvent {
+	return SqsPublishEvent{
+		GUID:            "guid",
+		StartTime:       "2025-01-01T00:00:00Z",
+		WorkflowStatus:  "Complete",
+		WorkflowName:    "vod",
+		SrcBucket:       "source",
+		SrcVideo:        "video.mp4",
+		EncodingProfile: 1080,
+		HlsUrl:          aws.String("https://cdn/guid/hls/video.m3u8"),
+		Version:         3,
+	}
+}
+
+func TestSqsPublishFifo(t *testing.T) {
+	sqsClientMock := new(SqsClientMock)
+	sqsClientMock.On("SendMessage", mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+		return *input.MessageGroupId == "guid" &&
+			*input.MessageDeduplicationId == "guid-Complete" &&
+			*input.MessageAttributes["status"].StringValue == "Complete" &&
+			*input.MessageAttributes["workflowName"].StringValue == "vod"
+	})).Return(&sqs.SendMessageOutput{}, nil)
+
+	handler := &Handler{
+		Config:    Config{SqsQueue: "https://sqs.amazonaws.com/1234/vod.fifo"},
+		SqsClient: sqsClientMock,
+	}
+
+	_, err := handler.HandleRequest(completeEvent())
+	assert.NoError(t, err)
+	sqsClientMock.AssertExpectations(t)
+}
+
+func TestSqsPublishSchema(t *testing.T) {
+	config := Config{SqsQueue: "https://sqs.amazonaws.com/1234/vod"}
+
+	t.Run("should send the public schema", func(t *testing.T) {
+		config := config
+		config.SqsMessageSchema = SchemaPublic
+
+		var sent *sqs.SendMessageInput
+		sqsClientMock := new(SqsClientMock)
+		sqsClientMock.On("SendMessage", mock.Anything).Run(func(args mock.Arguments) {
+			sent = args.Get(0).(*sqs.SendMessageInput)
+		}).Return(&sqs.SendMessageOutput{}, nil)
+
+		handler := &Handler{
+			Config:    config,
+			SqsClient: sqsClientMock,
+		}
+
+		_, err := handler.HandleRequest(completeEvent())
+		assert.NoError(t, err)
+		assert.Nil(t, sent.MessageGroupId)
+		assert.NotContains(t, *sent.MessageBody, "encodingJob")
+
+		var message PublicMessage
+		assert.Nil(t, json.Unmarshal([]byte(*sent.MessageBody), &message))
+		assert.Equal(t, "Complete", message.Status)
+		assert.Equal(t, MessageSource{Bucket: "source", Key: "video.mp4"}, message.Source)
+		assert.Equal(t, "https://cdn/guid/hls/video.m3u8", message.Playback.Hls)
+		assert.Equal(t, 1080, message.EncodingProfile)
+	})
+
+	t.Run("should reject an unknown schema", func(t *testing.T) {
+		config := config
+		config.SqsMessageSchema = "compact"
+
+		handler := &Handler{
+			Config:    config,
+			SqsClient: new(SqsClientMock),
+		}
+
+		_, err := handler.HandleRequest(completeEvent())
+		assert.ErrorIs(t, err, ErrInvalidSchema)
+	})
+}
+
+func TestSqsPublishClaimCheck(t *testing.T) {
+	config := Config{SqsQueue: "https://sqs.amazonaws.com/1234/vod"}
+
+	event := completeEvent()
+	event.SrcMediainfo = strings.Repeat("x", maxMessageSize)
+
+	t.Run("should offload large bodies to the state bucket", func(t *testing.T) {
+		config := config
+		config.StateBucket = "state"
+
+		var stored []byte
+		s3ClientMock := new(S3ClientMock)
+		s3ClientMock.On("PutObject", mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+			return *input.Bucket == "state" && *input.Key == "guid/messages/complete-3.json"
+		})).Run(func(args mock.Arguments) {
+			stored, _ = io.ReadAll(args.Get(0).(*s3.PutObjectInput).Body)
+		}).Return(&s3.PutObjectOutput{}, nil)
+
+		var sent *sqs.SendMessageInput
+		sqsClientMock := new(SqsClientMock)
+		sqsClientMock.On("SendMessage", mock.Anything).Run(func(args mock.Arguments) {
+			sent = args.Get(0).(*sqs.SendMessageInput)
+		}).Return(&sqs.SendMessageOutput{}, nil)
+
+		handler := &Handler{
+			Config:    config,
+			SqsClient: sqsClientMock,
+			S3Client:  s3ClientMock,
+		}
+
+		_, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Greater(t, len(stored), maxMessageSize)
+		assert.JSONEq(t, `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"state","s3Key":"guid/messages/complete-3.json"}]`, *sent.MessageBody)
+		assert.Equal(t, "Number", *sent.MessageAttributes[extendedPayloadSize].DataType)
+	})
+
+	t.Run("should fail without a state bucket", func(t *testing.T) {
+		handler := &Handler{
+			Config:    config,
+			SqsClient: new(SqsClientMock),
+		}
+
+		_, err := handler.HandleRequest(event)
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+	})
+}
+
+func TestSqsPublishHydrate(t *testing.T) {
+	config := Config{SqsQueue: "https://sqs.amazonaws.com/1234/vod"}
+	config.StateBucket = "state"
+	config.ClaimCheckThreshold = 64
+
+	// the state bucket keeps what is offloaded and serves it back
+	objects := map[string][]byte{}
+	s3ClientMock := new(S3ClientMock)
+	s3ClientMock.On("PutObject", mock.Anything).Run(func(args mock.Arguments) {
+		input := args.Get(0).(*s3.PutObjectInput)
+		objects[*input.Bucket+"/"+*input.Key], _ = io.ReadAll(input.Body)
+	}).Return(&s3.PutObjectOutput{}, nil)
+	s3ClientMock.On("GetObject", mock.Anything).Return(func(input *s3.GetObjectInput) *s3.GetObjectOutput {
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(objects[*input.Bucket+"/"+*input.Key]))}
+	}, nil)
+
+	event := completeEvent()
+	event.EncodingJob = mediaconvert.CreateJobInput{
+		Role:         aws.String("arn:aws:iam::123456789012:role/vod-mediaconvert"),
+		UserMetadata: map[string]*string{"guid": aws.String("guid"), "workflow": aws.String("vod")},
+	}
+	ref, err := config.Offload(s3ClientMock, event.GUID, "encodingJob", event.EncodingJob)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://state/guid/state/encodingJob.json", *ref)
+	encodingJob := event.EncodingJob
+	event.EncodingJob = mediaconvert.CreateJobInput{}
+	event.EncodingJobRef = ref
+
+	t.Run("should send the record with its claim-checked fields", func(t *testing.T) {
+		var sent *sqs.SendMessageInput
+		sqsClientMock := new(SqsClientMock)
+		sqsClientMock.On("SendMessage", mock.Anything).Run(func(args mock.Arguments) {
+			sent = args.Get(0).(*sqs.SendMessageInput)
+		}).Return(&sqs.SendMessageOutput{}, nil)
+
+		handler := &Handler{
+			Config:    config,
+			SqsClient: sqsClientMock,
+			S3Client:  s3ClientMock,
+		}
+
+		res, err := handler.HandleRequest(event)
+		assert.NoError(t, err)
+		assert.Equal(t, ref, res.EncodingJobRef)
+
+		var message SqsPublishEvent
+		assert.Nil(t, json.Unmarshal([]byte(*sent.MessageBody), &message))
+		assert.Equal(t, encodingJob, message.EncodingJob)
+		assert.Nil(t, message.EncodingJobRef)
+	})
+
+	t.Run("should fail when a claim-checked field cannot be read", func(t *testing.T) {
+		failing := new(S3ClientMock)
+		failing.On("GetObject", mock.Anything).Return(nil, assert.AnError)
+
+		handler := &Handler{
+			Config:    config,
+			SqsClient: new(SqsClientMock),
+			S3Client:  failing,
+		}
+
+		_, err := handler.HandleRequest(event)
+		assert.ErrorIs(t, err, assert.AnError)
 	})
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"shared/claimcheck"
+)
+
+// SqsMessageSchema selects the message body: "record" (the default) sends
+// the workflow record with its claim-checked fields read back, "public"
+// sends PublicMessage, which has the same shape as an asset of the asset API
+// and leaves out internal fields such as the MediaConvert job.
+const (
+	SchemaRecord = "record"
+	SchemaPublic = "public"
+)
+
+// Bodies larger than the SQS limit are written to the StateBucket and
+// replaced by a pointer in the format of the Amazon SQS Extended Client
+// Library, so consumers using that library read them transparently.
+const (
+	maxMessageSize            = 256 * 1024
+	extendedPayloadSize       = "ExtendedPayloadSize"
+	extendedPayloadPointerTag = "software.amazon.payloadoffloading.PayloadS3Pointer"
+)
+
+type S3Client interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type PublicMessage struct {
+	GUID            string          `json:"guid"`
+	Status          string          `json:"status"`
+	Workflow        string          `json:"workflow"`
+	Source          MessageSource   `json:"source"`
+	EncodingProfile int             `json:"encodingProfile,omitempty"`
+	JobTemplate     string          `json:"jobTemplate,omitempty"`
+	CreatedAt       string          `json:"createdAt"`
+	CompletedAt     string          `json:"completedAt,omitempty"`
+	Playback        MessagePlayback `json:"playback"`
+	Thumbnails      []string        `json:"thumbnails"`
+}
+
+type MessageSource struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type MessagePlayback struct {
+	Hls          string            `json:"hls,omitempty"`
+	Dash         string            `json:"dash,omitempty"`
+	CmafHls      string            `json:"cmafHls,omitempty"`
+	CmafDash     string            `json:"cmafDash,omitempty"`
+	Mss          string            `json:"mss,omitempty"`
+	Mp4          []string          `json:"mp4,omitempty"`
+	MediaPackage map[string]string `json:"mediaPackage,omitempty"`
+}
+
+type PayloadS3Pointer struct {
+	S3BucketName string `json:"s3BucketName"`
+	S3Key        string `json:"s3Key"`
+}
+
+// messageBody returns the body in the configured schema.
+func (h *Handler) messageBody(event SqsPublishEvent) ([]byte, error) {
+	switch schema := h.Config.SqsMessageSchema; schema {
+	case "", SchemaRecord:
+		if err := h.hydrate(&event); err != nil {
+			return nil, fmt.Errorf("hydrate: %w", err)
+		}
+		return json.Marshal(event)
+	case SchemaPublic:
+		return json.Marshal(toPublicMessage(event))
+	default:
+		return nil, fmt.Errorf("SqsMessageSchema %q: %w", schema, ErrInvalidSchema)
+	}
+}
+
+// hydrate reads the claim-checked fields back into the record, so consumers
+// of the record schema get the whole record. A record that no longer fits in
+// a message is then offloaded as a whole by claimCheck.
+func (h *Handler) hydrate(event *SqsPublishEvent) error {
+	if event.EncodingJobRef != nil {
+		if err := claimcheck.Load(h.S3Client, *event.EncodingJobRef, &event.EncodingJob); err != nil {
+			return fmt.Errorf("encodingJob: %w", err)
+		}
+		event.EncodingJobRef = nil
+	}
+	if event.EncodingOutputRef != nil {
+		if err := claimcheck.Load(h.S3Client, *event.EncodingOutputRef, &event.EncodingOutput); err != nil {
+			return fmt.Errorf("encodingOutput: %w", err)
+		}
+		event.EncodingOutputRef = nil
+	}
+	return nil
+}
+
+func toPublicMessage(event SqsPublishEvent) PublicMessage {
+	message := PublicMessage{
+		GUID:     event.GUID,
+		Status:   event.WorkflowStatus,
+		Workflow: event.WorkflowName,
+		Source: MessageSource{
+			Bucket: event.SrcBucket,
+			Key:    event.SrcVideo,
+		},
+		EncodingProfile: event.EncodingProfile,
+		JobTemplate:     event.JobTemplate,
+		CreatedAt:       event.StartTime,
+		Playback: MessagePlayback{
+			Hls:          aws.StringValue(event.HlsUrl),
+			Dash:         aws.StringValue(event.DashUrl),
+			CmafHls:      aws.StringValue(event.CmafHlsUrl),
+			CmafDash:     aws.StringValue(event.CmafDashUrl),
+			Mss:          aws.StringValue(event.MssUrl),
+			Mp4:          aws.StringValueSlice(event.Mp4Urls),
+			MediaPackage: event.EgressEndpoints,
+		},
+		Thumbnails: aws.StringValueSlice(event.ThumbNailsUrls),
+	}
+
+	if event.WorkflowStatus == "Complete" && !event.EndTime.IsZero() {
+		message.CompletedAt = event.EndTime.UTC().Format(time.RFC3339)
+	}
+	if len(message.Playback.MediaPackage) == 0 {
+		message.Playback.MediaPackage = nil
+	}
+
+	return message
+}
+
+// messageAttributes lets consumers filter and route on status and workflow.
+// SQS rejects empty attribute values, so those are left out.
+func messageAttributes(event SqsPublishEvent) map[string]*sqs.MessageAttributeValue {
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for name, value := range map[string]string{
+		"guid":         event.GUID,
+		"status":       event.WorkflowStatus,
+		"workflowName": event.WorkflowName,
+	} {
+		if value != "" {
+			attributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+
+	return attributes
+}
+
+// messageSize is the size SQS counts against its limit: the body and the
+// name, type and value of every attribute.
+func messageSize(body []byte, attributes map[string]*sqs.MessageAttributeValue) int {
+	size := len(body)
+	for name, value := range attributes {
+		size += len(name) + len(aws.StringValue(value.DataType)) + len(aws.StringValue(value.StringValue))
+	}
+	return size
+}
+
+// claimCheck writes the body to <guid>/messages/<status>-<version>.json in
+// the StateBucket and returns the pointer body that replaces it. The record
+// version is in the key, so the body of a reprocessed asset does not replace
+// the one an earlier message still points to.
+func (h *Handler) claimCheck(event SqsPublishEvent, body []byte) ([]byte, error) {
+	bucket := h.Config.StateBucket
+	if bucket == "" {
+		return nil, ErrMessageTooLarge
+	}
+
+	key := fmt.Sprintf("%s/messages/%s-%d.json", event.GUID, strings.ToLower(event.WorkflowStatus), event.Version)
+	_, err := h.S3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PutObject: %w", err)
+	}
+
+	return json.Marshal([]interface{}{
+		extendedPayloadPointerTag,
+		PayloadS3Pointer{S3BucketName: bucket, S3Key: key},
+	})
+}
+
+func extendedPayloadSizeAttribute(body []byte) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(len(body))),
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/google/uuid"
+
+	"shared/emf"
+	"shared/envconfig"
+	"shared/logging"
 )
 
+const serviceName = "step-functions"
+
 var (
 	ErrInvalidEventObject = errors.New("invalid event object")
 )
@@ -40,38 +55,71 @@ type StepFunctionEvent struct {
 	SrcVideo               *string                `json:"srcVideo"`
 	EnableMediaPackage     *bool                  `json:"enableMediaPackage"`
 	SrcMediainfo           *string                `json:"srcMediainfo"`
+	JobTemplate            *string                `json:"jobTemplate,omitempty"`
+	Execution              *ExecutionContext      `json:"execution,omitempty"`
+	RequestId              *string                `json:"requestId,omitempty"`
 }
 
 type ProcessWorkflowInput struct {
-	GUID *string `json:"guid"`
+	GUID        *string `json:"guid"`
+	JobTemplate *string `json:"jobTemplate,omitempty"`
+}
+
+// ExecutionContext is set on the state by the Ingest workflow's "Execution
+// Context" Pass state.
+type ExecutionContext struct {
+	Id string `json:"id"`
 }
 
 type StepFunctionClent interface {
 	StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error)
+	ListExecutions(input *sfn.ListExecutionsInput) (*sfn.ListExecutionsOutput, error)
+}
+
+type SQSClient interface {
+	ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error)
+	SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
+}
+
+type Config struct {
+	logging.LogConfig
+	emf.MetricsConfig
+
+	IngestWorkflow  string `env:"IngestWorkflow" required:"true"`
+	ProcessWorkflow string `env:"ProcessWorkflow" required:"true"`
+	PublishWorkflow string `env:"PublishWorkflow" required:"true"`
+	// FfmpegEventSource is the source of the encode service's ffmpeg job
+	// events, vod.ffmpeg when empty.
+	FfmpegEventSource string `env:"FfmpegEventSource"`
+	WorkflowName      string `env:"WorkflowName"`
+	// MaxConcurrentWorkflows caps the running executions in the Queue ingest
+	// mode, no cap when 0.
+	MaxConcurrentWorkflows int `env:"MaxConcurrentWorkflows" min:"0"`
+	// IngestQueueUrl is set in the Queue ingest mode, when messages that are
+	// not S3 notifications are sent to the TriggerDlqUrl queue.
+	IngestQueueUrl string `env:"IngestQueueUrl"`
+	TriggerDlqUrl  string `env:"TriggerDlqUrl" requiredIf:"IngestQueueUrl"`
 }
 
 type Handler struct {
+	Config             Config
 	StepFunctionClient StepFunctionClent
+	SQSClient          SQSClient
 }
 
-func (h *Handler) HandleRequest(generalEvent map[string]interface{}) (*string, error) {
+func (h *Handler) HandleRequest(ctx context.Context, generalEvent map[string]interface{}) (*string, error) {
 
 	var event StepFunctionEvent
 	var eventBridgeEvent events.EventBridgeEvent
-	if source, ok := generalEvent["source"]; ok && source == "aws.mediaconvert" {
+	if source, ok := generalEvent["source"].(string); ok && h.isJobStateChangeSource(source) {
 		eventBridgeBytes, err := json.Marshal(generalEvent)
 		if err != nil {
-			log.Printf("step-function: main.Handler: Error marshalling general event: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Marshal: %w", err)
 		}
 
 		if err := json.Unmarshal(eventBridgeBytes, &eventBridgeEvent); err != nil {
-			log.Printf("step-function: main.Handler: Error unmarshalling to EventBridgeEvent: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Unmarshal: %w", err)
 		}
-
-		log.Printf("Received EventBridge event")
-		log.Printf("REQUEST:: %s", eventBridgeBytes)
 	}
 
 	_, okRecord := generalEvent["Records"]
@@ -79,17 +127,12 @@ func (h *Handler) HandleRequest(generalEvent map[string]interface{}) (*string, e
 	if okRecord || okGuid {
 		eventBytes, err := json.Marshal(generalEvent)
 		if err != nil {
-			log.Printf("step-function: main.Handler: Error marshalling general event: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Marshal: %w", err)
 		}
 
 		if err := json.Unmarshal(eventBytes, &event); err != nil {
-			log.Printf("step-function: main.Handler: Error unmarshalling to StepFunctionEvent: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Unmarshal: %w", err)
 		}
-
-		log.Printf("Received StepFunction event")
-		log.Printf("REQUEST:: %s", eventBytes)
 	}
 
 	var response string
@@ -98,72 +141,167 @@ func (h *Handler) HandleRequest(generalEvent map[string]interface{}) (*string, e
 	switch {
 	case event.Records != nil:
 		// Ingest workflow triggerd by s3 event::
-		event.GUID = aws.String(uuid.New().String())
-		event.WorkflowTrigger = aws.String("Video")
-
-		inputBytes, err := json.Marshal(event)
-		if err != nil {
-			log.Printf("step-function: main.Handler: Error marshalling event: %v", err)
+		// S3 can batch several records in one notification. Each record is
+		// ingested by its own execution, and a failed start does not stop
+		// the others: the error is returned once every record was tried, and
+		// the redelivered event only starts the records that failed.
+		var errs []error
+		for _, record := range event.Records {
+			key, err := h.startIngest(event, record)
+			if err != nil {
+				slog.Error("INGEST FAILED", "bucket", record.S3.Bucket.Name, "key", record.S3.Object.Key, "error", err)
+				errs = append(errs, err)
+				continue
+			}
+			slog.Info("INGEST STARTED", "key", key)
 		}
-
-		startExecutionInput = sfn.StartExecutionInput{
-			Name:            event.GUID,
-			Input:           aws.String(string(inputBytes)),
-			StateMachineArn: aws.String(os.Getenv("IngestWorkflow")),
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: %d of %d records failed: %w", len(errs), len(event.Records), errors.Join(errs...))
 		}
+
 		response = "success"
+		return &response, nil
 	case event.GUID != nil:
 		inputBytes, err := json.Marshal(ProcessWorkflowInput{
-			GUID: event.GUID,
+			GUID:        event.GUID,
+			JobTemplate: event.JobTemplate,
 		})
 		if err != nil {
-			log.Printf("step-function: main.Handler: Error marshalling event: %v", err)
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Marshal: %w", err)
 		}
+
 		// Process workflow trigger
+		// Started from the Ingest workflow the attempt is its execution, so a
+		// retried "Process Execute" task is deduplicated; invoked directly it
+		// is the Lambda request, which async retries keep.
+		attempt := aws.StringValue(event.RequestId)
+		if event.Execution != nil && event.Execution.Id != "" {
+			attempt = event.Execution.Id
+		}
+		if lc, ok := lambdacontext.FromContext(ctx); ok && attempt == "" {
+			attempt = lc.AwsRequestID
+		}
+
 		startExecutionInput = sfn.StartExecutionInput{
-			Name:            event.GUID,
+			Name:            aws.String(executionName(*event.GUID, attempt)),
 			Input:           aws.String(string(inputBytes)),
-			StateMachineArn: aws.String(os.Getenv("ProcessWorkflow")),
+			StateMachineArn: aws.String(h.Config.ProcessWorkflow),
 		}
 		response = "success"
 	case eventBridgeEvent.Detail != nil:
 		eventBridgeBytes, err := json.Marshal(eventBridgeEvent)
 		if err != nil {
-			log.Printf("step-function: main.Handler: Error marshalling eventBridge: %v", err)
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Marshal: %w", err)
 		}
 
+		var detail struct {
+			UserMetadata struct {
+				GUID string `json:"guid"`
+			} `json:"userMetadata"`
+		}
+		if err := json.Unmarshal(eventBridgeEvent.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: json.Unmarshal: %w", err)
+		}
+
+		// EventBridge keeps the event id across redeliveries
 		startExecutionInput = sfn.StartExecutionInput{
-			Name:            event.GUID,
+			Name:            aws.String(executionName(detail.UserMetadata.GUID, eventBridgeEvent.ID)),
 			Input:           aws.String(string(eventBridgeBytes)),
-			StateMachineArn: aws.String(os.Getenv("PublishWorkflow")),
+			StateMachineArn: aws.String(h.Config.PublishWorkflow),
 		}
 		response = "success"
 	default:
 		return nil, ErrInvalidEventObject
 	}
 
-	data, err := h.StepFunctionClient.StartExecution(&startExecutionInput)
+	if err := h.startExecution(&startExecutionInput); err != nil {
+		return nil, fmt.Errorf("step-functions: main.Handler.HandleRequest: %w", err)
+	}
+
+	return &response, nil
+}
+
+// isJobStateChangeSource reports whether source sends encoding job events:
+// MediaConvert, or the encode service's ffmpeg backend which sends the same
+// event under FfmpegEventSource.
+func (h *Handler) isJobStateChangeSource(source string) bool {
+	ffmpegSource := h.Config.FfmpegEventSource
+	if ffmpegSource == "" {
+		ffmpegSource = "vod.ffmpeg"
+	}
+	return source == "aws.mediaconvert" || source == ffmpegSource
+}
+
+// startIngest starts the Ingest workflow for a single S3 record. The GUID is
+// derived from the object and its S3 sequencer, so a redelivered
+// notification starts the same execution with the same input while a new
+// upload of the same key gets a new GUID.
+func (h *Handler) startIngest(event StepFunctionEvent, record events.S3EventRecord) (string, error) {
+	key := fmt.Sprintf("s3://%s/%s", record.S3.Bucket.Name, record.S3.Object.Key)
+
+	event.Records = []events.S3EventRecord{record}
+	event.GUID = aws.String(uuid.NewSHA1(uuid.NameSpaceURL, []byte(key+"#"+record.S3.Object.Sequencer)).String())
+	event.WorkflowTrigger = aws.String("Video")
+
+	inputBytes, err := json.Marshal(event)
 	if err != nil {
-		log.Printf("step-function: main.Handler: Error starting execution: %v", err)
+		return key, fmt.Errorf("json.Marshal: %w", err)
 	}
 
-	dataJson, err := json.Marshal(data)
+	err = h.startExecution(&sfn.StartExecutionInput{
+		Name:            event.GUID,
+		Input:           aws.String(string(inputBytes)),
+		StateMachineArn: aws.String(h.Config.IngestWorkflow),
+	})
+	return key, err
+}
+
+// startExecution starts input, treating an execution that already exists
+// under the same name as a duplicate delivery of the same event.
+func (h *Handler) startExecution(input *sfn.StartExecutionInput) error {
+	data, err := h.StepFunctionClient.StartExecution(input)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == sfn.ErrCodeExecutionAlreadyExists {
+		slog.Info("DUPLICATE", "executionName", *input.Name)
+		return nil
+	}
 	if err != nil {
-		log.Printf("step-function: main.Handler: Error marshalling data: %v", err)
+		return fmt.Errorf("StartExecution: %w", err)
 	}
-	log.Printf("STATEMACHINE EXECUTE:: %s", dataJson)
 
-	return &response, nil
+	slog.Info("STATEMACHINE EXECUTE", "executionArn", aws.StringValue(data.ExecutionArn))
+
+	return nil
+}
+
+// executionName is deterministic for a given attempt, so a redelivered event
+// maps onto the execution it already started, and unique across attempts, so
+// reprocessing an asset never collides with its earlier executions. Names
+// are limited to 80 characters: a GUID plus 16 hex digits of the attempt.
+func executionName(guid string, attempt string) string {
+	sum := sha256.Sum256([]byte(attempt))
+	return fmt.Sprintf("%s-%s", guid, hex.EncodeToString(sum[:])[:16])
 }
 
 func main() {
+	slog.SetDefault(logging.New(serviceName))
+
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(os.Getenv("AWS_REGION")),
 	}))
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("step-functions: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
 	stepFunctionClient := sfn.New(sess)
 	handler := &Handler{
+		Config:             config,
 		StepFunctionClient: stepFunctionClient,
+		SQSClient:          sqs.New(sess),
 	}
 
-	lambda.Start(handler.HandleRequest)
+	lambda.Start(logging.Wrap(serviceName, handler.Invoke))
 }
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+
+	"shared/logging"
 )
 
 type StepFunctionClientMock struct {
@@ -15,7 +25,39 @@ type StepFunctionClientMock struct {
 }
 
 func (m *StepFunctionClientMock) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
-	return &sfn.StartExecutionOutput{}, nil
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.StartExecutionOutput), args.Error(1)
+}
+
+func (m *StepFunctionClientMock) ListExecutions(input *sfn.ListExecutionsInput) (*sfn.ListExecutionsOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.ListExecutionsOutput), args.Error(1)
+}
+
+type SQSClientMock struct {
+	mock.Mock
+}
+
+func (m *SQSClientMock) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sqs.ChangeMessageVisibilityOutput), args.Error(1)
+}
+
+func (m *SQSClientMock) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sqs.SendMessageOutput), args.Error(1)
 }
 
 func TestHandleRequest(t *testing.T) {
@@ -62,6 +104,19 @@ func TestHandleRequest(t *testing.T) {
 			expectedResponse: aws.String("success"),
 			expectedError:    nil,
 		},
+		{
+			name: "should return \"success\" on Publish Execute success from ffmpeg",
+			event: map[string]interface{}{
+				"detail": map[string]interface{}{
+					"status": "COMPLETE",
+					"jobId":  "1740305088-ffmpeg0a1b2c",
+				},
+				"source":      "vod.ffmpeg",
+				"detail-type": "MediaConvert Job State Change",
+			},
+			expectedResponse: aws.String("success"),
+			expectedError:    nil,
+		},
 		{
 			name:             "should return error on invalid event object",
 			event:            map[string]interface{}{},
@@ -77,12 +132,335 @@ func TestHandleRequest(t *testing.T) {
 				StepFunctionClient: mockStepFunctionClient,
 			}
 
-			mockStepFunctionClient.On("StartExecution", &sfn.StartExecutionInput{}).Return(&sfn.StartExecutionOutput{}, nil)
+			mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
 
-			response, err := handler.HandleRequest(tt.event)
+			response, err := handler.HandleRequest(context.Background(), tt.event)
 			assert.Equal(t, tt.expectedResponse, response)
 			assert.Equal(t, tt.expectedError, err)
 		})
 	}
 
 }
+
+func TestStartExecution(t *testing.T) {
+	s3Event := map[string]interface{}{
+		"Records": []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "source"},
+					Object: events.S3Object{Key: "test.mp4", Sequencer: "0055AED6DCD90281E5"},
+				},
+			},
+		},
+	}
+
+	t.Run("should surface StartExecution errors", func(t *testing.T) {
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(nil, assert.AnError)
+
+		handler := Handler{
+			StepFunctionClient: mockStepFunctionClient,
+		}
+
+		response, err := handler.HandleRequest(context.Background(), s3Event)
+		assert.Nil(t, response)
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+
+	t.Run("should treat an existing execution as a duplicate delivery", func(t *testing.T) {
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(nil, awserr.New(sfn.ErrCodeExecutionAlreadyExists, "exists", nil))
+
+		handler := Handler{
+			StepFunctionClient: mockStepFunctionClient,
+		}
+
+		response, err := handler.HandleRequest(context.Background(), s3Event)
+		assert.Nil(t, err)
+		assert.Equal(t, aws.String("success"), response)
+	})
+
+	t.Run("should name executions deterministically per attempt", func(t *testing.T) {
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
+
+		handler := Handler{
+			StepFunctionClient: mockStepFunctionClient,
+		}
+
+		guid := "123e4567-e89b-12d3-a456-426614174000"
+		for _, event := range []map[string]interface{}{
+			s3Event,
+			s3Event,
+			{"guid": guid, "execution": map[string]interface{}{"id": "ingest-1"}},
+			{"guid": guid, "execution": map[string]interface{}{"id": "ingest-1"}},
+			{"guid": guid, "execution": map[string]interface{}{"id": "ingest-2"}},
+			{
+				"id":          "event-1",
+				"source":      "aws.mediaconvert",
+				"detail-type": "MediaConvert Job State Change",
+				"detail":      map[string]interface{}{"status": "COMPLETE", "userMetadata": map[string]interface{}{"guid": guid}},
+			},
+		} {
+			_, err := handler.HandleRequest(context.Background(), event)
+			assert.Nil(t, err)
+		}
+
+		names := []string{}
+		for _, call := range mockStepFunctionClient.Calls {
+			name := call.Arguments.Get(0).(*sfn.StartExecutionInput).Name
+			assert.NotNil(t, name)
+			names = append(names, *name)
+		}
+		assert.Equal(t, names[0], names[1])
+		assert.Equal(t, names[2], names[3])
+		assert.NotEqual(t, names[3], names[4])
+		assert.Regexp(t, "^"+guid+"-[0-9a-f]{16}$", names[4])
+		assert.Regexp(t, "^"+guid+"-[0-9a-f]{16}$", names[5])
+	})
+}
+
+func TestMultiRecordEvent(t *testing.T) {
+	record := func(key string) events.S3EventRecord {
+		return events.S3EventRecord{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: "source"},
+				Object: events.S3Object{Key: key, Sequencer: "0055AED6DCD90281E5"},
+			},
+		}
+	}
+
+	mockStepFunctionClient := new(StepFunctionClientMock)
+	mockStepFunctionClient.On("StartExecution", mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+		return strings.Contains(*input.Input, "b.mp4")
+	})).Return(nil, assert.AnError)
+	mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
+
+	handler := Handler{
+		StepFunctionClient: mockStepFunctionClient,
+	}
+
+	response, err := handler.HandleRequest(context.Background(), map[string]interface{}{
+		"Records": []events.S3EventRecord{record("a.mp4"), record("b.mp4"), record("c.mp4")},
+	})
+
+	assert.Nil(t, response)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Contains(t, err.Error(), "1 of 3 records failed")
+
+	names := map[string]bool{}
+	for _, call := range mockStepFunctionClient.Calls {
+		input := call.Arguments.Get(0).(*sfn.StartExecutionInput)
+		names[*input.Name] = true
+
+		var event StepFunctionEvent
+		assert.Nil(t, json.Unmarshal([]byte(*input.Input), &event))
+		assert.Len(t, event.Records, 1)
+		assert.Equal(t, *input.Name, *event.GUID)
+	}
+	assert.Len(t, names, 3)
+}
+
+func TestHandleSQSEvent(t *testing.T) {
+	body := func(keys ...string) string {
+		notification := events.S3Event{}
+		for _, key := range keys {
+			notification.Records = append(notification.Records, events.S3EventRecord{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "source"},
+					Object: events.S3Object{Key: key},
+				},
+			})
+		}
+		bodyJson, _ := json.Marshal(notification)
+		return string(bodyJson)
+	}
+
+	event := map[string]interface{}{
+		"Records": []interface{}{
+			map[string]interface{}{"messageId": "m1", "eventSource": "aws:sqs", "body": body("a.mp4")},
+			map[string]interface{}{"messageId": "m2", "eventSource": "aws:sqs", "body": body("b.mp4", "c.mp4")},
+			map[string]interface{}{"messageId": "m3", "eventSource": "aws:sqs", "body": `{"Event":"s3:TestEvent"}`},
+			map[string]interface{}{"messageId": "m4", "eventSource": "aws:sqs", "body": "not json"},
+		},
+	}
+	config := Config{IngestQueueUrl: "https://sqs/ingest", TriggerDlqUrl: "https://sqs/trigger-dlq"}
+	deadLettered := mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+		return *input.QueueUrl == "https://sqs/trigger-dlq" && *input.MessageBody == "not json"
+	})
+
+	t.Run("should report the messages that failed", func(t *testing.T) {
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("StartExecution", mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+			return strings.Contains(*input.Input, "c.mp4")
+		})).Return(nil, assert.AnError)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
+		mockSQSClient := new(SQSClientMock)
+		mockSQSClient.On("SendMessage", deadLettered).Return(&sqs.SendMessageOutput{}, nil).Once()
+
+		handler := Handler{
+			Config:             config,
+			StepFunctionClient: mockStepFunctionClient,
+			SQSClient:          mockSQSClient,
+		}
+
+		response, err := handler.Invoke(context.Background(), event)
+
+		assert.Nil(t, err)
+		assert.Equal(t, events.SQSEventResponse{
+			BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m2"}},
+		}, response)
+		mockStepFunctionClient.AssertNumberOfCalls(t, "StartExecution", 3)
+		mockSQSClient.AssertExpectations(t)
+	})
+
+	t.Run("should report a malformed message that could not be dead-lettered", func(t *testing.T) {
+		mockSQSClient := new(SQSClientMock)
+		mockSQSClient.On("SendMessage", deadLettered).Return(nil, assert.AnError)
+
+		handler := Handler{
+			Config:             config,
+			StepFunctionClient: new(StepFunctionClientMock),
+			SQSClient:          mockSQSClient,
+		}
+
+		response, err := handler.Invoke(context.Background(), map[string]interface{}{
+			"Records": []interface{}{
+				map[string]interface{}{"messageId": "m4", "eventSource": "aws:sqs", "body": "not json"},
+			},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, events.SQSEventResponse{
+			BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m4"}},
+		}, response)
+	})
+
+	t.Run("should hand messages back once the workflow cap is reached", func(t *testing.T) {
+
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("ListExecutions", mock.Anything).Return(&sfn.ListExecutionsOutput{
+			Executions: []*sfn.ExecutionListItem{{}},
+		}, nil).Once()
+		mockStepFunctionClient.On("ListExecutions", mock.Anything).Return(&sfn.ListExecutionsOutput{}, nil)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
+		mockSQSClient := new(SQSClientMock)
+		mockSQSClient.On("SendMessage", deadLettered).Return(&sqs.SendMessageOutput{}, nil)
+		mockSQSClient.On("ChangeMessageVisibility", mock.MatchedBy(func(input *sqs.ChangeMessageVisibilityInput) bool {
+			return *input.QueueUrl == "https://sqs/ingest" && *input.ReceiptHandle == "r2" && *input.VisibilityTimeout == 240
+		})).Return(&sqs.ChangeMessageVisibilityOutput{}, nil).Once()
+
+		config := config
+		config.MaxConcurrentWorkflows = 3
+		handler := Handler{
+			Config:             config,
+			StepFunctionClient: mockStepFunctionClient,
+			SQSClient:          mockSQSClient,
+		}
+
+		response, err := handler.Invoke(context.Background(), map[string]interface{}{
+			"Records": []interface{}{
+				map[string]interface{}{"messageId": "m1", "eventSource": "aws:sqs", "body": body("a.mp4")},
+				map[string]interface{}{"messageId": "m2", "eventSource": "aws:sqs", "body": body("b.mp4", "c.mp4"),
+					"receiptHandle": "r2", "attributes": map[string]string{"ApproximateReceiveCount": "3"}},
+				map[string]interface{}{"messageId": "m4", "eventSource": "aws:sqs", "body": "not json"},
+			},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, events.SQSEventResponse{
+			BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m2"}},
+		}, response)
+		mockStepFunctionClient.AssertNumberOfCalls(t, "StartExecution", 1)
+		mockSQSClient.AssertExpectations(t)
+	})
+
+	t.Run("should hand a throttled message back when its backoff cannot be set", func(t *testing.T) {
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("ListExecutions", mock.Anything).Return(&sfn.ListExecutionsOutput{
+			Executions: []*sfn.ExecutionListItem{{}},
+		}, nil)
+		mockSQSClient := new(SQSClientMock)
+		mockSQSClient.On("ChangeMessageVisibility", mock.Anything).Return(nil, assert.AnError)
+
+		config := config
+		config.MaxConcurrentWorkflows = 1
+		handler := Handler{
+			Config:             config,
+			StepFunctionClient: mockStepFunctionClient,
+			SQSClient:          mockSQSClient,
+		}
+
+		response, err := handler.Invoke(context.Background(), map[string]interface{}{
+			"Records": []interface{}{
+				map[string]interface{}{"messageId": "m1", "eventSource": "aws:sqs", "body": body("a.mp4")},
+			},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, events.SQSEventResponse{
+			BatchItemFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "m1"}},
+		}, response)
+	})
+
+	t.Run("should publish the queue wait and the throttled messages", func(t *testing.T) {
+
+		var buf bytes.Buffer
+		output := logging.Output
+		logging.Output = &buf
+		defer func() { logging.Output = output }()
+
+		mockStepFunctionClient := new(StepFunctionClientMock)
+		mockStepFunctionClient.On("ListExecutions", mock.Anything).Return(&sfn.ListExecutionsOutput{}, nil)
+		mockStepFunctionClient.On("StartExecution", mock.Anything).Return(&sfn.StartExecutionOutput{}, nil)
+
+		mockSQSClient := new(SQSClientMock)
+		mockSQSClient.On("ChangeMessageVisibility", mock.Anything).Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+		handler := Handler{
+			Config:             Config{MaxConcurrentWorkflows: 2, WorkflowName: "vod"},
+			StepFunctionClient: mockStepFunctionClient,
+			SQSClient:          mockSQSClient,
+		}
+
+		sent := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+		_, err := handler.Invoke(context.Background(), map[string]interface{}{
+			"Records": []interface{}{
+				map[string]interface{}{"messageId": "m1", "eventSource": "aws:sqs", "body": body("a.mp4"), "attributes": map[string]string{"SentTimestamp": sent}},
+				map[string]interface{}{"messageId": "m2", "eventSource": "aws:sqs", "body": body("b.mp4", "c.mp4"), "attributes": map[string]string{"SentTimestamp": sent}},
+			},
+		})
+		assert.Nil(t, err)
+
+		metrics := map[string]map[string]interface{}{}
+		decoder := json.NewDecoder(&buf)
+		for decoder.More() {
+			var document map[string]interface{}
+			assert.Nil(t, decoder.Decode(&document))
+			for _, name := range []string{"IngestQueueWait", "IngestThrottled"} {
+				if document[name] != nil {
+					metrics[name] = document
+				}
+			}
+		}
+		assert.Len(t, metrics, 2)
+		assert.Equal(t, "m1", metrics["IngestQueueWait"]["messageId"])
+		assert.InDelta(t, 60, metrics["IngestQueueWait"]["IngestQueueWait"], 5)
+		assert.Equal(t, "vod", metrics["IngestThrottled"]["workflow"])
+		assert.Equal(t, float64(1), metrics["IngestThrottled"]["IngestThrottled"])
+	})
+}
+
+func TestReceiveBackoff(t *testing.T) {
+	for receives, backoff := range map[string]time.Duration{
+		"":   time.Minute,
+		"1":  time.Minute,
+		"2":  2 * time.Minute,
+		"4":  8 * time.Minute,
+		"7":  time.Hour,
+		"20": time.Hour,
+	} {
+		message := events.SQSMessage{Attributes: map[string]string{"ApproximateReceiveCount": receives}}
+		assert.Equal(t, backoff, receiveBackoff(message), receives)
+	}
+}
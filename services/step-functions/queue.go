@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"shared/emf"
+)
+
+// In the Queue ingest mode S3 notifications are delivered to the ingest SQS
+// queue, and the queue is drained in batches by this function. Failed
+// messages are reported back as batchItemFailures, so SQS redelivers only
+// those and moves them to the dead-letter queue once they keep failing.
+//
+// Every receive counts toward the queue's maxReceiveCount, throttled ones
+// included. Throttled messages are therefore made visible again after a
+// backoff that doubles with each receive, from throttleBackoff up to
+// maxThrottleBackoff, so the receives last through long periods at the
+// MaxConcurrentWorkflows cap: 20 receives span about 15 hours.
+
+const (
+	throttleBackoff    = time.Minute
+	maxThrottleBackoff = time.Hour
+)
+
+// Invoke is the Lambda entry point: it routes SQS batches to
+// HandleSQSEvent and every other event to HandleRequest.
+func (h *Handler) Invoke(ctx context.Context, generalEvent map[string]interface{}) (interface{}, error) {
+	if isSQSEvent(generalEvent) {
+		eventBytes, err := json.Marshal(generalEvent)
+		if err != nil {
+			return nil, fmt.Errorf("step-functions: main.Handler.Invoke: json.Marshal: %w", err)
+		}
+
+		var event events.SQSEvent
+		if err := json.Unmarshal(eventBytes, &event); err != nil {
+			return nil, fmt.Errorf("step-functions: main.Handler.Invoke: json.Unmarshal: %w", err)
+		}
+		return h.HandleSQSEvent(ctx, event)
+	}
+
+	return h.HandleRequest(ctx, generalEvent)
+}
+
+func isSQSEvent(generalEvent map[string]interface{}) bool {
+	records, ok := generalEvent["Records"].([]interface{})
+	if !ok || len(records) == 0 {
+		return false
+	}
+	record, ok := records[0].(map[string]interface{})
+	return ok && record["eventSource"] == "aws:sqs"
+}
+
+// HandleSQSEvent starts an ingest execution for every S3 record of every
+// message. Once MaxConcurrentWorkflows executions are running, the remaining
+// messages are handed back to the queue until capacity frees up.
+func (h *Handler) HandleSQSEvent(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	response := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{},
+	}
+
+	capacity, err := h.workflowCapacity()
+	if err != nil {
+		return response, fmt.Errorf("step-functions: main.Handler.HandleSQSEvent: %w", err)
+	}
+
+	for _, message := range event.Records {
+		var notification StepFunctionEvent
+		if err := json.Unmarshal([]byte(message.Body), &notification); err != nil {
+			// Not an S3 notification, retrying will not make it one: it is
+			// moved to the dead-letter queue at once
+			slog.Error("MESSAGE FAILED", "messageId", message.MessageId, "error", err)
+			if err := h.deadLetter(message); err != nil {
+				slog.Error("DEAD LETTER FAILED", "messageId", message.MessageId, "error", err)
+				response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			}
+			continue
+		}
+
+		if capacity >= 0 && capacity < len(notification.Records) {
+			backoff := receiveBackoff(message)
+			slog.Warn("THROTTLED", "messageId", message.MessageId, "reason", "max concurrent workflows reached", "backoff", backoff.String())
+			h.Config.PutMetrics(serviceName, map[string]string{"workflow": h.Config.WorkflowName}, nil,
+				emf.Metric{Name: "IngestThrottled", Value: 1, Unit: emf.UnitCount})
+			if err := h.delayMessage(message, backoff); err != nil {
+				// the message comes back after the queue's visibility timeout
+				slog.Warn("BACKOFF FAILED", "messageId", message.MessageId, "error", err)
+			}
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			continue
+		}
+
+		// s3:TestEvent and other bodies without records are acknowledged
+		failed := false
+		for _, record := range notification.Records {
+			key, err := h.startIngest(notification, record)
+			if err != nil {
+				slog.Error("INGEST FAILED", "messageId", message.MessageId, "key", key, "error", err)
+				failed = true
+				continue
+			}
+			slog.Info("INGEST STARTED", "messageId", message.MessageId, "key", key)
+			if capacity > 0 {
+				capacity--
+			}
+		}
+		if failed {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			continue
+		}
+		if wait, ok := queueWait(message); ok && len(notification.Records) > 0 {
+			h.Config.PutMetrics(serviceName, map[string]string{"workflow": h.Config.WorkflowName}, map[string]interface{}{"messageId": message.MessageId},
+				emf.Metric{Name: "IngestQueueWait", Value: wait.Seconds(), Unit: emf.UnitSeconds})
+		}
+	}
+
+	return response, nil
+}
+
+// receiveBackoff is how long a throttled message stays invisible: doubling
+// with every receive, from throttleBackoff up to maxThrottleBackoff.
+func receiveBackoff(message events.SQSMessage) time.Duration {
+	receives, err := strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+	if err != nil || receives < 1 {
+		receives = 1
+	}
+
+	backoff := throttleBackoff
+	for i := 1; i < receives && backoff < maxThrottleBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxThrottleBackoff {
+		backoff = maxThrottleBackoff
+	}
+	return backoff
+}
+
+// delayMessage makes the message visible again after backoff.
+func (h *Handler) delayMessage(message events.SQSMessage, backoff time.Duration) error {
+	_, err := h.SQSClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(h.Config.IngestQueueUrl),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(backoff.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("ChangeMessageVisibility: %w", err)
+	}
+	return nil
+}
+
+// deadLetter sends the message to the trigger dead-letter queue, so it can
+// be acknowledged.
+func (h *Handler) deadLetter(message events.SQSMessage) error {
+	_, err := h.SQSClient.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(h.Config.TriggerDlqUrl),
+		MessageBody: aws.String(message.Body),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"messageId": {DataType: aws.String("String"), StringValue: aws.String(message.MessageId)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("SendMessage: %w", err)
+	}
+	return nil
+}
+
+// queueWait is how long the message waited in the queue, throttled
+// deliveries included, before its executions were started.
+func queueWait(message events.SQSMessage) (time.Duration, bool) {
+	sent, err := strconv.ParseInt(message.Attributes["SentTimestamp"], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(time.UnixMilli(sent)), true
+}
+
+// workflowCapacity returns how many more executions may be started under
+// the MaxConcurrentWorkflows cap, counting the running executions of every
+// workflow, or -1 when no cap is set.
+func (h *Handler) workflowCapacity() (int, error) {
+	max := h.Config.MaxConcurrentWorkflows
+	if max <= 0 {
+		return -1, nil
+	}
+
+	running := 0
+	for _, stateMachine := range []string{h.Config.IngestWorkflow, h.Config.ProcessWorkflow, h.Config.PublishWorkflow} {
+		input := &sfn.ListExecutionsInput{
+			StateMachineArn: aws.String(stateMachine),
+			StatusFilter:    aws.String(sfn.ExecutionStatusRunning),
+		}
+		for running < max {
+			data, err := h.StepFunctionClient.ListExecutions(input)
+			if err != nil {
+				return 0, fmt.Errorf("ListExecutions: %w", err)
+			}
+			running += len(data.Executions)
+
+			if data.NextToken == nil {
+				break
+			}
+			input.NextToken = data.NextToken
+		}
+	}
+
+	if running >= max {
+		return 0, nil
+	}
+	return max - running, nil
+}
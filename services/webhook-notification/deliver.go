@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Every request carries the Unix time it was sent at in TimestampHeader and
+// SignatureHeader "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret. Receivers recompute the
+// signature and reject requests whose timestamp is too old to prevent
+// replays.
+const (
+	TimestampHeader = "X-Vod-Timestamp"
+	SignatureHeader = "X-Vod-Signature"
+
+	initialBackoff = time.Second
+	maxBackoff     = 30 * time.Second
+	requestTimeout = 10 * time.Second
+
+	// recordAttempts is how many times the deliveries are read and written
+	// back when other invocations record theirs at the same time.
+	recordAttempts = 3
+)
+
+var ErrInvalidUrl = errors.New("invalid webhook url")
+
+type Delivery struct {
+	Url       string    `json:"url"`
+	Status    string    `json:"status"`
+	Delivered bool      `json:"delivered"`
+	Attempts  []Attempt `json:"attempts"`
+}
+
+type Attempt struct {
+	At         string `json:"at"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// deliver POSTs the body to the endpoint, retrying with exponential backoff
+// on connection errors, 408, 429 and 5xx responses, up to
+// WebhookMaxAttempts times.
+func (h *Handler) deliver(endpoint, status string, body, secret []byte) Delivery {
+	delivery := Delivery{
+		Url:      redactUrl(endpoint),
+		Status:   status,
+		Attempts: []Attempt{},
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, err := h.post(endpoint, body, secret)
+		result := Attempt{
+			At:         time.Now().UTC().Format(time.RFC3339),
+			StatusCode: statusCode,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		delivery.Attempts = append(delivery.Attempts, result)
+
+		if err == nil && statusCode < 300 {
+			delivery.Delivered = true
+			return delivery
+		}
+		if !retryable(statusCode, err) || attempt >= h.Config.WebhookMaxAttempts {
+			return delivery
+		}
+
+		h.wait(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// post sends one signed request and returns the response status code.
+func (h *Handler) post(endpoint string, body, secret []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidUrl, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, sign(secret, timestamp, body))
+
+	resp, err := h.HTTPClient.Do(req)
+	if err != nil {
+		// url.Error repeats the full URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, fmt.Errorf("Do: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// sign returns the SignatureHeader value for the body sent at timestamp.
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func retryable(statusCode int, err error) bool {
+	if statusCode == 0 {
+		// No response: the request may not have been sent at all
+		return err != nil && !errors.Is(err, ErrInvalidUrl)
+	}
+	return statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= 500
+}
+
+func (h *Handler) wait(d time.Duration) {
+	if h.sleep != nil {
+		h.sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// redactUrl strips credentials and the query string, which may hold tokens,
+// before the URL is stored or logged.
+func redactUrl(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "invalid url"
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+
+	return parsed.String()
+}
+
+// recordDeliveries adds the deliveries to the webhookDeliveries of the
+// workflow record, keeping the last WebhookMaxDeliveries so the list does not
+// grow the item toward the DynamoDB item size limit. DynamoDB cannot trim a
+// list in an update expression, so the list is read and written back, and
+// read again when another invocation recorded its deliveries in between.
+func (h *Handler) recordDeliveries(guid string, deliveries []Delivery) error {
+	for attempt := 1; ; attempt++ {
+		err := h.writeDeliveries(guid, deliveries)
+		var conflict *dynamodb.ConditionalCheckFailedException
+		if err == nil || !errors.As(err, &conflict) || attempt >= recordAttempts {
+			return err
+		}
+	}
+}
+
+// writeDeliveries writes the recorded deliveries followed by the new ones
+// under a condition on webhookDeliveryCount, the number of deliveries ever
+// recorded, which no other invocation may have changed since the read.
+func (h *Handler) writeDeliveries(guid string, deliveries []Delivery) error {
+	key := map[string]*dynamodb.AttributeValue{
+		"guid": {S: aws.String(guid)},
+	}
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(h.Config.DynamoDBTable),
+		Key:                  key,
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#guid, #webhookDeliveries, #webhookDeliveryCount"),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":                 aws.String("guid"),
+			"#webhookDeliveries":    aws.String("webhookDeliveries"),
+			"#webhookDeliveryCount": aws.String("webhookDeliveryCount"),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("GetItem: %w", err)
+	}
+	if len(data.Item) == 0 {
+		return fmt.Errorf("record %s not found", guid)
+	}
+
+	var recorded struct {
+		Deliveries []Delivery `json:"webhookDeliveries"`
+		Count      int        `json:"webhookDeliveryCount"`
+	}
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &recorded); err != nil {
+		return fmt.Errorf("dynamodbattribute.UnmarshalMap: %w", err)
+	}
+
+	kept := append(recorded.Deliveries, deliveries...)
+	if len(kept) > h.Config.WebhookMaxDeliveries {
+		kept = kept[len(kept)-h.Config.WebhookMaxDeliveries:]
+	}
+	list, err := dynamodbattribute.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("dynamodbattribute.Marshal: %w", err)
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":deliveries": list,
+		":next":       {N: aws.String(strconv.Itoa(recorded.Count + len(deliveries)))},
+	}
+	// records written before the count was kept have deliveries but no count
+	condition := "attribute_exists(#guid) AND attribute_not_exists(#webhookDeliveryCount)"
+	if recorded.Count > 0 {
+		condition = "#webhookDeliveryCount = :count"
+		values[":count"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(recorded.Count))}
+	}
+
+	_, err = h.DynamoDBClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(h.Config.DynamoDBTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET #webhookDeliveries = :deliveries, #webhookDeliveryCount = :next"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{
+			"#guid":                 aws.String("guid"),
+			"#webhookDeliveries":    aws.String("webhookDeliveries"),
+			"#webhookDeliveryCount": aws.String("webhookDeliveryCount"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const executionStatusChange = "Step Functions Execution Status Change"
+
+// ExecutionStatusChange is the detail of a Step Functions execution event.
+type ExecutionStatusChange struct {
+	ExecutionArn string `json:"executionArn"`
+	Status       string `json:"status"`
+	Input        string `json:"input"`
+	Error        string `json:"error"`
+	Cause        string `json:"cause"`
+}
+
+// failedInput returns the Error webhook for a failed, timed out or aborted
+// workflow execution, or nil for other events and executions without a guid.
+// The workflow state is read from the record, as the event only carries the
+// execution input.
+func (h *Handler) failedInput(input WebhookInput) (*WebhookInput, error) {
+	if input.DetailType != executionStatusChange {
+		return nil, nil
+	}
+
+	var detail ExecutionStatusChange
+	if err := json.Unmarshal(input.Detail, &detail); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if detail.Status == "RUNNING" || detail.Status == "SUCCEEDED" {
+		return nil, nil
+	}
+	guid := executionGuid(detail.Input)
+	if guid == "" {
+		return nil, nil
+	}
+
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		ProjectionExpression: aws.String("#workflowName, #srcBucket, #srcVideo, #startTime, #encodingProfile, #encodeJobId"),
+		ExpressionAttributeNames: map[string]*string{
+			"#workflowName":    aws.String("workflowName"),
+			"#srcBucket":       aws.String("srcBucket"),
+			"#srcVideo":        aws.String("srcVideo"),
+			"#startTime":       aws.String("startTime"),
+			"#encodingProfile": aws.String("encodingProfile"),
+			"#encodeJobId":     aws.String("encodeJobId"),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+
+	var event WebhookEvent
+	if err := dynamodbattribute.UnmarshalMap(data.Item, &event); err != nil {
+		return nil, fmt.Errorf("dynamodbattribute.UnmarshalMap: %w", err)
+	}
+	event.GUID = guid
+	event.WorkflowStatus = "Error"
+	event.ErrorMessage = strings.TrimSpace(detail.Status + " " + detail.Error)
+	if detail.Cause != "" {
+		event.ErrorMessage += ": " + detail.Cause
+	}
+
+	return &WebhookInput{Event: event, ExecutionId: detail.ExecutionArn}, nil
+}
+
+// executionGuid returns the guid from the input of an Ingest or Process
+// execution, or from the MediaConvert event that started a Publish execution.
+func executionGuid(input string) string {
+	var execution struct {
+		GUID   string `json:"guid"`
+		Detail struct {
+			UserMetadata struct {
+				GUID string `json:"guid"`
+			} `json:"userMetadata"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal([]byte(input), &execution); err != nil {
+		return ""
+	}
+	if execution.GUID != "" {
+		return execution.GUID
+	}
+	return execution.Detail.UserMetadata.GUID
+}
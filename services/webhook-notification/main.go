@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+
+	"shared/envconfig"
+	"shared/logging"
+)
+
+const serviceName = "webhook-notification"
+
+type DynamoDBClient interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+type SecretsManagerClient interface {
+	GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Config struct {
+	logging.LogConfig
+
+	DynamoDBTable string `env:"DynamoDBTable" required:"true"`
+	// WebhookUrls are delivered every status change, along with the
+	// asset's callbackUrl.
+	WebhookUrls []string `env:"WebhookUrls"`
+	// WebhookSecretArn holds the secret every request is signed with:
+	// nothing is sent unsigned.
+	WebhookSecretArn   string `env:"WebhookSecretArn" required:"true"`
+	WebhookMaxAttempts int    `env:"WebhookMaxAttempts" default:"5" min:"1"`
+	// WebhookMaxDeliveries is how many of the latest deliveries the record
+	// keeps.
+	WebhookMaxDeliveries int `env:"WebhookMaxDeliveries" default:"20" min:"1"`
+}
+
+type Handler struct {
+	Config               Config
+	DynamoDBClient       DynamoDBClient
+	SecretsManagerClient SecretsManagerClient
+	HTTPClient           HTTPClient
+
+	// sleep waits between delivery attempts, time.Sleep when nil
+	sleep  func(time.Duration)
+	secret []byte
+}
+
+// WebhookInput is the workflow state and the id of the execution that
+// produced it, as passed by the state machines. The WorkflowFailedRule
+// passes the EventBridge event of a failed execution instead, with its
+// detail-type and detail.
+type WebhookInput struct {
+	Event       WebhookEvent `json:"event"`
+	ExecutionId string       `json:"executionId"`
+
+	DetailType string          `json:"detail-type,omitempty"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+}
+
+type WebhookEvent struct {
+	GUID            string            `json:"guid"`
+	StartTime       string            `json:"startTime"`
+	WorkflowStatus  string            `json:"workflowStatus"`
+	WorkflowName    string            `json:"workflowName"`
+	SrcBucket       string            `json:"srcBucket"`
+	SrcVideo        string            `json:"srcVideo"`
+	EncodingProfile int               `json:"encodingProfile,omitempty"`
+	EncodeJobId     string            `json:"encodeJobId"`
+	ErrorMessage    string            `json:"errorMessage,omitempty"`
+	EndTime         string            `json:"endTime"`
+	HlsUrl          string            `json:"hlsUrl"`
+	DashUrl         string            `json:"dashUrl"`
+	CmafHlsUrl      string            `json:"cmafHlsUrl"`
+	CmafDashUrl     string            `json:"cmafDashUrl"`
+	MssUrl          string            `json:"mssUrl"`
+	Mp4Urls         []string          `json:"mp4Urls"`
+	ThumbNailsUrls  []string          `json:"thumbNailsUrls"`
+	EgressEndpoints map[string]string `json:"egressEndpoints"`
+}
+
+// WebhookPayload is the body POSTed to the endpoints. Fields may be added but
+// are never renamed or removed.
+type WebhookPayload struct {
+	EventId         string        `json:"eventId"`
+	GUID            string        `json:"guid"`
+	Status          string        `json:"status"`
+	WorkflowName    string        `json:"workflowName"`
+	Source          PayloadSource `json:"source"`
+	EncodingProfile int           `json:"encodingProfile,omitempty"`
+	EncodeJobId     string        `json:"encodeJobId,omitempty"`
+	ErrorMessage    string        `json:"errorMessage,omitempty"`
+	StartTime       string        `json:"startTime"`
+	EndTime         string        `json:"endTime,omitempty"`
+	Playback        *Playback     `json:"playback,omitempty"`
+	Thumbnails      []string      `json:"thumbnails,omitempty"`
+	Timestamp       string        `json:"timestamp"`
+}
+
+type PayloadSource struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type Playback struct {
+	Hls          string            `json:"hls,omitempty"`
+	Dash         string            `json:"dash,omitempty"`
+	CmafHls      string            `json:"cmafHls,omitempty"`
+	CmafDash     string            `json:"cmafDash,omitempty"`
+	Mss          string            `json:"mss,omitempty"`
+	Mp4          []string          `json:"mp4,omitempty"`
+	MediaPackage map[string]string `json:"mediaPackage,omitempty"`
+}
+
+type WebhookOutput struct {
+	GUID       string     `json:"guid"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// HandleRequest POSTs the workflow event, or the Error event of a failed
+// execution, to the WebhookUrls and to the asset's callbackUrl. Failed
+// deliveries are recorded rather than returned, so a retried invocation does
+// not repeat the successful ones.
+func (h *Handler) HandleRequest(input WebhookInput) (*WebhookOutput, error) {
+	if input.DetailType != "" {
+		failed, err := h.failedInput(input)
+		if err != nil {
+			return nil, fmt.Errorf("webhook-notification: main.Handler.HandleRequest: failedInput: %w", err)
+		}
+		if failed == nil {
+			// Not a failure of an asset's workflow
+			return &WebhookOutput{Deliveries: []Delivery{}}, nil
+		}
+		input = *failed
+	}
+
+	event := input.Event
+	urls, err := h.endpoints(event.GUID)
+	if err != nil {
+		return nil, fmt.Errorf("webhook-notification: main.Handler.HandleRequest: endpoints: %w", err)
+	}
+
+	output := &WebhookOutput{
+		GUID:       event.GUID,
+		Deliveries: []Delivery{},
+	}
+	if len(urls) == 0 {
+		return output, nil
+	}
+
+	secret, err := h.signingSecret()
+	if err != nil {
+		return nil, fmt.Errorf("webhook-notification: main.Handler.HandleRequest: signingSecret: %w", err)
+	}
+
+	body, err := json.Marshal(newPayload(event, input.ExecutionId))
+	if err != nil {
+		return nil, fmt.Errorf("webhook-notification: main.Handler.HandleRequest: json.Marshal: %w", err)
+	}
+
+	// Endpoints are delivered in parallel, so the invocation takes as long
+	// as the slowest one rather than their sum
+	output.Deliveries = make([]Delivery, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output.Deliveries[i] = h.deliver(url, event.WorkflowStatus, body, secret)
+		}()
+	}
+	wg.Wait()
+
+	for _, delivery := range output.Deliveries {
+		slog.Info("DELIVERY", "workflowStatus", event.WorkflowStatus, "url", delivery.Url, "delivered", delivery.Delivered, "attempts", len(delivery.Attempts))
+	}
+
+	if err := h.recordDeliveries(event.GUID, output.Deliveries); err != nil {
+		slog.Error("DELIVERIES NOT RECORDED", "error", err)
+	}
+
+	return output, nil
+}
+
+// endpoints returns the global WebhookUrls followed by the asset's
+// callbackUrl, without repeats.
+func (h *Handler) endpoints(guid string) ([]string, error) {
+	urls := []string{}
+	seen := map[string]bool{}
+	add := func(url string) {
+		url = strings.TrimSpace(url)
+		if url != "" && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+
+	for _, url := range h.Config.WebhookUrls {
+		add(url)
+	}
+
+	data, err := h.DynamoDBClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(h.Config.DynamoDBTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"guid": {S: aws.String(guid)},
+		},
+		ProjectionExpression:     aws.String("#callbackUrl"),
+		ExpressionAttributeNames: map[string]*string{"#callbackUrl": aws.String("callbackUrl")},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetItem: %w", err)
+	}
+	if callbackUrl, ok := data.Item["callbackUrl"]; ok && callbackUrl.S != nil {
+		add(*callbackUrl.S)
+	}
+
+	return urls, nil
+}
+
+// signingSecret returns the secret stored under WebhookSecretArn, read once
+// per container. An empty secret is an error, as requests signed with it
+// could be forged.
+func (h *Handler) signingSecret() ([]byte, error) {
+	if h.secret != nil {
+		return h.secret, nil
+	}
+
+	data, err := h.SecretsManagerClient.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(h.Config.WebhookSecretArn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetSecretValue: %w", err)
+	}
+	if aws.StringValue(data.SecretString) == "" {
+		return nil, fmt.Errorf("secret %s is empty", h.Config.WebhookSecretArn)
+	}
+	h.secret = []byte(aws.StringValue(data.SecretString))
+
+	return h.secret, nil
+}
+
+// newPayload builds the body for the event. The eventId is the same for
+// every delivery of one status change, so receivers can drop repeats.
+func newPayload(event WebhookEvent, executionId string) WebhookPayload {
+	eventId := sha256.Sum256([]byte(executionId + "/" + event.WorkflowStatus))
+
+	payload := WebhookPayload{
+		EventId:      hex.EncodeToString(eventId[:16]),
+		GUID:         event.GUID,
+		Status:       event.WorkflowStatus,
+		WorkflowName: event.WorkflowName,
+		Source: PayloadSource{
+			Bucket: event.SrcBucket,
+			Key:    event.SrcVideo,
+		},
+		EncodingProfile: event.EncodingProfile,
+		EncodeJobId:     event.EncodeJobId,
+		ErrorMessage:    event.ErrorMessage,
+		StartTime:       event.StartTime,
+		Timestamp:       time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if event.WorkflowStatus == "Complete" {
+		payload.EndTime = event.EndTime
+		payload.Playback = &Playback{
+			Hls:          event.HlsUrl,
+			Dash:         event.DashUrl,
+			CmafHls:      event.CmafHlsUrl,
+			CmafDash:     event.CmafDashUrl,
+			Mss:          event.MssUrl,
+			Mp4:          event.Mp4Urls,
+			MediaPackage: event.EgressEndpoints,
+		}
+		payload.Thumbnails = event.ThumbNailsUrls
+	}
+
+	return payload
+}
+
+func main() {
+	slog.SetDefault(logging.New(serviceName))
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create session: %s", err)
+	}
+
+	var config Config
+	if err := envconfig.Load(&config, ssm.New(sess)); err != nil {
+		log.Fatalf("webhook-notification: main: envconfig.Load: %v", err)
+	}
+	logging.SetLevel(config.LogLevel)
+
+	handler := Handler{
+		Config:               config,
+		DynamoDBClient:       dynamodb.New(sess),
+		SecretsManagerClient: secretsmanager.New(sess),
+		HTTPClient:           &http.Client{Timeout: requestTimeout},
+	}
+
+	lambda.Start(logging.Wrap(serviceName, handler.HandleRequest))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type DynamoDBClientMock struct {
+	mock.Mock
+}
+
+func (m *DynamoDBClientMock) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+func (m *DynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+type SecretsManagerClientMock struct {
+	mock.Mock
+}
+
+func (m *SecretsManagerClientMock) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	args := m.Called(input)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*secretsmanager.GetSecretValueOutput), args.Error(1)
+}
+
+func completeInput() WebhookInput {
+	return WebhookInput{
+		ExecutionId: "arn:aws:states:us-east-1:123456789012:execution:vod-publish:guid-1",
+		Event: WebhookEvent{
+			GUID:           "guid-1",
+			WorkflowStatus: "Complete",
+			WorkflowName:   "vod",
+			SrcBucket:      "source",
+			SrcVideo:       "video.mp4",
+			HlsUrl:         "https://cdn/guid-1/hls/video.m3u8",
+		},
+	}
+}
+
+// secretsManager returns a mock holding the webhook secret.
+func secretsManager(secret string) *SecretsManagerClientMock {
+	secretsManagerClientMock := new(SecretsManagerClientMock)
+	secretsManagerClientMock.On("GetSecretValue", mock.Anything).Return(&secretsmanager.GetSecretValueOutput{
+		SecretString: aws.String(secret),
+	}, nil)
+	return secretsManagerClientMock
+}
+
+func TestHandleRequest(t *testing.T) {
+	t.Run("should sign and retry until delivered", func(t *testing.T) {
+		var timestamps, signatures []string
+		var body []byte
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			timestamps = append(timestamps, r.Header.Get(TimestampHeader))
+			signatures = append(signatures, r.Header.Get(SignatureHeader))
+			body, _ = io.ReadAll(r.Body)
+			if requests < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("guid-1")}},
+		}, nil)
+		var recorded *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Run(func(args mock.Arguments) {
+			recorded = args.Get(0).(*dynamodb.UpdateItemInput)
+		}).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		secretsManagerClientMock := new(SecretsManagerClientMock)
+		secretsManagerClientMock.On("GetSecretValue", mock.Anything).Return(&secretsmanager.GetSecretValueOutput{
+			SecretString: aws.String("shh"),
+		}, nil).Once()
+
+		var waits []time.Duration
+		handler := &Handler{
+			Config: Config{
+				WebhookUrls:          []string{server.URL + "/hooks?token=secret"},
+				WebhookSecretArn:     "arn:secret",
+				WebhookMaxAttempts:   5,
+				WebhookMaxDeliveries: 20,
+			},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManagerClientMock,
+			HTTPClient:           server.Client(),
+			sleep:                func(d time.Duration) { waits = append(waits, d) },
+		}
+
+		output, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		assert.Len(t, output.Deliveries, 1)
+
+		delivery := output.Deliveries[0]
+		assert.True(t, delivery.Delivered)
+		assert.Equal(t, server.URL+"/hooks", delivery.Url)
+		assert.Len(t, delivery.Attempts, 3)
+		assert.Equal(t, http.StatusServiceUnavailable, delivery.Attempts[0].StatusCode)
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits)
+
+		assert.Equal(t, sign([]byte("shh"), timestamps[2], body), signatures[2])
+
+		var payload WebhookPayload
+		assert.Nil(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, "Complete", payload.Status)
+		assert.Equal(t, "https://cdn/guid-1/hls/video.m3u8", payload.Playback.Hls)
+		assert.Len(t, payload.EventId, 32)
+
+		deliveries := recorded.ExpressionAttributeValues[":deliveries"].L
+		assert.Len(t, deliveries, 1)
+		assert.Len(t, deliveries[0].M["attempts"].L, 3)
+		assert.NotContains(t, *deliveries[0].M["url"].S, "token")
+		assert.Equal(t, "attribute_exists(#guid) AND attribute_not_exists(#webhookDeliveryCount)", *recorded.ConditionExpression)
+		assert.Equal(t, "1", *recorded.ExpressionAttributeValues[":next"].N)
+
+		// The secret is cached for the next invocation
+		_, err = handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		secretsManagerClientMock.AssertExpectations(t)
+	})
+
+	t.Run("should deliver to the callback url without retrying client errors", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			assert.NotEmpty(t, r.Header.Get(SignatureHeader))
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{"callbackUrl": {S: aws.String(server.URL)}},
+		}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(nil, assert.AnError)
+
+		handler := &Handler{
+			Config:               Config{WebhookSecretArn: "arn:secret", WebhookMaxAttempts: 5},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager("shh"),
+			HTTPClient:           server.Client(),
+			sleep:                func(time.Duration) {},
+		}
+
+		output, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, requests)
+		assert.False(t, output.Deliveries[0].Delivered)
+		assert.Equal(t, http.StatusBadRequest, output.Deliveries[0].Attempts[0].StatusCode)
+	})
+
+	t.Run("should give up after the maximum attempts", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		handler := &Handler{
+			Config:               Config{WebhookUrls: []string{server.URL}, WebhookSecretArn: "arn:secret", WebhookMaxAttempts: 2},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager("shh"),
+			HTTPClient:           server.Client(),
+			sleep:                func(time.Duration) {},
+		}
+
+		output, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		assert.False(t, output.Deliveries[0].Delivered)
+		assert.Len(t, output.Deliveries[0].Attempts, 2)
+	})
+
+	t.Run("should deliver to every endpoint at once", func(t *testing.T) {
+		// each endpoint answers only once both have been called
+		arrived := make(chan struct{}, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived <- struct{}{}
+			for len(arrived) < 2 {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		client := server.Client()
+		client.Timeout = 5 * time.Second
+		handler := &Handler{
+			Config:               Config{WebhookUrls: []string{server.URL + "/a", server.URL + "/b"}, WebhookSecretArn: "arn:secret", WebhookMaxAttempts: 1},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager("shh"),
+			HTTPClient:           client,
+		}
+
+		output, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		assert.Len(t, output.Deliveries, 2)
+		assert.Equal(t, server.URL+"/a", output.Deliveries[0].Url)
+		assert.Equal(t, server.URL+"/b", output.Deliveries[1].Url)
+		assert.True(t, output.Deliveries[0].Delivered)
+		assert.True(t, output.Deliveries[1].Delivered)
+	})
+
+	t.Run("should keep the latest deliveries on the record", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		recordedDeliveries, _ := dynamodbattribute.Marshal([]Delivery{
+			{Url: "https://example.com/1", Status: "Ingest"},
+			{Url: "https://example.com/2", Status: "Ingest"},
+			{Url: "https://example.com/3", Status: "Processing"},
+		})
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"guid":                 {S: aws.String("guid-1")},
+				"webhookDeliveries":    recordedDeliveries,
+				"webhookDeliveryCount": {N: aws.String("7")},
+			},
+		}, nil)
+		// another invocation records its deliveries first
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(nil, &dynamodb.ConditionalCheckFailedException{}).Once()
+		var recorded *dynamodb.UpdateItemInput
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Run(func(args mock.Arguments) {
+			recorded = args.Get(0).(*dynamodb.UpdateItemInput)
+		}).Return(&dynamodb.UpdateItemOutput{}, nil).Once()
+
+		handler := &Handler{
+			Config:               Config{WebhookUrls: []string{server.URL}, WebhookSecretArn: "arn:secret", WebhookMaxAttempts: 1, WebhookMaxDeliveries: 3},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager("shh"),
+			HTTPClient:           server.Client(),
+		}
+
+		_, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		dynamoDBClientMock.AssertNumberOfCalls(t, "UpdateItem", 2)
+
+		var kept []Delivery
+		assert.NoError(t, dynamodbattribute.Unmarshal(recorded.ExpressionAttributeValues[":deliveries"], &kept))
+		assert.Equal(t, []string{"https://example.com/2", "https://example.com/3", server.URL}, []string{kept[0].Url, kept[1].Url, kept[2].Url})
+		assert.Equal(t, "#webhookDeliveryCount = :count", *recorded.ConditionExpression)
+		assert.Equal(t, "7", *recorded.ExpressionAttributeValues[":count"].N)
+		assert.Equal(t, "8", *recorded.ExpressionAttributeValues[":next"].N)
+	})
+
+	t.Run("should deliver the Error event of a failed execution", func(t *testing.T) {
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.MatchedBy(func(input *dynamodb.GetItemInput) bool {
+			return input.ProjectionExpression != nil && *input.ProjectionExpression != "#callbackUrl"
+		})).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{
+				"workflowName": {S: aws.String("vod")},
+				"srcBucket":    {S: aws.String("source")},
+				"srcVideo":     {S: aws.String("video.mp4")},
+			},
+		}, nil).Once()
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{"callbackUrl": {S: aws.String(server.URL)}},
+		}, nil)
+		dynamoDBClientMock.On("UpdateItem", mock.Anything).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		handler := &Handler{
+			Config:               Config{WebhookSecretArn: "arn:secret", WebhookMaxAttempts: 1, WebhookMaxDeliveries: 20},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager("shh"),
+			HTTPClient:           server.Client(),
+		}
+
+		var input WebhookInput
+		assert.NoError(t, json.Unmarshal([]byte(`{
+			"detail-type": "Step Functions Execution Status Change",
+			"source": "aws.states",
+			"detail": {
+				"executionArn": "arn:aws:states:us-east-1:123456789012:execution:vod-process:guid-1",
+				"status": "FAILED",
+				"input": "{\"guid\":\"guid-1\"}",
+				"error": "States.TaskFailed",
+				"cause": "profiler failed"
+			}
+		}`), &input))
+
+		output, err := handler.HandleRequest(input)
+		assert.NoError(t, err)
+		assert.Equal(t, "guid-1", output.GUID)
+		assert.True(t, output.Deliveries[0].Delivered)
+
+		var payload WebhookPayload
+		assert.Nil(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, "Error", payload.Status)
+		assert.Equal(t, "guid-1", payload.GUID)
+		assert.Equal(t, "vod", payload.WorkflowName)
+		assert.Equal(t, "video.mp4", payload.Source.Key)
+		assert.Equal(t, "FAILED States.TaskFailed: profiler failed", payload.ErrorMessage)
+		assert.Nil(t, payload.Playback)
+	})
+
+	t.Run("should ignore executions that did not fail", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		output, err := handler.HandleRequest(WebhookInput{
+			DetailType: "Step Functions Execution Status Change",
+			Detail:     json.RawMessage(`{"status": "SUCCEEDED", "input": "{\"guid\":\"guid-1\"}"}`),
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, output.Deliveries)
+		dynamoDBClientMock.AssertNotCalled(t, "GetItem", mock.Anything)
+	})
+
+	t.Run("should not send unsigned requests", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		handler := &Handler{
+			Config:               Config{WebhookUrls: []string{"https://example.com/hooks"}, WebhookSecretArn: "arn:secret"},
+			DynamoDBClient:       dynamoDBClientMock,
+			SecretsManagerClient: secretsManager(""),
+		}
+
+		_, err := handler.HandleRequest(completeInput())
+		assert.ErrorContains(t, err, "secret arn:secret is empty")
+	})
+
+	t.Run("should not call out without endpoints", func(t *testing.T) {
+		dynamoDBClientMock := new(DynamoDBClientMock)
+		dynamoDBClientMock.On("GetItem", mock.Anything).Return(&dynamodb.GetItemOutput{}, nil)
+
+		handler := &Handler{
+			DynamoDBClient: dynamoDBClientMock,
+		}
+
+		output, err := handler.HandleRequest(completeInput())
+		assert.NoError(t, err)
+		assert.Empty(t, output.Deliveries)
+		dynamoDBClientMock.AssertNotCalled(t, "UpdateItem", mock.Anything)
+	})
+}
@@ -0,0 +1,216 @@
+package asl
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// comparisons holds the supported choice operators, built from the operand
+// kinds and the comparisons that apply to them, each with a Path variant.
+var comparisons = map[string]bool{
+	"IsNull": true, "IsPresent": true, "IsNumeric": true,
+	"IsString": true, "IsBoolean": true, "IsTimestamp": true,
+}
+
+func init() {
+	ordered := []string{"Equals", "LessThan", "GreaterThan", "LessThanEquals", "GreaterThanEquals"}
+	operators := map[string][]string{
+		"String":    append([]string{"Matches"}, ordered...),
+		"Numeric":   ordered,
+		"Timestamp": ordered,
+		"Boolean":   {"Equals"},
+	}
+	for kind, ops := range operators {
+		for _, op := range ops {
+			comparisons[kind+op] = true
+			if op != "Matches" {
+				comparisons[kind+op+"Path"] = true
+			}
+		}
+	}
+}
+
+// choose returns the Next of the first rule of state that matches input.
+func choose(state *State, input interface{}) (string, error) {
+	for _, rule := range state.Choices {
+		ok, err := match(rule, input)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return rule.Next, nil
+		}
+	}
+	if state.Default == "" {
+		return "", &Error{Name: ErrNoChoiceMatched, Cause: "no choice rule matched and there is no Default"}
+	}
+	return state.Default, nil
+}
+
+func match(rule *ChoiceRule, input interface{}) (bool, error) {
+	switch {
+	case rule.And != nil:
+		for _, r := range rule.And {
+			ok, err := match(r, input)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case rule.Or != nil:
+		for _, r := range rule.Or {
+			ok, err := match(r, input)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case rule.Not != nil:
+		ok, err := match(rule.Not, input)
+		return !ok, err
+	}
+
+	value, present, err := lookup(input, rule.Variable)
+	if err != nil {
+		return false, &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+
+	if strings.HasPrefix(rule.Operator, "Is") {
+		var want bool
+		if err := json.Unmarshal(rule.Operand, &want); err != nil {
+			return false, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("%s takes a boolean", rule.Operator)}
+		}
+		var is bool
+		switch rule.Operator {
+		case "IsPresent":
+			is = present
+		case "IsNull":
+			is = present && value == nil
+		case "IsNumeric":
+			_, is = value.(json.Number)
+		case "IsString":
+			_, is = value.(string)
+		case "IsBoolean":
+			_, is = value.(bool)
+		case "IsTimestamp":
+			_, is = timestamp(value)
+		}
+		return is == want, nil
+	}
+
+	if !present {
+		return false, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("invalid path %s: the choice state's condition path references an invalid value", rule.Variable)}
+	}
+
+	operator := rule.Operator
+	operand, err := decode(rule.Operand)
+	if err != nil {
+		return false, &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+	if strings.HasSuffix(operator, "Path") {
+		operator = strings.TrimSuffix(operator, "Path")
+		path, ok := operand.(string)
+		if !ok {
+			return false, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("%s takes a path", rule.Operator)}
+		}
+		if operand, err = get(input, path); err != nil {
+			return false, err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(operator, "String"):
+		a, ok := value.(string)
+		b, bok := operand.(string)
+		if !ok || !bok {
+			return false, nil
+		}
+		if operator == "StringMatches" {
+			return wildcard(b).MatchString(a), nil
+		}
+		return compare(strings.Compare(a, b), strings.TrimPrefix(operator, "String")), nil
+	case strings.HasPrefix(operator, "Numeric"):
+		a, ok := number(value)
+		b, bok := number(operand)
+		if !ok || !bok {
+			return false, nil
+		}
+		c := 0
+		if a < b {
+			c = -1
+		} else if a > b {
+			c = 1
+		}
+		return compare(c, strings.TrimPrefix(operator, "Numeric")), nil
+	case strings.HasPrefix(operator, "Boolean"):
+		a, ok := value.(bool)
+		b, bok := operand.(bool)
+		return ok && bok && a == b, nil
+	case strings.HasPrefix(operator, "Timestamp"):
+		a, ok := timestamp(value)
+		b, bok := timestamp(operand)
+		if !ok || !bok {
+			return false, nil
+		}
+		return compare(a.Compare(b), strings.TrimPrefix(operator, "Timestamp")), nil
+	}
+	return false, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("unsupported choice operator %s", rule.Operator)}
+}
+
+// compare applies op to the result c of comparing two values.
+func compare(c int, op string) bool {
+	switch op {
+	case "Equals":
+		return c == 0
+	case "LessThan":
+		return c < 0
+	case "GreaterThan":
+		return c > 0
+	case "LessThanEquals":
+		return c <= 0
+	case "GreaterThanEquals":
+		return c >= 0
+	}
+	return false
+}
+
+func number(value interface{}) (float64, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func timestamp(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// wildcard compiles a StringMatches pattern, where * matches any run of
+// characters and \* a literal asterisk.
+func wildcard(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern) && (pattern[i+1] == '*' || pattern[i+1] == '\\'):
+			expr.WriteString(regexp.QuoteMeta(pattern[i+1 : i+2]))
+			i++
+		case pattern[i] == '*':
+			expr.WriteString(".*")
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
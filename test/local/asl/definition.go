@@ -0,0 +1,222 @@
+// Package asl interprets the Amazon States Language definitions of the
+// stack's state machines so their routing can be unit-tested without
+// deploying them. Task states call Go handlers registered by function name,
+// Choice, Pass, Wait, Succeed and Fail states are evaluated in process, and
+// an Execution reports every state entered along the way:
+//
+//	machines, err := asl.LoadTemplate("../../video-on-demand-on-aws.template")
+//	interpreter := asl.New()
+//	interpreter.Register("InputValidateLambda", asl.Func(inputValidate.HandleRequest))
+//	execution, err := interpreter.Run(ctx, machines["IngestWorkflow"], input)
+//
+// Parallel and Map states and intrinsic functions are not supported, the
+// stack's definitions don't use them.
+package asl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// State types the interpreter executes.
+const (
+	TypeTask    = "Task"
+	TypeChoice  = "Choice"
+	TypePass    = "Pass"
+	TypeWait    = "Wait"
+	TypeSucceed = "Succeed"
+	TypeFail    = "Fail"
+)
+
+// StateMachine is a parsed state machine definition.
+type StateMachine struct {
+	// Name is the logical ID of the state machine in the template, without
+	// the hash suffix CDK adds.
+	Name    string            `json:"-"`
+	Comment string            `json:"Comment,omitempty"`
+	StartAt string            `json:"StartAt"`
+	States  map[string]*State `json:"States"`
+}
+
+// State is one state of a definition. Fields that don't apply to a state's
+// type are left empty.
+type State struct {
+	Type    string `json:"Type"`
+	Comment string `json:"Comment,omitempty"`
+	Next    string `json:"Next,omitempty"`
+	End     bool   `json:"End,omitempty"`
+
+	InputPath      *string         `json:"InputPath,omitempty"`
+	OutputPath     *string         `json:"OutputPath,omitempty"`
+	ResultPath     *string         `json:"ResultPath,omitempty"`
+	Parameters     json.RawMessage `json:"Parameters,omitempty"`
+	ResultSelector json.RawMessage `json:"ResultSelector,omitempty"`
+
+	// Task
+	Resource string    `json:"Resource,omitempty"`
+	Retry    []Retrier `json:"Retry,omitempty"`
+	Catch    []Catcher `json:"Catch,omitempty"`
+
+	// Pass
+	Result json.RawMessage `json:"Result,omitempty"`
+
+	// Choice
+	Choices []*ChoiceRule `json:"Choices,omitempty"`
+	Default string        `json:"Default,omitempty"`
+
+	// Wait
+	Seconds       *int64 `json:"Seconds,omitempty"`
+	SecondsPath   string `json:"SecondsPath,omitempty"`
+	Timestamp     string `json:"Timestamp,omitempty"`
+	TimestampPath string `json:"TimestampPath,omitempty"`
+
+	// Fail
+	Error string `json:"Error,omitempty"`
+	Cause string `json:"Cause,omitempty"`
+
+	// resultPathNull is set when ResultPath is explicitly null, which
+	// discards the result instead of replacing the input with it.
+	resultPathNull bool
+}
+
+// Retrier is an entry of a Task state's Retry field.
+type Retrier struct {
+	ErrorEquals     []string `json:"ErrorEquals"`
+	IntervalSeconds *float64 `json:"IntervalSeconds,omitempty"`
+	MaxAttempts     *int     `json:"MaxAttempts,omitempty"`
+	BackoffRate     *float64 `json:"BackoffRate,omitempty"`
+}
+
+// Catcher is an entry of a Task state's Catch field.
+type Catcher struct {
+	ErrorEquals []string `json:"ErrorEquals"`
+	Next        string   `json:"Next"`
+	ResultPath  *string  `json:"ResultPath,omitempty"`
+}
+
+// ChoiceRule is a Choice state rule. Top-level rules have Next set, the
+// rules nested in And, Or and Not don't. Comparison operands are kept as raw
+// JSON and decoded when the rule is evaluated.
+type ChoiceRule struct {
+	Variable string        `json:"Variable,omitempty"`
+	Next     string        `json:"Next,omitempty"`
+	And      []*ChoiceRule `json:"And,omitempty"`
+	Or       []*ChoiceRule `json:"Or,omitempty"`
+	Not      *ChoiceRule   `json:"Not,omitempty"`
+
+	// Operator is the comparison operator of the rule, StringEquals for
+	// example, and Operand its value.
+	Operator string          `json:"-"`
+	Operand  json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON reads the rule and picks out its comparison operator.
+func (r *ChoiceRule) UnmarshalJSON(data []byte) error {
+	type rule ChoiceRule
+	if err := json.Unmarshal(data, (*rule)(r)); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		switch name {
+		case "Variable", "Next", "And", "Or", "Not", "Comment":
+			continue
+		}
+		if _, ok := comparisons[name]; !ok {
+			return fmt.Errorf("unsupported choice operator %q", name)
+		}
+		if r.Operator != "" {
+			return fmt.Errorf("choice rule has operators %s and %s", r.Operator, name)
+		}
+		r.Operator, r.Operand = name, value
+	}
+	return nil
+}
+
+// UnmarshalJSON reads the state and records an explicit null ResultPath.
+func (s *State) UnmarshalJSON(data []byte) error {
+	type state State
+	if err := json.Unmarshal(data, (*state)(s)); err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if value, ok := fields["ResultPath"]; ok && bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+		s.resultPathNull = true
+	}
+	return nil
+}
+
+// Parse reads an Amazon States Language definition and checks that every
+// transition leads to a state of the definition.
+func Parse(data []byte) (*StateMachine, error) {
+	var machine StateMachine
+	if err := json.Unmarshal(data, &machine); err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+	if err := machine.validate(); err != nil {
+		return nil, err
+	}
+	return &machine, nil
+}
+
+func (m *StateMachine) validate() error {
+	if _, ok := m.States[m.StartAt]; !ok {
+		return fmt.Errorf("StartAt %q is not a state", m.StartAt)
+	}
+
+	names := make([]string, 0, len(m.States))
+	for name := range m.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		state := m.States[name]
+		var next []string
+		switch state.Type {
+		case TypeTask, TypePass, TypeWait:
+			if state.End == (state.Next != "") {
+				return fmt.Errorf("state %q must have exactly one of Next and End", name)
+			}
+			next = append(next, state.Next)
+			for _, c := range state.Catch {
+				next = append(next, c.Next)
+			}
+		case TypeChoice:
+			if len(state.Choices) == 0 {
+				return fmt.Errorf("choice state %q has no Choices", name)
+			}
+			for _, rule := range state.Choices {
+				if rule.Next == "" {
+					return fmt.Errorf("choice state %q has a rule without Next", name)
+				}
+				next = append(next, rule.Next)
+			}
+			next = append(next, state.Default)
+		case TypeSucceed, TypeFail:
+		default:
+			return fmt.Errorf("state %q has unsupported type %q", name, state.Type)
+		}
+		if state.Type == TypeTask && state.Resource == "" {
+			return fmt.Errorf("task state %q has no Resource", name)
+		}
+
+		for _, target := range next {
+			if target == "" {
+				continue
+			}
+			if _, ok := m.States[target]; !ok {
+				return fmt.Errorf("state %q transitions to %q which is not a state", name, target)
+			}
+		}
+	}
+	return nil
+}
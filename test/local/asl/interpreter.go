@@ -0,0 +1,514 @@
+package asl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Error names raised by the interpreter, as Step Functions names them.
+const (
+	ErrAll                    = "States.ALL"
+	ErrTaskFailed             = "States.TaskFailed"
+	ErrRuntime                = "States.Runtime"
+	ErrNoChoiceMatched        = "States.NoChoiceMatched"
+	ErrResultPathMatchFailure = "States.ResultPathMatchFailure"
+	ErrResourceNotFound       = "Lambda.ResourceNotFoundException"
+)
+
+// Execution statuses.
+const (
+	StatusSucceeded = "SUCCEEDED"
+	StatusFailed    = "FAILED"
+)
+
+// invokeResource is the Step Functions integration the stack uses to invoke
+// Lambda functions asynchronously.
+const invokeResource = ":states:::lambda:invoke"
+
+// Error is a named execution error. Handlers return it to fail with a given
+// name; other errors are named after their type, as the Lambda runtime
+// reports them in errorType.
+type Error struct {
+	Name  string
+	Cause string
+}
+
+func (e *Error) Error() string {
+	return e.Name + ": " + e.Cause
+}
+
+// Handler runs a Task state's function with the state's effective input.
+type Handler func(ctx context.Context, input json.RawMessage) (json.RawMessage, error)
+
+// Func adapts a handler method like the services' HandleRequest to a
+// Handler.
+func Func[In, Out any](fn func(In) (Out, error)) Handler {
+	return FuncContext(func(_ context.Context, input In) (Out, error) {
+		return fn(input)
+	})
+}
+
+// FuncContext adapts a handler method that takes a context to a Handler.
+func FuncContext[In, Out any](fn func(context.Context, In) (Out, error)) Handler {
+	return func(ctx context.Context, data json.RawMessage) (json.RawMessage, error) {
+		var input In
+		if err := json.Unmarshal(data, &input); err != nil {
+			return nil, err
+		}
+		output, err := fn(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(output)
+	}
+}
+
+// Step is a state the execution entered.
+type Step struct {
+	Name   string
+	Type   string
+	Input  json.RawMessage
+	Output json.RawMessage
+
+	// Attempts counts the invocations of a Task state's handler and Delays
+	// the Retry intervals between them.
+	Attempts int
+	Delays   []time.Duration
+
+	// Error is the error the state failed with, or the error of an
+	// asynchronous invocation, which doesn't fail the state.
+	Error error
+}
+
+// Execution is the result of running a state machine.
+type Execution struct {
+	Arn    string
+	Status string
+	Input  json.RawMessage
+	Output json.RawMessage
+	Error  *Error
+	Steps  []*Step
+}
+
+// Path returns the names of the states the execution entered in order.
+func (x *Execution) Path() []string {
+	path := make([]string, len(x.Steps))
+	for i, step := range x.Steps {
+		path[i] = step.Name
+	}
+	return path
+}
+
+// Step returns the last time the execution entered the named state, nil
+// when it never did.
+func (x *Execution) Step(name string) *Step {
+	for i := len(x.Steps) - 1; i >= 0; i-- {
+		if x.Steps[i].Name == name {
+			return x.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Interpreter runs state machines against registered handlers.
+type Interpreter struct {
+	handlers map[string]Handler
+
+	// Sleep is called with Retry intervals and Wait durations, which are
+	// skipped when it is nil.
+	Sleep func(ctx context.Context, d time.Duration) error
+	// Now stamps the execution and state entry times in the context object.
+	Now func() time.Time
+	// MaxTransitions bounds an execution so a loop that never exits fails
+	// instead of hanging the test.
+	MaxTransitions int
+}
+
+// New returns an Interpreter without handlers.
+func New() *Interpreter {
+	return &Interpreter{
+		handlers:       map[string]Handler{},
+		Now:            time.Now,
+		MaxTransitions: 1000,
+	}
+}
+
+// Register sets the handler for a Lambda function name, matched against the
+// last part of a Task state's function ARN, or for a full Resource.
+func (i *Interpreter) Register(function string, handler Handler) {
+	i.handlers[function] = handler
+}
+
+// Run executes machine with input, which is marshaled to JSON unless it
+// already is json.RawMessage. The execution is returned whether it succeeded
+// or not, with a non-nil error when it failed.
+func (i *Interpreter) Run(ctx context.Context, machine *StateMachine, input interface{}) (*Execution, error) {
+	data, ok := input.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(input); err != nil {
+			return nil, fmt.Errorf("Marshal: %w", err)
+		}
+	}
+	value, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+
+	name := machine.Name
+	if name == "" {
+		name = "StateMachine"
+	}
+	id := uuid.NewString()
+	x := &Execution{
+		Arn:   "arn:aws:states:us-east-1:123456789012:execution:" + name + ":" + id,
+		Input: data,
+	}
+	contextObject := map[string]interface{}{
+		"Execution": map[string]interface{}{
+			"Id":        x.Arn,
+			"Name":      id,
+			"Input":     value,
+			"StartTime": i.Now().UTC().Format(time.RFC3339Nano),
+		},
+		"StateMachine": map[string]interface{}{
+			"Id":   "arn:aws:states:us-east-1:123456789012:stateMachine:" + name,
+			"Name": name,
+		},
+	}
+
+	current := machine.StartAt
+	for transitions := 0; ; transitions++ {
+		if transitions == i.MaxTransitions {
+			return x.fail(&Error{Name: ErrRuntime, Cause: fmt.Sprintf("exceeded %d state transitions", i.MaxTransitions)})
+		}
+		if err := ctx.Err(); err != nil {
+			return x.fail(&Error{Name: ErrRuntime, Cause: err.Error()})
+		}
+
+		state := machine.States[current]
+		step := &Step{Name: current, Type: state.Type, Input: marshal(value)}
+		x.Steps = append(x.Steps, step)
+		contextObject["State"] = map[string]interface{}{
+			"Name":        current,
+			"EnteredTime": i.Now().UTC().Format(time.RFC3339Nano),
+			"RetryCount":  json.Number("0"),
+		}
+
+		next, output, err := i.execute(ctx, state, step, value, contextObject)
+		if err != nil {
+			var failure *Error
+			if !errors.As(err, &failure) {
+				failure = &Error{Name: ErrorName(err), Cause: err.Error()}
+			}
+			step.Error = failure
+			return x.fail(failure)
+		}
+		step.Output = marshal(output)
+		value = output
+
+		if next == "" {
+			x.Status, x.Output = StatusSucceeded, step.Output
+			return x, nil
+		}
+		current = next
+	}
+}
+
+func (x *Execution) fail(err *Error) (*Execution, error) {
+	x.Status, x.Error = StatusFailed, err
+	return x, err
+}
+
+// execute runs one state and returns the next state, empty when the
+// execution ends, and the state's output.
+func (i *Interpreter) execute(ctx context.Context, state *State, step *Step, input interface{}, contextObject map[string]interface{}) (string, interface{}, error) {
+	effective, err := path(input, state.InputPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch state.Type {
+	case TypeChoice:
+		next, err := choose(state, effective)
+		if err != nil {
+			return "", nil, err
+		}
+		output, err := path(effective, state.OutputPath)
+		return next, output, err
+	case TypeSucceed:
+		output, err := path(effective, state.OutputPath)
+		return "", output, err
+	case TypeFail:
+		return "", nil, &Error{Name: state.Error, Cause: state.Cause}
+	case TypeWait:
+		if err := i.wait(ctx, state, effective); err != nil {
+			return "", nil, err
+		}
+		output, err := path(effective, state.OutputPath)
+		return state.Next, output, err
+	}
+
+	if state.Parameters != nil {
+		if effective, err = template(state.Parameters, effective, contextObject); err != nil {
+			return "", nil, err
+		}
+	}
+
+	next := state.Next
+	result := effective
+	switch state.Type {
+	case TypePass:
+		if state.Result != nil && state.Parameters == nil {
+			if result, err = decode(state.Result); err != nil {
+				return "", nil, &Error{Name: ErrRuntime, Cause: err.Error()}
+			}
+		}
+	case TypeTask:
+		result, err = i.task(ctx, state, step, effective, contextObject)
+		if err != nil {
+			catcher := catch(state.Catch, err)
+			if catcher == nil {
+				return "", nil, err
+			}
+			step.Error = err
+			output, err := place(input, catcher.ResultPath, false, map[string]interface{}{
+				"Error": ErrorName(err),
+				"Cause": err.Error(),
+			})
+			return catcher.Next, output, err
+		}
+		if state.ResultSelector != nil {
+			if result, err = template(state.ResultSelector, result, contextObject); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	output, err := place(input, state.ResultPath, state.resultPathNull, result)
+	if err != nil {
+		return "", nil, err
+	}
+	output, err = path(output, state.OutputPath)
+	return next, output, err
+}
+
+// task invokes the state's handler, retrying failures its Retry field
+// matches.
+func (i *Interpreter) task(ctx context.Context, state *State, step *Step, input interface{}, contextObject map[string]interface{}) (interface{}, error) {
+	function, payload, async := state.Resource, input, false
+	if strings.HasSuffix(state.Resource, invokeResource) {
+		parameters, _ := input.(map[string]interface{})
+		name, _ := parameters["FunctionName"].(string)
+		function, payload = name, parameters["Payload"]
+		async = parameters["InvocationType"] == "Event"
+	}
+	handler, ok := i.handlers[state.Resource]
+	if !ok {
+		function = function[strings.LastIndex(function, ":")+1:]
+		if handler, ok = i.handlers[function]; !ok {
+			return nil, &Error{Name: ErrResourceNotFound, Cause: "no handler is registered for " + function}
+		}
+	}
+
+	attempts := make([]int, len(state.Retry))
+	for {
+		step.Attempts++
+		output, err := handler(ctx, marshal(payload))
+		if async {
+			// the invocation is queued, its failure doesn't reach the state
+			step.Error = err
+			return invokeResult("", true), nil
+		}
+		if err == nil {
+			result, err := decode(output)
+			if err != nil {
+				return nil, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("%s returned invalid JSON: %v", function, err)}
+			}
+			if strings.HasSuffix(state.Resource, invokeResource) {
+				return invokeResult(result, false), nil
+			}
+			return result, nil
+		}
+
+		r := retrier(state.Retry, err)
+		if r < 0 || attempts[r] >= maxAttempts(state.Retry[r]) {
+			return nil, err
+		}
+		delay := interval(state.Retry[r], attempts[r])
+		attempts[r]++
+		step.Delays = append(step.Delays, delay)
+		contextObject["State"].(map[string]interface{})["RetryCount"] = json.Number(fmt.Sprint(step.Attempts))
+		if i.Sleep != nil {
+			if err := i.Sleep(ctx, delay); err != nil {
+				return nil, &Error{Name: ErrRuntime, Cause: err.Error()}
+			}
+		}
+	}
+}
+
+// invokeResult is the result of the lambda:invoke integration.
+func invokeResult(payload interface{}, async bool) interface{} {
+	status := json.Number("200")
+	if async {
+		status = json.Number("202")
+	}
+	return map[string]interface{}{
+		"ExecutedVersion": "$LATEST",
+		"Payload":         payload,
+		"StatusCode":      status,
+	}
+}
+
+func (i *Interpreter) wait(ctx context.Context, state *State, input interface{}) error {
+	var d time.Duration
+	switch {
+	case state.Seconds != nil:
+		d = time.Duration(*state.Seconds) * time.Second
+	case state.SecondsPath != "":
+		value, err := get(input, state.SecondsPath)
+		if err != nil {
+			return err
+		}
+		seconds, ok := number(value)
+		if !ok {
+			return &Error{Name: ErrRuntime, Cause: fmt.Sprintf("%s is not a number", state.SecondsPath)}
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	default:
+		value := interface{}(state.Timestamp)
+		if state.TimestampPath != "" {
+			var err error
+			if value, err = get(input, state.TimestampPath); err != nil {
+				return err
+			}
+		}
+		t, ok := timestamp(value)
+		if !ok {
+			return &Error{Name: ErrRuntime, Cause: fmt.Sprintf("%v is not a timestamp", value)}
+		}
+		d = t.Sub(i.Now())
+	}
+	if i.Sleep == nil || d <= 0 {
+		return nil
+	}
+	if err := i.Sleep(ctx, d); err != nil {
+		return &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+	return nil
+}
+
+// ErrorName is the name Retry and Catch match err on: the Name of an *Error,
+// or the name of err's type like the Lambda runtime's errorType.
+func ErrorName(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Name
+	}
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// matches reports whether an ErrorEquals list matches err. States.ALL and
+// States.TaskFailed match any error except States.Runtime, which can't be
+// retried or caught.
+func matches(errorEquals []string, err error) bool {
+	name := ErrorName(err)
+	if name == ErrRuntime {
+		return false
+	}
+	for _, e := range errorEquals {
+		if e == name || e == ErrAll || e == ErrTaskFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// retrier returns the index of the first retrier matching err, -1 if none
+// does.
+func retrier(retry []Retrier, err error) int {
+	for i, r := range retry {
+		if matches(r.ErrorEquals, err) {
+			return i
+		}
+	}
+	return -1
+}
+
+func catch(catchers []Catcher, err error) *Catcher {
+	for i := range catchers {
+		if matches(catchers[i].ErrorEquals, err) {
+			return &catchers[i]
+		}
+	}
+	return nil
+}
+
+func maxAttempts(r Retrier) int {
+	if r.MaxAttempts == nil {
+		return 3
+	}
+	return *r.MaxAttempts
+}
+
+// interval is the delay before retry attempt n (from 0) of r.
+func interval(r Retrier, n int) time.Duration {
+	seconds, rate := 1.0, 2.0
+	if r.IntervalSeconds != nil {
+		seconds = *r.IntervalSeconds
+	}
+	if r.BackoffRate != nil {
+		rate = *r.BackoffRate
+	}
+	return time.Duration(seconds * math.Pow(rate, float64(n)) * float64(time.Second))
+}
+
+// path applies an InputPath or OutputPath, which default to $.
+func path(value interface{}, p *string) (interface{}, error) {
+	if p == nil || *p == "$" {
+		return value, nil
+	}
+	return get(value, *p)
+}
+
+// place applies a ResultPath: $ by default replaces the input with the
+// result, null keeps the input and discards it.
+func place(input interface{}, resultPath *string, null bool, result interface{}) (interface{}, error) {
+	switch {
+	case null:
+		return input, nil
+	case resultPath == nil:
+		return result, nil
+	}
+	return set(input, *resultPath, result)
+}
+
+// template evaluates a Parameters or ResultSelector field.
+func template(raw json.RawMessage, input interface{}, contextObject map[string]interface{}) (interface{}, error) {
+	t, err := decode(raw)
+	if err != nil {
+		return nil, &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+	return evaluate(t, input, contextObject)
+}
+
+func marshal(value interface{}) json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		// values come from decoded JSON and always marshal
+		panic(err)
+	}
+	return data
+}
@@ -0,0 +1,171 @@
+package asl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parse(t *testing.T, definition string) *StateMachine {
+	machine, err := Parse([]byte(definition))
+	require.NoError(t, err)
+	return machine
+}
+
+func output(t *testing.T, execution *Execution) map[string]interface{} {
+	var value map[string]interface{}
+	require.NoError(t, json.Unmarshal(execution.Output, &value))
+	return value
+}
+
+func TestInterpreter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Parse rejects transitions to missing states", func(t *testing.T) {
+		_, err := Parse([]byte(`{"StartAt": "A", "States": {"A": {"Type": "Pass", "Next": "B"}}}`))
+		assert.ErrorContains(t, err, `"B" which is not a state`)
+
+		_, err = Parse([]byte(`{"StartAt": "A", "States": {"A": {"Type": "Parallel", "End": true}}}`))
+		assert.ErrorContains(t, err, "unsupported type")
+
+		_, err = Parse([]byte(`{"StartAt": "A", "States": {"A": {"Type": "Choice", "Choices": [{"Variable": "$.a", "StringSounds": "b", "Next": "A"}]}}}`))
+		assert.ErrorContains(t, err, "unsupported choice operator")
+	})
+
+	t.Run("Paths shape the state input and output", func(t *testing.T) {
+		machine := parse(t, `{
+			"StartAt": "Task",
+			"States": {
+				"Task": {
+					"Type": "Task",
+					"Resource": "arn:aws:lambda:us-east-1:123456789012:function:Double",
+					"InputPath": "$.request",
+					"Parameters": {"value.$": "$.values[1]", "state.$": "$$.State.Name", "fixed": "x"},
+					"ResultSelector": {"doubled.$": "$.result"},
+					"ResultPath": "$.request.response",
+					"OutputPath": "$.request",
+					"Next": "Discard"
+				},
+				"Discard": {"Type": "Pass", "Result": {"ignored": true}, "ResultPath": null, "Next": "Done"},
+				"Done": {"Type": "Succeed"}
+			}
+		}`)
+		var received map[string]interface{}
+		interpreter := New()
+		interpreter.Register("Double", Func(func(input map[string]interface{}) (map[string]interface{}, error) {
+			received = input
+			value, _ := input["value"].(float64)
+			return map[string]interface{}{"result": value * 2, "other": 1}, nil
+		}))
+
+		execution, err := interpreter.Run(ctx, machine, map[string]interface{}{
+			"request": map[string]interface{}{"values": []int{1, 21}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"value": 21.0, "state": "Task", "fixed": "x"}, received)
+		assert.Equal(t, map[string]interface{}{
+			"values":   []interface{}{1.0, 21.0},
+			"response": map[string]interface{}{"doubled": 42.0},
+		}, output(t, execution))
+		assert.Equal(t, []string{"Task", "Discard", "Done"}, execution.Path())
+	})
+
+	t.Run("Choice evaluates compound rules", func(t *testing.T) {
+		machine := parse(t, `{
+			"StartAt": "Route",
+			"States": {
+				"Route": {
+					"Type": "Choice",
+					"Choices": [
+						{"And": [
+							{"Variable": "$.key", "StringMatches": "*.mp4"},
+							{"Not": {"Variable": "$.size", "NumericGreaterThanPath": "$.limit"}}
+						], "Next": "Small"},
+						{"Or": [
+							{"Variable": "$.force", "IsPresent": true},
+							{"Variable": "$.key", "StringEquals": "large.mov"}
+						], "Next": "Large"}
+					],
+					"Default": "Other"
+				},
+				"Small": {"Type": "Succeed"},
+				"Large": {"Type": "Succeed"},
+				"Other": {"Type": "Fail", "Error": "Unroutable", "Cause": "no route"}
+			}
+		}`)
+		for _, test := range []struct {
+			input map[string]interface{}
+			state string
+		}{
+			{map[string]interface{}{"key": "a.mp4", "size": 5, "limit": 10}, "Small"},
+			{map[string]interface{}{"key": "a.mp4", "size": 50, "limit": 10, "force": nil}, "Large"},
+			{map[string]interface{}{"key": "large.mov", "size": 5, "limit": 10}, "Large"},
+			{map[string]interface{}{"key": "a.mov", "size": 5, "limit": 10}, "Other"},
+		} {
+			execution, _ := New().Run(ctx, machine, test.input)
+			assert.Equal(t, []string{"Route", test.state}, execution.Path(), test.input)
+		}
+
+		execution, err := New().Run(ctx, machine, map[string]interface{}{"key": "a.mov", "size": 5, "limit": 10})
+		assert.Equal(t, &Error{Name: "Unroutable", Cause: "no route"}, err)
+		assert.Equal(t, StatusFailed, execution.Status)
+
+		_, err = New().Run(ctx, machine, map[string]interface{}{"key": "a.mp4"})
+		var failure *Error
+		require.ErrorAs(t, err, &failure)
+		assert.Equal(t, ErrRuntime, failure.Name)
+	})
+
+	t.Run("Catch routes errors the retries don't recover", func(t *testing.T) {
+		machine := parse(t, `{
+			"StartAt": "Task",
+			"States": {
+				"Task": {
+					"Type": "Task",
+					"Resource": "arn:aws:lambda:us-east-1:123456789012:function:Flaky",
+					"Retry": [{"ErrorEquals": ["Throttled"], "MaxAttempts": 2, "IntervalSeconds": 3}],
+					"Catch": [{"ErrorEquals": ["States.ALL"], "ResultPath": "$.error", "Next": "Recover"}],
+					"End": true
+				},
+				"Recover": {"Type": "Pass", "End": true}
+			}
+		}`)
+		interpreter := New()
+		interpreter.Register("Flaky", Func(func(map[string]interface{}) (interface{}, error) {
+			return nil, &Error{Name: "Throttled", Cause: "slow down"}
+		}))
+
+		execution, err := interpreter.Run(ctx, machine, map[string]interface{}{"guid": "a"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Task", "Recover"}, execution.Path())
+		assert.Equal(t, 3, execution.Step("Task").Attempts)
+		assert.Len(t, execution.Step("Task").Delays, 2)
+		assert.Equal(t, map[string]interface{}{
+			"guid":  "a",
+			"error": map[string]interface{}{"Error": "Throttled", "Cause": "Throttled: slow down"},
+		}, output(t, execution))
+	})
+
+	t.Run("Missing handlers and endless loops fail the execution", func(t *testing.T) {
+		machine := parse(t, `{"StartAt": "Task", "States": {"Task": {"Type": "Task", "Resource": "arn:aws:lambda:us-east-1:123456789012:function:Missing", "End": true}}}`)
+		_, err := New().Run(ctx, machine, map[string]interface{}{})
+		assert.ErrorContains(t, err, ErrResourceNotFound)
+
+		machine = parse(t, `{"StartAt": "Loop", "States": {"Loop": {"Type": "Wait", "Seconds": 1, "Next": "Loop"}}}`)
+		interpreter := New()
+		interpreter.MaxTransitions = 10
+		execution, err := interpreter.Run(ctx, machine, map[string]interface{}{})
+		assert.ErrorContains(t, err, "exceeded 10 state transitions")
+		assert.Len(t, execution.Steps, 10)
+	})
+
+	t.Run("ErrorName follows the Lambda error type", func(t *testing.T) {
+		assert.Equal(t, "VersionConflictError", ErrorName(&VersionConflictError{}))
+		assert.Equal(t, "errorString", ErrorName(errors.New("failed")))
+		assert.Equal(t, "States.Timeout", ErrorName(&Error{Name: "States.Timeout"}))
+	})
+}
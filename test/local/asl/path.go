@@ -0,0 +1,195 @@
+package asl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePath splits a reference path like $.a.b[0] or $['a b'] into map keys
+// and array indexes.
+func parsePath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q doesn't start with $", path)
+	}
+	var steps []interface{}
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %q has an empty field name", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated field name", path)
+			}
+			steps = append(steps, rest[2:end])
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated index", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("path %q has an unsupported index %q", path, rest[1:end])
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q is not a reference path", path)
+		}
+	}
+	return steps, nil
+}
+
+// lookup returns the value at path, ok is false when nothing is there.
+func lookup(value interface{}, path string) (result interface{}, ok bool, err error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				return nil, false, nil
+			}
+			if value, ok = object[step]; !ok {
+				return nil, false, nil
+			}
+		case int:
+			array, isArray := value.([]interface{})
+			if !isArray || step >= len(array) {
+				return nil, false, nil
+			}
+			value = array[step]
+		}
+	}
+	return value, true, nil
+}
+
+// get returns the value at path and fails with States.Runtime when nothing
+// is there, as Step Functions does.
+func get(value interface{}, path string) (interface{}, error) {
+	result, ok, err := lookup(value, path)
+	if err != nil {
+		return nil, &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+	if !ok {
+		return nil, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("path %s doesn't match the input", path)}
+	}
+	return result, nil
+}
+
+// set returns a copy of value with result placed at path, creating the
+// objects along the way. Only the objects on the path are copied.
+func set(value interface{}, path string, result interface{}) (interface{}, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, &Error{Name: ErrRuntime, Cause: err.Error()}
+	}
+	return setSteps(value, steps, result, path)
+}
+
+func setSteps(value interface{}, steps []interface{}, result interface{}, path string) (interface{}, error) {
+	if len(steps) == 0 {
+		return result, nil
+	}
+	key, ok := steps[0].(string)
+	if !ok {
+		return nil, &Error{Name: ErrResultPathMatchFailure, Cause: fmt.Sprintf("result path %s indexes an array", path)}
+	}
+
+	object := map[string]interface{}{}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			object[k] = v
+		}
+	case nil:
+	default:
+		return nil, &Error{Name: ErrResultPathMatchFailure, Cause: fmt.Sprintf("result path %s doesn't match an object", path)}
+	}
+
+	child, err := setSteps(object[key], steps[1:], result, path)
+	if err != nil {
+		return nil, err
+	}
+	object[key] = child
+	return object, nil
+}
+
+// evaluate fills a Parameters, Payload or ResultSelector template: fields
+// whose name ends in .$ take the value at their path, from the context
+// object when the path starts with $$.
+func evaluate(template interface{}, input interface{}, context interface{}) (interface{}, error) {
+	switch template := template.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(template))
+		for name, value := range template {
+			if !strings.HasSuffix(name, ".$") {
+				v, err := evaluate(value, input, context)
+				if err != nil {
+					return nil, err
+				}
+				object[name] = v
+				continue
+			}
+
+			path, ok := value.(string)
+			if !ok {
+				return nil, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("field %s is not a path", name)}
+			}
+			source := input
+			if strings.HasPrefix(path, "$$") {
+				source, path = context, path[1:]
+			}
+			if strings.HasPrefix(path, "States.") {
+				return nil, &Error{Name: ErrRuntime, Cause: fmt.Sprintf("intrinsic function %s is not supported", path)}
+			}
+			v, err := get(source, path)
+			if err != nil {
+				return nil, err
+			}
+			object[strings.TrimSuffix(name, ".$")] = v
+		}
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(template))
+		for i, value := range template {
+			v, err := evaluate(value, input, context)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = v
+		}
+		return array, nil
+	default:
+		return template, nil
+	}
+}
+
+// decode unmarshals JSON keeping numbers as json.Number so values pass
+// through the interpreter unchanged.
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,154 @@
+package asl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Values the template's pseudo parameters resolve to.
+const (
+	partition = "aws"
+	region    = "us-east-1"
+	accountId = "123456789012"
+)
+
+// hashSuffix is the suffix CDK appends to logical IDs.
+var hashSuffix = regexp.MustCompile(`^(.+?)[0-9A-F]{8}$`)
+
+type resource struct {
+	Type       string                     `json:"Type"`
+	Properties map[string]json.RawMessage `json:"Properties"`
+}
+
+// LoadTemplate reads the state machines of a CloudFormation template, see
+// ParseTemplate.
+func LoadTemplate(path string) (map[string]*StateMachine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	return ParseTemplate(data)
+}
+
+// ParseTemplate reads the AWS::StepFunctions::StateMachine resources of a
+// CloudFormation template, keyed by LogicalName. Fn::GetAtt Arn of a Lambda
+// function in the definitions resolves to an ARN ending in the function's
+// logical name, which is what handlers are registered under.
+func ParseTemplate(data []byte) (map[string]*StateMachine, error) {
+	var template struct {
+		Resources map[string]resource `json:"Resources"`
+	}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("Unmarshal: %w", err)
+	}
+
+	machines := map[string]*StateMachine{}
+	for id, r := range template.Resources {
+		if r.Type != "AWS::StepFunctions::StateMachine" {
+			continue
+		}
+
+		var definition []byte
+		if raw, ok := r.Properties["Definition"]; ok {
+			definition = raw
+		} else {
+			var value interface{}
+			if err := json.Unmarshal(r.Properties["DefinitionString"], &value); err != nil {
+				return nil, fmt.Errorf("%s: Unmarshal: %w", id, err)
+			}
+			s, err := resolve(template.Resources, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+			definition = []byte(s)
+		}
+
+		machine, err := Parse(definition)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		machine.Name = LogicalName(id)
+		machines[machine.Name] = machine
+	}
+	return machines, nil
+}
+
+// LogicalName strips the hash suffix CDK adds to a logical ID, so
+// IngestWorkflow58F2BCD4 is IngestWorkflow.
+func LogicalName(id string) string {
+	if m := hashSuffix.FindStringSubmatch(id); m != nil {
+		return m[1]
+	}
+	return id
+}
+
+// resolve evaluates the intrinsic functions a DefinitionString is built
+// with to a string.
+func resolve(resources map[string]resource, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case map[string]interface{}:
+		if len(value) != 1 {
+			break
+		}
+		switch {
+		case value["Fn::Join"] != nil:
+			args, ok := value["Fn::Join"].([]interface{})
+			if !ok || len(args) != 2 {
+				break
+			}
+			separator, _ := args[0].(string)
+			parts, _ := args[1].([]interface{})
+			resolved := make([]string, len(parts))
+			for i, part := range parts {
+				s, err := resolve(resources, part)
+				if err != nil {
+					return "", err
+				}
+				resolved[i] = s
+			}
+			return strings.Join(resolved, separator), nil
+		case value["Fn::GetAtt"] != nil:
+			args, ok := value["Fn::GetAtt"].([]interface{})
+			if !ok || len(args) != 2 || args[1] != "Arn" {
+				break
+			}
+			id, _ := args[0].(string)
+			return arn(resources, id), nil
+		case value["Ref"] != nil:
+			switch ref := value["Ref"].(string); ref {
+			case "AWS::Partition":
+				return partition, nil
+			case "AWS::Region":
+				return region, nil
+			case "AWS::AccountId":
+				return accountId, nil
+			case "AWS::URLSuffix":
+				return "amazonaws.com", nil
+			default:
+				return LogicalName(ref), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported intrinsic function %v", value)
+}
+
+// arn is the ARN of a template resource, named after its logical name.
+func arn(resources map[string]resource, id string) string {
+	name := LogicalName(id)
+	switch resources[id].Type {
+	case "AWS::Lambda::Function":
+		return fmt.Sprintf("arn:%s:lambda:%s:%s:function:%s", partition, region, accountId, name)
+	case "AWS::StepFunctions::StateMachine":
+		return fmt.Sprintf("arn:%s:states:%s:%s:stateMachine:%s", partition, region, accountId, name)
+	case "AWS::SNS::Topic":
+		return fmt.Sprintf("arn:%s:sns:%s:%s:%s", partition, region, accountId, name)
+	case "AWS::SQS::Queue":
+		return fmt.Sprintf("arn:%s:sqs:%s:%s:%s", partition, region, accountId, name)
+	}
+	return fmt.Sprintf("arn:%s:%s", partition, name)
+}
@@ -0,0 +1,324 @@
+package asl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const templatePath = "../../../video-on-demand-on-aws.template"
+
+// VersionConflictError stands in for the dynamo service's error of the same
+// name, which fails the DynamoDB Update states without a retry.
+type VersionConflictError struct{}
+
+func (*VersionConflictError) Error() string { return "version conflict" }
+
+// functions are the Lambda functions the workflows invoke.
+var functions = []string{
+	"InputValidateLambda", "MediaInfoLambda", "DynamoUpdateLambda", "StepFunctionsLambda",
+	"SnsNotificationLambda", "LifecycleEventsLambda", "WebhookNotificationLambda",
+	"ProfilerLambda", "EncodeLambda", "OutputValidateLambda", "ArchiveSourceLambda",
+	"MediaPackageAssetsLambda", "CdnInvalidationLambda", "SqsSendMessageLambda",
+}
+
+// workflows runs the template's state machines with handlers that return
+// their input unchanged and records what each function was called with.
+type workflows struct {
+	*Interpreter
+	machines map[string]*StateMachine
+	calls    map[string][]map[string]interface{}
+}
+
+func newWorkflows(t *testing.T) *workflows {
+	machines, err := LoadTemplate(templatePath)
+	require.NoError(t, err)
+
+	w := &workflows{Interpreter: New(), machines: machines, calls: map[string][]map[string]interface{}{}}
+	for _, function := range functions {
+		w.handle(function, func(input map[string]interface{}) (interface{}, error) {
+			return input, nil
+		})
+	}
+	return w
+}
+
+// handle registers fn for function, recording its calls.
+func (w *workflows) handle(function string, fn func(input map[string]interface{}) (interface{}, error)) {
+	w.Register(function, Func(func(input map[string]interface{}) (interface{}, error) {
+		w.calls[function] = append(w.calls[function], input)
+		return fn(input)
+	}))
+}
+
+func (w *workflows) run(t *testing.T, machine string, input map[string]interface{}) (*Execution, error) {
+	require.Contains(t, w.machines, machine)
+	return w.Run(context.Background(), w.machines[machine], input)
+}
+
+func TestTemplateWorkflows(t *testing.T) {
+	ingest := func() map[string]interface{} {
+		return map[string]interface{}{"guid": "guid-1", "enableSns": false, "duplicateAction": "PROCEED"}
+	}
+	process := func() map[string]interface{} {
+		return map[string]interface{}{
+			"guid": "guid-1", "enableSns": false, "isCustomTemplate": false,
+			"encodingProfile": 1080, "acceleratedTranscoding": "PREFERRED", "frameCapture": false,
+		}
+	}
+	publish := func() map[string]interface{} {
+		return map[string]interface{}{
+			"guid": "guid-1", "enableSns": false, "enableSqs": false,
+			"archiveSource": "DISABLED", "enableMediaPackage": false,
+		}
+	}
+	notInvalidated := func(map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"status": "NotRequired"}, nil
+	}
+
+	t.Run("Ingest runs through to Process Execute", func(t *testing.T) {
+		w := newWorkflows(t)
+		execution, err := w.run(t, "IngestWorkflow", ingest())
+		require.NoError(t, err)
+
+		assert.Equal(t, StatusSucceeded, execution.Status)
+		assert.Equal(t, []string{
+			"Input Validate", "Duplicate Choice", "MediaInfo", "Execution Context (Ingest)",
+			"DynamoDB Update (Ingest)", "Lifecycle (Ingested)", "Webhook (Ingest)",
+			"SNS Choice (Ingest)", "Process Execute",
+		}, execution.Path())
+
+		require.Len(t, w.calls["StepFunctionsLambda"], 1)
+		assert.Equal(t, map[string]interface{}{
+			"guid":      "guid-1",
+			"execution": map[string]interface{}{"id": execution.Arn},
+		}, w.calls["StepFunctionsLambda"][0])
+
+		update := w.calls["DynamoUpdateLambda"][0]
+		assert.Equal(t, map[string]interface{}{
+			"id":        execution.Arn,
+			"startTime": update["execution"].(map[string]interface{})["startTime"],
+			"state":     "Execution Context (Ingest)",
+		}, update["execution"])
+
+		require.Len(t, w.calls["LifecycleEventsLambda"], 1)
+		lifecycle := w.calls["LifecycleEventsLambda"][0]
+		assert.Equal(t, "Ingested", lifecycle["detailType"])
+		assert.Equal(t, execution.Arn, lifecycle["executionId"])
+		assert.Equal(t, "guid-1", lifecycle["event"].(map[string]interface{})["guid"])
+	})
+
+	t.Run("SNS Choice notifies when SNS is enabled", func(t *testing.T) {
+		w := newWorkflows(t)
+		input := ingest()
+		input["enableSns"] = true
+		execution, err := w.run(t, "IngestWorkflow", input)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"SNS Choice (Ingest)", "SNS Notification (Ingest)", "Process Execute"}, execution.Path()[7:])
+	})
+
+	t.Run("Duplicate Choice routes on the duplicate action", func(t *testing.T) {
+		for action, path := range map[string][]string{
+			"LINK":          {"Input Validate", "Duplicate Choice", "Duplicate Linked"},
+			"SHORT_CIRCUIT": {"Input Validate", "Duplicate Choice", "Execution Context (Duplicate)", "DynamoDB Update (Duplicate)"},
+		} {
+			w := newWorkflows(t)
+			input := ingest()
+			input["duplicateAction"] = action
+			execution, err := w.run(t, "IngestWorkflow", input)
+			require.NoError(t, err, action)
+			assert.Equal(t, path, execution.Path(), action)
+			assert.Empty(t, w.calls["MediaInfoLambda"], action)
+		}
+	})
+
+	t.Run("Encoding Profile Check picks the job template", func(t *testing.T) {
+		for _, test := range []struct {
+			custom  bool
+			profile int
+			state   string
+		}{
+			{true, 1080, "Custom jobTemplate"},
+			{false, 2160, "jobTemplate 2160p"},
+			{false, 1080, "jobTemplate 1080p"},
+			{false, 720, "jobTemplate 720p"},
+		} {
+			w := newWorkflows(t)
+			input := process()
+			input["isCustomTemplate"], input["encodingProfile"] = test.custom, test.profile
+			execution, err := w.run(t, "ProcessWorkflow", input)
+			require.NoError(t, err, test.state)
+			assert.Equal(t, []string{"Encoding Profile Check", test.state, "Accelerated Transcoding Check"}, execution.Path()[2:5])
+		}
+	})
+
+	t.Run("Encoding Profile Check fails an unknown profile", func(t *testing.T) {
+		w := newWorkflows(t)
+		input := process()
+		input["encodingProfile"] = 480
+		execution, err := w.run(t, "ProcessWorkflow", input)
+
+		var failure *Error
+		require.ErrorAs(t, err, &failure)
+		assert.Equal(t, ErrNoChoiceMatched, failure.Name)
+		assert.Equal(t, StatusFailed, execution.Status)
+		assert.Equal(t, "Encoding Profile Check", execution.Path()[len(execution.Path())-1])
+		assert.Empty(t, w.calls["EncodeLambda"])
+	})
+
+	t.Run("Accelerated Transcoding Check follows the setting", func(t *testing.T) {
+		for setting, state := range map[string]string{"ENABLED": "Enabled", "PREFERRED": "Preferred", "DISABLED": "Disabled"} {
+			w := newWorkflows(t)
+			input := process()
+			input["acceleratedTranscoding"] = setting
+			execution, err := w.run(t, "ProcessWorkflow", input)
+			require.NoError(t, err, setting)
+			assert.Contains(t, execution.Path(), state, setting)
+		}
+
+		w := newWorkflows(t)
+		input := process()
+		input["acceleratedTranscoding"] = "SOMETIMES"
+		execution, err := w.run(t, "ProcessWorkflow", input)
+		assert.ErrorContains(t, err, ErrNoChoiceMatched)
+		assert.Equal(t, "Accelerated Transcoding Check", execution.Path()[len(execution.Path())-1])
+	})
+
+	t.Run("Process without frame capture submits the job and completes", func(t *testing.T) {
+		w := newWorkflows(t)
+		execution, err := w.run(t, "ProcessWorkflow", process())
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"Profiler", "Lifecycle (ProfileSelected)", "Encoding Profile Check", "jobTemplate 1080p",
+			"Accelerated Transcoding Check", "Preferred", "Frame Capture Check", "No Frame Capture",
+			"Encode Job Submit", "Execution Context (Process)", "DynamoDB Update (Process)",
+			"Lifecycle (EncodeSubmitted)", "Webhook (Process)", "SNS Choice (Process)", "Process Complete",
+		}, execution.Path())
+		assert.Len(t, w.calls["EncodeLambda"], 1)
+	})
+
+	t.Run("Archive Source Choice archives per the policy", func(t *testing.T) {
+		for policy, state := range map[string]string{"GLACIER": "Archive", "DEEP_ARCHIVE": "Deep Archive", "DISABLED": ""} {
+			w := newWorkflows(t)
+			w.handle("CdnInvalidationLambda", notInvalidated)
+			input := publish()
+			input["archiveSource"] = policy
+			execution, err := w.run(t, "PublishWorkflow", input)
+			require.NoError(t, err, policy)
+
+			path := execution.Path()
+			assert.Equal(t, "Archive Source Choice", path[2], policy)
+			if state == "" {
+				assert.Equal(t, "MediaPackage Choice", path[3], policy)
+				assert.Empty(t, w.calls["ArchiveSourceLambda"], policy)
+				continue
+			}
+			assert.Equal(t, []string{state, "MediaPackage Choice"}, path[3:5], policy)
+			assert.Len(t, w.calls["ArchiveSourceLambda"], 1, policy)
+		}
+	})
+
+	t.Run("MediaPackage Choice ingests when MediaPackage is enabled", func(t *testing.T) {
+		for enabled, path := range map[bool][]string{
+			true:  {"MediaPackage Choice", "MediaPackage Assets", "CDN Invalidation"},
+			false: {"MediaPackage Choice", "CDN Invalidation"},
+		} {
+			w := newWorkflows(t)
+			w.handle("CdnInvalidationLambda", notInvalidated)
+			input := publish()
+			input["enableMediaPackage"] = enabled
+			execution, err := w.run(t, "PublishWorkflow", input)
+			require.NoError(t, err)
+			assert.Equal(t, path, execution.Path()[3:3+len(path)])
+		}
+	})
+
+	t.Run("CDN invalidation is polled until it completes", func(t *testing.T) {
+		w := newWorkflows(t)
+		var slept []time.Duration
+		w.Sleep = func(_ context.Context, d time.Duration) error {
+			slept = append(slept, d)
+			return nil
+		}
+		polls := 0
+		w.handle("CdnInvalidationLambda", func(input map[string]interface{}) (interface{}, error) {
+			if _, ok := input["invalidation"]; !ok {
+				return map[string]interface{}{"id": "I1", "status": "InProgress"}, nil
+			}
+			polls++
+			status := "InProgress"
+			if polls == 2 {
+				status = "Completed"
+			}
+			return map[string]interface{}{"id": "I1", "status": status}, nil
+		})
+
+		input := publish()
+		input["enableSqs"], input["enableSns"] = true, true
+		execution, err := w.run(t, "PublishWorkflow", input)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"CDN Invalidation", "CDN Invalidation Choice",
+			"CDN Invalidation Wait", "CDN Invalidation Status", "CDN Invalidation Choice",
+			"CDN Invalidation Wait", "CDN Invalidation Status", "CDN Invalidation Choice",
+			"Execution Context (Publish)", "DynamoDB Update (Publish)", "Lifecycle (Published)", "Webhook (Publish)",
+			"SQS Choice", "SQS Send Message", "SNS Choice (Publish)", "SNS Notification (Publish)", "Complete",
+		}, execution.Path()[4:])
+		assert.Equal(t, []time.Duration{30 * time.Second, 30 * time.Second}, slept)
+
+		var output map[string]interface{}
+		require.NoError(t, json.Unmarshal(execution.Output, &output))
+		assert.Equal(t, map[string]interface{}{"id": "I1", "status": "Completed"}, output["invalidation"])
+		assert.Equal(t, "guid-1", output["guid"])
+	})
+
+	t.Run("DynamoDB Update fails on a version conflict without retrying", func(t *testing.T) {
+		w := newWorkflows(t)
+		w.handle("DynamoUpdateLambda", func(map[string]interface{}) (interface{}, error) {
+			return nil, &VersionConflictError{}
+		})
+		execution, err := w.run(t, "IngestWorkflow", ingest())
+
+		var failure *Error
+		require.ErrorAs(t, err, &failure)
+		assert.Equal(t, "VersionConflictError", failure.Name)
+		assert.Equal(t, 1, execution.Step("DynamoDB Update (Ingest)").Attempts)
+		assert.Empty(t, w.calls["StepFunctionsLambda"])
+	})
+
+	t.Run("Lambda service errors are retried, handler errors aren't", func(t *testing.T) {
+		w := newWorkflows(t)
+		w.handle("MediaInfoLambda", func(map[string]interface{}) (interface{}, error) {
+			return nil, &Error{Name: "Lambda.ServiceException", Cause: "unavailable"}
+		})
+		execution, err := w.run(t, "IngestWorkflow", ingest())
+		assert.ErrorContains(t, err, "Lambda.ServiceException")
+		step := execution.Step("MediaInfo")
+		assert.Equal(t, 7, step.Attempts)
+		assert.Equal(t, 64*time.Second, step.Delays[5])
+
+		w = newWorkflows(t)
+		w.handle("MediaInfoLambda", func(map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("no video track")
+		})
+		execution, err = w.run(t, "IngestWorkflow", ingest())
+		assert.ErrorContains(t, err, "no video track")
+		assert.Equal(t, 1, execution.Step("MediaInfo").Attempts)
+	})
+
+	t.Run("Lifecycle failures don't fail the workflow", func(t *testing.T) {
+		w := newWorkflows(t)
+		w.handle("LifecycleEventsLambda", func(map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("PutEvents failed")
+		})
+		execution, err := w.run(t, "IngestWorkflow", ingest())
+		require.NoError(t, err)
+		assert.EqualError(t, execution.Step("Lifecycle (Ingested)").Error, "PutEvents failed")
+	})
+}
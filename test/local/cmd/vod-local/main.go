@@ -0,0 +1,100 @@
+// Command vod-local uploads a source to the local runner, runs the Ingest,
+// Process and Publish workflows and prints the states each execution went
+// through and the workflow record:
+//
+//	go generate ./... && go run ./cmd/vod-local -file video.mp4 -env EnableMediaPackage=true
+//
+// Handler logs go to stderr, the summary to stdout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"local"
+)
+
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	return fmt.Sprint(map[string]string(e))
+}
+
+func (e envFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not NAME=VALUE", value)
+	}
+	e[name] = v
+	return nil
+}
+
+func main() {
+	env := envFlag{}
+	file := flag.String("file", "", "source to upload; a placeholder when empty")
+	key := flag.String("key", "", "source key, the base name of -file by default")
+	reprocess := flag.Bool("reprocess", false, "reprocess the asset once it is published")
+	flag.Var(env, "env", "handler environment override NAME=VALUE, repeatable")
+	flag.Parse()
+
+	body := []byte("placeholder source written by vod-local\n")
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatalf("vod-local: ReadFile: %v", err)
+		}
+		body = data
+	}
+	if *key == "" {
+		*key = "video.mp4"
+		if *file != "" {
+			*key = filepath.Base(*file)
+		}
+	}
+
+	ctx := context.Background()
+	runner, err := local.New(local.Config{Env: env})
+	if err != nil {
+		log.Fatalf("vod-local: %v", err)
+	}
+	if err := runner.Upload(ctx, *key, body, nil); err != nil {
+		log.Fatalf("vod-local: %v", err)
+	}
+	runErr := runner.Run(ctx)
+
+	executions := runner.Executions()
+	if *reprocess && runErr == nil && len(executions) > 0 {
+		if err := runner.Reprocess(ctx, fmt.Sprint(executions[0].Input["guid"]), ""); err != nil {
+			log.Fatalf("vod-local: %v", err)
+		}
+		runErr = runner.Run(ctx)
+		executions = runner.Executions()
+	}
+
+	for _, execution := range executions {
+		fmt.Printf("%s %s\n", execution.Status, execution.Arn)
+		for _, state := range execution.States {
+			fmt.Printf("  %s\n", state)
+		}
+		if execution.Error != nil {
+			fmt.Printf("  error: %v\n", execution.Error)
+		}
+	}
+
+	if len(executions) > 0 {
+		if record, err := runner.Record(fmt.Sprint(executions[0].Input["guid"])); err == nil {
+			data, _ := json.MarshalIndent(record, "", "  ")
+			fmt.Printf("%s\n", data)
+		}
+	}
+
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
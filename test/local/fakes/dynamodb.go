@@ -0,0 +1,392 @@
+package fakes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Index is a global secondary index. Items without its keys are left out of
+// it, like a sparse index.
+type Index struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+type table struct {
+	hashKey  string
+	rangeKey string
+	indexes  map[string]Index
+	items    map[string]map[string]*dynamodb.AttributeValue
+}
+
+// DynamoDB keeps tables in memory. Items are copied in and out, so callers
+// never share them with the table.
+type DynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]*table
+}
+
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{tables: map[string]*table{}}
+}
+
+// CreateTable adds a table keyed on hashKey, and rangeKey unless it is "".
+func (d *DynamoDB) CreateTable(name, hashKey, rangeKey string, indexes ...Index) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t := &table{
+		hashKey:  hashKey,
+		rangeKey: rangeKey,
+		indexes:  map[string]Index{},
+		items:    map[string]map[string]*dynamodb.AttributeValue{},
+	}
+	for _, index := range indexes {
+		t.indexes[index.Name] = index
+	}
+	d.tables[name] = t
+}
+
+// Item returns a copy of the item with the given hash key, for tests.
+func (d *DynamoDB) Item(tableName, hashKey string) map[string]*dynamodb.AttributeValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tables[tableName]
+	if !ok {
+		return nil
+	}
+	for _, item := range t.items {
+		if aws.StringValue(item[t.hashKey].S) == hashKey {
+			return cloneItem(item)
+		}
+	}
+	return nil
+}
+
+// Items returns a copy of every item of a table, for tests.
+func (d *DynamoDB) Items(tableName string) []map[string]*dynamodb.AttributeValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tables[tableName]
+	if !ok {
+		return nil
+	}
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(t.items))
+	for _, id := range sortedIds(t.items) {
+		items = append(items, cloneItem(t.items[id]))
+	}
+	return items
+}
+
+func (d *DynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, id, err := d.keyOf(input.TableName, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	item, ok := t.items[id]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: cloneItem(project(item, input.ProjectionExpression, input.ExpressionAttributeNames))}, nil
+}
+
+func (d *DynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	put := &dynamodb.Put{
+		TableName:                 input.TableName,
+		Item:                      input.Item,
+		ConditionExpression:       input.ConditionExpression,
+		ExpressionAttributeNames:  input.ExpressionAttributeNames,
+		ExpressionAttributeValues: input.ExpressionAttributeValues,
+	}
+	apply, err := d.preparePut(put)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *DynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	update := &dynamodb.Update{
+		TableName:                 input.TableName,
+		Key:                       input.Key,
+		UpdateExpression:          input.UpdateExpression,
+		ConditionExpression:       input.ConditionExpression,
+		ExpressionAttributeNames:  input.ExpressionAttributeNames,
+		ExpressionAttributeValues: input.ExpressionAttributeValues,
+	}
+	apply, err := d.prepareUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	item := apply()
+
+	output := &dynamodb.UpdateItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllNew {
+		output.Attributes = cloneItem(item)
+	}
+	return output, nil
+}
+
+func (d *DynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, id, err := d.keyOf(input.TableName, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := evaluateCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, t.items[id])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionalCheckFailed()
+	}
+	delete(t.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// TransactWriteItems checks every condition before writing anything, and
+// cancels the whole transaction when one fails.
+func (d *DynamoDB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var applies []func()
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	canceled := false
+	for i, transactItem := range input.TransactItems {
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+
+		var err error
+		switch {
+		case transactItem.Put != nil:
+			var apply func()
+			apply, err = d.preparePut(transactItem.Put)
+			applies = append(applies, apply)
+		case transactItem.Update != nil:
+			var apply func() map[string]*dynamodb.AttributeValue
+			apply, err = d.prepareUpdate(transactItem.Update)
+			applies = append(applies, func() { apply() })
+		case transactItem.ConditionCheck != nil:
+			check := transactItem.ConditionCheck
+			var t *table
+			var id string
+			t, id, err = d.keyOf(check.TableName, check.Key)
+			if err == nil {
+				var ok bool
+				ok, err = evaluateCondition(check.ConditionExpression, check.ExpressionAttributeNames, check.ExpressionAttributeValues, t.items[id])
+				if err == nil && !ok {
+					err = conditionalCheckFailed()
+				}
+			}
+		default:
+			err = validationError("unsupported transact item %d", i)
+		}
+
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String("ConditionalCheckFailed"), Message: aws.String(aerr.Message())}
+			canceled = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if canceled {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+			CancellationReasons: reasons,
+		}
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// Query scans the table or index for the items matching the key condition,
+// in range key order, then applies the filter. Limit counts the items read
+// before filtering, like DynamoDB.
+func (d *DynamoDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tables[aws.StringValue(input.TableName)]
+	if !ok {
+		return nil, resourceNotFound(aws.StringValue(input.TableName))
+	}
+	hashKey, rangeKey := t.hashKey, t.rangeKey
+	if name := aws.StringValue(input.IndexName); name != "" {
+		index, ok := t.indexes[name]
+		if !ok {
+			return nil, validationError("the table does not have the specified index: %s", name)
+		}
+		hashKey, rangeKey = index.HashKey, index.RangeKey
+	}
+
+	var matches []map[string]*dynamodb.AttributeValue
+	for _, id := range sortedIds(t.items) {
+		item := t.items[id]
+		if item[hashKey] == nil || (rangeKey != "" && item[rangeKey] == nil) {
+			continue
+		}
+		ok, err := evaluateCondition(input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, item)
+		}
+	}
+
+	if rangeKey != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return compare(matches[i][rangeKey], matches[j][rangeKey], "<")
+		})
+	}
+	if input.ScanIndexForward != nil && !*input.ScanIndexForward {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+
+	if input.ExclusiveStartKey != nil {
+		start := t.id(input.ExclusiveStartKey)
+		for i, item := range matches {
+			if t.id(item) == start {
+				matches = matches[i+1:]
+				break
+			}
+		}
+	}
+
+	output := &dynamodb.QueryOutput{}
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+		last := matches[limit-1]
+		output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{t.hashKey: cloneValue(last[t.hashKey])}
+		if t.rangeKey != "" {
+			output.LastEvaluatedKey[t.rangeKey] = cloneValue(last[t.rangeKey])
+		}
+	}
+
+	for _, item := range matches {
+		ok, err := evaluateCondition(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			output.Items = append(output.Items, cloneItem(project(item, input.ProjectionExpression, input.ExpressionAttributeNames)))
+		}
+	}
+	output.Count = aws.Int64(int64(len(output.Items)))
+	output.ScannedCount = aws.Int64(int64(len(matches)))
+	return output, nil
+}
+
+func (d *DynamoDB) preparePut(put *dynamodb.Put) (func(), error) {
+	t, id, err := d.keyOf(put.TableName, put.Item)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := evaluateCondition(put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues, t.items[id])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionalCheckFailed()
+	}
+
+	item := cloneItem(put.Item)
+	return func() { t.items[id] = item }, nil
+}
+
+// prepareUpdate checks the condition and applies the update to a copy, so a
+// failed transaction leaves the item untouched.
+func (d *DynamoDB) prepareUpdate(update *dynamodb.Update) (func() map[string]*dynamodb.AttributeValue, error) {
+	t, id, err := d.keyOf(update.TableName, update.Key)
+	if err != nil {
+		return nil, err
+	}
+	current := t.items[id]
+	ok, err := evaluateCondition(update.ConditionExpression, update.ExpressionAttributeNames, update.ExpressionAttributeValues, current)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionalCheckFailed()
+	}
+
+	item := cloneItem(current)
+	if item == nil {
+		item = cloneItem(update.Key)
+	}
+	if err := applyUpdate(aws.StringValue(update.UpdateExpression), update.ExpressionAttributeNames, update.ExpressionAttributeValues, item); err != nil {
+		return nil, err
+	}
+	return func() map[string]*dynamodb.AttributeValue {
+		t.items[id] = item
+		return item
+	}, nil
+}
+
+func (d *DynamoDB) keyOf(tableName *string, key map[string]*dynamodb.AttributeValue) (*table, string, error) {
+	t, ok := d.tables[aws.StringValue(tableName)]
+	if !ok {
+		return nil, "", resourceNotFound(aws.StringValue(tableName))
+	}
+	if key[t.hashKey] == nil || (t.rangeKey != "" && key[t.rangeKey] == nil) {
+		return nil, "", validationError("the provided key element does not match the schema")
+	}
+	return t, t.id(key), nil
+}
+
+// id identifies an item by its key attributes.
+func (t *table) id(item map[string]*dynamodb.AttributeValue) string {
+	key := []*dynamodb.AttributeValue{item[t.hashKey]}
+	if t.rangeKey != "" {
+		key = append(key, item[t.rangeKey])
+	}
+	id, _ := json.Marshal(key)
+	return string(id)
+}
+
+func sortedIds(items map[string]map[string]*dynamodb.AttributeValue) []string {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func resourceNotFound(name string) error {
+	return awserr.New(dynamodb.ErrCodeResourceNotFoundException, fmt.Sprintf("Requested resource not found: Table: %s not found", name), nil)
+}
@@ -0,0 +1,116 @@
+package fakes
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamoDB(t *testing.T) {
+	newTable := func() *DynamoDB {
+		d := NewDynamoDB()
+		d.CreateTable("records", "guid", "", Index{Name: "status-index", HashKey: "status", RangeKey: "startTime"})
+		for _, item := range []map[string]*dynamodb.AttributeValue{
+			{"guid": {S: aws.String("a")}, "status": {S: aws.String("Complete")}, "startTime": {S: aws.String("2")}, "version": {N: aws.String("1")}},
+			{"guid": {S: aws.String("b")}, "status": {S: aws.String("Complete")}, "startTime": {S: aws.String("1")}},
+			{"guid": {S: aws.String("c")}, "status": {S: aws.String("Error")}, "startTime": {S: aws.String("3")}},
+		} {
+			_, err := d.PutItem(&dynamodb.PutItemInput{TableName: aws.String("records"), Item: item})
+			require.NoError(t, err)
+		}
+		return d
+	}
+
+	t.Run("UpdateItem applies SET and REMOVE under a condition", func(t *testing.T) {
+		d := newTable()
+		output, err := d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:           aws.String("records"),
+			Key:                 map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("a")}},
+			ConditionExpression: aws.String("#version = :expected"),
+			UpdateExpression:    aws.String("SET #version = #version + :one, #links = list_append(if_not_exists(#links, :empty), :link) REMOVE #status"),
+			ExpressionAttributeNames: map[string]*string{
+				"#version": aws.String("version"),
+				"#links":   aws.String("links"),
+				"#status":  aws.String("status"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":expected": {N: aws.String("1")},
+				":one":      {N: aws.String("1")},
+				":empty":    {L: []*dynamodb.AttributeValue{}},
+				":link":     {L: []*dynamodb.AttributeValue{{S: aws.String("x")}}},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "2", aws.StringValue(output.Attributes["version"].N))
+		assert.Len(t, output.Attributes["links"].L, 1)
+		assert.NotContains(t, output.Attributes, "status")
+	})
+
+	t.Run("UpdateItem fails a false condition", func(t *testing.T) {
+		d := newTable()
+		_, err := d.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String("records"),
+			Key:                       map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("b")}},
+			ConditionExpression:       aws.String("attribute_exists(version)"),
+			UpdateExpression:          aws.String("SET #status = :status"),
+			ExpressionAttributeNames:  map[string]*string{"#status": aws.String("status")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":status": {S: aws.String("Ingest")}},
+		})
+		var aerr awserr.Error
+		require.ErrorAs(t, err, &aerr)
+		assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, aerr.Code())
+		assert.Equal(t, "Complete", aws.StringValue(d.Item("records", "b")["status"].S))
+	})
+
+	t.Run("Query reads an index in range key order with a filter", func(t *testing.T) {
+		d := newTable()
+		output, err := d.Query(&dynamodb.QueryInput{
+			TableName:                aws.String("records"),
+			IndexName:                aws.String("status-index"),
+			KeyConditionExpression:   aws.String("#status = :status"),
+			FilterExpression:         aws.String("#guid <> :skip"),
+			ExpressionAttributeNames: map[string]*string{"#status": aws.String("status"), "#guid": aws.String("guid")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status": {S: aws.String("Complete")},
+				":skip":   {S: aws.String("none")},
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, output.Items, 2)
+		assert.Equal(t, "b", aws.StringValue(output.Items[0]["guid"].S))
+		assert.Equal(t, "a", aws.StringValue(output.Items[1]["guid"].S))
+	})
+
+	t.Run("TransactWriteItems writes nothing when a condition fails", func(t *testing.T) {
+		d := newTable()
+		_, err := d.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Put: &dynamodb.Put{
+					TableName: aws.String("records"),
+					Item:      map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("d")}},
+				}},
+				{Update: &dynamodb.Update{
+					TableName:           aws.String("records"),
+					Key:                 map[string]*dynamodb.AttributeValue{"guid": {S: aws.String("c")}},
+					ConditionExpression: aws.String("attribute_exists(version)"),
+					UpdateExpression:    aws.String("SET #status = :status"),
+					ExpressionAttributeNames: map[string]*string{
+						"#status": aws.String("status"),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":status": {S: aws.String("Complete")},
+					},
+				}},
+			},
+		})
+		var canceled *dynamodb.TransactionCanceledException
+		require.ErrorAs(t, err, &canceled)
+		assert.Equal(t, "ConditionalCheckFailed", aws.StringValue(canceled.CancellationReasons[1].Code))
+		assert.Nil(t, d.Item("records", "d"))
+	})
+}
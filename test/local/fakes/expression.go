@@ -0,0 +1,626 @@
+package fakes
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The expression support covers what the services send: conditions with
+// comparisons, AND, OR, NOT, IN, BETWEEN, attribute_exists,
+// attribute_not_exists and begins_with, and update expressions with SET
+// (including if_not_exists, list_append, + and -) and REMOVE.
+
+type token struct {
+	kind  string // "name", "value", "ident", "number" or the punctuation itself
+	value string
+}
+
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expression); {
+		c := rune(expression[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || c == ':' || unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(expression) && (unicode.IsLetter(rune(expression[j])) || unicode.IsDigit(rune(expression[j])) || expression[j] == '_') {
+				j++
+			}
+			kind := "ident"
+			switch c {
+			case '#':
+				kind = "name"
+			case ':':
+				kind = "value"
+			}
+			tokens = append(tokens, token{kind, expression[i:j]})
+			i = j
+		case unicode.IsDigit(c):
+			j := i + 1
+			for j < len(expression) && unicode.IsDigit(rune(expression[j])) {
+				j++
+			}
+			tokens = append(tokens, token{"number", expression[i:j]})
+			i = j
+		default:
+			op := punctuation(expression[i:])
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{op, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func punctuation(expression string) string {
+	for _, op := range []string{"<>", "<=", ">=", "=", "<", ">", "(", ")", ",", ".", "[", "]", "+", "-"} {
+		if strings.HasPrefix(expression, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	item   map[string]*dynamodb.AttributeValue
+}
+
+func newParser(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) (*parser, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, validationError("%s: %v", expression, err)
+	}
+	return &parser{tokens: tokens, names: names, values: values, item: item}, nil
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == "ident" && strings.EqualFold(t.value, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind string) (token, error) {
+	t := p.peek()
+	if t.kind != kind {
+		return t, validationError("expected %q, found %q", kind, t.value)
+	}
+	p.pos++
+	return t, nil
+}
+
+// evaluateCondition reports whether item matches expression. An empty
+// expression always matches.
+func evaluateCondition(expression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if aws.StringValue(expression) == "" {
+		return true, nil
+	}
+
+	p, err := newParser(*expression, names, values, item)
+	if err != nil {
+		return false, err
+	}
+	result, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if p.pos != len(p.tokens) {
+		return false, validationError("%s: unexpected %q", *expression, p.peek().value)
+	}
+	return result, nil
+}
+
+func (p *parser) or() (bool, error) {
+	result, err := p.and()
+	if err != nil {
+		return false, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return false, err
+		}
+		result = result || right
+	}
+	return result, nil
+}
+
+func (p *parser) and() (bool, error) {
+	result, err := p.not()
+	if err != nil {
+		return false, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return false, err
+		}
+		result = result && right
+	}
+	return result, nil
+}
+
+func (p *parser) not() (bool, error) {
+	if p.keyword("NOT") {
+		result, err := p.not()
+		return !result, err
+	}
+	return p.predicate()
+}
+
+func (p *parser) predicate() (bool, error) {
+	if p.peek().kind == "(" {
+		p.pos++
+		result, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return result, nil
+	}
+
+	if t := p.peek(); t.kind == "ident" && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == "(" {
+		switch strings.ToLower(t.value) {
+		case "attribute_exists", "attribute_not_exists":
+			p.pos += 2
+			value, err := p.path()
+			if err != nil {
+				return false, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return false, err
+			}
+			return (value != nil) == (strings.ToLower(t.value) == "attribute_exists"), nil
+		case "begins_with":
+			p.pos += 2
+			value, err := p.operand()
+			if err != nil {
+				return false, err
+			}
+			if _, err := p.expect(","); err != nil {
+				return false, err
+			}
+			prefix, err := p.operand()
+			if err != nil {
+				return false, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return false, err
+			}
+			return value != nil && value.S != nil && prefix != nil && prefix.S != nil && strings.HasPrefix(*value.S, *prefix.S), nil
+		}
+		return false, validationError("unsupported function %s", t.value)
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case p.keyword("BETWEEN"):
+		low, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		if !p.keyword("AND") {
+			return false, validationError("BETWEEN without AND")
+		}
+		high, err := p.operand()
+		if err != nil {
+			return false, err
+		}
+		return compare(left, low, ">=") && compare(left, high, "<="), nil
+	case p.keyword("IN"):
+		if _, err := p.expect("("); err != nil {
+			return false, err
+		}
+		found := false
+		for {
+			value, err := p.operand()
+			if err != nil {
+				return false, err
+			}
+			found = found || compare(left, value, "=")
+			if p.peek().kind != "," {
+				break
+			}
+			p.pos++
+		}
+		if _, err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return found, nil
+	}
+
+	op := p.peek().kind
+	switch op {
+	case "=", "<>", "<", "<=", ">", ">=":
+		p.pos++
+	default:
+		return false, validationError("expected a comparison, found %q", p.peek().value)
+	}
+	right, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	return compare(left, right, op), nil
+}
+
+// operand is a value placeholder or an attribute path; a missing attribute
+// is nil.
+func (p *parser) operand() (*dynamodb.AttributeValue, error) {
+	if t := p.peek(); t.kind == "value" {
+		p.pos++
+		value, ok := p.values[t.value]
+		if !ok {
+			return nil, validationError("value %s is not defined", t.value)
+		}
+		return value, nil
+	}
+	return p.path()
+}
+
+// pathElements parses an attribute path into map keys (string) and list
+// indexes (int).
+func (p *parser) pathElements() ([]interface{}, error) {
+	var elements []interface{}
+	for {
+		t := p.peek()
+		switch t.kind {
+		case "name":
+			name, ok := p.names[t.value]
+			if !ok {
+				return nil, validationError("name %s is not defined", t.value)
+			}
+			elements = append(elements, aws.StringValue(name))
+		case "ident":
+			elements = append(elements, t.value)
+		default:
+			return nil, validationError("expected an attribute, found %q", t.value)
+		}
+		p.pos++
+
+		for p.peek().kind == "[" {
+			p.pos++
+			index, err := p.expect("number")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n, _ := strconv.Atoi(index.value)
+			elements = append(elements, n)
+		}
+
+		if p.peek().kind != "." {
+			return elements, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *parser) path() (*dynamodb.AttributeValue, error) {
+	elements, err := p.pathElements()
+	if err != nil {
+		return nil, err
+	}
+	return lookup(p.item, elements), nil
+}
+
+func lookup(item map[string]*dynamodb.AttributeValue, elements []interface{}) *dynamodb.AttributeValue {
+	current := &dynamodb.AttributeValue{M: item}
+	for _, element := range elements {
+		switch e := element.(type) {
+		case string:
+			if current.M == nil {
+				return nil
+			}
+			current = current.M[e]
+		case int:
+			if e >= len(current.L) {
+				return nil
+			}
+			current = current.L[e]
+		}
+		if current == nil {
+			return nil
+		}
+	}
+	return current
+}
+
+// compare compares two attribute values. Numbers compare by value, strings
+// lexically; nil (a missing attribute) only satisfies <>.
+func compare(left, right *dynamodb.AttributeValue, op string) bool {
+	if left == nil || right == nil {
+		return op == "<>" && (left == nil) != (right == nil)
+	}
+
+	var order int
+	switch {
+	case left.N != nil && right.N != nil:
+		l, _ := new(big.Float).SetString(*left.N)
+		r, _ := new(big.Float).SetString(*right.N)
+		if l == nil || r == nil {
+			return false
+		}
+		order = l.Cmp(r)
+	case left.S != nil && right.S != nil:
+		order = strings.Compare(*left.S, *right.S)
+	default:
+		equal := reflect.DeepEqual(left, right)
+		switch op {
+		case "=":
+			return equal
+		case "<>":
+			return !equal
+		}
+		return false
+	}
+
+	switch op {
+	case "=":
+		return order == 0
+	case "<>":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+// applyUpdate applies an update expression to item in place.
+func applyUpdate(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) error {
+	p, err := newParser(expression, names, values, item)
+	if err != nil {
+		return err
+	}
+
+	for p.pos < len(p.tokens) {
+		switch {
+		case p.keyword("SET"):
+			for {
+				elements, err := p.pathElements()
+				if err != nil {
+					return err
+				}
+				if _, err := p.expect("="); err != nil {
+					return err
+				}
+				value, err := p.setValue()
+				if err != nil {
+					return err
+				}
+				if err := assign(item, elements, value); err != nil {
+					return err
+				}
+				if p.peek().kind != "," {
+					break
+				}
+				p.pos++
+			}
+		case p.keyword("REMOVE"):
+			for {
+				elements, err := p.pathElements()
+				if err != nil {
+					return err
+				}
+				remove(item, elements)
+				if p.peek().kind != "," {
+					break
+				}
+				p.pos++
+			}
+		default:
+			return validationError("%s: unsupported clause %q", expression, p.peek().value)
+		}
+	}
+	return nil
+}
+
+// setValue is the right-hand side of a SET action.
+func (p *parser) setValue() (*dynamodb.AttributeValue, error) {
+	left, err := p.setOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek().kind
+	if op != "+" && op != "-" {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.setOperand()
+	if err != nil {
+		return nil, err
+	}
+	if left == nil || right == nil || left.N == nil || right.N == nil {
+		return nil, validationError("%s needs two numbers", op)
+	}
+	l, _ := new(big.Float).SetString(*left.N)
+	r, _ := new(big.Float).SetString(*right.N)
+	if op == "+" {
+		l.Add(l, r)
+	} else {
+		l.Sub(l, r)
+	}
+	return &dynamodb.AttributeValue{N: aws.String(l.Text('f', -1))}, nil
+}
+
+func (p *parser) setOperand() (*dynamodb.AttributeValue, error) {
+	t := p.peek()
+	if t.kind != "ident" || p.pos+1 >= len(p.tokens) || p.tokens[p.pos+1].kind != "(" {
+		return p.operand()
+	}
+
+	p.pos += 2
+	var result *dynamodb.AttributeValue
+	switch strings.ToLower(t.value) {
+	case "if_not_exists":
+		current, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(","); err != nil {
+			return nil, err
+		}
+		fallback, err := p.setValue()
+		if err != nil {
+			return nil, err
+		}
+		result = current
+		if result == nil {
+			result = fallback
+		}
+	case "list_append":
+		first, err := p.setValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(","); err != nil {
+			return nil, err
+		}
+		second, err := p.setValue()
+		if err != nil {
+			return nil, err
+		}
+		if first == nil || second == nil || first.L == nil || second.L == nil {
+			return nil, validationError("list_append needs two lists")
+		}
+		result = &dynamodb.AttributeValue{L: append(append([]*dynamodb.AttributeValue{}, first.L...), second.L...)}
+	default:
+		return nil, validationError("unsupported function %s", t.value)
+	}
+
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func assign(item map[string]*dynamodb.AttributeValue, elements []interface{}, value *dynamodb.AttributeValue) error {
+	if value == nil {
+		return validationError("SET of a missing attribute")
+	}
+	value = cloneValue(value)
+
+	parent := lookup(item, elements[:len(elements)-1])
+	if parent == nil {
+		return validationError("the document path provided in the update expression is invalid for update")
+	}
+	switch e := elements[len(elements)-1].(type) {
+	case string:
+		if parent.M == nil {
+			return validationError("the document path provided in the update expression is invalid for update")
+		}
+		parent.M[e] = value
+	case int:
+		switch {
+		case e < len(parent.L):
+			parent.L[e] = value
+		default:
+			parent.L = append(parent.L, value)
+		}
+	}
+	return nil
+}
+
+func remove(item map[string]*dynamodb.AttributeValue, elements []interface{}) {
+	parent := lookup(item, elements[:len(elements)-1])
+	if parent == nil {
+		return
+	}
+	switch e := elements[len(elements)-1].(type) {
+	case string:
+		delete(parent.M, e)
+	case int:
+		if e < len(parent.L) {
+			parent.L = append(parent.L[:e], parent.L[e+1:]...)
+		}
+	}
+}
+
+// project keeps the top-level attributes of a projection expression.
+func project(item map[string]*dynamodb.AttributeValue, expression *string, names map[string]*string) map[string]*dynamodb.AttributeValue {
+	if aws.StringValue(expression) == "" {
+		return item
+	}
+
+	projected := map[string]*dynamodb.AttributeValue{}
+	for _, path := range strings.Split(*expression, ",") {
+		name := strings.TrimSpace(strings.SplitN(strings.SplitN(path, ".", 2)[0], "[", 2)[0])
+		if strings.HasPrefix(name, "#") {
+			name = aws.StringValue(names[name])
+		}
+		if value, ok := item[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected
+}
+
+func cloneValue(value *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if value == nil {
+		return nil
+	}
+	clone := *value
+	if value.M != nil {
+		clone.M = cloneItem(value.M)
+	}
+	if value.L != nil {
+		clone.L = make([]*dynamodb.AttributeValue, len(value.L))
+		for i, element := range value.L {
+			clone.L[i] = cloneValue(element)
+		}
+	}
+	return &clone
+}
+
+func cloneItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	clone := make(map[string]*dynamodb.AttributeValue, len(item))
+	for key, value := range item {
+		clone[key] = cloneValue(value)
+	}
+	return clone
+}
+
+func validationError(format string, args ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, args...), nil)
+}
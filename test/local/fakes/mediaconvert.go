@@ -0,0 +1,361 @@
+package fakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/mediaconvert"
+)
+
+// MediaConvert stands in for the service: it does not transcode, it writes
+// a small placeholder for every file a job would produce into the S3 fake
+// and queues the COMPLETE event EventBridge would deliver.
+type MediaConvert struct {
+	mu        sync.Mutex
+	s3        *S3
+	templates map[string]*mediaconvert.JobTemplate
+	jobs      []*mediaconvert.CreateJobInput
+	statuses  map[string]string
+	completed []events.EventBridgeEvent
+
+	// Region and AccountId are used in the job ARN and the event
+	Region    string
+	AccountId string
+}
+
+func NewMediaConvert(s3 *S3) *MediaConvert {
+	return &MediaConvert{
+		s3:        s3,
+		templates: map[string]*mediaconvert.JobTemplate{},
+		statuses:  map[string]string{},
+		Region:    "us-east-1",
+		AccountId: "123456789012",
+	}
+}
+
+// SetJobTemplate registers a template by name. A name that was not
+// registered gets DefaultJobTemplate.
+func (f *MediaConvert) SetJobTemplate(template *mediaconvert.JobTemplate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.templates[aws.StringValue(template.Name)] = template
+}
+
+// DefaultJobTemplate has the MP4, HLS, DASH and CMAF groups of the stack's
+// templates with two renditions each.
+func DefaultJobTemplate(name string) *mediaconvert.JobTemplate {
+	renditions := func(container string) []*mediaconvert.Output {
+		return []*mediaconvert.Output{
+			{NameModifier: aws.String("_1080p"), ContainerSettings: &mediaconvert.ContainerSettings{Container: aws.String(container)}},
+			{NameModifier: aws.String("_720p"), ContainerSettings: &mediaconvert.ContainerSettings{Container: aws.String(container)}},
+		}
+	}
+	group := func(name, groupType, container string) *mediaconvert.OutputGroup {
+		return &mediaconvert.OutputGroup{
+			Name:                aws.String(name),
+			OutputGroupSettings: &mediaconvert.OutputGroupSettings{Type: aws.String(groupType)},
+			Outputs:             renditions(container),
+		}
+	}
+
+	return &mediaconvert.JobTemplate{
+		Name: aws.String(name),
+		Arn:  aws.String("arn:aws:mediaconvert:us-east-1:123456789012:jobTemplates/" + name),
+		Settings: &mediaconvert.JobTemplateSettings{
+			OutputGroups: []*mediaconvert.OutputGroup{
+				group("File Group", "FILE_GROUP_SETTINGS", "MP4"),
+				group("Apple HLS", "HLS_GROUP_SETTINGS", "M3U8"),
+				group("DASH ISO", "DASH_ISO_GROUP_SETTINGS", "MPD"),
+				group("CMAF", "CMAF_GROUP_SETTINGS", "CMFC"),
+			},
+		},
+	}
+}
+
+func (f *MediaConvert) GetJobTemplate(input *mediaconvert.GetJobTemplateInput) (*mediaconvert.GetJobTemplateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.StringValue(input.Name)
+	if name == "" {
+		return nil, awserr.New(mediaconvert.ErrCodeBadRequestException, "name is required", nil)
+	}
+	template, ok := f.templates[name]
+	if !ok {
+		template = DefaultJobTemplate(name)
+	}
+	return &mediaconvert.GetJobTemplateOutput{JobTemplate: template}, nil
+}
+
+// CreateJob writes the outputs at once and queues the COMPLETE event.
+func (f *MediaConvert) CreateJob(input *mediaconvert.CreateJobInput) (*mediaconvert.CreateJobOutput, error) {
+	if input.Settings == nil || len(input.Settings.Inputs) == 0 {
+		return nil, awserr.New(mediaconvert.ErrCodeBadRequestException, "job has no inputs", nil)
+	}
+	source := aws.StringValue(input.Settings.Inputs[0].FileInput)
+	if _, _, err := splitS3Uri(source); err != nil {
+		return nil, awserr.New(mediaconvert.ErrCodeBadRequestException, err.Error(), nil)
+	}
+	base := strings.TrimSuffix(path.Base(source), path.Ext(source))
+
+	var details []*groupDetail
+	for _, group := range input.Settings.OutputGroups {
+		detail, err := f.writeGroup(group, base)
+		if err != nil {
+			return nil, awserr.New(mediaconvert.ErrCodeBadRequestException, err.Error(), nil)
+		}
+		details = append(details, detail)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.jobs = append(f.jobs, input)
+	id := fmt.Sprintf("%d-local%06d", time.Now().Unix(), len(f.jobs))
+	arn := fmt.Sprintf("arn:aws:mediaconvert:%s:%s:jobs/%s", f.Region, f.AccountId, id)
+
+	detail, err := json.Marshal(map[string]interface{}{
+		"timestamp":          time.Now().UnixMilli(),
+		"accountId":          f.AccountId,
+		"queue":              fmt.Sprintf("arn:aws:mediaconvert:%s:%s:queues/Default", f.Region, f.AccountId),
+		"jobId":              id,
+		"status":             "COMPLETE",
+		"userMetadata":       aws.StringValueMap(input.UserMetadata),
+		"outputGroupDetails": details,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	f.statuses[id] = accelerationStatus(input.AccelerationSettings)
+	f.completed = append(f.completed, events.EventBridgeEvent{
+		Version:    "0",
+		ID:         fmt.Sprintf("local-%s", id),
+		DetailType: "MediaConvert Job State Change",
+		Source:     "aws.mediaconvert",
+		AccountID:  f.AccountId,
+		Time:       time.Now().UTC(),
+		Region:     f.Region,
+		Resources:  []string{arn},
+		Detail:     detail,
+	})
+
+	return &mediaconvert.CreateJobOutput{
+		Job: &mediaconvert.Job{
+			Id:           aws.String(id),
+			Arn:          aws.String(arn),
+			Status:       aws.String(mediaconvert.JobStatusSubmitted),
+			Role:         input.Role,
+			JobTemplate:  input.JobTemplate,
+			UserMetadata: input.UserMetadata,
+			Settings:     input.Settings,
+			CreatedAt:    aws.Time(time.Now().UTC()),
+		},
+	}, nil
+}
+
+// GetJob reports the acceleration status of a submitted job.
+func (f *MediaConvert) GetJob(input *mediaconvert.GetJobInput) (*mediaconvert.GetJobOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, ok := f.statuses[aws.StringValue(input.Id)]
+	if !ok {
+		return nil, awserr.New(mediaconvert.ErrCodeNotFoundException, fmt.Sprintf("job %s not found", aws.StringValue(input.Id)), nil)
+	}
+	return &mediaconvert.GetJobOutput{
+		Job: &mediaconvert.Job{Id: input.Id, AccelerationStatus: aws.String(status)},
+	}, nil
+}
+
+// accelerationStatus is the status MediaConvert would report: an ENABLED job
+// is accelerated, and a PREFERRED one is not, since the placeholder sources
+// are too short to be.
+func accelerationStatus(settings *mediaconvert.AccelerationSettings) string {
+	if settings == nil {
+		return mediaconvert.AccelerationStatusNotApplicable
+	}
+	switch aws.StringValue(settings.Mode) {
+	case mediaconvert.AccelerationModeEnabled:
+		return mediaconvert.AccelerationStatusAccelerated
+	case mediaconvert.AccelerationModePreferred:
+		return mediaconvert.AccelerationStatusNotAccelerated
+	}
+	return mediaconvert.AccelerationStatusNotApplicable
+}
+
+// Jobs returns the submitted jobs, for tests.
+func (f *MediaConvert) Jobs() []*mediaconvert.CreateJobInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*mediaconvert.CreateJobInput{}, f.jobs...)
+}
+
+// Completed returns the COMPLETE events queued since the last call.
+func (f *MediaConvert) Completed() []events.EventBridgeEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	completed := f.completed
+	f.completed = nil
+	return completed
+}
+
+type groupDetail struct {
+	OutputDetails     []*outputDetail `json:"outputDetails"`
+	PlaylistFilePaths []string        `json:"playlistFilePaths,omitempty"`
+	Type              string          `json:"type"`
+}
+
+type outputDetail struct {
+	OutputFilePaths []string `json:"outputFilePaths"`
+	DurationInMs    int64    `json:"durationInMs"`
+}
+
+// writeGroup writes the files of one output group the way MediaConvert
+// names them: the source name plus each output's name modifier under the
+// group destination.
+func (f *MediaConvert) writeGroup(group *mediaconvert.OutputGroup, base string) (*groupDetail, error) {
+	settings := group.OutputGroupSettings
+	if settings == nil {
+		return nil, fmt.Errorf("output group %s has no settings", aws.StringValue(group.Name))
+	}
+
+	var destination, detailType string
+	var playlists []string
+	switch aws.StringValue(settings.Type) {
+	case mediaconvert.OutputGroupTypeFileGroupSettings:
+		destination, detailType = fileDestination(settings.FileGroupSettings), "FILE_GROUP"
+	case mediaconvert.OutputGroupTypeHlsGroupSettings:
+		destination, detailType = hlsDestination(settings.HlsGroupSettings), "HLS_GROUP"
+		playlists = []string{".m3u8"}
+	case mediaconvert.OutputGroupTypeDashIsoGroupSettings:
+		destination, detailType = dashDestination(settings.DashIsoGroupSettings), "DASH_ISO_GROUP"
+		playlists = []string{".mpd"}
+	case mediaconvert.OutputGroupTypeCmafGroupSettings:
+		destination, detailType = cmafDestination(settings.CmafGroupSettings), "CMAF_GROUP"
+		playlists = []string{".mpd", ".m3u8"}
+	case mediaconvert.OutputGroupTypeMsSmoothGroupSettings:
+		destination, detailType = mssDestination(settings.MsSmoothGroupSettings), "MS_SMOOTH_GROUP"
+		playlists = []string{".ism"}
+	default:
+		return nil, fmt.Errorf("output group type %s is not supported", aws.StringValue(settings.Type))
+	}
+
+	bucket, prefix, err := splitS3Uri(destination)
+	if err != nil {
+		return nil, fmt.Errorf("output group %s: %w", aws.StringValue(group.Name), err)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	detail := &groupDetail{Type: detailType}
+	for _, extension := range playlists {
+		key := prefix + base + extension
+		f.s3.Put(bucket, key, []byte(placeholder(key)), contentType(extension), nil)
+		detail.PlaylistFilePaths = append(detail.PlaylistFilePaths, fmt.Sprintf("s3://%s/%s", bucket, key))
+	}
+	for _, output := range group.Outputs {
+		name := base + aws.StringValue(output.NameModifier)
+		var keys []string
+		// the event names the first file of an output, or the last capture
+		reported := 0
+		switch detailType {
+		case "FILE_GROUP":
+			if output.ContainerSettings != nil && aws.StringValue(output.ContainerSettings.Container) == mediaconvert.ContainerTypeRaw {
+				keys = []string{prefix + name + ".0000000.jpg", prefix + name + ".0000001.jpg"}
+				reported = len(keys) - 1
+			} else {
+				keys = []string{prefix + name + ".mp4"}
+			}
+		case "HLS_GROUP":
+			keys = []string{prefix + name + ".m3u8", prefix + name + "_00001.ts"}
+		case "DASH_ISO_GROUP":
+			keys = []string{prefix + name + ".mp4"}
+		case "CMAF_GROUP":
+			keys = []string{prefix + name + ".m3u8", prefix + name + ".cmfv"}
+		case "MS_SMOOTH_GROUP":
+			keys = []string{prefix + name + ".ismv"}
+		}
+
+		for _, key := range keys {
+			f.s3.Put(bucket, key, []byte(placeholder(key)), contentType(path.Ext(key)), nil)
+		}
+		detail.OutputDetails = append(detail.OutputDetails, &outputDetail{
+			OutputFilePaths: []string{fmt.Sprintf("s3://%s/%s", bucket, keys[reported])},
+			DurationInMs:    10000,
+		})
+	}
+	return detail, nil
+}
+
+func fileDestination(settings *mediaconvert.FileGroupSettings) string {
+	if settings == nil {
+		return ""
+	}
+	return aws.StringValue(settings.Destination)
+}
+
+func hlsDestination(settings *mediaconvert.HlsGroupSettings) string {
+	if settings == nil {
+		return ""
+	}
+	return aws.StringValue(settings.Destination)
+}
+
+func dashDestination(settings *mediaconvert.DashIsoGroupSettings) string {
+	if settings == nil {
+		return ""
+	}
+	return aws.StringValue(settings.Destination)
+}
+
+func cmafDestination(settings *mediaconvert.CmafGroupSettings) string {
+	if settings == nil {
+		return ""
+	}
+	return aws.StringValue(settings.Destination)
+}
+
+func mssDestination(settings *mediaconvert.MsSmoothGroupSettings) string {
+	if settings == nil {
+		return ""
+	}
+	return aws.StringValue(settings.Destination)
+}
+
+func splitS3Uri(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", fmt.Errorf("%q is not an s3:// location", uri)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket", uri)
+	}
+	return bucket, key, nil
+}
+
+func placeholder(key string) string {
+	return fmt.Sprintf("placeholder for %s written by the local MediaConvert\n", key)
+}
+
+func contentType(extension string) string {
+	switch extension {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".mp4", ".cmfv", ".ismv":
+		return "video/mp4"
+	case ".ts":
+		return "video/MP2T"
+	case ".jpg":
+		return "image/jpeg"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,110 @@
+package fakes
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SNS records published messages.
+type SNS struct {
+	mu       sync.Mutex
+	messages []*sns.PublishInput
+}
+
+func NewSNS() *SNS {
+	return &SNS{}
+}
+
+func (f *SNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.messages = append(f.messages, input)
+	return &sns.PublishOutput{MessageId: aws.String(fmt.Sprintf("sns-%d", len(f.messages)))}, nil
+}
+
+// Messages returns everything published so far.
+func (f *SNS) Messages() []*sns.PublishInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*sns.PublishInput{}, f.messages...)
+}
+
+// SQS records sent messages.
+type SQS struct {
+	mu       sync.Mutex
+	messages []*sqs.SendMessageInput
+}
+
+func NewSQS() *SQS {
+	return &SQS{}
+}
+
+func (f *SQS) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.messages = append(f.messages, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String(fmt.Sprintf("sqs-%d", len(f.messages)))}, nil
+}
+
+// ChangeMessageVisibility accepts any receipt handle: the fake does not
+// deliver messages, so there is no visibility to change.
+func (f *SQS) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// Messages returns everything sent so far.
+func (f *SQS) Messages() []*sqs.SendMessageInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*sqs.SendMessageInput{}, f.messages...)
+}
+
+// EventBridge records put events.
+type EventBridge struct {
+	mu      sync.Mutex
+	entries []*eventbridge.PutEventsRequestEntry
+}
+
+func NewEventBridge() *EventBridge {
+	return &EventBridge{}
+}
+
+func (f *EventBridge) PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	for _, entry := range input.Entries {
+		f.entries = append(f.entries, entry)
+		output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{
+			EventId: aws.String(fmt.Sprintf("event-%d", len(f.entries))),
+		})
+	}
+	return output, nil
+}
+
+// Entries returns every event put so far.
+func (f *EventBridge) Entries() []*eventbridge.PutEventsRequestEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*eventbridge.PutEventsRequestEntry{}, f.entries...)
+}
+
+// DetailTypes returns the detail type of every event put so far, in order.
+func (f *EventBridge) DetailTypes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	types := []string{}
+	for _, entry := range f.entries {
+		types = append(types, aws.StringValue(entry.DetailType))
+	}
+	return types
+}
@@ -0,0 +1,232 @@
+package fakes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object is an object stored in the S3 fake.
+type Object struct {
+	Body         []byte
+	ContentType  string
+	Metadata     map[string]string
+	Tags         map[string]string
+	StorageClass string
+	LastModified time.Time
+}
+
+// ETag is the quoted MD5 of the body, as for a single part upload.
+func (o *Object) ETag() string {
+	sum := md5.Sum(o.Body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// S3 keeps objects in memory. Buckets exist as soon as they are written to.
+type S3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*Object
+}
+
+func NewS3() *S3 {
+	return &S3{buckets: map[string]map[string]*Object{}}
+}
+
+// Put stores an object. Metadata keys are canonicalized like the SDK does
+// with the x-amz-meta- headers it reads back.
+func (f *S3) Put(bucket, key string, body []byte, contentType string, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	canonical := map[string]string{}
+	for name, value := range metadata {
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = map[string]*Object{}
+	}
+	f.buckets[bucket][key] = &Object{
+		Body:         append([]byte{}, body...),
+		ContentType:  contentType,
+		Metadata:     canonical,
+		StorageClass: s3.StorageClassStandard,
+		LastModified: time.Now().UTC(),
+	}
+}
+
+// Object returns the object at bucket/key, or nil, for tests.
+func (f *S3) Object(bucket, key string) *Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buckets[bucket][key]
+}
+
+// Keys lists the keys under prefix in order, for tests.
+func (f *S3) Keys(bucket, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys(bucket, prefix)
+}
+
+func (f *S3) keys(bucket, prefix string) []string {
+	keys := []string{}
+	for key := range f.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *S3) get(bucket, key *string) (*Object, error) {
+	object, ok := f.buckets[aws.StringValue(bucket)][aws.StringValue(key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil), http.StatusNotFound, "")
+	}
+	return object, nil
+}
+
+func (f *S3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, err := f.get(input.Bucket, input.Key)
+	if err != nil {
+		// HEAD responses have no body, so the code is the status text
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.Body))),
+		ContentType:   aws.String(object.ContentType),
+		ETag:          aws.String(object.ETag()),
+		LastModified:  aws.Time(object.LastModified),
+		Metadata:      aws.StringMap(object.Metadata),
+		StorageClass:  aws.String(object.StorageClass),
+	}, nil
+}
+
+func (f *S3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, err := f.get(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(object.Body)),
+		ContentLength: aws.Int64(int64(len(object.Body))),
+		ContentType:   aws.String(object.ContentType),
+		ETag:          aws.String(object.ETag()),
+		LastModified:  aws.Time(object.LastModified),
+		Metadata:      aws.StringMap(object.Metadata),
+	}, nil
+}
+
+func (f *S3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if input.Body != nil {
+		var err error
+		if body, err = io.ReadAll(input.Body); err != nil {
+			return nil, fmt.Errorf("ReadAll: %w", err)
+		}
+	}
+	f.Put(aws.StringValue(input.Bucket), aws.StringValue(input.Key), body, aws.StringValue(input.ContentType), aws.StringValueMap(input.Metadata))
+
+	object := f.Object(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	return &s3.PutObjectOutput{ETag: aws.String(object.ETag())}, nil
+}
+
+func (f *S3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.buckets[aws.StringValue(input.Bucket)], aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *S3) PutObjectTagging(input *s3.PutObjectTaggingInput) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, err := f.get(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	object.Tags = map[string]string{}
+	for _, tag := range input.Tagging.TagSet {
+		object.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+// ListObjects returns every match in one page.
+func (f *S3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	contents, prefixes := f.list(aws.StringValue(input.Bucket), aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter))
+	return &s3.ListObjectsOutput{
+		Name:           input.Bucket,
+		Prefix:         input.Prefix,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+		IsTruncated:    aws.Bool(false),
+	}, nil
+}
+
+// ListObjectsV2 returns every match in one page.
+func (f *S3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	contents, prefixes := f.list(aws.StringValue(input.Bucket), aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter))
+	return &s3.ListObjectsV2Output{
+		Name:           input.Bucket,
+		Prefix:         input.Prefix,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+		KeyCount:       aws.Int64(int64(len(contents))),
+		IsTruncated:    aws.Bool(false),
+	}, nil
+}
+
+func (f *S3) list(bucket, prefix, delimiter string) ([]*s3.Object, []*s3.CommonPrefix) {
+	contents := []*s3.Object{}
+	var prefixes []*s3.CommonPrefix
+	seen := map[string]bool{}
+	for _, key := range f.keys(bucket, prefix) {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					prefixes = append(prefixes, &s3.CommonPrefix{Prefix: aws.String(common)})
+				}
+				continue
+			}
+		}
+
+		object := f.buckets[bucket][key]
+		contents = append(contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.Body))),
+			ETag:         aws.String(object.ETag()),
+			LastModified: aws.Time(object.LastModified),
+			StorageClass: aws.String(object.StorageClass),
+		})
+	}
+	return contents, prefixes
+}
@@ -0,0 +1,242 @@
+package fakes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/mediapackagevod"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// MediaPackageVod keeps assets by ID and returns an HLS, DASH and CMAF
+// egress endpoint for each under Domain.
+type MediaPackageVod struct {
+	mu     sync.Mutex
+	assets map[string]*mediapackagevod.CreateAssetInput
+
+	// Domain is the packaging group domain, GroupDomainName in the stack
+	Domain string
+}
+
+func NewMediaPackageVod() *MediaPackageVod {
+	return &MediaPackageVod{
+		assets: map[string]*mediapackagevod.CreateAssetInput{},
+		Domain: "https://local.egress.mediapackage-vod.us-east-1.amazonaws.com",
+	}
+}
+
+func (f *MediaPackageVod) CreateAsset(input *mediapackagevod.CreateAssetInput) (*mediapackagevod.CreateAssetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(input.Id)
+	if _, ok := f.assets[id]; ok {
+		return nil, awserr.New(mediapackagevod.ErrCodeUnprocessableEntityException, fmt.Sprintf("asset %s already exists", id), nil)
+	}
+	f.assets[id] = input
+
+	var endpoints []*mediapackagevod.EgressEndpoint
+	for _, config := range []string{"hls", "dash", "cmaf"} {
+		endpoints = append(endpoints, &mediapackagevod.EgressEndpoint{
+			PackagingConfigurationId: aws.String(fmt.Sprintf("%s-%s", aws.StringValue(input.PackagingGroupId), config)),
+			Status:                   aws.String("PLAYABLE"),
+			Url:                      aws.String(fmt.Sprintf("%s/out/v1/%s/%s/index", f.Domain, id, config)),
+		})
+	}
+	return &mediapackagevod.CreateAssetOutput{
+		Id:               input.Id,
+		PackagingGroupId: input.PackagingGroupId,
+		ResourceId:       input.ResourceId,
+		SourceArn:        input.SourceArn,
+		EgressEndpoints:  endpoints,
+		Tags:             input.Tags,
+	}, nil
+}
+
+func (f *MediaPackageVod) DeleteAsset(input *mediapackagevod.DeleteAssetInput) (*mediapackagevod.DeleteAssetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(input.Id)
+	if _, ok := f.assets[id]; !ok {
+		return nil, awserr.New(mediapackagevod.ErrCodeNotFoundException, fmt.Sprintf("asset %s not found", id), nil)
+	}
+	delete(f.assets, id)
+	return &mediapackagevod.DeleteAssetOutput{}, nil
+}
+
+// Asset returns the asset with id, or nil, for tests.
+func (f *MediaPackageVod) Asset(id string) *mediapackagevod.CreateAssetInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.assets[id]
+}
+
+// CloudFront records invalidations. They are InProgress when created and
+// Completed the first time they are looked up, so a workflow goes through
+// its wait loop once.
+type CloudFront struct {
+	mu            sync.Mutex
+	invalidations []*cloudfront.Invalidation
+	references    map[string]*cloudfront.Invalidation
+}
+
+func NewCloudFront() *CloudFront {
+	return &CloudFront{references: map[string]*cloudfront.Invalidation{}}
+}
+
+// CreateInvalidation is idempotent on the caller reference, like the service.
+func (f *CloudFront) CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reference := aws.StringValue(input.DistributionId) + "/" + aws.StringValue(input.InvalidationBatch.CallerReference)
+	invalidation, ok := f.references[reference]
+	if !ok {
+		invalidation = &cloudfront.Invalidation{
+			Id:                aws.String(fmt.Sprintf("I%013d", len(f.invalidations)+1)),
+			CreateTime:        aws.Time(time.Now().UTC()),
+			Status:            aws.String("InProgress"),
+			InvalidationBatch: input.InvalidationBatch,
+		}
+		f.invalidations = append(f.invalidations, invalidation)
+		f.references[reference] = invalidation
+	}
+	return &cloudfront.CreateInvalidationOutput{Invalidation: invalidation}, nil
+}
+
+func (f *CloudFront) GetInvalidation(input *cloudfront.GetInvalidationInput) (*cloudfront.GetInvalidationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, invalidation := range f.invalidations {
+		if aws.StringValue(invalidation.Id) == aws.StringValue(input.Id) {
+			invalidation.Status = aws.String("Completed")
+			return &cloudfront.GetInvalidationOutput{Invalidation: invalidation}, nil
+		}
+	}
+	return nil, awserr.New(cloudfront.ErrCodeNoSuchInvalidation, "The specified invalidation does not exist.", nil)
+}
+
+// Paths returns the paths of every invalidation, in order.
+func (f *CloudFront) Paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	paths := []string{}
+	for _, invalidation := range f.invalidations {
+		paths = append(paths, aws.StringValueSlice(invalidation.InvalidationBatch.Paths.Items)...)
+	}
+	return paths
+}
+
+// SecretsManager returns the secrets it was given.
+type SecretsManager struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func NewSecretsManager() *SecretsManager {
+	return &SecretsManager{secrets: map[string]string{}}
+}
+
+// Set stores value under id.
+func (f *SecretsManager) Set(id, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[id] = value
+}
+
+func (f *SecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	value, ok := f.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "Secrets Manager can't find the specified secret.", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{ARN: input.SecretId, SecretString: aws.String(value)}, nil
+}
+
+// Request is an HTTP request the HTTP fake received.
+type Request struct {
+	Method string
+	Url    string
+	Header http.Header
+	Body   []byte
+}
+
+// HTTP answers every request with Status and records it, so webhooks are
+// delivered without a network.
+type HTTP struct {
+	mu       sync.Mutex
+	requests []Request
+
+	Status int
+}
+
+func NewHTTP() *HTTP {
+	return &HTTP{Status: http.StatusOK}
+}
+
+func (f *HTTP) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("ReadAll: %w", err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, Request{
+		Method: req.Method,
+		Url:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   body,
+	})
+	return &http.Response{
+		Status:     http.StatusText(f.Status),
+		StatusCode: f.Status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}, nil
+}
+
+// Requests returns every request received so far.
+func (f *HTTP) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Request{}, f.requests...)
+}
+
+// Resolver resolves the hosts in Hosts to their addresses and every other
+// host to Default, a public address, so callback URLs are checked without a
+// network.
+type Resolver struct {
+	Hosts   map[string][]net.IP
+	Default net.IP
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{Hosts: map[string][]net.IP{}, Default: net.ParseIP("203.0.113.10")}
+}
+
+func (f *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ips, ok := f.Hosts[host]; ok {
+		return ips, nil
+	}
+	return []net.IP{f.Default}, nil
+}
@@ -0,0 +1,88 @@
+package fakes
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sfn"
+)
+
+// Execution is a started state machine execution.
+type Execution struct {
+	Arn             string
+	Name            string
+	StateMachineArn string
+	Input           string
+	StartDate       time.Time
+}
+
+// SFN queues started executions for the runner instead of running them.
+type SFN struct {
+	mu         sync.Mutex
+	executions map[string]*Execution
+	pending    []*Execution
+}
+
+func NewSFN() *SFN {
+	return &SFN{executions: map[string]*Execution{}}
+}
+
+// StartExecution rejects a name that was used before on the same state
+// machine with ExecutionAlreadyExists, which the step-functions handler
+// treats as a duplicate delivery.
+func (f *SFN) StartExecution(input *sfn.StartExecutionInput) (*sfn.StartExecutionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stateMachineArn := aws.StringValue(input.StateMachineArn)
+	if stateMachineArn == "" {
+		return nil, awserr.New(sfn.ErrCodeInvalidArn, "stateMachineArn is required", nil)
+	}
+	name := aws.StringValue(input.Name)
+	arn := fmt.Sprintf("%s:%s", executionPrefix(stateMachineArn), name)
+	if _, ok := f.executions[arn]; ok {
+		return nil, awserr.New(sfn.ErrCodeExecutionAlreadyExists, fmt.Sprintf("Execution Already Exists: '%s'", arn), nil)
+	}
+
+	execution := &Execution{
+		Arn:             arn,
+		Name:            name,
+		StateMachineArn: stateMachineArn,
+		Input:           aws.StringValue(input.Input),
+		StartDate:       time.Now().UTC(),
+	}
+	f.executions[arn] = execution
+	f.pending = append(f.pending, execution)
+
+	return &sfn.StartExecutionOutput{
+		ExecutionArn: aws.String(arn),
+		StartDate:    aws.Time(execution.StartDate),
+	}, nil
+}
+
+// ListExecutions returns nothing: executions the runner drained are done.
+func (f *SFN) ListExecutions(input *sfn.ListExecutionsInput) (*sfn.ListExecutionsOutput, error) {
+	return &sfn.ListExecutionsOutput{Executions: []*sfn.ExecutionListItem{}}, nil
+}
+
+// Next removes and returns the oldest execution that has not run, or nil.
+func (f *SFN) Next() *Execution {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.pending) == 0 {
+		return nil
+	}
+	execution := f.pending[0]
+	f.pending = f.pending[1:]
+	return execution
+}
+
+// executionPrefix turns arn:...:stateMachine:Name into arn:...:execution:Name.
+func executionPrefix(stateMachineArn string) string {
+	return strings.Replace(stateMachineArn, ":stateMachine:", ":execution:", 1)
+}
@@ -0,0 +1,132 @@
+// Command gen copies the workflow services into importable packages under
+// internal/services, so the runner can call their handlers in-process. Every
+// service is a package main in its own module, which Go does not let another
+// module import; the copies are the same sources with the package clause
+// renamed. Run it with go generate after changing a service.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// services are the handlers the Ingest, Process and Publish workflows run.
+var services = []string{
+	"archive-source",
+	"cdn-invalidation",
+	"dynamo",
+	"encode",
+	"input-validate",
+	"lifecycle-events",
+	"media-package-assets",
+	"output-validate",
+	"profiler",
+	"sns-notification",
+	"sqs-publish",
+	"step-functions",
+	"webhook-notification",
+}
+
+// configExport is added to the copies that load a Config, which the runner
+// reads from the environment it sets.
+const configExport = `// LoadConfig is how the local runner reads the handler's settings. Values
+// kept in SSM Parameter Store are not supported locally.
+func LoadConfig(config *Config) error {
+	return envconfig.Load(config, nil)
+}
+`
+
+// exports are added to the copies whose Handler has unexported fields.
+var exports = map[string]string{
+	"sns-notification": `// NewHandler is how the local runner builds the handler, whose config and
+// clients are unexported.
+func NewHandler(config Config, snsClient SNSClient, s3Client S3Client) *Handler {
+	return &Handler{config: config, snsClient: snsClient, s3Client: s3Client}
+}
+`,
+}
+
+var (
+	packageClause = regexp.MustCompile(`(?m)^package main$`)
+	configType    = regexp.MustCompile(`(?m)^type Config struct`)
+)
+
+func main() {
+	root := filepath.Join("..", "..", "services")
+	out := filepath.Join("internal", "services")
+
+	if err := os.RemoveAll(out); err != nil {
+		log.Fatalf("gen: RemoveAll: %v", err)
+	}
+	for _, service := range services {
+		if err := copyService(filepath.Join(root, service), filepath.Join(out, packageName(service)), service); err != nil {
+			log.Fatalf("gen: %s: %v", service, err)
+		}
+	}
+}
+
+// packageName is the service name without dashes: input-validate is
+// package inputvalidate.
+func packageName(service string) string {
+	return strings.ReplaceAll(service, "-", "")
+}
+
+func copyService(src, dst, service string) error {
+	files, err := filepath.Glob(filepath.Join(src, "*.go"))
+	if err != nil {
+		return fmt.Errorf("Glob: %w", err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Go files in %s", src)
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("MkdirAll: %w", err)
+	}
+
+	header := fmt.Sprintf("// Code generated by internal/gen from services/%s; DO NOT EDIT.\n\n", service)
+	clause := "package " + packageName(service)
+	hasConfig := false
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("ReadFile: %w", err)
+		}
+		if !packageClause.Match(source) {
+			return fmt.Errorf("%s is not in package main", file)
+		}
+		source = packageClause.ReplaceAll(source, []byte(clause))
+		hasConfig = hasConfig || configType.Match(source)
+
+		if err := os.WriteFile(filepath.Join(dst, filepath.Base(file)), append([]byte(header), source...), 0o644); err != nil {
+			return fmt.Errorf("WriteFile: %w", err)
+		}
+	}
+
+	var imports, local []string
+	if hasConfig {
+		imports = append(imports, `"shared/envconfig"`)
+		local = append(local, configExport)
+	}
+	if export, ok := exports[service]; ok {
+		local = append(local, export)
+	}
+	if len(local) > 0 {
+		source := header + clause + "\n\n"
+		if len(imports) > 0 {
+			source += "import (\n\t" + strings.Join(imports, "\n\t") + "\n)\n\n"
+		}
+		source += strings.Join(local, "\n")
+		if err := os.WriteFile(filepath.Join(dst, "local.go"), []byte(source), 0o644); err != nil {
+			return fmt.Errorf("WriteFile: %w", err)
+		}
+	}
+	return nil
+}
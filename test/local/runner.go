@@ -0,0 +1,448 @@
+// Package local runs the Ingest, Process and Publish workflows in-process,
+// calling the service handlers in the order of the state machines against
+// in-memory fakes of the AWS services they use. It is for tests and for
+// debugging a workflow without an AWS account; the state machine
+// definitions themselves are not read, see workflows.go.
+//
+// The handlers read their configuration from the environment, so a Runner
+// sets process environment variables and only one Runner may be used at a
+// time.
+//
+// The handlers are copies of the service sources made by internal/gen; run
+// go generate after changing a service.
+package local
+
+//go:generate go run ./internal/gen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"local/fakes"
+	"local/internal/services/archivesource"
+	"local/internal/services/cdninvalidation"
+	"local/internal/services/dynamo"
+	"local/internal/services/encode"
+	"local/internal/services/inputvalidate"
+	"local/internal/services/lifecycleevents"
+	"local/internal/services/mediapackageassets"
+	"local/internal/services/outputvalidate"
+	"local/internal/services/profiler"
+	"local/internal/services/snsnotification"
+	"local/internal/services/sqspublish"
+	"local/internal/services/stepfunctions"
+	"local/internal/services/webhooknotification"
+)
+
+const (
+	stateMachinePrefix = "arn:aws:states:us-east-1:123456789012:stateMachine:"
+	ingestWorkflow     = stateMachinePrefix + "vod-local-ingest"
+	processWorkflow    = stateMachinePrefix + "vod-local-process"
+	publishWorkflow    = stateMachinePrefix + "vod-local-publish"
+)
+
+// defaultEnv is the configuration the stack gives the functions, with the
+// defaults of the template parameters.
+var defaultEnv = map[string]string{
+	"AWS_REGION":                  "us-east-1",
+	"AWS_LAMBDA_FUNCTION_NAME":    "vod-local-archive-source",
+	"WorkflowName":                "vod-local",
+	"Source":                      "vod-local-source",
+	"Destination":                 "vod-local-destination",
+	"CloudFront":                  "d1234567890.cloudfront.net",
+	"DistributionId":              "ELOCAL1234567",
+	"InvalidateSegments":          "false",
+	"InvalidationBatchSize":       "1000",
+	"InvalidationMaxChecks":       "20",
+	"DynamoDBTable":               "vod-local",
+	"HistoryTable":                "vod-local-history",
+	"CostTable":                   "vod-local-costs",
+	"StateBucket":                 "vod-local-state",
+	"ClaimCheckThreshold":         "32768",
+	"FrameCapture":                "false",
+	"ArchiveSource":               "DISABLED",
+	"MediaConvert_Template_2160p": "vod-local_Ott_2160p_Avc_Aac_16x9_qvbr_no_preset",
+	"MediaConvert_Template_1080p": "vod-local_Ott_1080p_Avc_Aac_16x9_qvbr_no_preset",
+	"MediaConvert_Template_720p":  "vod-local_Ott_720p_Avc_Aac_16x9_qvbr_no_preset",
+	"MediaConvertRole":            "arn:aws:iam::123456789012:role/vod-local-mediaconvert",
+	"InputRotate":                 "DEGREE_0",
+	"AcceleratedTranscoding":      "PREFERRED",
+	"DuplicatePolicy":             "PROCEED",
+	"SourceRetention":             "KEEP",
+	"SourceRetentionDays":         "30",
+	"EnableSns":                   "true",
+	"SnsTopic":                    "arn:aws:sns:us-east-1:123456789012:vod-local-notifications",
+	"EnableSqs":                   "true",
+	"SqsQueue":                    "https://sqs.us-east-1.amazonaws.com/123456789012/vod-local",
+	"SqsMessageSchema":            "record",
+	"EnableMediaPackage":          "false",
+	"GroupId":                     "vod-local-packaging-group",
+	"GroupDomainName":             "https://local.egress.mediapackage-vod.us-east-1.amazonaws.com",
+	"MediaPackageVodRole":         "arn:aws:iam::123456789012:role/vod-local-mediapackage",
+	"LifecycleEventBus":           "vod-local-lifecycle",
+	"EventSource":                 "video-on-demand",
+	"WebhookUrls":                 "",
+	"WebhookSecretArn":            "arn:aws:secretsmanager:us-east-1:123456789012:secret:vod-local-webhook",
+	"WebhookMaxAttempts":          "1",
+	"IngestWorkflow":              ingestWorkflow,
+	"ProcessWorkflow":             processWorkflow,
+	"PublishWorkflow":             publishWorkflow,
+	"MaxConcurrentWorkflows":      "0",
+}
+
+// Config changes how the workflows run.
+type Config struct {
+	// Env overrides the environment the handlers read, e.g. "EnableSns" or
+	// "DuplicatePolicy", on top of the stack defaults.
+	Env map[string]string
+
+	// MediaInfo returns the srcMediainfo the MediaInfo function would
+	// report for a source, which the profiler picks the encoding profile
+	// from. A 1920x1080 H.264 source when nil.
+	MediaInfo func(bucket, key string) (string, error)
+}
+
+// Runner holds the fakes and the handlers wired to them. The fakes are
+// exported so tests can seed and inspect them.
+type Runner struct {
+	S3              *fakes.S3
+	DynamoDB        *fakes.DynamoDB
+	SNS             *fakes.SNS
+	SQS             *fakes.SQS
+	EventBridge     *fakes.EventBridge
+	MediaConvert    *fakes.MediaConvert
+	MediaPackageVod *fakes.MediaPackageVod
+	CloudFront      *fakes.CloudFront
+	SecretsManager  *fakes.SecretsManager
+	HTTP            *fakes.HTTP
+	Resolver        *fakes.Resolver
+	SFN             *fakes.SFN
+
+	env        map[string]string
+	mediaInfo  func(bucket, key string) (string, error)
+	executions []*Execution
+	sequencer  int
+
+	archiveSource      *archivesource.Handler
+	cdnInvalidation    *cdninvalidation.Handler
+	dynamo             *dynamo.Handler
+	encode             *encode.Handler
+	inputValidate      *inputvalidate.Handler
+	lifecycleEvents    *lifecycleevents.Handler
+	mediaPackageAssets *mediapackageassets.Handler
+	outputValidate     *outputvalidate.Handler
+	profiler           *profiler.Handler
+	snsNotification    *snsnotification.Handler
+	sqsPublish         *sqspublish.Handler
+	stepFunctions      *stepfunctions.Handler
+	webhook            *webhooknotification.Handler
+}
+
+// New creates the fakes, the workflow tables and the handlers, sets the
+// environment and loads the handlers' config from it.
+func New(config Config) (*Runner, error) {
+	env := map[string]string{}
+	for name, value := range defaultEnv {
+		env[name] = value
+	}
+	for name, value := range config.Env {
+		env[name] = value
+	}
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			return nil, fmt.Errorf("local: New: Setenv: %w", err)
+		}
+	}
+
+	r := &Runner{
+		S3:              fakes.NewS3(),
+		DynamoDB:        fakes.NewDynamoDB(),
+		SNS:             fakes.NewSNS(),
+		SQS:             fakes.NewSQS(),
+		EventBridge:     fakes.NewEventBridge(),
+		MediaPackageVod: fakes.NewMediaPackageVod(),
+		CloudFront:      fakes.NewCloudFront(),
+		SecretsManager:  fakes.NewSecretsManager(),
+		HTTP:            fakes.NewHTTP(),
+		Resolver:        fakes.NewResolver(),
+		SFN:             fakes.NewSFN(),
+		env:             env,
+		mediaInfo:       config.MediaInfo,
+	}
+	r.MediaConvert = fakes.NewMediaConvert(r.S3)
+	r.SecretsManager.Set(env["WebhookSecretArn"], "vod-local-webhook-secret")
+	r.MediaPackageVod.Domain = env["GroupDomainName"]
+	if r.mediaInfo == nil {
+		r.mediaInfo = defaultMediaInfo
+	}
+
+	r.DynamoDB.CreateTable(env["DynamoDBTable"], "guid", "",
+		fakes.Index{Name: "srcBucket-startTime-index", HashKey: "srcBucket", RangeKey: "startTime"},
+		fakes.Index{Name: "workflowStatus-startTime-index", HashKey: "workflowStatus", RangeKey: "startTime"},
+		fakes.Index{Name: "srcVideo-startTime-index", HashKey: "srcVideo", RangeKey: "startTime"},
+		fakes.Index{Name: "contentHash-startTime-index", HashKey: "contentHash", RangeKey: "startTime"},
+		fakes.Index{Name: "retentionPolicy-retentionDueAt-index", HashKey: "retentionPolicy", RangeKey: "retentionDueAt"},
+	)
+	r.DynamoDB.CreateTable(env["HistoryTable"], "guid", "version")
+	r.DynamoDB.CreateTable(env["CostTable"], "month", "jobId")
+
+	var snsConfig snsnotification.Config
+	r.archiveSource = &archivesource.Handler{S3Client: r.S3}
+	r.cdnInvalidation = &cdninvalidation.Handler{DynamoDBClient: r.DynamoDB, S3Client: r.S3, CloudFrontClient: r.CloudFront}
+	r.dynamo = &dynamo.Handler{DynamoDBClient: r.DynamoDB, S3Client: r.S3}
+	r.encode = &encode.Handler{MediaConvertClient: r.MediaConvert, S3Client: r.S3}
+	r.inputValidate = &inputvalidate.Handler{S3Client: r.S3, DynamoDBClient: r.DynamoDB, Resolver: r.Resolver}
+	r.lifecycleEvents = &lifecycleevents.Handler{EventBridgeClient: r.EventBridge}
+	r.mediaPackageAssets = &mediapackageassets.Handler{MediaPackageVodClient: r.MediaPackageVod}
+	r.outputValidate = &outputvalidate.Handler{DynamoDBClient: r.DynamoDB, S3Client: r.S3, MediaConvertClient: r.MediaConvert}
+	r.profiler = &profiler.Handler{DynamoDBClient: r.DynamoDB}
+	r.sqsPublish = &sqspublish.Handler{SqsClient: r.SQS, S3Client: r.S3}
+	r.stepFunctions = &stepfunctions.Handler{StepFunctionClient: r.SFN, SQSClient: r.SQS}
+	r.webhook = &webhooknotification.Handler{DynamoDBClient: r.DynamoDB, SecretsManagerClient: r.SecretsManager, HTTPClient: r.HTTP}
+
+	// Each handler reads its settings as it would at cold start, so an
+	// invalid Env fails here rather than in the workflow
+	configs := []struct {
+		service string
+		load    func() error
+	}{
+		{"archive-source", func() error { return archivesource.LoadConfig(&r.archiveSource.Config) }},
+		{"cdn-invalidation", func() error { return cdninvalidation.LoadConfig(&r.cdnInvalidation.Config) }},
+		{"dynamo", func() error { return dynamo.LoadConfig(&r.dynamo.Config) }},
+		{"encode", func() error { return encode.LoadConfig(&r.encode.Config) }},
+		{"input-validate", func() error { return inputvalidate.LoadConfig(&r.inputValidate.Config) }},
+		{"lifecycle-events", func() error { return lifecycleevents.LoadConfig(&r.lifecycleEvents.Config) }},
+		{"media-package-assets", func() error { return mediapackageassets.LoadConfig(&r.mediaPackageAssets.Config) }},
+		{"output-validate", func() error { return outputvalidate.LoadConfig(&r.outputValidate.Config) }},
+		{"profiler", func() error { return profiler.LoadConfig(&r.profiler.Config) }},
+		{"sns-notification", func() error { return snsnotification.LoadConfig(&snsConfig) }},
+		{"sqs-publish", func() error { return sqspublish.LoadConfig(&r.sqsPublish.Config) }},
+		{"step-functions", func() error { return stepfunctions.LoadConfig(&r.stepFunctions.Config) }},
+		{"webhook-notification", func() error { return webhooknotification.LoadConfig(&r.webhook.Config) }},
+	}
+	for _, config := range configs {
+		if err := config.load(); err != nil {
+			return nil, fmt.Errorf("local: New: %s: %w", config.service, err)
+		}
+	}
+	r.snsNotification = snsnotification.NewHandler(snsConfig, r.SNS, r.S3)
+
+	return r, nil
+}
+
+// Env returns the value the handlers read for name.
+func (r *Runner) Env(name string) string {
+	return r.env[name]
+}
+
+// Upload puts a source in the source bucket, with metadata as the
+// x-amz-meta- headers, and delivers the S3 notification to the
+// step-functions handler, which starts the Ingest workflow. Call Run to
+// run it.
+func (r *Runner) Upload(ctx context.Context, key string, body []byte, metadata map[string]string) error {
+	bucket := r.env["Source"]
+	r.S3.Put(bucket, key, body, "video/mp4", metadata)
+	object := r.S3.Object(bucket, key)
+
+	r.sequencer++
+	record := events.S3EventRecord{
+		EventVersion: "2.1",
+		EventSource:  "aws:s3",
+		AWSRegion:    r.env["AWS_REGION"],
+		EventTime:    time.Now().UTC(),
+		EventName:    "ObjectCreated:Put",
+		S3: events.S3Entity{
+			SchemaVersion: "1.0",
+			Bucket: events.S3Bucket{
+				Name: bucket,
+				Arn:  "arn:aws:s3:::" + bucket,
+			},
+			Object: events.S3Object{
+				// S3 notifications URL encode keys, with spaces as '+'
+				Key:       strings.ReplaceAll(url.QueryEscape(key), "%2F", "/"),
+				Size:      int64(len(object.Body)),
+				ETag:      strings.Trim(object.ETag(), `"`),
+				Sequencer: fmt.Sprintf("%016X", r.sequencer),
+			},
+		},
+	}
+
+	return r.trigger(ctx, map[string]interface{}{"Records": []events.S3EventRecord{record}})
+}
+
+// Reprocess starts the Process workflow for an ingested asset, as the
+// asset API does, with jobTemplate overriding the profiler's choice when it
+// is not empty.
+func (r *Runner) Reprocess(ctx context.Context, guid, jobTemplate string) error {
+	r.sequencer++
+	event := map[string]interface{}{
+		"guid":      guid,
+		"requestId": fmt.Sprintf("local-reprocess-%d", r.sequencer),
+	}
+	if jobTemplate != "" {
+		event["jobTemplate"] = jobTemplate
+	}
+	return r.trigger(ctx, event)
+}
+
+// Run runs the executions that were started, and the Publish executions
+// the completed MediaConvert jobs start, until there is nothing left. A
+// failed execution does not stop the others; the failures are returned
+// together.
+func (r *Runner) Run(ctx context.Context) error {
+	var errs []error
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if next := r.SFN.Next(); next != nil {
+			execution := r.run(ctx, next)
+			if execution.Error != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", execution.Arn, execution.Error))
+			}
+			continue
+		}
+
+		completed := r.MediaConvert.Completed()
+		if len(completed) == 0 {
+			return errors.Join(errs...)
+		}
+		for _, event := range completed {
+			// EventBridge delivers the job state change to the step-functions
+			// function, which starts the Publish workflow
+			var general map[string]interface{}
+			if err := remarshal(event, &general); err != nil {
+				return fmt.Errorf("local: Runner.Run: %w", err)
+			}
+			if err := r.trigger(ctx, general); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+}
+
+// Executions returns every execution run so far, in order.
+func (r *Runner) Executions() []*Execution {
+	return append([]*Execution{}, r.executions...)
+}
+
+// Record returns the workflow record of guid, decoded as JSON would be.
+func (r *Runner) Record(guid string) (map[string]interface{}, error) {
+	item := r.DynamoDB.Item(r.env["DynamoDBTable"], guid)
+	if item == nil {
+		return nil, fmt.Errorf("local: Runner.Record: %s not found", guid)
+	}
+	var record map[string]interface{}
+	if err := unmarshalItem(item, &record); err != nil {
+		return nil, fmt.Errorf("local: Runner.Record: %w", err)
+	}
+	return record, nil
+}
+
+func (r *Runner) trigger(ctx context.Context, event map[string]interface{}) error {
+	if _, err := r.stepFunctions.HandleRequest(ctx, event); err != nil {
+		return fmt.Errorf("local: step-functions: %w", err)
+	}
+	return nil
+}
+
+func (r *Runner) run(ctx context.Context, started *fakes.Execution) *Execution {
+	execution := &Execution{
+		Arn:          started.Arn,
+		StateMachine: strings.TrimPrefix(started.StateMachineArn, stateMachinePrefix),
+		StartTime:    started.StartDate,
+		Status:       StatusRunning,
+	}
+	r.executions = append(r.executions, execution)
+
+	var workflow func(context.Context, *Execution, state) (interface{}, error)
+	switch started.StateMachineArn {
+	case ingestWorkflow:
+		workflow = r.ingest
+	case processWorkflow:
+		workflow = r.process
+	case publishWorkflow:
+		workflow = r.publish
+	default:
+		execution.fail(fmt.Errorf("unknown state machine %s", started.StateMachineArn))
+		return execution
+	}
+
+	if err := json.Unmarshal([]byte(started.Input), &execution.Input); err != nil {
+		execution.fail(fmt.Errorf("json.Unmarshal: %w", err))
+		return execution
+	}
+	var input state
+	if err := remarshal(execution.Input, &input); err != nil {
+		execution.fail(err)
+		return execution
+	}
+
+	log.Printf("LOCAL:: %s started", execution.Arn)
+	output, err := workflow(ctx, execution, input)
+	if err != nil {
+		execution.fail(err)
+		log.Printf("LOCAL:: %s failed in %q: %v", execution.Arn, execution.current(), err)
+		return execution
+	}
+	if execution.Output, err = json.Marshal(output); err != nil {
+		execution.fail(fmt.Errorf("json.Marshal: %w", err))
+		return execution
+	}
+	execution.Status = StatusSucceeded
+	log.Printf("LOCAL:: %s succeeded", execution.Arn)
+	return execution
+}
+
+// defaultMediaInfo is what the MediaInfo function reports for a 10 second
+// 1920x1080 H.264 source with AAC audio.
+func defaultMediaInfo(bucket, key string) (string, error) {
+	metadata := map[string]interface{}{
+		"filename": key,
+		"container": map[string]interface{}{
+			"format":       "MPEG-4",
+			"fileSize":     7500000,
+			"duration":     10.0,
+			"totalBitrate": 6000000,
+		},
+		"video": []map[string]interface{}{{
+			"codec":       "AVC",
+			"profile":     "High@L4",
+			"bitrate":     5800000,
+			"duration":    10.0,
+			"frameCount":  300,
+			"width":       1920,
+			"height":      1080,
+			"framerate":   30,
+			"scanType":    "Progressive",
+			"aspectRatio": "1.778",
+			"bitDepth":    8,
+			"colorSpace":  "YUV 4:2:0",
+		}},
+		"audio": []map[string]interface{}{{
+			"codec":          "AAC",
+			"bitrate":        192000,
+			"duration":       10.0,
+			"frameCount":     469,
+			"bitrateMode":    "CBR",
+			"channels":       2,
+			"samplingRate":   48000,
+			"samplePerFrame": 1024,
+		}},
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,141 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func executionStates(runner *Runner) map[string][]string {
+	states := map[string][]string{}
+	for _, execution := range runner.Executions() {
+		states[execution.StateMachine] = append(states[execution.StateMachine], execution.Status)
+	}
+	return states
+}
+
+func TestRunnerWorkflows(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Upload is ingested, processed and published", func(t *testing.T) {
+		runner, err := New(Config{Env: map[string]string{"FrameCapture": "true"}})
+		require.NoError(t, err)
+
+		require.NoError(t, runner.Upload(ctx, "uploads/my video.mp4", []byte("video"), map[string]string{
+			"callback-url": "https://example.com/hook",
+		}))
+		require.NoError(t, runner.Run(ctx))
+
+		assert.Equal(t, map[string][]string{
+			"vod-local-ingest":  {StatusSucceeded},
+			"vod-local-process": {StatusSucceeded},
+			"vod-local-publish": {StatusSucceeded},
+		}, executionStates(runner))
+
+		executions := runner.Executions()
+		guid := executions[0].Input["guid"]
+		require.NotEmpty(t, guid)
+		assert.Equal(t, "Complete", executions[2].States[len(executions[2].States)-1])
+
+		record, err := runner.Record(guid.(string))
+		require.NoError(t, err)
+		assert.Equal(t, "Complete", record["workflowStatus"])
+		assert.Equal(t, "uploads/my video.mp4", record["srcVideo"])
+		assert.EqualValues(t, 1080, record["encodingProfile"])
+		assert.Equal(t, "s3://vod-local-destination/"+guid.(string)+"/hls/my video.m3u8", record["hlsPlaylist"])
+		assert.NotEmpty(t, record["dashPlaylist"])
+		assert.Len(t, record["mp4Outputs"], 2)
+		assert.Len(t, record["thumbNails"], 1)
+		cost := record["cost"].(map[string]interface{})
+		assert.Equal(t, "USD", cost["currency"])
+		assert.NotEmpty(t, cost["outputs"])
+		entries := runner.DynamoDB.Items("vod-local-costs")
+		require.Len(t, entries, 1)
+		assert.Equal(t, guid, aws.StringValue(entries[0]["guid"].S))
+		assert.Regexp(t, `^\d{4}-\d{2}$`, aws.StringValue(entries[0]["month"].S))
+		// nothing was cached before the first publish
+		assert.NotContains(t, record, "invalidation")
+
+		assert.Contains(t, runner.S3.Keys("vod-local-destination", guid.(string)+"/"), guid.(string)+"/hls/my video_720p.m3u8")
+		assert.Len(t, runner.MediaConvert.Jobs(), 1)
+		assert.Len(t, runner.SNS.Messages(), 3)
+		assert.Len(t, runner.SQS.Messages(), 1)
+		assert.Equal(t, []string{"Ingested", "ProfileSelected", "EncodeSubmitted", "EncodeComplete", "Published"}, runner.EventBridge.DetailTypes())
+
+		requests := runner.HTTP.Requests()
+		require.Len(t, requests, 3)
+		assert.Equal(t, "https://example.com/hook", requests[2].Url)
+		var payload map[string]interface{}
+		require.NoError(t, json.Unmarshal(requests[2].Body, &payload))
+		assert.Equal(t, "Complete", payload["status"])
+	})
+
+	t.Run("Reprocess invalidates the replaced outputs", func(t *testing.T) {
+		runner, err := New(Config{})
+		require.NoError(t, err)
+
+		require.NoError(t, runner.Upload(ctx, "video.mp4", []byte("video"), nil))
+		require.NoError(t, runner.Run(ctx))
+		guid := runner.Executions()[0].Input["guid"].(string)
+
+		require.NoError(t, runner.Reprocess(ctx, guid, ""))
+		require.NoError(t, runner.Run(ctx))
+
+		executions := runner.Executions()
+		require.Len(t, executions, 5)
+		assert.Contains(t, executions[4].States, "CDN Invalidation Wait")
+
+		record, err := runner.Record(guid)
+		require.NoError(t, err)
+		invalidation := record["invalidation"].(map[string]interface{})
+		assert.Equal(t, "Completed", invalidation["status"])
+		assert.Contains(t, runner.CloudFront.Paths(), "/"+guid+"/hls/video.m3u8")
+		assert.Len(t, runner.MediaConvert.Jobs(), 2)
+	})
+
+	t.Run("Duplicate upload is linked to the first asset", func(t *testing.T) {
+		runner, err := New(Config{Env: map[string]string{"DuplicatePolicy": "LINK"}})
+		require.NoError(t, err)
+
+		require.NoError(t, runner.Upload(ctx, "first.mp4", []byte("same content"), nil))
+		require.NoError(t, runner.Run(ctx))
+		require.NoError(t, runner.Upload(ctx, "second.mp4", []byte("same content"), nil))
+		require.NoError(t, runner.Run(ctx))
+
+		executions := runner.Executions()
+		require.Len(t, executions, 4)
+		assert.Equal(t, "Duplicate Linked", executions[3].States[len(executions[3].States)-1])
+
+		record, err := runner.Record(executions[0].Input["guid"].(string))
+		require.NoError(t, err)
+		linked := record["linkedSources"].([]interface{})
+		require.Len(t, linked, 1)
+		assert.Equal(t, "second.mp4", linked[0].(map[string]interface{})["key"])
+	})
+
+	t.Run("Invalid configuration is reported", func(t *testing.T) {
+		_, err := New(Config{Env: map[string]string{"AcceleratedTranscoding": "SOMETIMES"}})
+		assert.ErrorContains(t, err, `input-validate: invalid configuration: AcceleratedTranscoding: "SOMETIMES" is not one of ENABLED, DISABLED, PREFERRED`)
+	})
+
+	t.Run("Failed execution is reported", func(t *testing.T) {
+		runner, err := New(Config{})
+		require.NoError(t, err)
+		// A value the state machine has no choice for
+		runner.inputValidate.Config.AcceleratedTranscoding = "SOMETIMES"
+
+		require.NoError(t, runner.Upload(ctx, "video.mp4", []byte("video"), nil))
+		err = runner.Run(ctx)
+		assert.ErrorContains(t, err, "States.NoChoiceMatched")
+
+		executions := runner.Executions()
+		require.Len(t, executions, 2)
+		assert.Equal(t, StatusFailed, executions[1].Status)
+		assert.Equal(t, "Accelerated Transcoding Check", executions[1].States[len(executions[1].States)-1])
+		assert.Empty(t, runner.MediaConvert.Jobs())
+	})
+}
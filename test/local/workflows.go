@@ -0,0 +1,389 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"local/internal/services/cdninvalidation"
+)
+
+// The workflows below follow the Ingest, Process and Publish state machines
+// of the template state by state. Tasks are called with the state as their
+// JSON input and their output becomes the state, as the Lambda integration
+// does. Waits are skipped and retries are immediate.
+
+const (
+	StatusRunning   = "RUNNING"
+	StatusSucceeded = "SUCCEEDED"
+	StatusFailed    = "FAILED"
+)
+
+// Execution is a workflow run and the states it went through.
+type Execution struct {
+	Arn          string
+	StateMachine string
+	StartTime    time.Time
+	Status       string
+	States       []string
+	Input        map[string]interface{}
+	Output       json.RawMessage
+	Error        error
+}
+
+func (x *Execution) enter(name string) {
+	x.States = append(x.States, name)
+}
+
+func (x *Execution) current() string {
+	if len(x.States) == 0 {
+		return ""
+	}
+	return x.States[len(x.States)-1]
+}
+
+func (x *Execution) fail(err error) {
+	x.Status = StatusFailed
+	x.Error = err
+}
+
+// state is the JSON document passed between states.
+type state = map[string]interface{}
+
+// retrier is a Retry field of a task: the error names and MaxAttempts.
+type retrier struct {
+	errors      []string
+	maxAttempts int
+}
+
+var tooManyInvalidations = retrier{errors: []string{"TooManyInvalidationsError"}, maxAttempts: 10}
+
+// task runs a Task state: input is converted to the handler's input type
+// through JSON, and the output back to a state.
+func task[In any, Out any](x *Execution, name string, handler func(In) (*Out, error), input state, retriers ...retrier) (state, error) {
+	output, err := call(x, name, handler, input, retriers...)
+	if err != nil {
+		return nil, err
+	}
+	var result state
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("%s: json.Unmarshal: %w", name, err)
+	}
+	return result, nil
+}
+
+// call runs a Task state and returns its output as it is, for a last state
+// whose output is not an object.
+func call[In any, Out any](x *Execution, name string, handler func(In) (*Out, error), input state, retriers ...retrier) (json.RawMessage, error) {
+	x.enter(name)
+
+	var event In
+	if err := remarshal(input, &event); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	attempts := map[string]int{}
+	for {
+		output, err := handler(event)
+		if err == nil {
+			data, err := json.Marshal(output)
+			if err != nil {
+				return nil, fmt.Errorf("%s: json.Marshal: %w", name, err)
+			}
+			return data, nil
+		}
+
+		errorType := lambdaErrorType(err)
+		retry := false
+		for _, r := range retriers {
+			for _, match := range r.errors {
+				if match == errorType && attempts[match] < r.maxAttempts {
+					attempts[match]++
+					retry = true
+				}
+			}
+		}
+		if !retry {
+			return nil, fmt.Errorf("%s: %s: %w", name, errorType, err)
+		}
+		log.Printf("LOCAL:: %s: retrying %s", name, errorType)
+	}
+}
+
+// asyncTask runs a lambda:invoke Task with InvocationType Event: the function
+// is called and the state passes through unchanged, ResultPath null. The
+// state machine does not see the function fail, so errors are only logged.
+func asyncTask[In any, Out any](x *Execution, name string, handler func(In) (*Out, error), payload interface{}) {
+	x.enter(name)
+
+	var input In
+	if err := remarshal(payload, &input); err != nil {
+		log.Printf("LOCAL:: %s: %v", name, err)
+		return
+	}
+	if _, err := handler(input); err != nil {
+		log.Printf("LOCAL:: %s: %v", name, err)
+	}
+}
+
+// executionContext runs the "Execution Context" Pass states, which set the
+// execution id, its start time and the state name at $.execution.
+func (x *Execution) executionContext(name string, input state) state {
+	x.enter(name)
+	input["execution"] = map[string]interface{}{
+		"id":        x.Arn,
+		"startTime": x.StartTime.Format("2006-01-02T15:04:05.000Z"),
+		"state":     name,
+	}
+	return input
+}
+
+// lambdaErrorType is the errorType the Lambda runtime reports for err, the
+// name of its type, which Retry and Catch match on.
+func lambdaErrorType(err error) string {
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+func (r *Runner) ingest(ctx context.Context, x *Execution, input state) (interface{}, error) {
+	s, err := task(x, "Input Validate", r.inputValidate.HandleRequest, input)
+	if err != nil {
+		return nil, err
+	}
+
+	x.enter("Duplicate Choice")
+	switch s["duplicateAction"] {
+	case "LINK":
+		x.enter("Duplicate Linked")
+		return s, nil
+	case "SHORT_CIRCUIT":
+		s = x.executionContext("Execution Context (Duplicate)", s)
+		return task(x, "DynamoDB Update (Duplicate)", r.dynamo.HandleRequest, s)
+	}
+
+	if s, err = r.mediaInfoTask(x, s); err != nil {
+		return nil, err
+	}
+	s = x.executionContext("Execution Context (Ingest)", s)
+	if s, err = task(x, "DynamoDB Update (Ingest)", r.dynamo.HandleRequest, s); err != nil {
+		return nil, err
+	}
+	r.notify(x, "Ingested", "Ingest", s)
+
+	x.enter("SNS Choice (Ingest)")
+	if s["enableSns"] == true {
+		if s, err = task(x, "SNS Notification (Ingest)", r.snsNotification.HandleRequest, s); err != nil {
+			return nil, err
+		}
+	}
+
+	processExecute := func(event state) (*string, error) {
+		return r.stepFunctions.HandleRequest(ctx, event)
+	}
+	return call(x, "Process Execute", processExecute, state{
+		"guid":      s["guid"],
+		"execution": state{"id": x.Arn},
+	})
+}
+
+// mediaInfoTask stands in for the MediaInfo function, which is Python: it
+// adds srcMediainfo to the state.
+func (r *Runner) mediaInfoTask(x *Execution, s state) (state, error) {
+	x.enter("MediaInfo")
+
+	bucket, _ := s["srcBucket"].(string)
+	key, _ := s["srcVideo"].(string)
+	metadata, err := r.mediaInfo(bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("MediaInfo: %w", err)
+	}
+	s["srcMediainfo"] = metadata
+	return s, nil
+}
+
+func (r *Runner) process(ctx context.Context, x *Execution, input state) (interface{}, error) {
+	s, err := task(x, "Profiler", r.profiler.HandleRequest, input)
+	if err != nil {
+		return nil, err
+	}
+	asyncTask(x, "Lifecycle (ProfileSelected)", r.lifecycleEvents.HandleRequest, lifecyclePayload("ProfileSelected", x, s))
+
+	x.enter("Encoding Profile Check")
+	switch {
+	case s["isCustomTemplate"] == true:
+		x.enter("Custom jobTemplate")
+	case number(s["encodingProfile"]) == 2160:
+		x.enter("jobTemplate 2160p")
+	case number(s["encodingProfile"]) == 1080:
+		x.enter("jobTemplate 1080p")
+	case number(s["encodingProfile"]) == 720:
+		x.enter("jobTemplate 720p")
+	default:
+		return nil, noChoiceMatched("Encoding Profile Check")
+	}
+
+	x.enter("Accelerated Transcoding Check")
+	switch s["acceleratedTranscoding"] {
+	case "ENABLED":
+		x.enter("Enabled")
+	case "PREFERRED":
+		x.enter("Preferred")
+	case "DISABLED":
+		x.enter("Disabled")
+	default:
+		return nil, noChoiceMatched("Accelerated Transcoding Check")
+	}
+
+	x.enter("Frame Capture Check")
+	switch s["frameCapture"] {
+	case true:
+		x.enter("Frame Capture")
+	case false:
+		x.enter("No Frame Capture")
+	default:
+		return nil, noChoiceMatched("Frame Capture Check")
+	}
+
+	if s, err = task(x, "Encode Job Submit", r.encode.HandleRequest, s); err != nil {
+		return nil, err
+	}
+	s = x.executionContext("Execution Context (Process)", s)
+	if s, err = task(x, "DynamoDB Update (Process)", r.dynamo.HandleRequest, s); err != nil {
+		return nil, err
+	}
+	r.notify(x, "EncodeSubmitted", "Process", s)
+
+	x.enter("SNS Choice (Process)")
+	if s["enableSns"] == true {
+		return task(x, "SNS Notification (Process)", r.snsNotification.HandleRequest, s)
+	}
+	x.enter("Process Complete")
+	return s, nil
+}
+
+func (r *Runner) publish(ctx context.Context, x *Execution, input state) (interface{}, error) {
+	s, err := task(x, "Validate Encoding Outputs", r.outputValidate.HandleRequest, input)
+	if err != nil {
+		return nil, err
+	}
+	asyncTask(x, "Lifecycle (EncodeComplete)", r.lifecycleEvents.HandleRequest, lifecyclePayload("EncodeComplete", x, s))
+
+	x.enter("Archive Source Choice")
+	switch s["archiveSource"] {
+	case "GLACIER":
+		s, err = task(x, "Archive", r.archiveSource.HandleRequest, s)
+	case "DEEP_ARCHIVE":
+		s, err = task(x, "Deep Archive", r.archiveSource.HandleRequest, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	x.enter("MediaPackage Choice")
+	if s["enableMediaPackage"] == true {
+		if s, err = task(x, "MediaPackage Assets", r.mediaPackageAssets.HanleRequest, s); err != nil {
+			return nil, err
+		}
+	}
+
+	invalidate := func(event state) (*cdninvalidation.Invalidation, error) {
+		return r.cdnInvalidation.HandleRequest(ctx, event)
+	}
+	invalidation, err := task(x, "CDN Invalidation", invalidate, s, tooManyInvalidations)
+	if err != nil {
+		return nil, err
+	}
+	s["invalidation"] = invalidation
+	for {
+		x.enter("CDN Invalidation Choice")
+		if invalidation["status"] != "InProgress" {
+			break
+		}
+		x.enter("CDN Invalidation Wait")
+		invalidation, err = task(x, "CDN Invalidation Status", invalidate, state{
+			"guid":         s["guid"],
+			"invalidation": s["invalidation"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		s["invalidation"] = invalidation
+	}
+
+	s = x.executionContext("Execution Context (Publish)", s)
+	if s, err = task(x, "DynamoDB Update (Publish)", r.dynamo.HandleRequest, s); err != nil {
+		return nil, err
+	}
+	r.notify(x, "Published", "Publish", s)
+
+	x.enter("SQS Choice")
+	if s["enableSqs"] == true {
+		if s, err = task(x, "SQS Send Message", r.sqsPublish.HandleRequest, s); err != nil {
+			return nil, err
+		}
+	}
+
+	x.enter("SNS Choice (Publish)")
+	if s["enableSns"] == true {
+		if s, err = task(x, "SNS Notification (Publish)", r.snsNotification.HandleRequest, s); err != nil {
+			return nil, err
+		}
+	}
+	x.enter("Complete")
+	return s, nil
+}
+
+// notify runs the Lifecycle and Webhook states that follow each DynamoDB
+// Update state.
+func (r *Runner) notify(x *Execution, detailType, stage string, s state) {
+	asyncTask(x, fmt.Sprintf("Lifecycle (%s)", detailType), r.lifecycleEvents.HandleRequest, lifecyclePayload(detailType, x, s))
+	asyncTask(x, fmt.Sprintf("Webhook (%s)", stage), r.webhook.HandleRequest, state{"event": s, "executionId": x.Arn})
+}
+
+func lifecyclePayload(detailType string, x *Execution, s state) state {
+	return state{"detailType": detailType, "event": s, "executionId": x.Arn}
+}
+
+func noChoiceMatched(name string) error {
+	return fmt.Errorf("%s: States.NoChoiceMatched: no Choice rule matched and there is no Default", name)
+}
+
+// number returns a JSON number of the state as a float64.
+func number(value interface{}) float64 {
+	switch n := value.(type) {
+	case float64:
+		return n
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	}
+	return 0
+}
+
+// remarshal converts from into to through JSON.
+func remarshal(from interface{}, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := json.Unmarshal(data, to); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
+
+func unmarshalItem(item map[string]*dynamodb.AttributeValue, to interface{}) error {
+	if err := dynamodbattribute.UnmarshalMap(item, to); err != nil {
+		return fmt.Errorf("dynamodbattribute.UnmarshalMap: %w", err)
+	}
+	return nil
+}
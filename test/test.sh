@@ -18,6 +18,7 @@ show_help() {
     echo "Examples:"
     echo "  $0                          Test all services"
     echo "  $0 profiler                 Test only the profiler service"
+    echo "  $0 local                    Test only the local workflow runner"
     echo "  $0 -t TestUserCreate        Run specific test across all services"
     echo "  $0 profiler -t TestUserCreate  Run specific test in profiler service"
 }
@@ -105,6 +106,25 @@ for service_dir in "$SERVICES_DIR"/*; do
     fi
 done
 
+# The local runner runs the workflows end to end on copies of the services
+LOCAL_DIR=$(realpath "$(dirname "$0")/local")
+if [ -z "$TARGET_SERVICE" ] || [ "$TARGET_SERVICE" == "local" ]; then
+    echo "----------------------------------------"
+    echo "Running tests for the local runner"
+    echo "----------------------------------------"
+
+    cd "$LOCAL_DIR" || exit 1
+
+    if go generate ./... && go test $VERBOSE_FLAG ./... $TEST_FILTER; then
+        echo "✅ local tests passed"
+    else
+        echo "❌ local tests failed"
+        FAILED_SERVICES+=("local")
+    fi
+
+    SERVICES_COUNT=$((SERVICES_COUNT+1))
+fi
+
 # Check if we were looking for a specific service but didn't find it
 if [ -n "$TARGET_SERVICE" ] && [ "$SERVICES_COUNT" -eq 0 ]; then
     echo "Error: Service '$TARGET_SERVICE' not found"